@@ -15,17 +15,27 @@
 package eiam
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/lithammer/dedent"
 	"github.com/manifoldco/promptui"
 	"github.com/spf13/cobra"
+	credentialspb "google.golang.org/genproto/googleapis/iam/credentials/v1"
 
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
 	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
 	"github.com/rigup/ephemeral-iam/internal/gcpclient"
 	"github.com/rigup/ephemeral-iam/internal/proxy"
 	"github.com/rigup/ephemeral-iam/pkg/options"
 )
 
-var apCmdConfig options.CmdConfig
+var (
+	apCmdConfig options.CmdConfig
+
+	apAccessBoundary []gcpclient.AccessBoundaryRule
+)
 
 func newCmdAssumePrivileges() *cobra.Command {
 	cmd := &cobra.Command{
@@ -35,20 +45,96 @@ func newCmdAssumePrivileges() *cobra.Command {
 		Long: dedent.Dedent(`
 			The "assume-privileges" command fetches short-lived credentials for the provided service Account
 			and configures gcloud to proxy its traffic through an auth proxy. This auth proxy sets the
-			authorization header to the OAuth2 token generated for the provided service account. Once
-			the credentials have expired, the auth proxy is shut down and the gcloud config is restored.
+			authorization header to the OAuth2 token generated for the provided service account. gcloud
+			in the privileged sub-shell uses a copy of your gcloud config, so your own config isn't
+			changed. Once the credentials have expired, the auth proxy is shut down and the copy is removed.
+			Use "--duration" or set tokenconfig.sessionlength to keep the session open longer, in which
+			case the credentials are refreshed before they expire. Sessions never last longer than
+			security.maxsessionduration. When the session ends, the sub-shell is closed.
 			
 			The reason flag is used to add additional metadata to audit logs.  The provided reason will
-			be in 'protoPayload.requestMetadata.requestAttributes.reason'.`),
+			be in 'protoPayload.requestMetadata.requestAttributes.reason'.
+
+			Use "--exec" to run a single command or script in the session instead of starting a
+			sub-shell, e.g. in CI pipelines and Makefiles. eiam exits with the exit status of the
+			command, and gcloud is configured for the command only.
+
+			Use "--access-boundary" to limit the session to specific Cloud Storage buckets with a
+			Credential Access Boundary. Down-scoped tokens are only accepted by Cloud Storage.
+
+			Use "--capture har" to record the traffic intercepted by the auth proxy to a HAR file
+			with the Authorization headers redacted, e.g. to debug why a tool fails when it uses
+			the service account's credentials.
+
+			Use "--role" where impersonating service accounts isn't allowed. Instead of a service
+			account, the role is granted to your own identity on the project with a role binding
+			that expires at the end of the session, and the binding is removed when the session
+			ends. This requires permission to set the project's IAM policy.`),
 		Example: dedent.Dedent(`
 				eiam assume-privileges \
 				  --service-account-email example@my-project.iam.gserviceaccount.com \
-				  --reason "Emergency security patch (JIRA-1234)"`),
+				  --reason "Emergency security patch (JIRA-1234)"
+
+				eiam assume-privileges \
+				  --service-account-email example@my-project.iam.gserviceaccount.com \
+				  --reason "Terraform apply for JIRA-1235" \
+				  --duration 3h
+
+				eiam assume-privileges \
+				  --service-account-email deployer@my-project.iam.gserviceaccount.com \
+				  --reason "Deploy from CI (JIRA-1236)" \
+				  --yes \
+				  --exec 'terraform apply -auto-approve'
+
+				eiam assume-privileges \
+				  --role roles/cloudsql.admin \
+				  --reason "Restore database backup (JIRA-1237)"`),
 		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if apCmdConfig.Role != "" {
+				return checkRoleSession(cmd)
+			}
 			if err := options.CheckRequired(cmd.Flags()); err != nil {
 				return err
 			}
+			if err := options.CheckServiceAccount(apCmdConfig.ServiceAccountEmail); err != nil {
+				return err
+			}
+			if err := options.CheckDelegates(apCmdConfig.Delegates); err != nil {
+				return err
+			}
+			boundary, err := options.ParseAccessBoundary(apCmdConfig.AccessBoundary)
+			if err != nil {
+				return err
+			}
+			// gcloud impersonates the service account itself when the auth proxy
+			// listens on a Unix socket, which would get around the boundary.
+			if len(boundary) > 0 && proxy.SocketPath() != "" {
+				return argsError(fmt.Errorf("--%s can't be used when %s is set", options.AccessBoundaryFlag.Name, appconfig.AuthProxySocketPath))
+			}
+			apAccessBoundary = boundary
+			apCmdConfig.Scopes = options.ParseScopes(apCmdConfig.Scopes)
+			if len(apCmdConfig.Scopes) > 0 && proxy.SocketPath() != "" {
+				return argsError(fmt.Errorf("--%s can't be used when %s is set", options.ScopesFlag.Name, appconfig.AuthProxySocketPath))
+			}
+			if err := options.CheckSubject(apCmdConfig.Subject); err != nil {
+				return err
+			}
+			if apCmdConfig.Subject != "" && proxy.SocketPath() != "" {
+				return argsError(fmt.Errorf("--%s can't be used when %s is set", options.SubjectFlag.Name, appconfig.AuthProxySocketPath))
+			}
+			if err := options.CheckLifetime(apCmdConfig.TokenLifetime); err != nil {
+				return err
+			}
+			if err := options.CheckDuration(apCmdConfig.SessionDuration); err != nil {
+				return err
+			}
+			if err := options.CheckCapture(apCmdConfig.Capture); err != nil {
+				return err
+			}
 
+			if err := options.CheckReason(apCmdConfig.Reason); err != nil {
+				return err
+			}
 			if err := util.FormatReason(&apCmdConfig.Reason); err != nil {
 				return err
 			}
@@ -57,6 +143,9 @@ func newCmdAssumePrivileges() *cobra.Command {
 				util.Confirm(map[string]string{
 					"Project":         apCmdConfig.Project,
 					"Service Account": apCmdConfig.ServiceAccountEmail,
+					"Delegates":       strings.Join(apCmdConfig.Delegates, ", "),
+					"Scopes":          strings.Join(gcpclient.ScopesOrDefault(apCmdConfig.Scopes), ", "),
+					"Subject":         apCmdConfig.Subject,
 					"Reason":          apCmdConfig.Reason,
 				})
 			}
@@ -70,39 +159,187 @@ func newCmdAssumePrivileges() *cobra.Command {
 	options.AddServiceAccountEmailFlag(cmd.Flags(), &apCmdConfig.ServiceAccountEmail, true)
 	options.AddReasonFlag(cmd.Flags(), &apCmdConfig.Reason, true)
 	options.AddProjectFlag(cmd.Flags(), &apCmdConfig.Project, false)
+	options.AddDelegatesFlag(cmd.Flags(), &apCmdConfig.Delegates)
+	options.AddAccessBoundaryFlag(cmd.Flags(), &apCmdConfig.AccessBoundary)
+	options.AddScopesFlag(cmd.Flags(), &apCmdConfig.Scopes)
+	options.AddSubjectFlag(cmd.Flags(), &apCmdConfig.Subject)
+	options.AddRoleFlag(cmd.Flags(), &apCmdConfig.Role)
+	options.AddLifetimeFlag(cmd.Flags(), &apCmdConfig.TokenLifetime)
+	options.AddDurationFlag(cmd.Flags(), &apCmdConfig.SessionDuration)
+	options.AddCaptureFlag(cmd.Flags(), &apCmdConfig.Capture)
+	options.AddExecFlag(cmd.Flags(), &apCmdConfig.Exec)
 
 	return cmd
 }
 
+// checkRoleSession validates the flags of a session started with --role, which
+// grants the role to the user instead of impersonating a service account.
+func checkRoleSession(cmd *cobra.Command) error {
+	if err := cmd.Flags().SetAnnotation(options.ServiceAccountEmailFlag.Name, options.RequiredAnnotation, []string{"false"}); err != nil {
+		return err
+	}
+	if err := options.CheckRequired(cmd.Flags()); err != nil {
+		return err
+	}
+	// The service account flag defaults to the configured default account,
+	// so only reject it when it was set.
+	for _, flag := range []string{
+		options.ServiceAccountEmailFlag.Name,
+		options.DelegatesFlag.Name,
+		options.SubjectFlag.Name,
+		options.ScopesFlag.Name,
+		options.AccessBoundaryFlag.Name,
+	} {
+		if cmd.Flags().Changed(flag) {
+			return argsError(fmt.Errorf("--%s can't be used with --%s", flag, options.RoleFlag.Name))
+		}
+	}
+	apCmdConfig.ServiceAccountEmail = ""
+	if err := options.CheckRole(apCmdConfig.Role); err != nil {
+		return err
+	}
+	if apCmdConfig.Project == "" {
+		return argsError(fmt.Errorf("--%s is required with --%s", options.ProjectFlag.Name, options.RoleFlag.Name))
+	}
+	// gcloud would impersonate a service account itself when the auth proxy
+	// listens on a Unix socket.
+	if proxy.SocketPath() != "" {
+		return argsError(fmt.Errorf("--%s can't be used when %s is set", options.RoleFlag.Name, appconfig.AuthProxySocketPath))
+	}
+	if err := options.CheckDuration(apCmdConfig.SessionDuration); err != nil {
+		return err
+	}
+	if err := options.CheckCapture(apCmdConfig.Capture); err != nil {
+		return err
+	}
+	if err := options.CheckReason(apCmdConfig.Reason); err != nil {
+		return err
+	}
+	if err := util.FormatReason(&apCmdConfig.Reason); err != nil {
+		return err
+	}
+
+	if !options.YesOption {
+		util.Confirm(map[string]string{
+			"Project": apCmdConfig.Project,
+			"Role":    apCmdConfig.Role,
+			"Reason":  apCmdConfig.Reason,
+		})
+	}
+	return nil
+}
+
 func startPrivilegedSession() error {
-	hasAccess, err := gcpclient.CanImpersonate(apCmdConfig.Project, apCmdConfig.ServiceAccountEmail)
-	if err != nil {
+	if apCmdConfig.Role != "" {
+		return startRoleSession()
+	}
+	if err := checkCanImpersonate(apCmdConfig.Project, apCmdConfig.ServiceAccountEmail, apCmdConfig.Delegates); err != nil {
 		return err
-	} else if !hasAccess {
-		util.Logger.Fatalln("You do not have access to impersonate this service account")
 	}
 
-	util.Logger.Info("Fetching short-lived access token for ", apCmdConfig.ServiceAccountEmail)
-	accessToken, err := gcpclient.GenerateTemporaryAccessToken(apCmdConfig.ServiceAccountEmail, apCmdConfig.Reason)
+	// The access token shouldn't outlive the longest session allowed.
+	lifetime := apCmdConfig.TokenLifetime
+	sessionLength := apCmdConfig.SessionDuration
+	if sessionLength == 0 {
+		sessionLength = lifetime
+	}
+	if limit := appconfig.MaxSessionDuration(); limit > 0 {
+		if lifetime > limit {
+			lifetime = limit
+		}
+		if sessionLength > limit {
+			sessionLength = limit
+		}
+	}
+
+	command := "assume-privileges"
+	if apCmdConfig.Exec != "" {
+		command = fmt.Sprintf("assume-privileges --exec %q", apCmdConfig.Exec)
+	}
+	if err := confirmMFA(); err != nil {
+		return err
+	}
+	if err := requestApproval(&apCmdConfig, command, sessionLength); err != nil {
+		return err
+	}
+
+	var (
+		accessToken *credentialspb.GenerateAccessTokenResponse
+		err         error
+	)
+	scopes := gcpclient.ScopesOrDefault(apCmdConfig.Scopes)
+	if apCmdConfig.Subject != "" {
+		util.Logger.Infof("Fetching short-lived access token for %s through %s", apCmdConfig.Subject, apCmdConfig.ServiceAccountEmail)
+		if lifetime > gcpclient.MaxDelegatedLifetime {
+			lifetime = gcpclient.MaxDelegatedLifetime
+		}
+		accessToken, err = gcpclient.GenerateDelegatedAccessToken(
+			apCmdConfig.ServiceAccountEmail,
+			apCmdConfig.Subject,
+			apCmdConfig.Reason,
+			lifetime,
+			scopes,
+			apCmdConfig.Delegates,
+		)
+	} else {
+		util.Logger.Info("Fetching short-lived access token for ", apCmdConfig.ServiceAccountEmail)
+		accessToken, err = gcpclient.GenerateScopedAccessToken(
+			apCmdConfig.ServiceAccountEmail,
+			apCmdConfig.Reason,
+			lifetime,
+			scopes,
+			apCmdConfig.Delegates,
+		)
+	}
 	if err != nil {
 		return err
 	}
 
-	util.Logger.Info("Configuring gcloud to use auth proxy")
-	if gcpclient.ConfigureGcloudProxy(apCmdConfig.Project) != nil {
+	if err := proxy.ChoosePort(); err != nil {
 		return err
 	}
 
-	clusters, err := gcpclient.GetClusters(apCmdConfig.Project, apCmdConfig.Reason)
+	defaultCluster, err := chooseDefaultCluster(apCmdConfig.Project, apCmdConfig.Reason, apCmdConfig.Exec != "")
 	if err != nil {
 		return err
 	}
+	token := accessToken.GetAccessToken()
+	expirationDate := accessToken.GetExpireTime().AsTime()
+	return proxy.StartProxyServer(
+		token,
+		apCmdConfig.Reason,
+		apCmdConfig.ServiceAccountEmail,
+		apCmdConfig.Project,
+		apCmdConfig.Subject,
+		nil,
+		apCmdConfig.Delegates,
+		apAccessBoundary,
+		apCmdConfig.Scopes,
+		expirationDate,
+		lifetime,
+		apCmdConfig.SessionDuration,
+		defaultCluster,
+		apCmdConfig.Capture,
+		apCmdConfig.Exec,
+	)
+}
+
+// chooseDefaultCluster returns the GKE cluster in the project that kubectl is
+// configured for in the session. The user chooses one if there are several,
+// unless noPrompt is set.
+func chooseDefaultCluster(project, reason string, noPrompt bool) (map[string]string, error) {
+	clusters, err := gcpclient.GetClusters(project, reason)
+	if err != nil {
+		return nil, err
+	}
 
 	defaultCluster := map[string]string{}
 	if len(clusters) == 0 {
-		util.Logger.Warnf("No clusters found in %s", apCmdConfig.Project)
+		util.Logger.Warnf("No clusters found in %s", project)
 	} else if len(clusters) == 1 {
 		defaultCluster = clusters[0]
+	} else if noPrompt {
+		util.Logger.Warnf("Found %d clusters in %s, no default cluster will be configured for the command", len(clusters), project)
 	} else {
 		clusterNames := []string{}
 		for _, cl := range clusters {
@@ -128,14 +365,87 @@ func startPrivilegedSession() error {
 			}
 		}
 	}
-	token := accessToken.GetAccessToken()
-	expirationDate := accessToken.GetExpireTime().AsTime()
+	return defaultCluster, nil
+}
+
+// startRoleSession grants the role to the user's own identity on the project
+// until the session ends and starts the session with their own credentials.
+func startRoleSession() error {
+	sessionLength := apCmdConfig.SessionDuration
+	if sessionLength == 0 {
+		sessionLength = apCmdConfig.TokenLifetime
+	}
+	if limit := appconfig.MaxSessionDuration(); limit > 0 && sessionLength > limit {
+		sessionLength = limit
+	}
+
+	command := fmt.Sprintf("assume-privileges --role %s", apCmdConfig.Role)
+	if apCmdConfig.Exec != "" {
+		command = fmt.Sprintf("%s --exec %q", command, apCmdConfig.Exec)
+	}
+	projectResource := gcpclient.ProjectResource(apCmdConfig.Project)
+	if err := checkPrerequisites(
+		gcpclient.Prerequisite{Permission: "resourcemanager.projects.getIamPolicy", Resource: projectResource},
+		gcpclient.Prerequisite{Permission: "resourcemanager.projects.setIamPolicy", Resource: projectResource},
+	); err != nil {
+		return err
+	}
+	if err := confirmMFA(); err != nil {
+		return err
+	}
+	if err := requestApproval(&apCmdConfig, command, sessionLength); err != nil {
+		return err
+	}
+
+	principal, err := gcpclient.ADCPrincipal()
+	if err != nil {
+		return err
+	}
+	token, expirationDate, err := gcpclient.ADCAccessToken()
+	if err != nil {
+		return err
+	}
+
+	member := gcpclient.IAMMember(principal)
+	util.Logger.Infof("Granting %s to %s on %s", apCmdConfig.Role, member, apCmdConfig.Project)
+	binding, err := gcpclient.AddTemporaryRoleBinding(
+		apCmdConfig.Project,
+		apCmdConfig.Role,
+		member,
+		apCmdConfig.Reason,
+		time.Now().Add(sessionLength),
+	)
+	if err != nil {
+		return err
+	}
+	util.Logger.Info("It can take a few minutes before the role takes effect")
+
+	if err := proxy.ChoosePort(); err != nil {
+		if rmErr := gcpclient.RemoveTemporaryRoleBinding(binding, apCmdConfig.Reason); rmErr != nil {
+			util.Logger.WithError(rmErr).Error("Failed to remove the role binding")
+		}
+		return err
+	}
+	defaultCluster, err := chooseDefaultCluster(apCmdConfig.Project, apCmdConfig.Reason, apCmdConfig.Exec != "")
+	if err != nil {
+		util.Logger.WithError(err).Warn("No default cluster will be configured")
+	}
+
 	return proxy.StartProxyServer(
 		token,
 		apCmdConfig.Reason,
-		apCmdConfig.ServiceAccountEmail,
+		principal,
 		apCmdConfig.Project,
+		"",
+		binding,
+		nil,
+		nil,
+		nil,
 		expirationDate,
+		apCmdConfig.TokenLifetime,
+		sessionLength,
 		defaultCluster,
+		apCmdConfig.Capture,
+		apCmdConfig.Exec,
 	)
 }
@@ -0,0 +1,457 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	"github.com/rigup/ephemeral-iam/internal/audit"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+	"github.com/rigup/ephemeral-iam/internal/output"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+var (
+	auditSince          time.Duration
+	auditServiceAccount string
+)
+
+func newCmdAudit() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Review the history of eiam commands",
+		Long: dedent.Dedent(`
+			Every eiam command is recorded in a local audit history with the service account,
+			project, and reason that it used, how long it ran for, and its exit status, so that
+			what was done with elevated access can be reconstructed later. The history is
+			only ever appended to. The audit commands themselves aren't recorded.
+
+			Set audit.history to 'false' to stop recording commands.`),
+	}
+
+	cmd.AddCommand(newCmdAuditCloud())
+	cmd.AddCommand(newCmdAuditExport())
+	cmd.AddCommand(newCmdAuditList())
+
+	return cmd
+}
+
+func newCmdAuditList() *cobra.Command {
+	var (
+		limit  int
+		asJSON bool
+	)
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the most recent eiam commands",
+		Long: dedent.Dedent(`
+			The "list" command prints the most recent commands in the audit history, newest
+			last. The PID of a command that started a privileged session is also the ID of
+			that session.`),
+		Example: dedent.Dedent(`
+			eiam audit list --since 24h
+			eiam audit list -s example-svc@my-project.iam.gserviceaccount.com -o json`),
+		Args: auditOutputArgs(&asJSON),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			entries, err := auditHistory()
+			if err != nil {
+				return err
+			}
+			if limit > 0 && len(entries) > limit {
+				entries = entries[len(entries)-limit:]
+			}
+			if len(entries) == 0 {
+				util.Logger.Info("No commands have been recorded")
+				if output.IsTable() {
+					return nil
+				}
+			}
+			return printAuditEntries(entries)
+		},
+	}
+	addAuditFilterFlags(cmd)
+	cmd.Flags().IntVar(&limit, "limit", 20, "The most commands to list. Set to 0 to list every command")
+	addAuditOutputFlags(cmd, &asJSON)
+	return cmd
+}
+
+func newCmdAuditExport() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export [FILE]",
+		Short: "Export the audit history as JSON",
+		Long: dedent.Dedent(`
+			The "export" command writes the commands in the audit history to the provided
+			file as a JSON array, or to stdout if no file is provided.`),
+		Example: dedent.Dedent(`
+			eiam audit export audit.json --since 168h
+			eiam audit export | jq '.[] | select(.exitStatus != 0)'`),
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			entries, err := auditHistory()
+			if err != nil {
+				return err
+			}
+			if len(args) == 0 {
+				return writeAuditEntries(os.Stdout, entries)
+			}
+			f, err := os.OpenFile(args[0], os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+			if err != nil {
+				return errorsutil.New(fmt.Sprintf("Failed to create %s", args[0]), err)
+			}
+			defer f.Close()
+			if err := writeAuditEntries(f, entries); err != nil {
+				return err
+			}
+			util.Logger.Infof("Exported %d commands to %s", len(entries), args[0])
+			return nil
+		},
+	}
+	addAuditFilterFlags(cmd)
+	return cmd
+}
+
+// auditLogDelay is how long after a session ends its API calls are looked
+// for, as Cloud Audit Logs entries can be written after the call returns.
+const auditLogDelay = time.Minute
+
+func newCmdAuditCloud() *cobra.Command {
+	var (
+		sessionID string
+		project   string
+		asJSON    bool
+	)
+	cmd := &cobra.Command{
+		Use:   "cloud",
+		Short: "List the Cloud Audit Logs entries of a privileged session",
+		Long: dedent.Dedent(`
+			The "cloud" command reads the Cloud Audit Logs entries of the API calls that the
+			service account of a privileged session made while it ran, so that you can see
+			exactly what the session did.
+
+			The session can be a running session, or any command in "eiam audit list" by
+			its PID. Entries are read from the session's project unless --project is set.
+			Data Access audit logs are only included if they are enabled in the project, and
+			entries can take a few minutes to be written after a call is made.`),
+		Example: dedent.Dedent(`
+			eiam audit cloud --session 41822
+			eiam audit cloud --session 41822 --project other-project -o json`),
+		Args: auditOutputArgs(&asJSON),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			principal, sessionProject, start, end, err := auditSessionWindow(sessionID)
+			if err != nil {
+				return err
+			}
+			if project == "" {
+				project = sessionProject
+			}
+			if project == "" {
+				return argsError(errors.New("the session has no project, set one with --project"))
+			}
+			util.Logger.Infof("Reading the audit logs of %s in %s from %s to %s", principal, project,
+				start.Local().Format(time.Kitchen), end.Local().Format(time.Kitchen))
+			entries, err := gcpclient.FetchAuditLogEntries(project, principal, start, end)
+			if err != nil {
+				return err
+			}
+			if len(entries) == 0 {
+				util.Logger.Info("No audit log entries were found")
+				if output.IsTable() {
+					return nil
+				}
+			}
+			return printAuditLogEntries(entries)
+		},
+	}
+	cmd.Flags().StringVar(&sessionID, "session", "", "The PID of the session, as shown by 'eiam audit list'. Defaults to the current privileged session")
+	cmd.Flags().StringVarP(&project, options.ProjectFlag.Name, options.ProjectFlag.Shorthand, "", "The project to read the audit logs of. Defaults to the project of the session")
+	addAuditOutputFlags(cmd, &asJSON)
+	return cmd
+}
+
+// addAuditOutputFlags adds the -o/--output and --fields flags, and --json,
+// which was replaced by -o json.
+func addAuditOutputFlags(cmd *cobra.Command, asJSON *bool) {
+	options.AddOutputFlags(cmd.Flags())
+	cmd.Flags().BoolVar(asJSON, "json", false, "Print the results as JSON")
+	if err := cmd.Flags().MarkDeprecated("json", "use -o json instead"); err != nil {
+		util.Logger.Fatal(err)
+	}
+}
+
+// auditOutputArgs checks that a command has no arguments and that its output
+// flags are valid.
+func auditOutputArgs(asJSON *bool) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if err := cobra.NoArgs(cmd, args); err != nil {
+			return err
+		}
+		if *asJSON {
+			output.Format = output.FormatJSON
+		}
+		return options.CheckOutput()
+	}
+}
+
+// auditSessionWindow returns the principal that a privileged session made API
+// calls as, its project, and when it ran. The session is found among the
+// running sessions, and then in the audit history by its PID. The current
+// session is used if id is "".
+func auditSessionWindow(id string) (principal, project string, start, end time.Time, err error) {
+	if session, findErr := findSession(id); findErr == nil {
+		return session.ServiceAccount, session.Project, session.Started, time.Now(), nil
+	} else if id == "" {
+		return "", "", time.Time{}, time.Time{}, findErr
+	}
+
+	pid, err := strconv.Atoi(id)
+	if err != nil {
+		return "", "", time.Time{}, time.Time{}, argsError(fmt.Errorf("no privileged session matches %q, a past session is chosen by its PID", id))
+	}
+	entries, err := audit.History(time.Time{})
+	if err != nil {
+		return "", "", time.Time{}, time.Time{}, err
+	}
+	// PIDs are reused, so the latest command with the PID is used.
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.PID != pid {
+			continue
+		}
+		principal = e.ServiceAccount
+		if principal == "" {
+			principal = e.Principal
+		}
+		end := time.Now()
+		if e.Ended != nil {
+			end = e.Ended.Add(auditLogDelay)
+		}
+		return principal, e.Project, e.Started, end, nil
+	}
+	return "", "", time.Time{}, time.Time{}, fmt.Errorf("no session with PID %d is running or in the audit history, list them with 'eiam audit list'", pid)
+}
+
+func printAuditLogEntries(entries []*gcpclient.AuditLogEntry) error {
+	table := &output.Table{Columns: []output.Column{
+		{Name: "timestamp", Header: "TIME"},
+		{Name: "service", Header: "SERVICE"},
+		{Name: "method", Header: "METHOD"},
+		{Name: "resource", Header: "RESOURCE"},
+		{Name: "status", Header: "STATUS"},
+	}}
+	for _, e := range entries {
+		timestamp := e.Timestamp
+		if t, err := time.Parse(time.RFC3339Nano, e.Timestamp); err == nil {
+			timestamp = t.Local().Format("2006-01-02 15:04:05")
+		}
+		table.Rows = append(table.Rows, []string{timestamp, e.Service, e.Method, valueOrDash(e.Resource), e.Status})
+	}
+	return output.Print(entries, table)
+}
+
+func addAuditFilterFlags(cmd *cobra.Command) {
+	cmd.Flags().DurationVar(&auditSince, "since", 0, "Only include commands that started within this long ago, e.g. 24h")
+	cmd.Flags().StringVarP(
+		&auditServiceAccount,
+		options.ServiceAccountEmailFlag.Name,
+		options.ServiceAccountEmailFlag.Shorthand,
+		"",
+		"Only include commands that used this service account",
+	)
+}
+
+// auditHistory returns the entries in the audit history that match the
+// --since and --service-account-email flags.
+func auditHistory() ([]*audit.Entry, error) {
+	var since time.Time
+	if auditSince > 0 {
+		since = time.Now().Add(-auditSince)
+	}
+	entries, err := audit.History(since)
+	if err != nil {
+		return nil, err
+	}
+	if auditServiceAccount == "" {
+		return entries, nil
+	}
+	var matched []*audit.Entry
+	for _, entry := range entries {
+		if entry.ServiceAccount == auditServiceAccount {
+			matched = append(matched, entry)
+		}
+	}
+	return matched, nil
+}
+
+func printAuditEntries(entries []*audit.Entry) error {
+	table := &output.Table{Columns: []output.Column{
+		{Name: "started", Header: "STARTED"},
+		{Name: "pid", Header: "PID"},
+		{Name: "command", Header: "COMMAND"},
+		{Name: "serviceAccount", Header: "SERVICE ACCOUNT"},
+		{Name: "project", Header: "PROJECT"},
+		{Name: "duration", Header: "DURATION"},
+		{Name: "exitStatus", Header: "EXIT"},
+	}}
+	for _, e := range entries {
+		exitStatus := "-"
+		if e.ExitStatus != nil {
+			exitStatus = strconv.Itoa(*e.ExitStatus)
+		}
+		table.Rows = append(table.Rows, []string{
+			e.Started.Local().Format("2006-01-02 15:04:05"),
+			strconv.Itoa(e.PID),
+			e.Command,
+			valueOrDash(e.ServiceAccount),
+			valueOrDash(e.Project),
+			e.Duration,
+			exitStatus,
+		})
+	}
+	return output.Print(entries, table)
+}
+
+func writeAuditEntries(f *os.File, entries []*audit.Entry) error {
+	if entries == nil {
+		entries = []*audit.Entry{}
+	}
+	return writeJSON(f, entries)
+}
+
+// writeJSON writes v to f as indented JSON.
+func writeJSON(f *os.File, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errorsutil.New("Failed to encode the output", err)
+	}
+	if _, err := fmt.Fprintln(f, string(data)); err != nil {
+		return errorsutil.New("Failed to write the output", err)
+	}
+	return nil
+}
+
+// commandStarted is when eiam started.
+var commandStarted = time.Now()
+
+// RecordCommand appends the command that eiam ran to the audit history and
+// sends it to the audit sinks. It is called when eiam exits, with the status
+// that it exits with.
+func RecordCommand(exitStatus int) {
+	record := viper.GetBool(appconfig.AuditHistory)
+	if !record && !audit.SinksEnabled() {
+		return
+	}
+	entry := commandEntry()
+	if entry == nil {
+		return
+	}
+	ended := time.Now().UTC()
+	entry.Ended = &ended
+	entry.Duration = ended.Sub(commandStarted).Round(time.Millisecond).String()
+	entry.ExitStatus = &exitStatus
+
+	if record {
+		if err := audit.Record(entry); err != nil {
+			util.Logger.WithError(err).Warn("Failed to record the command in the audit history")
+		}
+	}
+	audit.Ship(audit.EventCommandFinished, entry)
+	// The started event may still be being sent too.
+	audit.Flush()
+}
+
+// shipCommandStarted sends the command that eiam is running to the audit
+// sinks once its flags are parsed, if it impersonates a service account, so
+// that long privileged sessions are seen while they run.
+func shipCommandStarted() {
+	if !audit.SinksEnabled() {
+		return
+	}
+	if entry := commandEntry(); entry != nil && entry.ServiceAccount != "" {
+		audit.Ship(audit.EventCommandStarted, entry)
+	}
+}
+
+// commandEntry returns the audit entry of the command that eiam runs, without
+// the fields that are set when it ends, or nil if the command isn't audited.
+func commandEntry() *audit.Entry {
+	if RootCommand == nil {
+		return nil
+	}
+	cmd, _, err := RootCommand.Find(os.Args[1:])
+	if err != nil {
+		cmd = &RootCommand.Command
+	}
+	// Reading the history isn't recorded in it.
+	if cmd.CommandPath() == "eiam audit" || (cmd.HasParent() && cmd.Parent().CommandPath() == "eiam audit") {
+		return nil
+	}
+
+	entry := &audit.Entry{
+		PID:            os.Getpid(),
+		Command:        auditCommandLine(cmd),
+		ServiceAccount: flagValue(cmd, options.ServiceAccountEmailFlag.Name),
+		Project:        flagValue(cmd, options.ProjectFlag.Name),
+		Reason:         flagValue(cmd, options.ReasonFlag.Name),
+		Started:        commandStarted.UTC(),
+	}
+	if u, err := user.Current(); err == nil {
+		entry.User = u.Username
+	}
+	if principal, err := gcpclient.CheckActiveAccountSet(); err == nil {
+		entry.Principal = principal
+	}
+	return entry
+}
+
+// auditCommandLine returns the command line that eiam was run with. The values
+// of sensitive config fields set with "eiam config set" are left out.
+func auditCommandLine(cmd *cobra.Command) string {
+	args := append([]string{"eiam"}, os.Args[1:]...)
+	// Tokens and keys can be passed to wrapped commands, such as
+	// "eiam curl -H 'Authorization: Bearer ...'".
+	for i, arg := range args {
+		args[i] = string(util.Redact([]byte(arg)))
+	}
+	if cmd.CommandPath() == "eiam config set" {
+		for i := 1; i < len(args)-1; i++ {
+			if field, ok := appconfig.LookupField(args[i]); ok && field.Sensitive {
+				args[i+1] = "REDACTED"
+			}
+		}
+	}
+	return util.JoinArgs(args)
+}
+
+// flagValue returns the value of a flag of the command, or "" if the command
+// doesn't have the flag.
+func flagValue(cmd *cobra.Command, name string) string {
+	if f := cmd.Flags().Lookup(name); f != nil {
+		return f.Value.String()
+	}
+	return ""
+}
@@ -0,0 +1,40 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestAuditCommandLineRedactsSecrets(t *testing.T) {
+	args := os.Args
+	defer func() { os.Args = args }()
+	os.Args = []string{
+		"/usr/local/bin/eiam", "curl", "-H", "Authorization: Bearer ya29.a0AfH6SMBx",
+		"https://example.com/?access_token=ya29.c0Ab", "-R", "JIRA-1234",
+	}
+
+	got := auditCommandLine(&cobra.Command{Use: "curl"})
+	if strings.Contains(got, "ya29.") {
+		t.Errorf("expected the tokens to be redacted, got %s", got)
+	}
+	if !strings.HasPrefix(got, "eiam curl -H") || !strings.HasSuffix(got, "-R JIRA-1234") {
+		t.Errorf("expected the rest of the command line to be kept, got %s", got)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/proxy"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+var (
+	bqCmdArgs   []string
+	bqCmdConfig options.CmdConfig
+)
+
+func newCmdBq() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "bq [BQ_ARGS]",
+		Short: "Run a bq command with the permissions of the specified service account",
+		Long: dedent.Dedent(`
+			The "bq" command runs the provided BigQuery CLI command with the permissions of the
+			specified service account. Like "eiam gsutil", the command runs in a short privileged
+			session: the auth proxy is started for the command, and bq is pointed at it with its
+			--proxy_address, --proxy_port, and --ca_certificates_file flags. The session ends when
+			bq exits.`),
+		Example: dedent.Dedent(`
+			eiam bq ls --project_id my-project \
+			  --service-account-email example@my-project.iam.gserviceaccount.com \
+			  --reason "Debugging for (JIRA-1234)"
+
+			eiam bq rm -f -t my-project:staging.tmp_export \
+			  -s example@my-project.iam.gserviceaccount.com -R "Clean up export (JIRA-1235)"`),
+		Args:               cobra.ArbitraryArgs,
+		FParseErrWhitelist: cobra.FParseErrWhitelist{UnknownFlags: true},
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if viper.GetString(appconfig.BqPath) == "" {
+				err := errors.New(`"bq": executable file not found in $PATH`)
+				return errorsutil.New("Failed to run bq command", err)
+			}
+			// bq can't use an auth proxy on a Unix socket.
+			if proxy.SocketPath() != "" {
+				return argsError(fmt.Errorf("the bq command can't be used when %s is set", appconfig.AuthProxySocketPath))
+			}
+			if err := options.CheckRequired(cmd.Flags()); err != nil {
+				return err
+			}
+			if err := options.CheckServiceAccount(bqCmdConfig.ServiceAccountEmail); err != nil {
+				return err
+			}
+			if err := options.CheckDelegates(bqCmdConfig.Delegates); err != nil {
+				return err
+			}
+			if err := options.CheckLifetime(bqCmdConfig.TokenLifetime); err != nil {
+				return err
+			}
+
+			bqCmdArgs = util.ExtractUnknownArgs(cmd.Flags(), os.Args)
+			if err := options.CheckReason(bqCmdConfig.Reason); err != nil {
+				return err
+			}
+			if err := util.FormatReason(&bqCmdConfig.Reason); err != nil {
+				return err
+			}
+
+			if !options.YesOption {
+				util.Confirm(map[string]string{
+					"Project":         bqCmdConfig.Project,
+					"Service Account": bqCmdConfig.ServiceAccountEmail,
+					"Delegates":       strings.Join(bqCmdConfig.Delegates, ", "),
+					"Reason":          bqCmdConfig.Reason,
+					"Command":         fmt.Sprintf("bq %s", strings.Join(bqCmdArgs, " ")),
+				})
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runBqCommand()
+		},
+	}
+
+	options.AddServiceAccountEmailFlag(cmd.Flags(), &bqCmdConfig.ServiceAccountEmail, true)
+	options.AddReasonFlag(cmd.Flags(), &bqCmdConfig.Reason, true)
+	options.AddProjectFlag(cmd.Flags(), &bqCmdConfig.Project, false)
+	options.AddDelegatesFlag(cmd.Flags(), &bqCmdConfig.Delegates)
+	options.AddLifetimeFlag(cmd.Flags(), &bqCmdConfig.TokenLifetime)
+
+	return cmd
+}
+
+func runBqCommand() error {
+	return runInSession(&bqCmdConfig, "bq", bqCmdArgs, func(host, port, _ string) ([]string, func(), error) {
+		// bq only reads global flags before the command name.
+		command := []string{
+			viper.GetString(appconfig.BqPath),
+			"--proxy_address=" + host,
+			"--proxy_port=" + port,
+			"--ca_certificates_file=" + viper.GetString(appconfig.AuthProxyCertFile),
+		}
+		return append(command, bqCmdArgs...), func() {}, nil
+	})
+}
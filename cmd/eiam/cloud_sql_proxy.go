@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 
 	"github.com/lithammer/dedent"
@@ -36,19 +37,29 @@ var (
 	cspCmdConfig         options.CmdConfig
 
 	cloudSQLProxyPath string
+	cloudSQLInstances []string
 )
 
 func newCmdCloudSQLProxy() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "cloud_sql_proxy [GCLOUD_ARGS]",
-		Short: "Run cloud_sql_proxy with the permissions of the specified service account",
+		Use:     "cloud_sql_proxy [CLOUD_SQL_PROXY_ARGS]",
+		Aliases: []string{"cloud-sql-proxy"},
+		Short:   "Run cloud_sql_proxy with the permissions of the specified service account",
 		Long: dedent.Dedent(`
 			The "cloud_sql_proxy" command runs the provided cloud_sql_proxy command with the permissions of the specified
-			service account.`),
+			service account.
+
+			The Cloud SQL Auth Proxy is given the service account's access token, and is stopped when the token
+			expires, so the database connections that it opens last no longer than "--lifetime". Both version 1
+			(cloud_sql_proxy) and version 2 (cloud-sql-proxy) of the proxy are supported. The instances to connect
+			to can be given with "--instance" instead of the proxy's own arguments, which differ between them.`),
 		Example: dedent.Dedent(`
 			eiam cloud_sql_proxy -instances my-project:us-central1:example-instance=tcp:3306 \
 			--service-account-email example@my-project.iam.gserviceaccount.com \
-			--reason "Debugging for (JIRA-1234)"`),
+			--reason "Debugging for (JIRA-1234)"
+
+			eiam cloud-sql-proxy --instance my-project:us-central1:example-instance --lifetime 2h \
+			-s db-admin@my-project.iam.gserviceaccount.com -R "Database migration (JIRA-1235)"`),
 		Args:               cobra.ArbitraryArgs,
 		FParseErrWhitelist: cobra.FParseErrWhitelist{UnknownFlags: true},
 		PreRunE: func(cmd *cobra.Command, args []string) error {
@@ -60,8 +71,17 @@ func newCmdCloudSQLProxy() *cobra.Command {
 			if err := options.CheckRequired(cmd.Flags()); err != nil {
 				return err
 			}
+			if err := options.CheckServiceAccount(cspCmdConfig.ServiceAccountEmail); err != nil {
+				return err
+			}
+			if err := options.CheckLifetime(cspCmdConfig.TokenLifetime); err != nil {
+				return err
+			}
 
 			cloudSQLProxyCmdArgs = util.ExtractUnknownArgs(cmd.Flags(), os.Args)
+			if err := options.CheckReason(cspCmdConfig.Reason); err != nil {
+				return err
+			}
 			if err := util.FormatReason(&cspCmdConfig.Reason); err != nil {
 				return err
 			}
@@ -71,6 +91,7 @@ func newCmdCloudSQLProxy() *cobra.Command {
 					"Project":         cspCmdConfig.Project,
 					"Service Account": cspCmdConfig.ServiceAccountEmail,
 					"Reason":          cspCmdConfig.Reason,
+					"Instances":       strings.Join(cloudSQLInstances, ", "),
 					"Command":         fmt.Sprintf("cloud_sql_proxy %s", strings.Join(cloudSQLProxyCmdArgs, " ")),
 				})
 			}
@@ -84,34 +105,64 @@ func newCmdCloudSQLProxy() *cobra.Command {
 	options.AddServiceAccountEmailFlag(cmd.Flags(), &cspCmdConfig.ServiceAccountEmail, true)
 	options.AddReasonFlag(cmd.Flags(), &cspCmdConfig.Reason, true)
 	options.AddProjectFlag(cmd.Flags(), &cspCmdConfig.Project, false)
+	options.AddLifetimeFlag(cmd.Flags(), &cspCmdConfig.TokenLifetime)
+	cmd.Flags().StringSliceVar(&cloudSQLInstances, "instance", nil, "The connection name of a Cloud SQL instance to connect to, e.g. 'my-project:us-central1:my-instance'. Can be repeated")
 
 	return cmd
 }
 
 func runCloudSQLProxyCommand() error {
-	hasAccess, err := gcpclient.CanImpersonate(cspCmdConfig.Project, cspCmdConfig.ServiceAccountEmail)
-	if err != nil {
+	if err := checkCanImpersonate(cspCmdConfig.Project, cspCmdConfig.ServiceAccountEmail, nil); err != nil {
+		return err
+	}
+	if err := confirmMFA(); err != nil {
+		return err
+	}
+	if err := requestApproval(&cspCmdConfig, fmt.Sprintf("cloud_sql_proxy %s", strings.Join(cloudSQLProxyCmdArgs, " ")), cspCmdConfig.TokenLifetime); err != nil {
 		return err
-	} else if !hasAccess {
-		util.Logger.Fatalln("You do not have access to impersonate this service account")
 	}
 
 	util.Logger.Infof("Fetching access token for %s", cspCmdConfig.ServiceAccountEmail)
-	accessToken, err := gcpclient.GenerateTemporaryAccessToken(cspCmdConfig.ServiceAccountEmail, cspCmdConfig.Reason)
+	accessToken, err := gcpclient.GenerateTemporaryAccessToken(
+		cspCmdConfig.ServiceAccountEmail,
+		cspCmdConfig.Reason,
+		cspCmdConfig.TokenLifetime,
+		nil,
+	)
 	if err != nil {
 		return err
 	}
 
-	util.Logger.Infof("Running: [cloud_sql_proxy %s]\n\n", strings.Join(cloudSQLProxyCmdArgs, " "))
-	cloudSQLProxyAuth := append(cloudSQLProxyCmdArgs, "-token", accessToken.GetAccessToken())
-	c := exec.Command(cloudSQLProxyPath, cloudSQLProxyAuth...)
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
-	c.Stdin = os.Stdin
+	cmdArgs := cloudSQLProxyArgs(cloudSQLProxyPath, cloudSQLProxyCmdArgs, cloudSQLInstances)
+	fullCmd := fmt.Sprintf("%s %s", filepath.Base(cloudSQLProxyPath), strings.Join(cmdArgs, " "))
+	util.Logger.Infof("Running: [%s]\n\n", fullCmd)
+	c := exec.Command(cloudSQLProxyPath, append(cmdArgs, tokenFlag(cloudSQLProxyPath), accessToken.GetAccessToken())...)
+	return runForegroundUntil(c, fullCmd, accessToken.GetExpireTime().AsTime())
+}
+
+// cloudSQLProxyV2 reports whether the binary is version 2 of the Cloud SQL
+// Auth Proxy, which was renamed to cloud-sql-proxy.
+func cloudSQLProxyV2(binPath string) bool {
+	return strings.HasPrefix(filepath.Base(binPath), "cloud-sql-proxy")
+}
 
-	if err := c.Run(); err != nil {
-		fullCmd := fmt.Sprintf("cloud_sql_proxy %s", strings.Join(cloudSQLProxyCmdArgs, " "))
-		return errorsutil.New(fmt.Sprintf("Failed to run command [%s]", fullCmd), err)
+func tokenFlag(binPath string) string {
+	if cloudSQLProxyV2(binPath) {
+		return "--token"
+	}
+	return "-token"
+}
+
+// cloudSQLProxyArgs adds the instances chosen with --instance to the proxy's
+// arguments. Version 1 takes them in its -instances flag, and version 2 as
+// arguments.
+func cloudSQLProxyArgs(binPath string, args, instances []string) []string {
+	if len(instances) == 0 {
+		return args
+	}
+	withInstances := append([]string(nil), args...)
+	if cloudSQLProxyV2(binPath) {
+		return append(withInstances, instances...)
 	}
-	return nil
+	return append(withInstances, "-instances="+strings.Join(instances, ","))
 }
@@ -15,10 +15,13 @@
 package eiam
 
 import (
+	"os"
+
 	"github.com/lithammer/dedent"
 	"github.com/spf13/cobra"
 
 	eiam "github.com/rigup/ephemeral-iam/internal"
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
 	"github.com/rigup/ephemeral-iam/pkg/options"
 )
 
@@ -71,21 +74,58 @@ func NewEphemeralIamCommand() (*eiam.RootCommand, error) {
 	cmds.ResetFlags()
 
 	cmds.AddCommand(newCmdAssumePrivileges())
+	cmds.AddCommand(newCmdAudit())
+	cmds.AddCommand(newCmdBq())
 	cmds.AddCommand(newCmdCloudSQLProxy())
+	cmds.AddCommand(newCmdCompletion())
 	cmds.AddCommand(newCmdConfig())
 	cmds.AddCommand(newCmdDefaultServiceAccounts())
+	cmds.AddCommand(newCmdDockerCredential())
 	cmds.AddCommand(newCmdGcloud())
+	cmds.AddCommand(newCmdGenerateIDToken())
+	cmds.AddCommand(newCmdGenerateSAKey())
+	cmds.AddCommand(newCmdGsutil())
 	cmds.AddCommand(newCmdKubectl())
 	cmds.AddCommand(newCmdListServiceAccounts())
+	cmds.AddCommand(newCmdMFA())
+	cmds.AddCommand(newCmdPaths())
 	cmds.AddCommand(newCmdPlugins())
+	cmds.AddCommand(newCmdProxy())
 	cmds.AddCommand(newCmdQueryPermissions())
+	cmds.AddCommand(newCmdReauth())
+	cmds.AddCommand(newCmdRun())
+	cmds.AddCommand(newCmdSessions())
+	cmds.AddCommand(newCmdSSH())
+	cmds.AddCommand(newCmdTerraform())
+	cmds.AddCommand(newCmdTokens())
 	cmds.AddCommand(newCmdVersion())
+	cmds.AddCommand(newCmdWhoami())
+	// Plugins read their arguments when they are loaded, so aliases need to be
+	// expanded first.
+	if err := cmds.ExpandAliases(); err != nil {
+		return nil, err
+	}
 	if err := cmds.LoadPlugins(); err != nil {
 		return nil, err
 	}
+	if err := cmds.IgnorePluginAlias(); err != nil {
+		return nil, err
+	}
 	options.AddPersistentFlags(cmds.PersistentFlags())
+	cobra.OnInitialize(applyFlagOverrides, shipCommandStarted)
+	registerCompletions(&cmds.Command)
 
 	RootCommand = cmds
 
 	return cmds, nil
 }
+
+// applyFlagOverrides applies the logging flags of the command that eiam runs
+// once its command line is parsed.
+func applyFlagOverrides() {
+	cmd, _, err := RootCommand.Find(os.Args[1:])
+	if err != nil {
+		return
+	}
+	appconfig.ApplyFlagOverrides(cmd.Flags())
+}
@@ -0,0 +1,185 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+// The shells that "completion" can generate scripts for.
+var completionShells = []string{"bash", "zsh", "fish", "powershell"}
+
+// serviceAccountCacheFile holds the service accounts that list-service-accounts
+// found in each project, which the completion of --service-account-email
+// suggests without calling the IAM API.
+const serviceAccountCacheFile = "service_account_cache.json"
+
+func newCmdCompletion() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "completion bash|zsh|fish|powershell",
+		Short: "Generate the shell completion script for eiam",
+		Long: dedent.Dedent(`
+			The "completion" command prints the script that completes eiam commands, flags,
+			and arguments in the given shell.
+
+			The --service-account-email flag completes the service accounts that
+			"list-service-accounts" last found in the project, and your default service
+			accounts. Run "list-service-accounts" to update the list. The "config" commands
+			complete config keys.`),
+		Example: dedent.Dedent(`
+			# Load the completions in the current bash shell
+			source <(eiam completion bash)
+
+			# Load the completions for every new zsh shell
+			eiam completion zsh > "${fpath[1]}/_eiam"
+
+			# Load the completions for every new fish shell
+			eiam completion fish > ~/.config/fish/completions/eiam.fish
+
+			# Load the completions in the current PowerShell session
+			eiam completion powershell | Out-String | Invoke-Expression`),
+		Args:                  cobra.ExactValidArgs(1),
+		ValidArgs:             completionShells,
+		DisableFlagsInUseLine: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			root := cmd.Root()
+			switch args[0] {
+			case "bash":
+				return root.GenBashCompletion(os.Stdout)
+			case "zsh":
+				return root.GenZshCompletion(os.Stdout)
+			case "fish":
+				return root.GenFishCompletion(os.Stdout, true)
+			default:
+				return root.GenPowerShellCompletionWithDesc(os.Stdout)
+			}
+		},
+	}
+	return cmd
+}
+
+// registerCompletions adds the completion of --service-account-email to every
+// command that has the flag.
+func registerCompletions(cmd *cobra.Command) {
+	if cmd.Flags().Lookup(options.ServiceAccountEmailFlag.Name) != nil {
+		if err := cmd.RegisterFlagCompletionFunc(options.ServiceAccountEmailFlag.Name, completeServiceAccounts); err != nil {
+			util.Logger.Fatalf("failed to register completion of --%s: %v", options.ServiceAccountEmailFlag.Name, err)
+		}
+	}
+	for _, child := range cmd.Commands() {
+		registerCompletions(child)
+	}
+}
+
+// completeServiceAccounts completes the service accounts of the project of
+// the command from the cache, and the configured default service accounts.
+func completeServiceAccounts(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	project, _ := cmd.Flags().GetString(options.ProjectFlag.Name)
+	if project == "" {
+		project, _ = options.DefaultProject()
+	}
+
+	candidates := cachedServiceAccounts(project)
+	for _, sa := range viper.GetStringMapString(appconfig.DefaultServiceAccounts) {
+		candidates = append(candidates, sa)
+	}
+	candidates = append(candidates, viper.GetString(appconfig.DefaultsServiceAccount))
+
+	seen := map[string]bool{}
+	emails := []string{}
+	for _, email := range candidates {
+		if email != "" && !seen[email] && strings.HasPrefix(email, toComplete) {
+			seen[email] = true
+			emails = append(emails, email)
+		}
+	}
+	sort.Strings(emails)
+	return emails, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeConfigKey completes the config key that is the first argument of
+// the config commands.
+func completeConfigKey(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	keys := []string{}
+	for _, key := range viper.AllKeys() {
+		if strings.HasPrefix(key, toComplete) && checkManagedKey(key) == nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeConfigSet completes the key of "config set", and the value of
+// boolean keys.
+func completeConfigSet(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	switch len(args) {
+	case 0:
+		return completeConfigKey(cmd, args, toComplete)
+	case 1:
+		if f, ok := appconfig.LookupField(args[0]); ok && f.Type == appconfig.BoolField {
+			return []string{"true", "false"}, cobra.ShellCompDirectiveNoFileComp
+		}
+	}
+	return nil, cobra.ShellCompDirectiveNoFileComp
+}
+
+// cachedServiceAccounts returns the service accounts cached for project.
+func cachedServiceAccounts(project string) []string {
+	data, err := ioutil.ReadFile(filepath.Join(appconfig.GetConfigDir(), serviceAccountCacheFile))
+	if err != nil {
+		return nil
+	}
+	cache := map[string][]string{}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil
+	}
+	return cache[project]
+}
+
+// cacheServiceAccounts replaces the cached service accounts of project.
+func cacheServiceAccounts(project string, emails []string) error {
+	cacheFile := filepath.Join(appconfig.GetConfigDir(), serviceAccountCacheFile)
+	cache := map[string][]string{}
+	if data, err := ioutil.ReadFile(cacheFile); err == nil {
+		json.Unmarshal(data, &cache) //nolint:errcheck // A corrupt cache is replaced
+	}
+	cache[project] = emails
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(cacheFile, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", cacheFile, err)
+	}
+	return nil
+}
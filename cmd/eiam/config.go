@@ -18,84 +18,28 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"strconv"
+	"path/filepath"
 	"strings"
 
 	"github.com/lithammer/dedent"
-	"github.com/sirupsen/logrus"
+	"github.com/mitchellh/go-wordwrap"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
 	"github.com/rigup/ephemeral-iam/internal/appconfig"
 	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/pkg/options"
 )
 
-var (
-	loggingLevels    = []string{"trace", "debug", "info", "warn", "error", "fatal", "panic"}
-	loggingFormats   = []string{"text", "json", "debug"}
-	boolConfigFields = []string{
-		appconfig.AuthProxyVerbose,
-		appconfig.GithubAuth,
-		appconfig.LoggingLevelTruncation,
-		appconfig.LoggingPadLevelText,
-	}
-)
+// The formats that "config print" can output the effective configuration in.
+var configPrintFormats = []string{"json", "yaml", "flat"}
 
-var configInfo = dedent.Dedent(`
-		┏━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┳━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┓
-		┃ Key                            ┃ Description                                 ┃
-		┡━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━╇━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┩
-		│ authproxy.certfile             │ The path to the auth proxy's TLS            │
-		│                                │ certificate                                 │
-		├────────────────────────────────┼─────────────────────────────────────────────┤
-		│ authproxy.keyfile              │ The path to the auth proxy's x509 key       │
-		├────────────────────────────────┼─────────────────────────────────────────────┤
-		│ authproxy.logdir               │ The directory that auth proxy logs will be  │
-		│                                │ written to                                  │
-		├────────────────────────────────┼─────────────────────────────────────────────┤
-		│ authproxy.proxyaddress         │ The address that the auth proxy is hosted   │
-		│                                │ on                                          │
-		├────────────────────────────────┼─────────────────────────────────────────────┤
-		│ authproxy.proxyport            │ The port that the auth proxy runs on        │
-		├────────────────────────────────┼─────────────────────────────────────────────┤
-		│ authproxy.verbose              │ When set to 'true', verbose output for      │
-		│                                │ proxy logs will be enabled                  │
-		├────────────────────────────────┼─────────────────────────────────────────────┤
-		│ binarypaths.cloudsqlproxy      │ The path to the cloud_sql_proxy binary on   │
-		│                                │ your filesystem                             │
-		├────────────────────────────────┼─────────────────────────────────────────────┤
-		│ binarypaths.gcloud             │ The path to the gcloud binary on your       │
-		│                                │ filesystem                                  │
-		├────────────────────────────────┼─────────────────────────────────────────────┤
-		│ binarypaths.kubectl            │ The path to the kubectl binary on your      │
-		│                                │ filesystem                                  │
-		├────────────────────────────────┼─────────────────────────────────────────────┤
-		│ github.auth                    │ When set to 'true', the "plugins install"   │
-		│                                │ command will use a configured personal      │
-		│                                │ access token to authenticate to the Github  │
-		│                                │ API.                                        │
-		├────────────────────────────────┼─────────────────────────────────────────────┤
-		│ github.tokens                  │ The configured Github personal access       │
-		│                                │ tokens                                      │
-		├────────────────────────────────┼─────────────────────────────────────────────┤
-		│ logging.format                 │ The format for which to write console logs  │
-		│                                │ Can be 'json', 'text', or 'debug'           │
-		├────────────────────────────────┼─────────────────────────────────────────────┤
-		│ logging.level                  │ The logging level to write to the console   │
-		│                                │ Can be one of 'trace', 'debug', 'info',     │
-		│                                │ 'warn', 'error', 'fatal', or 'panic'        │
-		├────────────────────────────────┼─────────────────────────────────────────────┤
-		│ logging.disableleveltruncation │ When set to 'true', the level indicator for │
-		│                                │ logs will not be trucated                   │
-		├────────────────────────────────┼─────────────────────────────────────────────┤
-		│ logging.padleveltext           │ When set to 'true', output logs will align  │
-		│                                │ evenly with their output level indicator    │
-		├────────────────────────────────┼─────────────────────────────────────────────┤
-		│ serviceaccounts                │ The default service accounts set via the    │
-		│                                │ 'default-service-accounts' command          │
-		└────────────────────────────────┴─────────────────────────────────────────────┘
-`)
+// Widths of the columns in the "config info" table.
+const (
+	configInfoMinKeyWidth = 30
+	configInfoDescWidth   = 43
+)
 
 func newCmdConfig() *cobra.Command {
 	cmd := &cobra.Command{
@@ -107,43 +51,67 @@ func newCmdConfig() *cobra.Command {
 	cmd.AddCommand(newCmdConfigView())
 	cmd.AddCommand(newCmdConfigSet())
 	cmd.AddCommand(newCmdConfigInfo())
+	cmd.AddCommand(newCmdConfigReset())
+	cmd.AddCommand(newCmdConfigExport())
+	cmd.AddCommand(newCmdConfigImport())
+	cmd.AddCommand(newCmdConfigSetup())
+	cmd.AddCommand(newCmdConfigConvert())
+	cmd.AddCommand(newCmdConfigEdit())
+	cmd.AddCommand(newCmdConfigDoctor())
 
 	return cmd
 }
 
 func newCmdConfigPrint() *cobra.Command {
+	var format string
 	cmd := &cobra.Command{
 		Use:   "print",
 		Short: "Print the current configuration",
+		Long: dedent.Dedent(`
+			The "print" command prints the contents of the config file.
+
+			When the --format flag is set, the effective configuration is printed instead,
+			after overrides from flags, EIAM_* environment variables, and the per-project
+			.eiam.yaml file are applied. The "flat" format prints one key=value pair per
+			line, with lists joined by commas, which is convenient for shell scripts.
+
+			Sensitive values, such as Github personal access tokens, are always masked.`),
+		Example: dedent.Dedent(`
+			eiam config print
+			eiam config print --format json | jq -r .authproxy.proxyport
+			eiam config print --format flat | grep '^logging\.'`),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				return argsError(errors.New("the print command does not accept arguments"))
+			}
+			if format != "" && !util.Contains(configPrintFormats, format) {
+				return argsError(fmt.Errorf("--format must be one of %v", configPrintFormats))
+			}
+			return nil
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			configFile := viper.ConfigFileUsed()
-			data, err := ioutil.ReadFile(configFile)
+			settings := appconfig.FileSettings()
+			outputFormat := appconfig.ConfigFormat()
+			if format != "" {
+				settings = appconfig.EffectiveSettings()
+				outputFormat = format
+			}
+			appconfig.MaskSensitive(settings)
+			data, err := appconfig.MarshalSettings(settings, outputFormat)
 			if err != nil {
-				return errorsutil.New("Failed to read configuration file", err)
-			}
-			lines := strings.Split(string(data), "\n")
-			inTokens := false
-			fmt.Printf("\n")
-			for i := 0; i < len(lines); i++ {
-				if lines[i] == "  tokens:" {
-					inTokens = true
-				} else if inTokens {
-					// Mask Github personal access tokens.
-					tokenConfig := viper.GetStringMapString(appconfig.GithubTokens)
-					for tokenName := range tokenConfig {
-						fmt.Printf("    %s: **********\n", tokenName)
-						i++
-					}
-					i--
-					inTokens = false
-					continue
-				}
-				fmt.Println(lines[i])
+				return errorsutil.New("Failed to format configuration", err)
 			}
-			fmt.Printf("\n")
+			if format != "" {
+				// Keep the output parsable.
+				fmt.Println(strings.TrimSpace(string(data)))
+				return nil
+			}
+			fmt.Printf("\n%s\n", strings.TrimSpace(string(data)))
 			return nil
 		},
 	}
+	// This intentionally shadows the global --format flag.
+	cmd.Flags().StringVar(&format, "format", "", fmt.Sprintf("Print the effective configuration in one of %v", configPrintFormats))
 	return cmd
 }
 
@@ -152,31 +120,60 @@ func newCmdConfigInfo() *cobra.Command {
 		Use:   "info",
 		Short: "Print information about config fields",
 		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Println(configInfo)
+			fmt.Println(formatConfigInfo(appconfig.Fields()))
 		},
 	}
 	return cmd
 }
 
 func newCmdConfigView() *cobra.Command {
+	var showSource bool
 	cmd := &cobra.Command{
-		Use:       "view",
-		Short:     "View the value of a provided config item",
+		Use:   "view",
+		Short: "View the value of a provided config item",
+		Long: dedent.Dedent(`
+			The "view" command prints the effective value of a config item.
+
+			Every config item can be overridden by an environment variable named after
+			the key with an "EIAM_" prefix, where dots are replaced with underscores
+			(e.g. EIAM_LOGGING_LEVEL overrides logging.level). Values are resolved in
+			the following order of precedence:
+
+			  1. Command line flags
+			  2. EIAM_* environment variables
+			  3. A .eiam.yaml file in the current working directory
+			  4. The config file
+			  5. Built-in defaults
+
+			Use the --source flag to show where the value came from.`),
 		Args:      cobra.ExactValidArgs(1),
 		ValidArgs: viper.AllKeys(),
 		Run: func(cmd *cobra.Command, args []string) {
-			val := viper.Get(args[0])
-			util.Logger.Infof("%s: %v\n", args[0], val)
+			val := appconfig.MaskValue(args[0], viper.Get(args[0]))
+			if !showSource {
+				util.Logger.Infof("%s: %v\n", args[0], val)
+				return
+			}
+			source := appconfig.Source(args[0])
+			switch source {
+			case appconfig.SourceEnv:
+				source = fmt.Sprintf("%s (%s)", source, appconfig.EnvVarName(args[0]))
+			case appconfig.SourceProject:
+				source = fmt.Sprintf("%s (%s)", source, appconfig.ProjectConfigFile())
+			}
+			util.Logger.Infof("%s: %v [source: %s]\n", args[0], val, source)
 		},
 	}
+	cmd.Flags().BoolVar(&showSource, "source", false, "Show which layer (flag, env, project, file, or default) supplied the value")
 	return cmd
 }
 
 func newCmdConfigSet() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "set",
-		Short: "Set the value of a provided config item",
-		Args:  checkSetArgs,
+		Use:               "set",
+		Short:             "Set the value of a provided config item",
+		Args:              checkSetArgs,
+		ValidArgsFunction: completeConfigSet,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			oldVal := viper.Get(args[0])
 
@@ -184,41 +181,237 @@ func newCmdConfigSet() *cobra.Command {
 				util.Logger.Warn("New value is the same as the current one")
 				return nil
 			}
-			if util.Contains(boolConfigFields, args[0]) {
-				newValue, err := strconv.ParseBool(args[1])
-				if err != nil {
-					return argsError(fmt.Errorf("the %s value must be either true or false", args[0]))
-				}
-				viper.Set(args[0], newValue)
-			} else {
-				viper.Set(args[0], args[1])
+			newValue, err := appconfig.ParseValue(args[0], args[1])
+			if err != nil {
+				return argsError(err)
 			}
+			viper.Set(args[0], newValue)
+
 			// Update the logger (for testing).
-			switch args[0] {
-			case appconfig.LoggingLevel:
-				level, err := logrus.ParseLevel(args[1])
-				if err != nil {
-					return argsError(err)
+			util.ConfigureLogger(util.Logger)
+			if err := appconfig.WriteConfig(); err != nil {
+				return errorsutil.New("Failed to write updated configuration", err)
+			}
+			util.Logger.Infof("Updated %s from %v to %s", args[0], oldVal, args[1])
+			if appconfig.Source(args[0]) == appconfig.SourceProject {
+				util.Logger.Warnf("%s is overridden by %s in the current directory", args[0], appconfig.ProjectConfigFile())
+			}
+			return nil
+		},
+	}
+	return cmd
+}
+
+func newCmdConfigReset() *cobra.Command {
+	var resetAll bool
+	cmd := &cobra.Command{
+		Use:   "reset [KEY]",
+		Short: "Restore a config item, or the entire config, to the default value",
+		Long: dedent.Dedent(`
+			The "reset" command restores the provided config item to its built-in default value.
+			Use the --all flag to reset the entire configuration file instead.
+
+			Before any changes are made, a timestamped backup of the current configuration file
+			is written to the configuration directory.`),
+		Example: dedent.Dedent(`
+			eiam config reset logging.level
+			eiam config reset --all`),
+		ValidArgsFunction: completeConfigKey,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if resetAll && len(args) > 0 {
+				return argsError(errors.New("a config key cannot be provided with the --all flag"))
+			} else if !resetAll && len(args) != 1 {
+				return argsError(errors.New("requires either a config key or the --all flag"))
+			}
+			if !resetAll {
+				if err := checkManagedKey(args[0]); err != nil {
+					return err
 				}
-				util.Logger.Level = level
-
-			case appconfig.LoggingFormat:
-				switch args[1] {
-				case "debug":
-					util.Logger.Formatter = util.NewRuntimeFormatter()
-				case "json":
-					util.Logger.Formatter = util.NewJSONFormatter()
-				default:
-					util.Logger.Formatter = util.NewTextFormatter()
+				if !util.Contains(viper.AllKeys(), args[0]) {
+					return argsError(fmt.Errorf("invalid config key %s", args[0]))
 				}
 			}
-			if err := viper.WriteConfig(); err != nil {
-				return errorsutil.New("Failed to write updated configuration", err)
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if resetAll && !options.YesOption {
+				util.Confirm(map[string]string{
+					"Config File": appconfig.ConfigFile(),
+					"Action":      "Reset all config items to their default values",
+				})
 			}
-			util.Logger.Infof("Updated %s from %v to %s", args[0], oldVal, args[1])
+
+			backupFile, err := appconfig.BackupConfig()
+			if err != nil {
+				return err
+			}
+			util.Logger.Infof("Wrote backup of the current configuration to %s", backupFile)
+
+			if resetAll {
+				if err := appconfig.ResetConfig(); err != nil {
+					return err
+				}
+				util.Logger.Info("Reset all config items to their default values")
+				return nil
+			}
+
+			oldVal := viper.Get(args[0])
+			if err := appconfig.ResetKey(args[0]); err != nil {
+				return err
+			}
+			util.Logger.Infof("Reset %s from %v to %v", args[0], oldVal, viper.Get(args[0]))
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&resetAll, "all", false, "Reset every config item to its default value")
+	return cmd
+}
+
+func newCmdConfigExport() *cobra.Command {
+	var asJSON bool
+	cmd := &cobra.Command{
+		Use:   "export [FILE]",
+		Short: "Export the shareable configuration to a YAML, JSON, or TOML file",
+		Long: dedent.Dedent(`
+			The "export" command writes the current configuration to the provided file so
+			that it can be shared with your team and loaded with "eiam config import".
+			Machine specific values such as binary paths and certificate files, as well as
+			credentials like Github access tokens, are left out.
+
+			The format is determined by the file extension (.yaml, .yml, .json, or .toml). If no
+			file is provided, the configuration is written to stdout as YAML, or as JSON
+			when the --json flag is set.`),
+		Example: dedent.Dedent(`
+			eiam config export team-config.yaml
+			eiam config export --json > team-config.json`),
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			format := "yaml"
+			if asJSON {
+				format = "json"
+			}
+			if len(args) == 1 {
+				format = strings.TrimPrefix(filepath.Ext(args[0]), ".")
+			}
+			data, err := appconfig.MarshalSettings(appconfig.ExportSettings(), format)
+			if err != nil {
+				return argsError(err)
+			}
+
+			if len(args) == 0 {
+				fmt.Println(strings.TrimSpace(string(data)))
+				return nil
+			}
+			if err := ioutil.WriteFile(args[0], data, 0o644); err != nil {
+				return errorsutil.New(fmt.Sprintf("Failed to write %s", args[0]), err)
+			}
+			util.Logger.Infof("Exported configuration to %s", args[0])
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Write the configuration to stdout as JSON instead of YAML")
+	return cmd
+}
+
+func newCmdConfigImport() *cobra.Command {
+	var merge, overwrite bool
+	cmd := &cobra.Command{
+		Use:   "import FILE",
+		Short: "Import configuration from a YAML, JSON, or TOML file",
+		Long: dedent.Dedent(`
+			The "import" command loads configuration created by "eiam config export".
+
+			With --merge (the default), the imported values are added to the current
+			configuration and everything else is left alone. With --overwrite, every
+			shareable value that isn't in the file is reset to its default value.
+
+			Machine specific values and credentials in the file are ignored. Every value
+			is validated before any changes are made, and a timestamped backup of the
+			current configuration file is written to the configuration directory.`),
+		Example: dedent.Dedent(`
+			eiam config import team-config.yaml
+			eiam config import team-config.json --overwrite`),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return argsError(errors.New("requires the path to the file to import"))
+			}
+			if merge && overwrite {
+				return argsError(errors.New("the --merge and --overwrite flags are mutually exclusive"))
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if overwrite && !options.YesOption {
+				util.Confirm(map[string]string{
+					"Config File": appconfig.ConfigFile(),
+					"Import File": args[0],
+					"Action":      "Replace the shareable config items with the imported values",
+				})
+			}
+
+			backupFile, err := appconfig.BackupConfig()
+			if err != nil {
+				return err
+			}
+			util.Logger.Infof("Wrote backup of the current configuration to %s", backupFile)
+
+			skipped, err := appconfig.ImportSettings(args[0], overwrite)
+			if err != nil {
+				return err
+			}
+			for _, key := range skipped {
+				util.Logger.Warnf("Skipped %s, machine specific values and credentials are not imported", key)
+			}
+			util.Logger.Infof("Imported configuration from %s", args[0])
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&merge, "merge", false, "Merge the imported values into the current configuration (default)")
+	cmd.Flags().BoolVar(&overwrite, "overwrite", false, "Reset shareable values that aren't in the imported file to their defaults")
+	return cmd
+}
+
+func newCmdConfigConvert() *cobra.Command {
+	var format string
+	cmd := &cobra.Command{
+		Use:   "convert",
+		Short: "Convert the config file to YAML, JSON, or TOML",
+		Long: dedent.Dedent(`
+			The "convert" command rewrites the config file in the provided format and removes
+			the original file. The config file's format is determined by its extension, so a
+			config.json or config.toml file in the configuration directory can also be
+			created by hand or by other tooling.
+
+			A timestamped backup of the current configuration file is written to the
+			configuration directory before it is converted.`),
+		Example: dedent.Dedent(`
+			eiam config convert --format json`),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				return argsError(errors.New("the convert command does not accept arguments"))
+			}
+			if !util.Contains(appconfig.ConfigFormats, format) {
+				return argsError(fmt.Errorf("--format must be one of %v", appconfig.ConfigFormats))
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			backupFile, err := appconfig.BackupConfig()
+			if err != nil {
+				return err
+			}
+			util.Logger.Infof("Wrote backup of the current configuration to %s", backupFile)
+
+			newFile, err := appconfig.ConvertConfig(format)
+			if err != nil {
+				return err
+			}
+			util.Logger.Infof("Converted the configuration to %s", newFile)
 			return nil
 		},
 	}
+	// This intentionally shadows the global --format flag.
+	cmd.Flags().StringVar(&format, "format", "", fmt.Sprintf("The format to convert the config file to. One of %v", appconfig.ConfigFormats))
 	return cmd
 }
 
@@ -227,35 +420,58 @@ func checkSetArgs(cmd *cobra.Command, args []string) error {
 		return argsError(errors.New("requires both a config key and a new value"))
 	}
 
-	switch args[0] {
-	case appconfig.LoggingLevel:
-		if !util.Contains(loggingLevels, args[1]) {
-			return argsError(fmt.Errorf("logging level must be one of %v", loggingLevels))
-		}
-		return nil
-	case appconfig.LoggingFormat:
-		if !util.Contains(loggingFormats, args[1]) {
-			return argsError(fmt.Errorf("logging format must be one of %v", loggingFormats))
-		}
-		return nil
+	if err := checkManagedKey(args[0]); err != nil {
+		return err
+	}
+	if _, err := appconfig.ParseValue(args[0], args[1]); err != nil {
+		return argsError(err)
+	}
+	return nil
+}
+
+// checkManagedKey returns an error for config keys that are managed by other
+// commands and shouldn't be edited directly.
+func checkManagedKey(key string) error {
+	f, _ := appconfig.LookupField(key)
+	switch f.Key {
 	case appconfig.GithubTokens:
 		return errors.New("please use the 'plugins auth' commands to edit configured Github access tokens")
 	case appconfig.DefaultServiceAccounts:
 		return errors.New("please use the 'default-service-accounts' commands to edit configured default service accounts")
 	}
+	return nil
+}
 
-	if util.Contains(boolConfigFields, args[0]) {
-		if _, err := strconv.ParseBool(args[1]); err != nil {
-			return argsError(fmt.Errorf("the %s value must be either true or false", args[0]))
+// formatConfigInfo renders the description of each config field as a table.
+func formatConfigInfo(fields []appconfig.Field) string {
+	keyWidth := configInfoMinKeyWidth
+	for _, f := range fields {
+		if len(f.Key) > keyWidth {
+			keyWidth = len(f.Key)
 		}
-		return nil
 	}
+	keyBar, descBar := strings.Repeat("━", keyWidth+2), strings.Repeat("━", configInfoDescWidth+2)
+	keySep, descSep := strings.Repeat("─", keyWidth+2), strings.Repeat("─", configInfoDescWidth+2)
 
-	if !util.Contains(viper.AllKeys(), args[0]) {
-		return argsError(fmt.Errorf("invalid config key %s", args[0]))
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "\n┏%s┳%s┓\n", keyBar, descBar)
+	fmt.Fprintf(&buf, "┃ %-*s ┃ %-*s ┃\n", keyWidth, "Key", configInfoDescWidth, "Description")
+	fmt.Fprintf(&buf, "┡%s╇%s┩\n", keyBar, descBar)
+	for i, f := range fields {
+		if i > 0 {
+			fmt.Fprintf(&buf, "├%s┼%s┤\n", keySep, descSep)
+		}
+		desc := strings.Split(wordwrap.WrapString(f.Description, configInfoDescWidth), "\n")
+		for j, line := range desc {
+			key := ""
+			if j == 0 {
+				key = f.Key
+			}
+			fmt.Fprintf(&buf, "│ %-*s │ %-*s │\n", keyWidth, key, configInfoDescWidth, line)
+		}
 	}
-
-	return nil
+	fmt.Fprintf(&buf, "└%s┴%s┘", keySep, descSep)
+	return buf.String()
 }
 
 func argsError(err error) error {
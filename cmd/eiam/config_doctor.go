@@ -0,0 +1,269 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2/google"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+	"github.com/rigup/ephemeral-iam/internal/proxy"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+// The results of a "config doctor" check.
+const (
+	doctorPass = "PASS"
+	doctorWarn = "WARN"
+	doctorFail = "FAIL"
+	doctorSkip = "SKIP"
+)
+
+type doctorResult struct {
+	Status  string
+	Details string
+	// Hint tells the user how to fix a failed check.
+	Hint string
+}
+
+type doctorCheck struct {
+	Name string
+	Run  func() doctorResult
+}
+
+func newCmdConfigDoctor() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Check the environment for common problems",
+		Long: dedent.Dedent(`
+			The "doctor" command checks everything that ephemeral-iam depends on and
+			prints a report with a hint on how to fix each problem that it finds:
+
+			  - The config file can be parsed and contains valid values
+			  - The auth proxy certificate and key match and haven't expired
+			  - The gcloud and kubectl binaries can be run
+			  - Application default credentials exist and can be used
+			  - The auth proxy port is available
+			  - You can impersonate the default service account
+
+			The command exits with a non-zero status if any check fails.`),
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDoctor()
+		},
+	}
+	return cmd
+}
+
+func runDoctor() error {
+	adcResult := checkADC()
+	checks := []doctorCheck{
+		{Name: "Config file", Run: checkDoctorConfig},
+		{Name: "Auth proxy certificate", Run: checkProxyCertPair},
+		{Name: "gcloud", Run: func() doctorResult {
+			return checkBinary(appconfig.GcloudPath, "--version")
+		}},
+		{Name: "kubectl", Run: func() doctorResult {
+			return checkBinary(appconfig.KubectlPath, "version", "--client")
+		}},
+		{Name: "Application default credentials", Run: func() doctorResult { return adcResult }},
+		{Name: "Auth proxy port", Run: checkProxyPort},
+		{Name: "IAM permissions", Run: func() doctorResult {
+			if adcResult.Status == doctorFail {
+				return doctorResult{Status: doctorSkip, Details: "application default credentials are required"}
+			}
+			return checkImpersonation()
+		}},
+	}
+
+	var failed int
+	var hints []string
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 4, ' ', 0)
+	fmt.Fprintln(w, "\nCHECK\tSTATUS\tDETAILS")
+	for _, check := range checks {
+		res := check.Run()
+		fmt.Fprintf(w, "%s\t%s\t%s\n", check.Name, res.Status, res.Details)
+		if res.Status == doctorFail {
+			failed++
+		}
+		if res.Hint != "" && (res.Status == doctorFail || res.Status == doctorWarn) {
+			hints = append(hints, fmt.Sprintf("  - %s: %s", check.Name, res.Hint))
+		}
+	}
+	w.Flush()
+
+	if len(hints) > 0 {
+		fmt.Printf("\nTo fix the problems above:\n%s\n", strings.Join(hints, "\n"))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+func checkDoctorConfig() doctorResult {
+	hint := `Run "eiam config edit" to fix the config file or "eiam config reset" to restore the defaults`
+	if err := appconfig.CheckConfigFile(appconfig.ConfigFile()); err != nil {
+		return doctorResult{Status: doctorFail, Details: configProblems(err), Hint: hint}
+	}
+	if err := appconfig.ValidateConfig(); err != nil {
+		return doctorResult{Status: doctorFail, Details: configProblems(err), Hint: hint}
+	}
+	return doctorResult{Status: doctorPass, Details: appconfig.ConfigFile()}
+}
+
+func checkProxyCertPair() doctorResult {
+	hint := `Run "eiam proxy rotate-certs" to regenerate the auth proxy certificates`
+	pair, err := tls.LoadX509KeyPair(viper.GetString(appconfig.AuthProxyCertFile), viper.GetString(appconfig.AuthProxyKeyFile))
+	if err != nil {
+		return doctorResult{Status: doctorFail, Details: err.Error(), Hint: hint}
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return doctorResult{Status: doctorFail, Details: err.Error(), Hint: hint}
+	}
+
+	expiry := cert.NotAfter.Format("2006-01-02")
+	switch {
+	case !cert.IsCA:
+		return doctorResult{Status: doctorFail, Details: "the certificate is not a CA certificate", Hint: hint}
+	case time.Now().After(cert.NotAfter):
+		return doctorResult{Status: doctorFail, Details: fmt.Sprintf("expired on %s", expiry), Hint: hint}
+	case time.Until(cert.NotAfter) < viper.GetDuration(appconfig.AuthProxyRotateBefore):
+		return doctorResult{
+			Status:  doctorWarn,
+			Details: fmt.Sprintf("expires on %s and will be rotated when the next privileged session starts", expiry),
+			Hint:    hint,
+		}
+	}
+	return doctorResult{Status: doctorPass, Details: fmt.Sprintf("valid until %s", expiry)}
+}
+
+func checkBinary(key string, args ...string) doctorResult {
+	hint := fmt.Sprintf(`Install it or run "eiam config set %s PATH"`, key)
+	binPath := viper.GetString(key)
+	if binPath == "" {
+		return doctorResult{Status: doctorFail, Details: "no path is set", Hint: hint}
+	}
+	out, err := exec.Command(binPath, args...).CombinedOutput() //nolint:gosec // The path is set by the user
+	if err != nil {
+		return doctorResult{Status: doctorFail, Details: fmt.Sprintf("%s: %v", binPath, err), Hint: hint}
+	}
+	if version := firstLine(string(out)); version != "" {
+		return doctorResult{Status: doctorPass, Details: version}
+	}
+	return doctorResult{Status: doctorPass, Details: binPath}
+}
+
+func checkADC() doctorResult {
+	if credFile := viper.GetString(appconfig.AuthCredentialFile); credFile != "" {
+		hint := fmt.Sprintf("Check the credential file set in %s", appconfig.AuthCredentialFile)
+		principal, err := gcpclient.UseCredentialFile(credFile)
+		if err != nil {
+			return doctorResult{Status: doctorFail, Details: firstLine(err.Error()), Hint: hint}
+		}
+		return doctorResult{Status: doctorPass, Details: fmt.Sprintf("authenticated as %s with %s", principal, credFile)}
+	}
+	hint := `Run "gcloud auth application-default login"`
+	creds, err := google.FindDefaultCredentials(context.Background())
+	if err != nil {
+		return doctorResult{Status: doctorFail, Details: "no credentials were found", Hint: hint}
+	}
+	if _, err := creds.TokenSource.Token(); err != nil {
+		return doctorResult{Status: doctorFail, Details: firstLine(err.Error()), Hint: hint}
+	}
+	return doctorResult{Status: doctorPass, Details: "found valid credentials"}
+}
+
+func checkProxyPort() doctorResult {
+	if socketPath := proxy.SocketPath(); socketPath != "" {
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			conn.Close()
+			return doctorResult{
+				Status:  doctorFail,
+				Details: fmt.Sprintf("%s is in use", socketPath),
+				Hint:    fmt.Sprintf(`End the other privileged session or run "eiam config set %s PATH"`, appconfig.AuthProxySocketPath),
+			}
+		}
+		return doctorResult{Status: doctorPass, Details: fmt.Sprintf("%s is available", socketPath)}
+	}
+	address := proxy.Address()
+	port := viper.GetInt(appconfig.AuthProxyPort)
+	if free, err := proxy.FindFreePort(appconfig.ProxyHost(), port); err != nil || free != port {
+		return doctorResult{
+			Status:  doctorFail,
+			Details: fmt.Sprintf("%s is in use", address),
+			Hint:    fmt.Sprintf(`Stop the process using the port or run "eiam config set %s PORT"`, appconfig.AuthProxyPort),
+		}
+	}
+	return doctorResult{Status: doctorPass, Details: fmt.Sprintf("%s is available", address)}
+}
+
+func checkImpersonation() doctorResult {
+	project, err := options.DefaultProject()
+	if err != nil || project == "" {
+		return doctorResult{Status: doctorSkip, Details: "no default project is set"}
+	}
+	serviceAccount := options.DefaultServiceAccount(project)
+	if serviceAccount == "" {
+		return doctorResult{Status: doctorSkip, Details: fmt.Sprintf("no default service account is set for %s", project)}
+	}
+
+	canImpersonate, err := gcpclient.CanImpersonate(project, serviceAccount)
+	if err != nil {
+		return doctorResult{Status: doctorFail, Details: firstLine(err.Error()), Hint: "Check that the service account exists"}
+	}
+	if !canImpersonate {
+		return doctorResult{
+			Status:  doctorFail,
+			Details: fmt.Sprintf("missing iam.serviceAccounts.getAccessToken on %s", serviceAccount),
+			Hint:    "Ask a project owner to grant you roles/iam.serviceAccountTokenCreator on the service account",
+		}
+	}
+	return doctorResult{Status: doctorPass, Details: fmt.Sprintf("can impersonate %s", serviceAccount)}
+}
+
+// configProblems joins the list of problems in a config validation error into
+// a single line.
+func configProblems(err error) string {
+	var problems []string
+	for _, line := range strings.Split(err.Error(), "\n") {
+		if strings.HasPrefix(line, "  - ") {
+			problems = append(problems, strings.TrimPrefix(line, "  - "))
+		}
+	}
+	if len(problems) == 0 {
+		return firstLine(err.Error())
+	}
+	return strings.Join(problems, "; ")
+}
+
+func firstLine(s string) string {
+	return strings.SplitN(strings.TrimSpace(s), "\n", 2)[0]
+}
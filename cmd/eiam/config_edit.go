@@ -0,0 +1,138 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+func newCmdConfigEdit() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "edit",
+		Short: "Edit the config file in your text editor",
+		Long: dedent.Dedent(`
+			The "edit" command opens a copy of the config file in the editor set by the
+			VISUAL or EDITOR environment variables.
+
+			When the editor exits, the edited file is validated before it replaces the
+			config file. If the file can't be parsed or contains invalid values, you are
+			offered to re-open the editor to fix the problems; otherwise the changes are
+			discarded. A timestamped backup of the current configuration file is written
+			to the configuration directory before it is replaced.`),
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return editConfig()
+		},
+	}
+	return cmd
+}
+
+func editConfig() error {
+	configFile := appconfig.ConfigFile()
+	original, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return errorsutil.New("Failed to read configuration file", err)
+	}
+
+	// The copy needs the same extension so it's parsed in the same format.
+	tmpFile, err := ioutil.TempFile("", fmt.Sprintf("eiam-config-*%s", filepath.Ext(configFile)))
+	if err != nil {
+		return errorsutil.New("Failed to create temporary file", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(original); err != nil {
+		return errorsutil.New("Failed to write temporary file", err)
+	}
+	tmpFile.Close()
+
+	for {
+		if err := openEditor(tmpFile.Name()); err != nil {
+			return err
+		}
+		edited, err := ioutil.ReadFile(tmpFile.Name())
+		if err != nil {
+			return errorsutil.New("Failed to read edited configuration", err)
+		}
+		if bytes.Equal(edited, original) {
+			util.Logger.Info("No changes were made to the configuration")
+			return nil
+		}
+
+		if err := appconfig.CheckConfigFile(tmpFile.Name()); err != nil {
+			util.Logger.Error(err)
+			if !options.YesOption && util.PromptConfirm("Re-open the editor to fix the problems") {
+				continue
+			}
+			util.Logger.Warn("Discarding changes to the configuration")
+			return nil
+		}
+
+		backupFile, err := appconfig.BackupConfig()
+		if err != nil {
+			return err
+		}
+		util.Logger.Infof("Wrote backup of the current configuration to %s", backupFile)
+
+		info, err := os.Stat(configFile)
+		if err != nil {
+			return errorsutil.New("Failed to read configuration file", err)
+		}
+		if err := ioutil.WriteFile(configFile, edited, info.Mode().Perm()); err != nil {
+			return errorsutil.New("Failed to write updated configuration", err)
+		}
+		util.Logger.Infof("Updated %s", configFile)
+		return nil
+	}
+}
+
+// openEditor opens a file in the user's editor and waits for it to exit.
+func openEditor(file string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+		if runtime.GOOS == "windows" {
+			editor = "notepad"
+		}
+	}
+
+	// The editor can include arguments, e.g. "code --wait".
+	editorArgs := strings.Fields(editor)
+	c := exec.Command(editorArgs[0], append(editorArgs[1:], file)...) //nolint:gosec // The editor is chosen by the user
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		return errorsutil.New(fmt.Sprintf("Failed to run editor %s", editor), err)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/proxy"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+func newCmdConfigSetup() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "setup",
+		Short: "Interactively create or update the configuration",
+		Long: dedent.Dedent(`
+			The "setup" command walks you through the settings that ephemeral-iam needs
+			to run:
+
+			  - The paths to the gcloud, kubectl, and cloud_sql_proxy binaries
+			  - The port that the auth proxy listens on
+			  - The TLS certificate and key used by the auth proxy
+
+			Detected values are offered as defaults and can be accepted by pressing enter.
+			The wizard runs automatically the first time ephemeral-iam is used from a
+			terminal. Use the --yes flag to accept every detected value without prompting.`),
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return RunConfigSetup()
+		},
+	}
+	return cmd
+}
+
+// RunConfigSetup prompts the user for the values that ephemeral-iam needs to
+// run and writes them to the config file.
+func RunConfigSetup() error {
+	util.Logger.Infof("Setting up the configuration in %s", appconfig.ConfigFile())
+
+	for _, key := range []string{appconfig.GcloudPath, appconfig.KubectlPath, appconfig.CloudSQLProxyPath, appconfig.GsutilPath, appconfig.BqPath, appconfig.TerraformPath} {
+		binPath, err := setupBinaryPath(key)
+		if err != nil {
+			return err
+		}
+		viper.Set(key, binPath)
+	}
+
+	port, err := setupProxyPort()
+	if err != nil {
+		return err
+	}
+	viper.Set(appconfig.AuthProxyPort, port)
+
+	if err := setupProxyCerts(); err != nil {
+		return err
+	}
+
+	if err := appconfig.WriteConfig(); err != nil {
+		return errorsutil.New("Failed to write configuration file", err)
+	}
+	util.Logger.Infof("Wrote configuration to %s", appconfig.ConfigFile())
+	return nil
+}
+
+func setupBinaryPath(key string) (string, error) {
+	binPath := viper.GetString(key)
+	if binPath == "" {
+		binPath, _ = appconfig.DetectBinaryPath(key)
+	}
+	// Some binaries are only needed by the commands that wrap them.
+	optional := appconfig.OptionalBinary(key)
+	if options.YesOption {
+		if binPath == "" && !optional {
+			return "", fmt.Errorf("failed to find a path for %s", key)
+		}
+		return binPath, nil
+	}
+
+	binPath, err := util.Prompt(key, binPath, func(val string) error {
+		if val == "" {
+			if optional {
+				return nil
+			}
+			return errors.New("a path is required")
+		}
+		info, err := os.Stat(val)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Mode()&0o111 == 0 {
+			return fmt.Errorf("%s is not an executable file", val)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", errorsutil.New(fmt.Sprintf("Failed to set %s", key), err)
+	}
+	return binPath, nil
+}
+
+func setupProxyPort() (string, error) {
+	current := viper.GetInt(appconfig.AuthProxyPort)
+	port, err := proxy.FindFreePort(appconfig.ProxyHost(), current)
+	if err != nil {
+		return "", err
+	}
+	if port != current {
+		util.Logger.Warnf("Port %d is already in use, using %d instead", current, port)
+	}
+	if options.YesOption {
+		return strconv.Itoa(port), nil
+	}
+
+	val, err := util.Prompt(appconfig.AuthProxyPort, strconv.Itoa(port), func(val string) error {
+		_, err := appconfig.ParseValue(appconfig.AuthProxyPort, val)
+		return err
+	})
+	if err != nil {
+		return "", errorsutil.New(fmt.Sprintf("Failed to set %s", appconfig.AuthProxyPort), err)
+	}
+	return val, nil
+}
+
+func setupProxyCerts() error {
+	_, certErr := os.Stat(viper.GetString(appconfig.AuthProxyCertFile))
+	_, keyErr := os.Stat(viper.GetString(appconfig.AuthProxyKeyFile))
+	if certErr == nil && keyErr == nil {
+		if options.YesOption || !util.PromptConfirm("Regenerate the existing auth proxy certificates") {
+			return nil
+		}
+	}
+
+	util.Logger.Info("Generating auth proxy certificates")
+	return proxy.GenerateCerts()
+}
@@ -75,10 +75,17 @@ func TestConfigNoSubCommand(t *testing.T) {
           config [command]
 
         Available Commands:
+          convert     Convert the config file to YAML, JSON, or TOML
+          doctor      Check the environment for common problems
+          edit        Edit the config file in your text editor
+          export      Export the shareable configuration to a YAML, JSON, or TOML file
           help        Help about any command
+          import      Import configuration from a YAML, JSON, or TOML file
           info        Print information about config fields
           print       Print the current configuration
+          reset       Restore a config item, or the entire config, to the default value
           set         Set the value of a provided config item
+          setup       Interactively create or update the configuration
           view        View the value of a provided config item
 
         Flags:
@@ -101,7 +108,8 @@ func TestConfigViewCommand(t *testing.T) {
 		if err != nil {
 			t.Errorf("unexpected error: %v", err)
 		}
-		expectedOutput := fmt.Sprintf("%s: %v", configKey, configValue)
+		// Sensitive values are masked.
+		expectedOutput := fmt.Sprintf("%s: %v", configKey, appconfig.MaskValue(configKey, configValue))
 		if !strings.Contains(output, expectedOutput) {
 			t.Errorf("unexpected output:\nEXPECTED TO FIND: level=info msg=\"%s\"\nACTUAL: %s", expectedOutput, output)
 		}
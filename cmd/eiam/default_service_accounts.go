@@ -52,7 +52,7 @@ func newCmdSetDefaultServiceAccount() *cobra.Command {
 			defaultSAs := viper.GetStringMapString(appconfig.DefaultServiceAccounts)
 			defaultSAs[project] = selected
 			viper.Set(appconfig.DefaultServiceAccounts, defaultSAs)
-			if err := viper.WriteConfig(); err != nil {
+			if err := appconfig.WriteConfig(); err != nil {
 				return errorsutil.New("Failed to write updated configuration", err)
 			}
 
@@ -0,0 +1,124 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/proxy"
+)
+
+// errCredentialsNotFound is the message that Docker expects from a credential
+// helper that has no credentials for a registry.
+const errCredentialsNotFound = "credentials not found in native keychain"
+
+// dockerCredentials is the response to the "get" action of the Docker
+// credential helper protocol.
+type dockerCredentials struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+func newCmdDockerCredential() *cobra.Command {
+	var sessionID string
+	cmd := &cobra.Command{
+		Use:   "docker-credential [get|store|erase|list]",
+		Short: "Authenticate Docker to Google registries as the service account of a privileged session",
+		Long: dedent.Dedent(`
+			The "docker-credential" command implements the Docker credential helper protocol
+			with the access token of a privileged session, so that "docker push" and
+			"docker pull" to Container Registry (gcr.io) and Artifact Registry (*-docker.pkg.dev)
+			use the session's service account.
+
+			Docker runs the helper itself: in the privileged sub-shell, DOCKER_CONFIG points at a
+			copy of your Docker config that uses the helper for the Google registries, and a
+			docker-credential-eiam script that runs this command is on PATH. They are removed
+			when the session ends, and your own Docker config isn't changed.
+
+			Credentials can't be stored with "docker login", since they come from the session.`),
+		Example: dedent.Dedent(`
+			docker push us-docker.pkg.dev/my-project/images/app:v1
+			echo gcr.io | eiam docker-credential get`),
+		Args:      cobra.ExactValidArgs(1),
+		ValidArgs: []string{"get", "store", "erase", "list"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			switch args[0] {
+			case "get":
+				return dockerCredentialGet(cmd, sessionID)
+			case "store":
+				return dockerCredentialError(cmd, "eiam doesn't store credentials, the privileged session's access token is used")
+			case "erase":
+				// There is nothing to remove, and "docker logout" shouldn't fail.
+				return nil
+			default:
+				registries := map[string]string{}
+				for _, registry := range proxy.DockerRegistries {
+					registries["https://"+registry] = proxy.DockerUsername
+				}
+				return json.NewEncoder(cmd.OutOrStdout()).Encode(registries)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&sessionID, "session", "", sessionFlagUsage)
+	return cmd
+}
+
+func dockerCredentialGet(cmd *cobra.Command, sessionID string) error {
+	input, err := ioutil.ReadAll(cmd.InOrStdin())
+	if err != nil {
+		return errorsutil.New("Failed to read the registry", err)
+	}
+	serverURL := strings.TrimSpace(string(input))
+	if !util.Contains(proxy.DockerRegistries, dockerRegistryHost(serverURL)) {
+		return dockerCredentialError(cmd, errCredentialsNotFound)
+	}
+
+	session, err := findSession(sessionID)
+	if err != nil {
+		return dockerCredentialError(cmd, err.Error())
+	}
+	token, err := session.DockerToken()
+	if err != nil {
+		return dockerCredentialError(cmd, err.Error())
+	}
+	return json.NewEncoder(cmd.OutOrStdout()).Encode(dockerCredentials{
+		ServerURL: serverURL,
+		Username:  proxy.DockerUsername,
+		Secret:    token,
+	})
+}
+
+// dockerCredentialError reports an error the way the credential helper
+// protocol expects, on stdout and with a non-zero exit status.
+func dockerCredentialError(cmd *cobra.Command, msg string) error {
+	fmt.Fprintln(cmd.OutOrStdout(), msg)
+	return errorsutil.ExitError{Code: 1}
+}
+
+// dockerRegistryHost returns the host of a registry that Docker refers to by
+// its URL, e.g. "https://gcr.io/v2/".
+func dockerRegistryHost(serverURL string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(serverURL, "https://"), "http://")
+	return strings.SplitN(host, "/", 2)[0]
+}
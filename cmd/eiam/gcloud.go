@@ -16,6 +16,7 @@ package eiam
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"strings"
@@ -24,6 +25,7 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
 	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
 	"github.com/rigup/ephemeral-iam/internal/gcpclient"
@@ -41,7 +43,11 @@ func newCmdGcloud() *cobra.Command {
 		Short: "Run a gcloud command with the permissions of the specified service account",
 		Long: dedent.Dedent(`
 			The "gcloud" command runs the provided gcloud command with the permissions of the specified
-			service account. Output from the gcloud command is able to be piped into other commands.`),
+			service account. Output from the gcloud command is able to be piped into other commands.
+
+			With --scopes, eiam generates an access token that is limited to the given OAuth scopes and
+			gcloud uses it instead of impersonating the service account itself. The token is valid for
+			tokenconfig.lifetime, so the command has to finish before then.`),
 		Example: dedent.Dedent(`
 			eiam gcloud compute instances list --format=json \
 			--service-account-email example@my-project.iam.gserviceaccount.com \
@@ -49,15 +55,28 @@ func newCmdGcloud() *cobra.Command {
 			
 			eiam gcloud compute instances list --format=json \
 			-s example@my-project.iam.gserviceaccount.com -r "example" \
-			| jq`),
+			| jq
+
+			eiam gcloud storage ls gs://my-bucket --scopes devstorage.read_only \
+			-s example@my-project.iam.gserviceaccount.com -R "Checking uploads (JIRA-1234)"`),
 		Args:               cobra.ArbitraryArgs,
 		FParseErrWhitelist: cobra.FParseErrWhitelist{UnknownFlags: true},
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			if err := options.CheckRequired(cmd.Flags()); err != nil {
 				return err
 			}
+			if err := options.CheckServiceAccount(gcloudCmdConfig.ServiceAccountEmail); err != nil {
+				return err
+			}
+			if err := options.CheckDelegates(gcloudCmdConfig.Delegates); err != nil {
+				return err
+			}
+			gcloudCmdConfig.Scopes = options.ParseScopes(gcloudCmdConfig.Scopes)
 
 			gcloudCmdArgs = util.ExtractUnknownArgs(cmd.Flags(), os.Args)
+			if err := options.CheckReason(gcloudCmdConfig.Reason); err != nil {
+				return err
+			}
 			if err := util.FormatReason(&gcloudCmdConfig.Reason); err != nil {
 				return err
 			}
@@ -68,6 +87,8 @@ func newCmdGcloud() *cobra.Command {
 				util.Confirm(map[string]string{
 					"Project":         gcloudCmdConfig.Project,
 					"Service Account": gcloudCmdConfig.ServiceAccountEmail,
+					"Delegates":       strings.Join(gcloudCmdConfig.Delegates, ", "),
+					"Scopes":          strings.Join(gcpclient.ScopesOrDefault(gcloudCmdConfig.Scopes), ", "),
 					"Reason":          gcloudCmdConfig.Reason,
 					"Command":         fmt.Sprintf("gcloud %s", strings.Join(gcloudCmdArgs, " ")),
 				})
@@ -82,16 +103,21 @@ func newCmdGcloud() *cobra.Command {
 	options.AddServiceAccountEmailFlag(cmd.Flags(), &gcloudCmdConfig.ServiceAccountEmail, true)
 	options.AddReasonFlag(cmd.Flags(), &gcloudCmdConfig.Reason, true)
 	options.AddProjectFlag(cmd.Flags(), &gcloudCmdConfig.Project, false)
+	options.AddDelegatesFlag(cmd.Flags(), &gcloudCmdConfig.Delegates)
+	options.AddScopesFlag(cmd.Flags(), &gcloudCmdConfig.Scopes)
 
 	return cmd
 }
 
 func runGcloudCommand() error {
-	hasAccess, err := gcpclient.CanImpersonate(gcloudCmdConfig.Project, gcloudCmdConfig.ServiceAccountEmail)
-	if err != nil {
+	if err := checkCanImpersonate(gcloudCmdConfig.Project, gcloudCmdConfig.ServiceAccountEmail, gcloudCmdConfig.Delegates); err != nil {
+		return err
+	}
+	if err := confirmMFA(); err != nil {
+		return err
+	}
+	if err := requestApproval(&gcloudCmdConfig, fmt.Sprintf("gcloud %s", strings.Join(gcloudCmdArgs, " ")), 0); err != nil {
 		return err
-	} else if !hasAccess {
-		util.Logger.Fatalln("You do not have access to impersonate this service account")
 	}
 
 	// gcloud reads the CLOUDSDK_CORE_REQUEST_REASON environment variable
@@ -112,7 +138,19 @@ func runGcloudCommand() error {
     }
 
 	cmdArgs := append([]string(nil), gcloudOpts...)
-	cmdArgs = append(cmdArgs, "--impersonate-service-account", gcloudCmdConfig.ServiceAccountEmail, "--verbosity=error")
+	if len(gcloudCmdConfig.Scopes) > 0 {
+		// gcloud can't limit the scopes of the tokens that it generates when
+		// it impersonates a service account, so it is given a scoped token.
+		tokenFile, err := writeScopedToken()
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tokenFile)
+		cmdArgs = append(cmdArgs, "--access-token-file", tokenFile, "--verbosity=error")
+	} else {
+		impersonate := gcpclient.ImpersonationChain(gcloudCmdConfig.ServiceAccountEmail, gcloudCmdConfig.Delegates)
+		cmdArgs = append(cmdArgs, "--impersonate-service-account", impersonate, "--verbosity=error")
+	}
 	cmdArgs = append(cmdArgs, positionalArgs...)
 
 	gcloud := viper.GetString("binarypaths.gcloud")
@@ -121,6 +159,11 @@ func runGcloudCommand() error {
 	c.Stderr = os.Stderr
 	c.Stdin = os.Stdin
 	c.Env = append(os.Environ(), reasonHeader)
+	// Run the command in the project of the permission checks without changing
+	// the active gcloud project.
+	if gcloudCmdConfig.Project != "" {
+		c.Env = append(c.Env, fmt.Sprintf("CLOUDSDK_CORE_PROJECT=%s", gcloudCmdConfig.Project))
+	}
 
 	if err := c.Run(); err != nil {
 		fullCmd := fmt.Sprintf("gcloud %s", strings.Join(gcloudCmdArgs, " "))
@@ -128,3 +171,39 @@ func runGcloudCommand() error {
 	}
 	return nil
 }
+
+// writeScopedToken generates an access token that is limited to the scopes set
+// with --scopes and writes it to a temporary file that only the current user
+// can read. The caller removes the file.
+func writeScopedToken() (string, error) {
+	lifetime := viper.GetDuration(appconfig.TokenLifetime)
+	if limit := appconfig.MaxSessionDuration(); limit > 0 && lifetime > limit {
+		lifetime = limit
+	}
+	accessToken, err := gcpclient.GenerateScopedAccessToken(
+		gcloudCmdConfig.ServiceAccountEmail,
+		gcloudCmdConfig.Reason,
+		lifetime,
+		gcloudCmdConfig.Scopes,
+		gcloudCmdConfig.Delegates,
+	)
+	if err != nil {
+		return "", err
+	}
+	return writeTokenFile(accessToken.GetAccessToken())
+}
+
+// writeTokenFile writes an access token to a temporary file for gcloud's
+// --access-token-file flag.
+func writeTokenFile(accessToken string) (string, error) {
+	f, err := ioutil.TempFile("", "eiam-token-")
+	if err != nil {
+		return "", errorsutil.New("Failed to create the access token file", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(accessToken); err != nil {
+		os.Remove(f.Name())
+		return "", errorsutil.New("Failed to write the access token file", err)
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+var (
+	idTokenCmdConfig options.CmdConfig
+
+	idTokenIncludeEmail bool
+	idTokenEnvVar       string
+	idTokenShell        string
+)
+
+func newCmdGenerateIDToken() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "generate-id-token",
+		Short: "Generate an OpenID Connect ID token for a service account",
+		Long: dedent.Dedent(`
+			The "generate-id-token" command generates an OpenID Connect ID token for the
+			specified service account without a service account key. ID tokens are used
+			to call IAP-protected resources, Cloud Run services, and Cloud Functions, which
+			don't accept access tokens. The token is valid for 1 hour.
+
+			The token is printed on its own by default. Use --env to print a command that
+			sets an environment variable to the token instead, which can be evaluated by
+			the shell. Since the confirmation prompt is printed too, use --yes when the
+			output is evaluated.`),
+		Example: dedent.Dedent(`
+			eiam generate-id-token \
+			  --audience https://my-service-abcdefghij-uc.a.run.app \
+			  --service-account-email invoker@my-project.iam.gserviceaccount.com \
+			  --reason "Debugging for (JIRA-1234)"
+
+			eval "$(eiam generate-id-token --audience https://my-service-abcdefghij-uc.a.run.app \
+			  -s invoker@my-project.iam.gserviceaccount.com -R "Debugging for (JIRA-1234)" \
+			  --env ID_TOKEN --yes)"
+			curl -H "Authorization: Bearer $ID_TOKEN" https://my-service-abcdefghij-uc.a.run.app`),
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if !util.Contains(proxyEnvShells, idTokenShell) {
+				return argsError(fmt.Errorf("--shell must be one of %v", proxyEnvShells))
+			}
+			if err := options.CheckRequired(cmd.Flags()); err != nil {
+				return err
+			}
+			if err := options.CheckServiceAccount(idTokenCmdConfig.ServiceAccountEmail); err != nil {
+				return err
+			}
+			if err := options.CheckDelegates(idTokenCmdConfig.Delegates); err != nil {
+				return err
+			}
+			if err := options.CheckReason(idTokenCmdConfig.Reason); err != nil {
+				return err
+			}
+			if err := util.FormatReason(&idTokenCmdConfig.Reason); err != nil {
+				return err
+			}
+
+			if !options.YesOption {
+				util.Confirm(map[string]string{
+					"Project":         idTokenCmdConfig.Project,
+					"Service Account": idTokenCmdConfig.ServiceAccountEmail,
+					"Delegates":       strings.Join(idTokenCmdConfig.Delegates, ", "),
+					"Reason":          idTokenCmdConfig.Reason,
+					"Audience":        idTokenCmdConfig.Audience,
+				})
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return generateIDToken()
+		},
+	}
+
+	options.AddServiceAccountEmailFlag(cmd.Flags(), &idTokenCmdConfig.ServiceAccountEmail, true)
+	options.AddReasonFlag(cmd.Flags(), &idTokenCmdConfig.Reason, true)
+	options.AddProjectFlag(cmd.Flags(), &idTokenCmdConfig.Project, false)
+	options.AddAudienceFlag(cmd.Flags(), &idTokenCmdConfig.Audience)
+	options.AddDelegatesFlag(cmd.Flags(), &idTokenCmdConfig.Delegates)
+	cmd.Flags().BoolVar(&idTokenIncludeEmail, "include-email", false, "Include the email and email_verified claims of the service account in the token")
+	cmd.Flags().StringVar(&idTokenEnvVar, "env", "", "Print a command that sets this environment variable to the token instead of the token itself")
+	cmd.Flags().StringVar(&idTokenShell, "shell", "sh", fmt.Sprintf("The shell to print the command for with --env, one of %v", proxyEnvShells))
+
+	return cmd
+}
+
+func generateIDToken() error {
+	if len(idTokenCmdConfig.Delegates) == 0 {
+		// Generating an ID token needs a permission of its own, rather than
+		// the one to generate access tokens.
+		if err := gcpclient.CheckServiceAccountExists(idTokenCmdConfig.Project, idTokenCmdConfig.ServiceAccountEmail); err != nil {
+			return err
+		}
+		if err := checkPrerequisites(gcpclient.Prerequisite{
+			Permission: "iam.serviceAccounts.getOpenIdToken",
+			Resource:   gcpclient.ServiceAccountResource(idTokenCmdConfig.Project, idTokenCmdConfig.ServiceAccountEmail),
+		}); err != nil {
+			return err
+		}
+	} else if err := checkCanImpersonate(idTokenCmdConfig.Project, idTokenCmdConfig.ServiceAccountEmail, idTokenCmdConfig.Delegates); err != nil {
+		return err
+	}
+	if err := confirmMFA(); err != nil {
+		return err
+	}
+	if err := requestApproval(&idTokenCmdConfig, "generate-id-token", time.Hour); err != nil {
+		return err
+	}
+
+	util.Logger.Infof("Fetching ID token for %s", idTokenCmdConfig.ServiceAccountEmail)
+	token, err := gcpclient.GenerateIDToken(
+		idTokenCmdConfig.ServiceAccountEmail,
+		idTokenCmdConfig.Reason,
+		idTokenCmdConfig.Audience,
+		idTokenIncludeEmail,
+		idTokenCmdConfig.Delegates,
+	)
+	if err != nil {
+		return err
+	}
+
+	if idTokenEnvVar != "" {
+		fmt.Println(formatEnvVar(idTokenShell, idTokenEnvVar, token))
+		return nil
+	}
+	fmt.Println(token)
+	return nil
+}
@@ -0,0 +1,308 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+const (
+	// saKeysDirName is the directory in the config directory that holds the
+	// key files and the record of the keys that haven't been deleted yet.
+	saKeysDirName = "sa_keys"
+
+	minKeyTTL = time.Minute
+	maxKeyTTL = 24 * time.Hour
+)
+
+var (
+	saKeyCmdConfig options.CmdConfig
+
+	saKeyTTL    time.Duration
+	saKeyOutput string
+)
+
+// pendingKey records a key that has to be deleted, so that keys left behind
+// when eiam is killed are deleted the next time the command runs.
+type pendingKey struct {
+	Name    string    `json:"name"`
+	File    string    `json:"file"`
+	Expires time.Time `json:"expires"`
+}
+
+func newCmdGenerateSAKey() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "generate-sa-key",
+		Short: "Create a service account key that is deleted after a short time",
+		Long: dedent.Dedent(`
+			The "generate-sa-key" command creates a key for the specified service account,
+			writes it to a file that only you can read, and deletes the key when --ttl has
+			elapsed or the command is interrupted. Only use it for legacy tools that can't
+			use anything but a key file: keys are long-lived credentials that work from
+			anywhere until they are deleted, so prefer the other commands where possible.
+
+			The command keeps running until the key is deleted. Keys that are left behind
+			because eiam was killed are deleted the next time the command runs. The key is
+			created with your own credentials, so you need permission to create keys for
+			the service account.`),
+		Example: dedent.Dedent(`
+			eiam generate-sa-key \
+			  --service-account-email legacy-tool@my-project.iam.gserviceaccount.com \
+			  --reason "Run the legacy exporter (JIRA-1234)" \
+			  --ttl 10m`),
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := options.CheckRequired(cmd.Flags()); err != nil {
+				return err
+			}
+			if err := options.CheckServiceAccount(saKeyCmdConfig.ServiceAccountEmail); err != nil {
+				return err
+			}
+			if err := checkKeyTTL(saKeyTTL); err != nil {
+				return err
+			}
+			if err := options.CheckReason(saKeyCmdConfig.Reason); err != nil {
+				return err
+			}
+			if err := util.FormatReason(&saKeyCmdConfig.Reason); err != nil {
+				return err
+			}
+
+			if !options.YesOption {
+				util.Logger.Warn("Service account keys can be used by anyone who has a copy until they are deleted")
+				util.Confirm(map[string]string{
+					"Project":         saKeyCmdConfig.Project,
+					"Service Account": saKeyCmdConfig.ServiceAccountEmail,
+					"Reason":          saKeyCmdConfig.Reason,
+					"Deleted After":   saKeyTTL.String(),
+				})
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return generateServiceAccountKey()
+		},
+	}
+
+	options.AddServiceAccountEmailFlag(cmd.Flags(), &saKeyCmdConfig.ServiceAccountEmail, true)
+	options.AddReasonFlag(cmd.Flags(), &saKeyCmdConfig.Reason, true)
+	options.AddProjectFlag(cmd.Flags(), &saKeyCmdConfig.Project, false)
+	cmd.Flags().DurationVar(&saKeyTTL, "ttl", 10*time.Minute, "How long until the key is deleted")
+	cmd.Flags().StringVar(&saKeyOutput, "output", "", "The file to write the key to. Defaults to a file in the config directory")
+
+	return cmd
+}
+
+// checkKeyTTL ensures that keys don't outlive the longest session allowed.
+func checkKeyTTL(ttl time.Duration) error {
+	limit := maxKeyTTL
+	if maxSession := appconfig.MaxSessionDuration(); maxSession > 0 && maxSession < limit {
+		limit = maxSession
+	}
+	if ttl < minKeyTTL || ttl > limit {
+		return argsError(fmt.Errorf("--ttl must be between %s and %s", minKeyTTL, limit))
+	}
+	return nil
+}
+
+func generateServiceAccountKey() error {
+	keysDir := filepath.Join(appconfig.GetConfigDir(), saKeysDirName)
+	if err := os.MkdirAll(keysDir, 0o700); err != nil {
+		return errorsutil.New("Failed to create the service account key directory", err)
+	}
+	deleteLeftoverKeys(keysDir)
+
+	if saKeyOutput != "" {
+		if _, err := os.Lstat(saKeyOutput); err == nil {
+			return argsError(fmt.Errorf("%s already exists", saKeyOutput))
+		}
+	}
+	if err := gcpclient.CheckServiceAccountExists(saKeyCmdConfig.Project, saKeyCmdConfig.ServiceAccountEmail); err != nil {
+		return err
+	}
+	// The key is deleted when it expires, so it must not be created if it
+	// can't be deleted.
+	saResource := gcpclient.ServiceAccountResource(saKeyCmdConfig.Project, saKeyCmdConfig.ServiceAccountEmail)
+	if err := checkPrerequisites(
+		gcpclient.Prerequisite{Permission: "iam.serviceAccountKeys.create", Resource: saResource},
+		gcpclient.Prerequisite{Permission: "iam.serviceAccountKeys.delete", Resource: saResource},
+	); err != nil {
+		return err
+	}
+	if err := confirmMFA(); err != nil {
+		return err
+	}
+	if err := requestApproval(&saKeyCmdConfig, "generate-sa-key", saKeyTTL); err != nil {
+		return err
+	}
+
+	// Catch interrupts from here on so that the key is always deleted.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(stop)
+
+	util.Logger.Warnf("Creating a key for %s", saKeyCmdConfig.ServiceAccountEmail)
+	keyName, keyFile, err := gcpclient.CreateServiceAccountKey(saKeyCmdConfig.ServiceAccountEmail, saKeyCmdConfig.Reason)
+	if err != nil {
+		return err
+	}
+	keyID := path.Base(keyName)
+	key := pendingKey{
+		Name:    keyName,
+		Expires: time.Now().Add(saKeyTTL),
+	}
+	keyPath := saKeyOutput
+	if keyPath == "" {
+		keyPath = filepath.Join(keysDir, keyID+".json")
+	}
+	record := filepath.Join(keysDir, keyID+".pending")
+
+	// Record the key before anything else can fail, so that it is deleted even
+	// if eiam is killed. The file is only added to the record once eiam has
+	// created it, so that a file that was already there is never removed.
+	if err := writePendingKey(record, key); err != nil {
+		util.Logger.WithError(err).Error("Failed to record the key for deletion")
+		deleteKey(record, key)
+		return err
+	}
+	if err := writeKeyFile(keyPath, keyFile); err != nil {
+		deleteKey(record, key)
+		return errorsutil.New("Failed to write the service account key", err)
+	}
+	key.File = keyPath
+	if err := writePendingKey(record, key); err != nil {
+		util.Logger.WithError(err).Warnf("Failed to record the key file, remove %s by hand if eiam is killed", key.File)
+	}
+
+	util.Logger.Warnf("Created key %s for %s, it will be deleted at %s", keyID, saKeyCmdConfig.ServiceAccountEmail, key.Expires.Format(time.RFC1123))
+	util.Logger.Warn("Press Ctrl-C to delete the key now")
+	fmt.Println(key.File)
+
+	select {
+	case <-time.After(saKeyTTL):
+	case <-stop:
+	}
+	if !deleteKey(record, key) {
+		return errorsutil.New("Failed to delete the service account key", fmt.Errorf("delete %s by hand", keyName))
+	}
+	return nil
+}
+
+// deleteKey deletes the key, its file, and the record of it. The record is
+// kept if the key can't be deleted, so that deleting it is tried again later.
+func deleteKey(record string, key pendingKey) bool {
+	if key.File != "" {
+		if err := os.Remove(key.File); err != nil && !os.IsNotExist(err) {
+			util.Logger.WithError(err).Errorf("Failed to remove the key file %s", key.File)
+		}
+	}
+	if err := gcpclient.DeleteServiceAccountKey(key.Name, saKeyCmdConfig.Reason); err != nil {
+		util.Logger.WithError(err).Errorf("The key %s was NOT deleted. Delete it with: gcloud iam service-accounts keys delete %s --iam-account %s",
+			key.Name, path.Base(key.Name), keyServiceAccount(key.Name))
+		return false
+	}
+	if err := os.Remove(record); err != nil && !os.IsNotExist(err) {
+		util.Logger.WithError(err).Warnf("Failed to remove %s", record)
+	}
+	util.Logger.Warnf("Deleted key %s", path.Base(key.Name))
+	return true
+}
+
+// deleteLeftoverKeys deletes the keys that should have been deleted already.
+// Keys that haven't expired yet may belong to a command that is still running,
+// so they are left alone.
+func deleteLeftoverKeys(keysDir string) {
+	records, err := filepath.Glob(filepath.Join(keysDir, "*.pending"))
+	if err != nil {
+		return
+	}
+	for _, record := range records {
+		key, err := readPendingKey(record)
+		if err != nil {
+			util.Logger.WithError(err).Warnf("Failed to read %s", record)
+			continue
+		}
+		if time.Now().Before(key.Expires) {
+			continue
+		}
+		util.Logger.Warnf("Deleting key %s, which was left behind by an earlier run", path.Base(key.Name))
+		deleteKey(record, key)
+	}
+}
+
+// writeKeyFile creates the key file. It fails if the file already exists, so
+// that the key isn't written to a file that someone else created.
+func writeKeyFile(filename string, data []byte) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(filename)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(filename)
+		return err
+	}
+	return nil
+}
+
+func writePendingKey(record string, key pendingKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(record, data, 0o600)
+}
+
+func readPendingKey(record string) (pendingKey, error) {
+	var key pendingKey
+	data, err := ioutil.ReadFile(record)
+	if err != nil {
+		return key, err
+	}
+	err = json.Unmarshal(data, &key)
+	return key, err
+}
+
+// keyServiceAccount returns the email of the service account in the resource
+// name of a key, projects/PROJECT/serviceAccounts/EMAIL/keys/ID.
+func keyServiceAccount(keyName string) string {
+	parts := strings.Split(keyName, "/")
+	if len(parts) < 6 {
+		return ""
+	}
+	return parts[3]
+}
@@ -0,0 +1,49 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteKeyFile(t *testing.T) {
+	dir := t.TempDir()
+
+	keyFile := filepath.Join(dir, "key.json")
+	if err := writeKeyFile(keyFile, []byte("key")); err != nil {
+		t.Fatalf("unexpected error writing a new key file: %v", err)
+	}
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("expected the key file to be created with mode 0600, got %o", perm)
+	}
+
+	existing := filepath.Join(dir, "existing.json")
+	if err := ioutil.WriteFile(existing, []byte("keep"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeKeyFile(existing, []byte("key")); err == nil {
+		t.Error("expected an error writing the key to an existing file")
+	}
+	if data, _ := ioutil.ReadFile(existing); string(data) != "keep" {
+		t.Errorf("expected the existing file to be left alone, got %q", data)
+	}
+}
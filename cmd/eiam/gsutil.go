@@ -0,0 +1,170 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/proxy"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+var (
+	gsutilCmdArgs   []string
+	gsutilCmdConfig options.CmdConfig
+)
+
+func newCmdGsutil() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "gsutil [GSUTIL_ARGS]",
+		Short: "Run a gsutil command with the permissions of the specified service account",
+		Long: dedent.Dedent(`
+			The "gsutil" command runs the provided gsutil command with the permissions of the specified
+			service account. gsutil doesn't accept an access token, so the command runs in a short
+			privileged session: the auth proxy is started for the command, and gsutil is pointed at it
+			with a temporary boto config that sets the proxy and its CA certificate. Your own boto
+			config is still read, and the session ends when gsutil exits.`),
+		Example: dedent.Dedent(`
+			eiam gsutil ls gs://my-bucket \
+			  --service-account-email example@my-project.iam.gserviceaccount.com \
+			  --reason "Debugging for (JIRA-1234)"
+
+			eiam gsutil -m cp -r ./backup gs://my-bucket/backup \
+			  -s example@my-project.iam.gserviceaccount.com -R "Restore backup (JIRA-1235)"`),
+		Args:               cobra.ArbitraryArgs,
+		FParseErrWhitelist: cobra.FParseErrWhitelist{UnknownFlags: true},
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if viper.GetString(appconfig.GsutilPath) == "" {
+				err := errors.New(`"gsutil": executable file not found in $PATH`)
+				return errorsutil.New("Failed to run gsutil command", err)
+			}
+			// gsutil can't use an auth proxy on a Unix socket.
+			if proxy.SocketPath() != "" {
+				return argsError(fmt.Errorf("the gsutil command can't be used when %s is set", appconfig.AuthProxySocketPath))
+			}
+			if err := options.CheckRequired(cmd.Flags()); err != nil {
+				return err
+			}
+			if err := options.CheckServiceAccount(gsutilCmdConfig.ServiceAccountEmail); err != nil {
+				return err
+			}
+			if err := options.CheckDelegates(gsutilCmdConfig.Delegates); err != nil {
+				return err
+			}
+			if err := options.CheckLifetime(gsutilCmdConfig.TokenLifetime); err != nil {
+				return err
+			}
+
+			gsutilCmdArgs = util.ExtractUnknownArgs(cmd.Flags(), os.Args)
+			if err := options.CheckReason(gsutilCmdConfig.Reason); err != nil {
+				return err
+			}
+			if err := util.FormatReason(&gsutilCmdConfig.Reason); err != nil {
+				return err
+			}
+
+			if !options.YesOption {
+				util.Confirm(map[string]string{
+					"Project":         gsutilCmdConfig.Project,
+					"Service Account": gsutilCmdConfig.ServiceAccountEmail,
+					"Delegates":       strings.Join(gsutilCmdConfig.Delegates, ", "),
+					"Reason":          gsutilCmdConfig.Reason,
+					"Command":         fmt.Sprintf("gsutil %s", strings.Join(gsutilCmdArgs, " ")),
+				})
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runGsutilCommand()
+		},
+	}
+
+	options.AddServiceAccountEmailFlag(cmd.Flags(), &gsutilCmdConfig.ServiceAccountEmail, true)
+	options.AddReasonFlag(cmd.Flags(), &gsutilCmdConfig.Reason, true)
+	options.AddProjectFlag(cmd.Flags(), &gsutilCmdConfig.Project, false)
+	options.AddDelegatesFlag(cmd.Flags(), &gsutilCmdConfig.Delegates)
+	options.AddLifetimeFlag(cmd.Flags(), &gsutilCmdConfig.TokenLifetime)
+
+	return cmd
+}
+
+func runGsutilCommand() error {
+	return runInSession(&gsutilCmdConfig, "gsutil", gsutilCmdArgs, func(host, port, _ string) ([]string, func(), error) {
+		botoConfig, err := writeBotoConfig(host, port)
+		if err != nil {
+			return nil, nil, err
+		}
+		// The command inherits the environment of eiam. BOTO_CONFIG would hide
+		// the files in BOTO_PATH, so the user's config is read from there too.
+		botoPath := userBotoConfig()
+		if botoPath != "" {
+			botoPath += string(os.PathListSeparator)
+		}
+		os.Unsetenv("BOTO_CONFIG")
+		os.Setenv("BOTO_PATH", botoPath+botoConfig)
+
+		command := append([]string{viper.GetString(appconfig.GsutilPath)}, gsutilCmdArgs...)
+		return command, func() { os.Remove(botoConfig) }, nil
+	})
+}
+
+// writeBotoConfig writes a temporary boto config that points gsutil at the
+// auth proxy and trusts its CA certificate.
+func writeBotoConfig(host, port string) (string, error) {
+	config := fmt.Sprintf(
+		"[Boto]\nproxy = %s\nproxy_port = %s\nca_certificates_file = %s\n",
+		host, port, viper.GetString(appconfig.AuthProxyCertFile),
+	)
+	f, err := ioutil.TempFile("", "eiam-boto-")
+	if err != nil {
+		return "", errorsutil.New("Failed to create the boto config", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(config); err != nil {
+		os.Remove(f.Name())
+		return "", errorsutil.New("Failed to write the boto config", err)
+	}
+	return f.Name(), nil
+}
+
+// userBotoConfig returns the boto config files that gsutil would read, in the
+// form of BOTO_PATH.
+func userBotoConfig() string {
+	if path := os.Getenv("BOTO_CONFIG"); path != "" {
+		return path
+	}
+	if path := os.Getenv("BOTO_PATH"); path != "" {
+		return path
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		path := filepath.Join(home, ".boto")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
@@ -0,0 +1,302 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/manifoldco/promptui"
+	"github.com/spf13/viper"
+	"golang.org/x/term"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	"github.com/rigup/ephemeral-iam/internal/approval"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+	"github.com/rigup/ephemeral-iam/internal/mfa"
+	"github.com/rigup/ephemeral-iam/internal/proxy"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+// checkCanImpersonate checks that the service account that the user
+// impersonates directly, the first delegate or the service account itself,
+// exists in the project and that the user can impersonate it, along with any
+// other prerequisites of the command. The user's permissions are checked in the
+// project rather than the active gcloud project, so service accounts in other
+// projects can be used with --project.
+func checkCanImpersonate(project, serviceAccountEmail string, delegates []string, prereqs ...gcpclient.Prerequisite) error {
+	firstHop := gcpclient.FirstHop(serviceAccountEmail, delegates)
+	if err := gcpclient.CheckServiceAccountExists(project, firstHop); err != nil {
+		return err
+	}
+	return checkPrerequisites(append([]gcpclient.Prerequisite{{
+		Permission: "iam.serviceAccounts.getAccessToken",
+		Resource:   gcpclient.ServiceAccountResource(project, firstHop),
+	}}, prereqs...)...)
+}
+
+// checkPrerequisites checks that the user has every permission that a command
+// needs before it starts anything, such as the auth proxy or a wrapped command,
+// so that it doesn't fail part way through with a permission denied error. All
+// of the missing permissions are listed at once.
+func checkPrerequisites(prereqs ...gcpclient.Prerequisite) error {
+	missing, err := gcpclient.MissingPrerequisites(prereqs)
+	if err != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	for _, prereq := range missing {
+		util.Logger.Errorf("Missing %s", prereq)
+	}
+	util.Logger.Infof("Run 'eiam query-permissions explain %s --resource %s' to see which roles grant it", missing[0].Permission, missing[0].Resource)
+	return errorsutil.New(
+		"You don't have the permissions that this command needs",
+		fmt.Errorf("%d of %d required permissions are missing", len(missing), len(prereqs)),
+	)
+}
+
+// mfaAttempts is how many times a TOTP code can be entered before the command
+// fails.
+const mfaAttempts = 3
+
+// totpCounterFileName is the file in the config directory that records the
+// period of the last TOTP code that was accepted.
+const totpCounterFileName = "totp_counter"
+
+// confirmMFA asks for the second factor set in security.mfa, so that eiam
+// can't be used to impersonate service accounts without a person present. It
+// isn't skipped with --yes.
+func confirmMFA() error {
+	switch viper.GetString(appconfig.SecurityMFA) {
+	case appconfig.MFATOTP:
+		return confirmTOTP()
+	case appconfig.MFACommand:
+		command := viper.GetString(appconfig.SecurityMFACommand)
+		if command == "" {
+			return errorsutil.New("Failed to confirm MFA", fmt.Errorf("%s is 'command' but %s isn't set", appconfig.SecurityMFA, appconfig.SecurityMFACommand))
+		}
+		util.Logger.Info("Waiting for MFA confirmation")
+		return mfa.RunCommand(command)
+	default:
+		return nil
+	}
+}
+
+func confirmTOTP() error {
+	secret := viper.GetString(appconfig.SecurityMFASecret)
+	if secret == "" {
+		return errorsutil.New("Failed to confirm MFA", fmt.Errorf("no TOTP secret is set, run 'eiam mfa enroll'"))
+	}
+	return promptTOTP(secret)
+}
+
+// promptTOTP asks for a code from the authenticator app that has the secret.
+// Each code is only accepted once.
+func promptTOTP(secret string) error {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return errorsutil.New("Failed to confirm MFA", fmt.Errorf("a TOTP code can only be entered in a terminal"))
+	}
+	counterFile := filepath.Join(appconfig.GetConfigDir(), totpCounterFileName)
+	last, err := mfa.ReadCounter(counterFile)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < mfaAttempts; i++ {
+		prompt := promptui.Prompt{Label: "Authenticator code"}
+		code, err := prompt.Run()
+		if err != nil {
+			return errorsutil.New("Failed to read the TOTP code", err)
+		}
+		counter, valid, err := mfa.Validate(secret, code, time.Now(), last)
+		if err != nil {
+			return errorsutil.New("Failed to check the TOTP code", err)
+		}
+		if valid {
+			return mfa.WriteCounter(counterFile, counter)
+		}
+		util.Logger.Warn("The code is incorrect or was already used")
+	}
+	return errorsutil.New("Failed to confirm MFA", fmt.Errorf("too many incorrect codes"))
+}
+
+// requestApproval asks the approval webhook to allow the service account in
+// cfg to be impersonated and waits for an approver to respond, when the config
+// requires approval for it. duration is how long the credentials will be used
+// for, or 0 if it isn't known.
+func requestApproval(cfg *options.CmdConfig, command string, duration time.Duration) error {
+	// Granting a role with --role always needs approval when a webhook is set.
+	if cfg.Role != "" {
+		if viper.GetString(appconfig.SecurityApprovalWebhook) == "" {
+			return nil
+		}
+	} else if !appconfig.ApprovalRequired(cfg.ServiceAccountEmail, cfg.Delegates) {
+		return nil
+	}
+	principal, err := gcpclient.CheckActiveAccountSet()
+	if err != nil {
+		return err
+	}
+	id, err := approval.NewID()
+	if err != nil {
+		return errorsutil.New("Failed to create the approval request", err)
+	}
+	req := approval.Request{
+		ID:             id,
+		Principal:      principal,
+		ServiceAccount: cfg.ServiceAccountEmail,
+		Role:           cfg.Role,
+		Subject:        cfg.Subject,
+		Delegates:      cfg.Delegates,
+		Project:        cfg.Project,
+		Reason:         cfg.Reason,
+		Command:        command,
+		RequestedAt:    time.Now().UTC(),
+	}
+	if duration > 0 {
+		req.Duration = duration.String()
+	}
+
+	action := "impersonate " + cfg.ServiceAccountEmail
+	if cfg.Role != "" {
+		action = fmt.Sprintf("grant %s on %s", cfg.Role, cfg.Project)
+	}
+	timeout := viper.GetDuration(appconfig.SecurityApprovalTimeout)
+	util.Logger.Infof("Waiting up to %s for approval to %s (request %s)", timeout, action, id)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	decision, err := approval.Wait(
+		ctx,
+		viper.GetString(appconfig.SecurityApprovalWebhook),
+		viper.GetString(appconfig.SecurityApprovalToken),
+		req,
+	)
+	if err != nil {
+		return err
+	}
+	if decision.Approver != "" {
+		util.Logger.Infof("Approved by %s", decision.Approver)
+	} else {
+		util.Logger.Info("Approved")
+	}
+	return nil
+}
+
+// runInSession runs a command for the wrappers of tools that can't be given an
+// access token, such as gsutil and bq, in a short privileged session. The auth
+// proxy is started for the command and stopped when it exits. Once the port of
+// the auth proxy is chosen, command returns the command line to run and a
+// function that cleans up after it. It is also given the access token that the
+// session starts with.
+func runInSession(cfg *options.CmdConfig, name string, args []string, command func(host, port, accessToken string) ([]string, func(), error)) error {
+	fullCmd := fmt.Sprintf("%s %s", name, strings.Join(args, " "))
+	if err := checkCanImpersonate(cfg.Project, cfg.ServiceAccountEmail, cfg.Delegates); err != nil {
+		return err
+	}
+	if err := confirmMFA(); err != nil {
+		return err
+	}
+	if err := requestApproval(cfg, fullCmd, cfg.TokenLifetime); err != nil {
+		return err
+	}
+
+	util.Logger.Infof("Fetching access token for %s", cfg.ServiceAccountEmail)
+	accessToken, err := gcpclient.GenerateTemporaryAccessToken(cfg.ServiceAccountEmail, cfg.Reason, cfg.TokenLifetime, cfg.Delegates)
+	if err != nil {
+		return err
+	}
+
+	if err := proxy.ChoosePort(); err != nil {
+		return err
+	}
+	host, port, err := net.SplitHostPort(proxy.Address())
+	if err != nil {
+		return errorsutil.New("Invalid auth proxy address", err)
+	}
+	cmdLine, cleanup, err := command(host, port, accessToken.GetAccessToken())
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	return proxy.StartProxyServer(
+		accessToken.GetAccessToken(),
+		cfg.Reason,
+		cfg.ServiceAccountEmail,
+		cfg.Project,
+		"",
+		nil,
+		cfg.Delegates,
+		nil,
+		nil,
+		accessToken.GetExpireTime().AsTime(),
+		cfg.TokenLifetime,
+		0,
+		nil,
+		"",
+		util.JoinArgs(cmdLine),
+	)
+}
+
+// runForeground runs a wrapped command with the terminal's input and output
+// and returns its exit status as an errorsutil.ExitError. Interrupts are left
+// to the command, e.g. so that kubectl port-forward and terraform apply stop
+// cleanly, and eiam cleans up after it has exited.
+func runForeground(c *exec.Cmd, fullCmd string) error {
+	return runForegroundUntil(c, fullCmd, time.Time{})
+}
+
+// runForegroundUntil is runForeground for commands that are stopped at
+// deadline, if it is set, e.g. when their access token expires.
+func runForegroundUntil(c *exec.Cmd, fullCmd string, deadline time.Time) error {
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	c.Stdin = os.Stdin
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	if err := c.Start(); err != nil {
+		return errorsutil.New(fmt.Sprintf("Failed to run command [%s]", fullCmd), err)
+	}
+	if !deadline.IsZero() {
+		timer := time.AfterFunc(time.Until(deadline), func() {
+			util.Logger.Warnf("The access token expired, stopping [%s]", fullCmd)
+			util.Terminate(c.Process) //nolint:errcheck // The command may have exited already
+		})
+		defer timer.Stop()
+	}
+
+	err := c.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		return errorsutil.ExitError{Code: exitErr.ExitCode()}
+	} else if err != nil {
+		return errorsutil.New(fmt.Sprintf("Failed to run command [%s]", fullCmd), err)
+	}
+	return nil
+}
@@ -16,6 +16,7 @@ package eiam
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"strings"
@@ -41,23 +42,52 @@ func newCmdKubectl() *cobra.Command {
 		Short: "Run a kubectl command with the permissions of the specified service account",
 		Long: dedent.Dedent(`
 			The "kubectl" command runs the provided kubectl command with the permissions of the specified
-			service account. Output from the kubectl command is able to be piped into other commands.`),
+			service account. Output from the kubectl command is able to be piped into other commands.
+
+			Use "--cluster" to run the command against a GKE cluster without a kubeconfig entry for
+			it. The cluster is looked up with the service account's token, in the location set with
+			"--region" or in all locations of the project, and a temporary kubeconfig that only has
+			that cluster is written for the command and removed afterwards.`),
 		Example: dedent.Dedent(`
 			eiam kubectl pods -o json \
 			  --service-account-email example@my-project.iam.gserviceaccount.com \
 			  --reason "Debugging for (JIRA-1234)"
 				
 			eiam kubectl pods -o json \
-			  -s example@my-project.iam.gserviceaccount.com -r "example" \
-			  | jq`),
+			  -s example@my-project.iam.gserviceaccount.com -R "example" \
+			  | jq
+
+			eiam kubectl get pods -n kube-system \
+			  --cluster prod-cluster --region us-central1 \
+			  -s example@my-project.iam.gserviceaccount.com -R "Debugging for (JIRA-1234)"`),
 		Args:               cobra.ArbitraryArgs,
 		FParseErrWhitelist: cobra.FParseErrWhitelist{UnknownFlags: true},
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			if err := options.CheckRequired(cmd.Flags()); err != nil {
 				return err
 			}
+			if err := options.CheckServiceAccount(kubectlCmdConfig.ServiceAccountEmail); err != nil {
+				return err
+			}
+			if err := options.CheckDelegates(kubectlCmdConfig.Delegates); err != nil {
+				return err
+			}
+			if err := options.CheckLifetime(kubectlCmdConfig.TokenLifetime); err != nil {
+				return err
+			}
+			// The region flag defaults to the gcloud region, which would miss
+			// zonal clusters, so it only narrows the lookup when it is set.
+			if !cmd.Flags().Changed(options.RegionFlag.Name) {
+				kubectlCmdConfig.Region = ""
+			}
+			if kubectlCmdConfig.Cluster != "" && kubectlCmdConfig.Project == "" {
+				return argsError(fmt.Errorf("--%s is required with --%s", options.ProjectFlag.Name, options.ClusterFlag.Name))
+			}
 
 			kubectlCmdArgs = util.ExtractUnknownArgs(cmd.Flags(), os.Args)
+			if err := options.CheckReason(kubectlCmdConfig.Reason); err != nil {
+				return err
+			}
 			if err := util.FormatReason(&kubectlCmdConfig.Reason); err != nil {
 				return err
 			}
@@ -66,6 +96,8 @@ func newCmdKubectl() *cobra.Command {
 				util.Confirm(map[string]string{
 					"Project":         kubectlCmdConfig.Project,
 					"Service Account": kubectlCmdConfig.ServiceAccountEmail,
+					"Delegates":       strings.Join(kubectlCmdConfig.Delegates, ", "),
+					"Cluster":         kubectlCmdConfig.Cluster,
 					"Reason":          kubectlCmdConfig.Reason,
 					"Command":         fmt.Sprintf("kubectl %s", strings.Join(kubectlCmdArgs, " ")),
 				})
@@ -80,39 +112,94 @@ func newCmdKubectl() *cobra.Command {
 	options.AddServiceAccountEmailFlag(cmd.Flags(), &kubectlCmdConfig.ServiceAccountEmail, true)
 	options.AddReasonFlag(cmd.Flags(), &kubectlCmdConfig.Reason, true)
 	options.AddProjectFlag(cmd.Flags(), &kubectlCmdConfig.Project, false)
+	options.AddDelegatesFlag(cmd.Flags(), &kubectlCmdConfig.Delegates)
+	options.AddLifetimeFlag(cmd.Flags(), &kubectlCmdConfig.TokenLifetime)
+	options.AddClusterFlag(cmd.Flags(), &kubectlCmdConfig.Cluster)
+	options.AddRegionFlag(cmd.Flags(), &kubectlCmdConfig.Region, false)
 
 	return cmd
 }
 
 func runKubectlCommand() error {
-	hasAccess, err := gcpclient.CanImpersonate(kubectlCmdConfig.Project, kubectlCmdConfig.ServiceAccountEmail)
-	if err != nil {
+	if err := checkCanImpersonate(kubectlCmdConfig.Project, kubectlCmdConfig.ServiceAccountEmail, kubectlCmdConfig.Delegates); err != nil {
+		return err
+	}
+	if err := confirmMFA(); err != nil {
+		return err
+	}
+	if err := requestApproval(&kubectlCmdConfig, fmt.Sprintf("kubectl %s", strings.Join(kubectlCmdArgs, " ")), kubectlCmdConfig.TokenLifetime); err != nil {
 		return err
-	} else if !hasAccess {
-		util.Logger.Fatalln("You do not have access to impersonate this service account")
 	}
 
 	util.Logger.Infof("Fetching access token for %s", kubectlCmdConfig.ServiceAccountEmail)
 	accessToken, err := gcpclient.GenerateTemporaryAccessToken(
 		kubectlCmdConfig.ServiceAccountEmail,
 		kubectlCmdConfig.Reason,
+		kubectlCmdConfig.TokenLifetime,
+		kubectlCmdConfig.Delegates,
 	)
 	if err != nil {
 		return err
 	}
 
-	util.Logger.Infof("Running: [kubectl %s]\n\n", strings.Join(kubectlCmdArgs, " "))
-	kubectlAuth := append(kubectlCmdArgs, "--token", accessToken.GetAccessToken())
+	kubectlAuth := withFlags(kubectlCmdArgs, "--token", accessToken.GetAccessToken())
 	kubectl := viper.GetString("binarypaths.kubectl")
 	c := exec.Command(kubectl, kubectlAuth...)
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
-	c.Stdin = os.Stdin
+	if kubectlCmdConfig.Cluster != "" {
+		kubeconfig, err := writeClusterKubeconfig(accessToken.GetAccessToken())
+		if err != nil {
+			return err
+		}
+		defer os.Remove(kubeconfig)
+		c = exec.Command(kubectl, kubectlCmdArgs...)
+		c.Env = append(os.Environ(), "KUBECONFIG="+kubeconfig)
+	}
+
+	fullCmd := fmt.Sprintf("kubectl %s", strings.Join(kubectlCmdArgs, " "))
+	util.Logger.Infof("Running: [%s]\n\n", fullCmd)
+	return runForeground(c, fullCmd)
+}
 
-	if err := c.Run(); err != nil {
-		fullCmd := fmt.Sprintf("kubectl %s", strings.Join(kubectlCmdArgs, " "))
-		return errorsutil.New(fmt.Sprintf("Failed to run command [%s]", fullCmd), err)
+// withFlags adds flags to the arguments of a wrapped command before "--", so
+// that they aren't passed to the command run by kubectl exec or to ssh instead.
+func withFlags(args []string, flags ...string) []string {
+	withArgs := make([]string, 0, len(args)+len(flags))
+	for i, arg := range args {
+		if arg == "--" {
+			withArgs = append(withArgs, flags...)
+			return append(withArgs, args[i:]...)
+		}
+		withArgs = append(withArgs, arg)
 	}
+	return append(withArgs, flags...)
+}
 
-	return nil
+// writeClusterKubeconfig writes a temporary kubeconfig for the cluster chosen
+// with --cluster that authenticates with the access token.
+func writeClusterKubeconfig(accessToken string) (string, error) {
+	util.Logger.Infof("Fetching the credentials of cluster %s", kubectlCmdConfig.Cluster)
+	cluster, err := gcpclient.FindCluster(
+		kubectlCmdConfig.Project,
+		kubectlCmdConfig.Region,
+		kubectlCmdConfig.Cluster,
+		accessToken,
+		kubectlCmdConfig.Reason,
+	)
+	if err != nil {
+		return "", err
+	}
+	config, err := cluster.Kubeconfig(accessToken)
+	if err != nil {
+		return "", errorsutil.New("Failed to create the kubeconfig", err)
+	}
+	f, err := ioutil.TempFile("", "eiam-kubeconfig-")
+	if err != nil {
+		return "", errorsutil.New("Failed to create the kubeconfig", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(config); err != nil {
+		os.Remove(f.Name())
+		return "", errorsutil.New("Failed to write the kubeconfig", err)
+	}
+	return f.Name(), nil
 }
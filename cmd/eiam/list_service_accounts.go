@@ -16,21 +16,23 @@ package eiam
 
 import (
 	"fmt"
-	"os"
 	"strings"
-	"text/tabwriter"
 
 	"github.com/lithammer/dedent"
-	"github.com/mitchellh/go-wordwrap"
 	"github.com/spf13/cobra"
 	"google.golang.org/api/iam/v1"
 
 	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
 	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+	"github.com/rigup/ephemeral-iam/internal/output"
 	"github.com/rigup/ephemeral-iam/pkg/options"
 )
 
-var listCmdConfig options.CmdConfig
+var (
+	listCmdConfig     options.CmdConfig
+	whoCanImpersonate bool
+	listFilter        string
+)
 
 func newCmdListServiceAccounts() *cobra.Command {
 	cmd := &cobra.Command{
@@ -41,45 +43,142 @@ func newCmdListServiceAccounts() *cobra.Command {
 		Long: dedent.Dedent(`
 			The "list-service-accounts" command fetches all Cloud IAM Service Accounts in the current
 			GCP project (as determined by the activated gcloud config) and checks each of them to see
-			which ones the current user has access to impersonate.`),
+			which ones the current user has access to impersonate.
+
+			With the --who-can-impersonate flag, every service account in the project is listed
+			with the members that are granted a role that includes
+			iam.serviceAccounts.getAccessToken on it, such as Service Account Token Creator,
+			Owner, Editor, or a custom role, either directly or on the project, its folders, or
+			its organization, to audit who can impersonate which service accounts. This requires
+			permission to read the IAM policies of the project and its service accounts, and the
+			roles that are granted. The policies of folders and organizations that can't be read
+			are skipped with a warning.
+
+			With the --folder, --organization, or --filter flags, the service accounts are found
+			with Cloud Asset Inventory instead, which scales to every project in a folder or
+			organization. The filter is a Cloud Asset Inventory search query such as
+			'displayName:deploy*'. This requires the Cloud Asset API to be enabled and permission
+			to search the assets in the folder, organization, or project.`),
 		Example: dedent.Dedent(`
 			$ eiam list-service-accounts
-			$ eiam list`),
+			$ eiam list
+			$ eiam list-service-accounts --who-can-impersonate
+			$ eiam list-service-accounts --organization 123456789012 --filter 'displayName:deploy*'`),
 		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if listCmdConfig.Folder != "" && listCmdConfig.Organization != "" {
+				return argsError(fmt.Errorf("only one of --folder and --organization can be set"))
+			}
+			if whoCanImpersonate && (listCmdConfig.Folder != "" || listCmdConfig.Organization != "" || listFilter != "") {
+				return argsError(fmt.Errorf("--who-can-impersonate can't be used with --folder, --organization, or --filter"))
+			}
+			if err := options.CheckOutput(); err != nil {
+				return err
+			}
 			return options.CheckRequired(cmd.Flags())
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if listCmdConfig.Folder != "" || listCmdConfig.Organization != "" || listFilter != "" {
+				return searchServiceAccounts()
+			}
+			if whoCanImpersonate {
+				impersonators, err := gcpclient.FetchImpersonators(listCmdConfig.Project)
+				if err != nil {
+					return err
+				}
+				return printImpersonators(impersonators)
+			}
 			availableSAs, err := gcpclient.FetchAvailableServiceAccounts(listCmdConfig.Project)
 			if err != nil {
 				return err
 			}
+			emails := make([]string, len(availableSAs))
+			for i, sa := range availableSAs {
+				emails[i] = sa.Email
+			}
+			// The list is cached for the completion of --service-account-email.
+			if err := cacheServiceAccounts(listCmdConfig.Project, emails); err != nil {
+				util.Logger.WithError(err).Debug("Failed to cache the service accounts")
+			}
 			if len(availableSAs) == 0 {
 				util.Logger.Warning("You do not have access to impersonate any accounts in this project")
-				return nil
+				if output.IsTable() {
+					return nil
+				}
 			}
-			printColumns(availableSAs)
-			return nil
+			return printColumns(availableSAs)
 		},
 	}
 	options.AddProjectFlag(cmd.Flags(), &listCmdConfig.Project, false)
+	cmd.Flags().BoolVar(
+		&whoCanImpersonate,
+		"who-can-impersonate",
+		false,
+		"List the members that can impersonate each service account in the project",
+	)
+	options.AddFolderFlag(cmd.Flags(), &listCmdConfig.Folder, false)
+	options.AddOrganizationFlag(cmd.Flags(), &listCmdConfig.Organization, false)
+	cmd.Flags().StringVar(&listFilter, "filter", "", "A Cloud Asset Inventory query that the service accounts must match")
+	options.AddOutputFlags(cmd.Flags())
 
 	return cmd
 }
 
-func printColumns(serviceAccounts []*iam.ServiceAccount) {
-	w := tabwriter.NewWriter(os.Stdout, 0, 4, 4, ' ', 0)
-	fmt.Fprintln(w, "\nEMAIL\tDESCRIPTION")
+// searchServiceAccounts lists the service accounts that can be impersonated in
+// the folder, organization, or project using Cloud Asset Inventory.
+func searchServiceAccounts() error {
+	scope := "projects/" + listCmdConfig.Project
+	if listCmdConfig.Folder != "" {
+		scope = "folders/" + strings.TrimPrefix(listCmdConfig.Folder, "folders/")
+	} else if listCmdConfig.Organization != "" {
+		scope = "organizations/" + strings.TrimPrefix(listCmdConfig.Organization, "organizations/")
+	}
+	util.Logger.Infof("Searching for service accounts in %s", scope)
+	serviceAccounts, err := gcpclient.SearchServiceAccounts(scope, listFilter)
+	if err != nil {
+		return err
+	}
+	util.Logger.Infof("Checking %d service accounts in %s", len(serviceAccounts), scope)
+	availableSAs := gcpclient.FilterImpersonable(serviceAccounts)
+	if len(availableSAs) == 0 {
+		util.Logger.Warningf("You do not have access to impersonate any matching accounts in %s", scope)
+		if output.IsTable() {
+			return nil
+		}
+	}
+	return printColumns(availableSAs)
+}
+
+func printColumns(serviceAccounts []*iam.ServiceAccount) error {
+	table := &output.Table{Columns: []output.Column{
+		{Name: "email", Header: "EMAIL"},
+		{Name: "description", Header: "DESCRIPTION", Wrap: 75},
+	}}
+	for _, sa := range serviceAccounts {
+		table.Rows = append(table.Rows, []string{sa.Email, sa.Description})
+	}
+	return output.Print(serviceAccounts, table)
+}
+
+func printImpersonators(serviceAccounts []gcpclient.ServiceAccountImpersonators) error {
+	table := &output.Table{Columns: []output.Column{
+		{Name: "serviceAccount", Header: "SERVICE ACCOUNT", Group: true},
+		{Name: "member", Header: "MEMBER"},
+		{Name: "role", Header: "ROLE"},
+		{Name: "grantedOn", Header: "GRANTED ON"},
+		{Name: "condition", Header: "CONDITION"},
+	}}
 	for _, sa := range serviceAccounts {
-		desc := strings.Split(wordwrap.WrapString(sa.Description, 75), "\n")
-		if len(desc) == 1 {
-			fmt.Fprintf(w, "%s\t%s\n", sa.Email, desc[0])
-		} else {
-			firstLine, remaining := desc[0], desc[1:]
-			fmt.Fprintf(w, "%s\t%s\n", sa.Email, firstLine)
-			for _, line := range remaining {
-				fmt.Fprintf(w, "%s\t%s\n", " ", line)
+		if len(sa.Impersonators) == 0 {
+			table.Rows = append(table.Rows, []string{sa.ServiceAccount, "(none)", "", "", ""})
+			continue
+		}
+		for _, impersonator := range sa.Impersonators {
+			grantedOn := impersonator.GrantedOn
+			if strings.HasSuffix(grantedOn, "/serviceAccounts/"+sa.ServiceAccount) {
+				grantedOn = "service account"
 			}
+			table.Rows = append(table.Rows, []string{sa.ServiceAccount, impersonator.Member, impersonator.Role, grantedOn, impersonator.Condition})
 		}
 	}
-	w.Flush()
+	return output.Print(serviceAccounts, table)
 }
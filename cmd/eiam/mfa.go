@@ -0,0 +1,87 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"fmt"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+	"github.com/rigup/ephemeral-iam/internal/mfa"
+)
+
+func newCmdMFA() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "mfa",
+		Short: "Manage the confirmation required before impersonating service accounts",
+	}
+
+	cmd.AddCommand(newCmdMFAEnroll())
+
+	return cmd
+}
+
+func newCmdMFAEnroll() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "enroll",
+		Short: "Set up an authenticator app to confirm privilege escalations",
+		Long: dedent.Dedent(`
+			The "enroll" command generates a TOTP secret, prints it to add to an
+			authenticator app, and asks for a code from the app to check that it was added.
+			It then sets security.mfa to 'totp', so commands that impersonate a service
+			account ask for a code from the app first. The secret is stored in the system
+			keyring when keyring.enabled is true.
+
+			If a second factor is already required, it has to be confirmed before a new
+			secret is enrolled.`),
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := confirmMFA(); err != nil {
+				return err
+			}
+			account, err := gcpclient.CheckActiveAccountSet()
+			if err != nil {
+				return err
+			}
+			secret, err := mfa.GenerateSecret()
+			if err != nil {
+				return err
+			}
+
+			fmt.Println("Add this secret to your authenticator app:")
+			fmt.Printf("\n    %s\n\n", secret)
+			fmt.Println("or import it from this URI, e.g. by turning it into a QR code:")
+			fmt.Printf("\n    %s\n\n", mfa.URI(secret, account))
+			if err := promptTOTP(secret); err != nil {
+				return err
+			}
+
+			viper.Set(appconfig.SecurityMFASecret, secret)
+			viper.Set(appconfig.SecurityMFA, appconfig.MFATOTP)
+			if err := appconfig.WriteConfig(); err != nil {
+				return errorsutil.New("Failed to write updated configuration", err)
+			}
+			util.Logger.Info("Commands that impersonate a service account now ask for a code from your authenticator app")
+			return nil
+		},
+	}
+	return cmd
+}
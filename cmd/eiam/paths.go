@@ -0,0 +1,187 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+var (
+	pathsCmdConfig options.CmdConfig
+	pathsMembers   []string
+	pathsMaxDepth  int
+	pathsFormat    string
+	pathsFormats   = []string{"dot", "json", "text"}
+)
+
+func newCmdPaths() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "paths",
+		Short: "Find chains of service accounts that lead to privileged service accounts",
+		Long: dedent.Dedent(`
+			The "paths" command reads the IAM policies of a project, or of every project under a
+			folder, and finds the chains of service accounts that you can impersonate one after
+			the other to reach a privileged service account, e.g. one that is a project owner.
+
+			A member can act as a service account if it is granted one of the following roles on
+			the service account, or on a project or folder that the service account is in:
+
+				roles/editor, roles/owner
+				roles/iam.serviceAccountAdmin, roles/iam.serviceAccountKeyAdmin
+				roles/iam.serviceAccountTokenCreator, roles/iam.serviceAccountUser
+				roles/iam.workloadIdentityUser
+
+			A service account is privileged if it is granted roles/owner, roles/editor, or a role
+			that administers IAM policies or service accounts on a project or folder.
+
+			The paths start from your account, allUsers, and allAuthenticatedUsers. Group
+			memberships aren't expanded, so add the groups that you belong to with --member.
+
+			The shortest path to each privileged service account is printed as text, or as a
+			Graphviz graph or JSON with --output.`),
+		Example: dedent.Dedent(`
+			eiam paths
+			eiam paths --folder 123456789012 --member group:sre@example.com
+			eiam paths --output dot | dot -Tsvg > paths.svg`),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				return argsError(fmt.Errorf("the paths command does not accept arguments"))
+			}
+			if !util.Contains(pathsFormats, pathsFormat) {
+				return argsError(fmt.Errorf("--%s must be one of %v", options.OutputFlag.Name, pathsFormats))
+			}
+			if pathsMaxDepth < 1 {
+				return argsError(fmt.Errorf("--max-depth must be at least 1"))
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			userAcct, err := gcpclient.CheckActiveAccountSet()
+			if err != nil {
+				return err
+			}
+			sources := append([]string{gcpclient.IAMMember(userAcct), "allUsers", "allAuthenticatedUsers"}, pathsMembers...)
+
+			var graph *gcpclient.PrivilegeGraph
+			if pathsCmdConfig.Folder != "" {
+				util.Logger.Infof("Reading the IAM policies under folder %s", pathsCmdConfig.Folder)
+				graph, err = gcpclient.CrawlFolderPrivileges(pathsCmdConfig.Folder)
+			} else {
+				util.Logger.Infof("Reading the IAM policies in %s", pathsCmdConfig.Project)
+				graph, err = gcpclient.CrawlProjectPrivileges(pathsCmdConfig.Project)
+			}
+			if err != nil {
+				return err
+			}
+
+			paths := graph.PathsFrom(sources, pathsMaxDepth)
+			switch pathsFormat {
+			case "dot":
+				fmt.Print(escalationPathsDOT(paths))
+			case "json":
+				data, err := json.MarshalIndent(map[string]interface{}{
+					"sources": sources,
+					"paths":   paths,
+				}, "", "  ")
+				if err != nil {
+					return errorsutil.New("Failed to format the escalation paths", err)
+				}
+				fmt.Println(string(data))
+			default:
+				printEscalationPaths(paths)
+			}
+			return nil
+		},
+	}
+
+	options.AddProjectFlag(cmd.Flags(), &pathsCmdConfig.Project, false)
+	options.AddFolderFlag(cmd.Flags(), &pathsCmdConfig.Folder, false)
+	cmd.Flags().StringSliceVar(
+		&pathsMembers,
+		"member",
+		nil,
+		"Other IAM members to start from, e.g. the groups that you belong to (group:sre@example.com)",
+	)
+	cmd.Flags().IntVar(&pathsMaxDepth, "max-depth", 4, "The most service accounts in a path")
+	cmd.Flags().StringVarP(
+		&pathsFormat,
+		options.OutputFlag.Name,
+		options.OutputFlag.Shorthand,
+		"text",
+		fmt.Sprintf("Print the paths in one of %v", pathsFormats),
+	)
+
+	return cmd
+}
+
+func printEscalationPaths(paths []gcpclient.EscalationPath) {
+	if len(paths) == 0 {
+		util.Logger.Info("No paths to privileged service accounts were found")
+		return
+	}
+	util.Logger.Infof("Found %d paths to privileged service accounts", len(paths))
+	for _, path := range paths {
+		fmt.Printf("\n%s (%s)\n", path.Target, strings.Join(path.Privileges, ", "))
+		fmt.Printf("  %s\n", path.Hops[0].From)
+		for _, hop := range path.Hops {
+			fmt.Printf("    -> %s (%s on %s)\n", strings.TrimPrefix(hop.To, "serviceAccount:"), hop.Role, hop.GrantedOn)
+		}
+	}
+	fmt.Println()
+}
+
+// escalationPathsDOT draws the paths as a Graphviz graph. The privileged
+// service accounts are red boxes.
+func escalationPathsDOT(paths []gcpclient.EscalationPath) string {
+	var buf bytes.Buffer
+	buf.WriteString("digraph escalation_paths {\n  rankdir=LR;\n")
+
+	targets := map[string]string{}
+	edges := map[string]bool{}
+	for _, path := range paths {
+		targets["serviceAccount:"+path.Target] = strings.Join(path.Privileges, "\n")
+		for _, hop := range path.Hops {
+			edge := fmt.Sprintf("  %s -> %s [label=%s];\n",
+				strconv.Quote(hop.From), strconv.Quote(hop.To), strconv.Quote(strings.TrimPrefix(hop.Role, "roles/")))
+			if !edges[edge] {
+				edges[edge] = true
+				buf.WriteString(edge)
+			}
+		}
+	}
+	names := make([]string, 0, len(targets))
+	for target := range targets {
+		names = append(names, target)
+	}
+	sort.Strings(names)
+	for _, target := range names {
+		fmt.Fprintf(&buf, "  %s [shape=box, color=red, tooltip=%s];\n", strconv.Quote(target), strconv.Quote(targets[target]))
+	}
+	buf.WriteString("}\n")
+	return buf.String()
+}
@@ -80,7 +80,7 @@ func newCmdPluginsAuthAdd() *cobra.Command {
 				viper.Set(appconfig.GithubAuth, true)
 			}
 
-			if err := viper.WriteConfig(); err != nil {
+			if err := appconfig.WriteConfig(); err != nil {
 				return errorsutil.New("Failed to write updated configuration", err)
 			}
 			return nil
@@ -145,7 +145,7 @@ func newCmdPluginsAuthDelete() *cobra.Command {
 				viper.Set(appconfig.GithubAuth, false)
 			}
 
-			if err := viper.WriteConfig(); err != nil {
+			if err := appconfig.WriteConfig(); err != nil {
 				return errorsutil.New("Failed to write updated configuration", err)
 			}
 			util.Logger.Infof("%s was successfully deleted", tokenName)
@@ -0,0 +1,233 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	"github.com/rigup/ephemeral-iam/internal/proxy"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+func newCmdProxy() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "proxy",
+		Short: "Manage the auth proxy used by privileged sessions",
+	}
+
+	cmd.AddCommand(newCmdProxyEnv())
+	cmd.AddCommand(newCmdProxyStatus())
+	cmd.AddCommand(newCmdProxyRotateCerts())
+	cmd.AddCommand(newCmdProxyTrustCA())
+
+	return cmd
+}
+
+// The shells that "proxy env" can print commands for.
+var proxyEnvShells = []string{"sh", "fish", "powershell"}
+
+func newCmdProxyEnv() *cobra.Command {
+	var shell, sessionID string
+	cmd := &cobra.Command{
+		Use:   "env",
+		Short: "Print the environment variables that use the running privileged session",
+		Long: dedent.Dedent(`
+			The "env" command prints the commands that set the environment variables which
+			point gcloud and other tools at the auth proxy of the running privileged
+			session. This lets you use the session from shells and tools other than the
+			sub-shell that "assume-privileges" starts.
+
+			The variables set the proxy (HTTPS_PROXY, HTTP_PROXY, and CLOUDSDK_PROXY_*), the
+			CA that tools need to trust (CLOUDSDK_CORE_CUSTOM_CA_CERTS_FILE,
+			REQUESTS_CA_BUNDLE, CURL_CA_BUNDLE, and NODE_EXTRA_CA_CERTS), and the project of
+			the session. When the auth proxy listens on a Unix socket, the variables make
+			gcloud impersonate the service account itself instead.
+
+			When more than one session is running, choose one with --session.`),
+		Example: dedent.Dedent(`
+			eval "$(eiam proxy env)"
+			eiam proxy env --shell fish | source
+			eval "$(eiam proxy env --session deployer@my-project.iam.gserviceaccount.com)"`),
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if !util.Contains(proxyEnvShells, shell) {
+				return argsError(fmt.Errorf("--shell must be one of %v", proxyEnvShells))
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			session, err := findSession(sessionID)
+			if err != nil {
+				return err
+			}
+			for _, env := range session.Env() {
+				kv := strings.SplitN(env, "=", 2)
+				fmt.Println(formatEnvVar(shell, kv[0], kv[1]))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&shell, "shell", "sh", fmt.Sprintf("The shell to print the commands for, one of %v", proxyEnvShells))
+	cmd.Flags().StringVar(&sessionID, "session", "", sessionFlagUsage)
+	return cmd
+}
+
+// formatEnvVar returns the command that sets an environment variable in the
+// given shell.
+func formatEnvVar(shell, key, val string) string {
+	switch shell {
+	case "fish":
+		val = strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(val)
+		return fmt.Sprintf("set -gx %s '%s'", key, val)
+	case "powershell":
+		return fmt.Sprintf("$env:%s = '%s'", key, strings.ReplaceAll(val, "'", "''"))
+	default:
+		return fmt.Sprintf("export %s='%s'", key, strings.ReplaceAll(val, "'", `'\''`))
+	}
+}
+
+func newCmdProxyStatus() *cobra.Command {
+	var (
+		asJSON    bool
+		sessionID string
+	)
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Check that the running privileged session is live",
+		Long: dedent.Dedent(`
+			The "status" command asks the auth proxy of the running privileged session
+			whether it can still be used, and prints the service account, the time that the
+			access token expires, and the number of requests in flight.
+
+			The command exits with a non-zero status if no session is running, the auth
+			proxy can't be reached, the access token has expired, or the proxy is shutting
+			down, so scripts can check the session before they start long jobs. When more
+			than one session is running, choose one with --session.`),
+		Example: dedent.Dedent(`
+			eiam proxy status
+			eiam proxy status --json
+			eiam proxy status >/dev/null && ./long-running-job.sh`),
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			session, err := findSession(sessionID)
+			if err != nil {
+				return err
+			}
+			health, err := session.Health()
+			if err != nil {
+				return err
+			}
+
+			if asJSON {
+				out, err := json.MarshalIndent(health, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(out))
+			} else {
+				printProxyStatus(session, health)
+			}
+			if !health.Live() {
+				return fmt.Errorf("the privileged session is not live: %s", health.Status)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Write the status to stdout as JSON")
+	cmd.Flags().StringVar(&sessionID, "session", "", sessionFlagUsage)
+	return cmd
+}
+
+func printProxyStatus(session *proxy.Session, health *proxy.Health) {
+	listening := session.Address
+	if session.SocketPath != "" {
+		listening = session.SocketPath
+	}
+	remaining := time.Duration(health.Remaining) * time.Second
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 4, ' ', 0)
+	fmt.Fprintf(w, "Status\t%s\n", health.Status)
+	fmt.Fprintf(w, "Service account\t%s\n", health.ServiceAccount)
+	if session.Subject != "" {
+		fmt.Fprintf(w, "Subject\t%s\n", session.Subject)
+	}
+	if session.Project != "" {
+		fmt.Fprintf(w, "Project\t%s\n", session.Project)
+	}
+	fmt.Fprintf(w, "Reason\t%s\n", session.Reason)
+	fmt.Fprintf(w, "Listening on\t%s\n", listening)
+	fmt.Fprintf(w, "Expires\t%s (%s remaining)\n", health.Expires.Local().Format(time.RFC1123), remaining)
+	fmt.Fprintf(w, "Requests in flight\t%d\n", health.InFlight)
+	w.Flush()
+}
+
+func newCmdProxyRotateCerts() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rotate-certs",
+		Short: "Replace the auth proxy CA certificate and key",
+		Long: dedent.Dedent(`
+			The "rotate-certs" command generates a new CA certificate and key for the auth
+			proxy and writes them to the files referenced by authproxy.certfile and
+			authproxy.keyfile. The client certificate is reissued if one exists.
+
+			The CA is also rotated automatically when a privileged session starts less than
+			authproxy.rotatecertsbefore before the CA expires. gcloud reads the CA from
+			authproxy.certfile, but if you added the CA to any other trust stores you need
+			to replace it with the new one, e.g. with "eiam proxy trust-ca".`),
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !options.YesOption && !util.PromptConfirm("Replace the auth proxy CA") {
+				util.Logger.Warn("Abandoning Command...")
+				return nil
+			}
+			return proxy.RotateCerts()
+		},
+	}
+	return cmd
+}
+
+func newCmdProxyTrustCA() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "trust-ca",
+		Short: "Add the auth proxy CA to your trust store",
+		Long: dedent.Dedent(`
+			The "trust-ca" command adds the auth proxy CA in authproxy.certfile to the trust
+			store of the current user, so that tools which only trust the certificates of
+			the OS, such as programs written in Go on Windows and macOS, can be used in
+			privileged sessions. gcloud doesn't need it, as it reads the CA from
+			authproxy.certfile.
+
+			On Windows the CA is added to the Trusted Root Certification Authorities store of
+			the current user with certutil, and on macOS it is added to the login keychain.
+			Both ask you to confirm the change. On Linux, add the CA with your
+			distribution's tools instead, e.g. update-ca-certificates.
+
+			Run it again after the CA is rotated.`),
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return proxy.TrustCA()
+		},
+	}
+	return cmd
+}
@@ -20,7 +20,8 @@ import (
 	"io"
 	"os"
 	"os/exec"
-	"text/tabwriter"
+	"strconv"
+	"strings"
 
 	"github.com/fatih/color"
 	"github.com/lithammer/dedent"
@@ -31,12 +32,15 @@ import (
 	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
 	"github.com/rigup/ephemeral-iam/internal/gcpclient"
 	queryiam "github.com/rigup/ephemeral-iam/internal/gcpclient/query_iam"
+	"github.com/rigup/ephemeral-iam/internal/output"
 	"github.com/rigup/ephemeral-iam/pkg/options"
 )
 
 // Resource string templates.
 var (
 	computeInstanceRes = "//compute.googleapis.com/projects/%s/zones/%s/instances/%s"
+	foldersRes         = "//cloudresourcemanager.googleapis.com/folders/%s"
+	organizationsRes   = "//cloudresourcemanager.googleapis.com/organizations/%s"
 	projectsRes        = "//cloudresourcemanager.googleapis.com/projects/%s"
 	pubsubTopicsRes    = "//pubsub.googleapis.com/projects/%s/topics/%s"
 	serviceAccountsRes = "//iam.googleapis.com/projects/%s/serviceAccounts/%s"
@@ -101,12 +105,27 @@ func newCmdQueryPermissions() *cobra.Command {
 				pubsub.topics.updateTag             ✔
 			
 				INFO    sa1@project.iam.gserviceaccount.com has full access to this resource
+			
+			Set the -o flag to print the results as CSV, JSON, or YAML instead, e.g. to feed
+			audit spreadsheets or policy checks, and --fields to only print some of them:
+			
+				$ eiam query-permissions pubsub -t topic1 -o json
+				$ eiam query-permissions pubsub -t topic1 -o csv --fields permission,granted
 		`),
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return options.CheckOutput()
+		},
 	}
+	options.AddOutputFlags(cmd.PersistentFlags())
 
 	cmd.AddCommand(newCmdQueryComputeInstancePermissions())
+	cmd.AddCommand(newCmdQueryPermissionsDiff())
+	cmd.AddCommand(newCmdQueryPermissionsExplain())
+	cmd.AddCommand(newCmdQueryFolderPermissions())
+	cmd.AddCommand(newCmdQueryOrganizationPermissions())
 	cmd.AddCommand(newCmdQueryProjectPermissions())
 	cmd.AddCommand(newCmdQueryPubSubPermissions())
+	cmd.AddCommand(newCmdQueryResourcePermissions())
 	cmd.AddCommand(newCmdQueryServiceAccountPermissions())
 	cmd.AddCommand(newCmdQueryStorageBucketPermissions())
 
@@ -157,13 +176,13 @@ func newCmdQueryComputeInstancePermissions() *cobra.Command {
 				return err
 			}
 			if queryPermsCmdConfig.ServiceAccountEmail != "" {
-				return printPermissions(util.Uniq(testablePerms), userPerms, queryPermsCmdConfig.ServiceAccountEmail)
+				return printPermissions(resourceString, util.Uniq(testablePerms), userPerms, queryPermsCmdConfig.ServiceAccountEmail)
 			}
 			userAcct, err := gcpclient.CheckActiveAccountSet()
 			if err != nil {
 				return err
 			}
-			return printPermissions(util.Uniq(testablePerms), userPerms, userAcct)
+			return printPermissions(resourceString, util.Uniq(testablePerms), userPerms, userAcct)
 		},
 	}
 
@@ -176,6 +195,251 @@ func newCmdQueryComputeInstancePermissions() *cobra.Command {
 	return cmd
 }
 
+func newCmdQueryPermissionsDiff() *cobra.Command {
+	var resourceString string
+	cmd := &cobra.Command{
+		Use:   "diff [FULL_RESOURCE_NAME]",
+		Short: "Compare your permissions on a resource to a service account's",
+		Long: dedent.Dedent(`
+			Compare the permissions you are granted on a resource to the permissions that a
+			service account is granted on it, and list the permissions you would gain and
+			lose by assuming the privileges of the service account.
+			
+			The resource is given by its full resource name, and any resource supported by
+			"eiam query-permissions resource" can be compared. If no resource is given, the
+			project is compared.
+		`),
+		Example: dedent.Dedent(`
+			  eiam query-permissions diff \
+			    --service-account-email example@my-project.iam.gserviceaccount.com
+			
+			  eiam query-permissions diff //storage.googleapis.com/projects/_/buckets/my-bucket \
+			    --service-account-email example@my-project.iam.gserviceaccount.com
+		`),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 1 {
+				return argsError(fmt.Errorf("expected at most one full resource name, got %d", len(args)))
+			}
+			return nil
+		},
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := options.CheckRequired(cmd.Flags()); err != nil {
+				return err
+			}
+			if len(args) == 1 {
+				resourceString = args[0]
+			} else {
+				resourceString = fmt.Sprintf(projectsRes, queryPermsCmdConfig.Project)
+			}
+			return queryiam.CheckResourceSupported(resourceString)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			userAcct, err := gcpclient.CheckActiveAccountSet()
+			if err != nil {
+				return err
+			}
+			util.Logger.Infof("Comparing permissions granted on %s", resourceString)
+			testablePerms, err := queryiam.QueryTestablePermissionsOnResource(resourceString)
+			if err != nil {
+				return err
+			}
+			userPerms, err := queryiam.QueryResourcePermissions(testablePerms, resourceString, "", "")
+			if err != nil {
+				return err
+			}
+			svcAcctPerms, err := queryiam.QueryResourcePermissions(
+				testablePerms,
+				resourceString,
+				queryPermsCmdConfig.ServiceAccountEmail,
+				queryPermsCmdConfig.Reason,
+			)
+			if err != nil {
+				return err
+			}
+			return printPermissionsDiff(
+				resourceString,
+				util.Uniq(testablePerms),
+				makePermsMap(userPerms),
+				makePermsMap(svcAcctPerms),
+				userAcct,
+				queryPermsCmdConfig.ServiceAccountEmail,
+			)
+		},
+	}
+
+	options.AddProjectFlag(cmd.Flags(), &queryPermsCmdConfig.Project, false)
+	options.AddServiceAccountEmailFlag(cmd.Flags(), &queryPermsCmdConfig.ServiceAccountEmail, true)
+	options.AddReasonFlag(cmd.Flags(), &queryPermsCmdConfig.Reason, false)
+
+	return cmd
+}
+
+func newCmdQueryPermissionsExplain() *cobra.Command {
+	var resourceString string
+	cmd := &cobra.Command{
+		Use:   "explain [PERMISSION]",
+		Short: "Show which of your role bindings grant a permission",
+		Long: dedent.Dedent(`
+			Show which role bindings grant you a permission on a resource, which member of
+			each binding you are granted it through, e.g. a group that you belong to, and
+			which resource the binding is inherited from.
+			
+			The bindings are found with the Policy Troubleshooter API, which requires the
+			permissions to read the IAM policies of the resource and its ancestors. The
+			resource is given by its full resource name with the --resource flag, and the
+			project is used if it isn't set. Set --service-account-email to explain the
+			permission of a service account instead.
+		`),
+		Example: dedent.Dedent(`
+			  eiam query-permissions explain resourcemanager.projects.setIamPolicy
+			
+			  eiam query-permissions explain storage.objects.get \
+			    --resource //storage.googleapis.com/projects/_/buckets/my-bucket
+			
+			  eiam query-permissions explain pubsub.topics.publish \
+			    --resource //pubsub.googleapis.com/projects/my-project/topics/my-topic \
+			    --service-account-email example@my-project.iam.gserviceaccount.com
+		`),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return argsError(fmt.Errorf("expected exactly one permission, got %d", len(args)))
+			}
+			return nil
+		},
+		PreRun: func(cmd *cobra.Command, args []string) {
+			if resourceString == "" {
+				resourceString = fmt.Sprintf(projectsRes, queryPermsCmdConfig.Project)
+			}
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			principal := queryPermsCmdConfig.ServiceAccountEmail
+			if principal == "" {
+				userAcct, err := gcpclient.CheckActiveAccountSet()
+				if err != nil {
+					return err
+				}
+				principal = userAcct
+			}
+			util.Logger.Infof("Explaining %s on %s", args[0], resourceString)
+			explanation, err := queryiam.ExplainPermission(principal, resourceString, args[0])
+			if err != nil {
+				return err
+			}
+			return printExplanation(explanation)
+		},
+	}
+
+	cmd.Flags().StringVar(&resourceString, "resource", "", "The full resource name of the resource to explain the permission on")
+	options.AddProjectFlag(cmd.Flags(), &queryPermsCmdConfig.Project, false)
+	options.AddServiceAccountEmailFlag(cmd.Flags(), &queryPermsCmdConfig.ServiceAccountEmail, false)
+
+	return cmd
+}
+
+func newCmdQueryFolderPermissions() *cobra.Command {
+	var resourceString string
+	cmd := &cobra.Command{
+		Use:   "folder",
+		Short: "Query the permissions you are granted at the folder level",
+		Example: dedent.Dedent(`
+			  eiam query-permissions folder --folder 123456789012
+			
+			  eiam query-permissions folder --folder 123456789012 \
+			    --service-account-email example@my-project.iam.gserviceaccount.com
+		`),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := options.CheckRequired(cmd.Flags()); err != nil {
+				return err
+			}
+			queryPermsCmdConfig.Folder = strings.TrimPrefix(queryPermsCmdConfig.Folder, "folders/")
+			resourceString = fmt.Sprintf(foldersRes, queryPermsCmdConfig.Folder)
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			util.Logger.Infof("Querying permissions granted on %s", resourceString)
+			testablePerms, err := queryiam.QueryTestablePermissionsOnResource(resourceString)
+			if err != nil {
+				return err
+			}
+			userPerms, err := queryiam.QueryFolderPermissions(
+				testablePerms,
+				queryPermsCmdConfig.Folder,
+				queryPermsCmdConfig.ServiceAccountEmail,
+				queryPermsCmdConfig.Reason,
+			)
+			if err != nil {
+				return err
+			}
+			if queryPermsCmdConfig.ServiceAccountEmail != "" {
+				return printPermissions(resourceString, util.Uniq(testablePerms), userPerms, queryPermsCmdConfig.ServiceAccountEmail)
+			}
+			userAcct, err := gcpclient.CheckActiveAccountSet()
+			if err != nil {
+				return err
+			}
+			return printPermissions(resourceString, util.Uniq(testablePerms), userPerms, userAcct)
+		},
+	}
+
+	options.AddFolderFlag(cmd.Flags(), &queryPermsCmdConfig.Folder, true)
+	options.AddServiceAccountEmailFlag(cmd.Flags(), &queryPermsCmdConfig.ServiceAccountEmail, false)
+	options.AddReasonFlag(cmd.Flags(), &queryPermsCmdConfig.Reason, false)
+
+	return cmd
+}
+
+func newCmdQueryOrganizationPermissions() *cobra.Command {
+	var resourceString string
+	cmd := &cobra.Command{
+		Use:   "organization",
+		Short: "Query the permissions you are granted at the organization level",
+		Example: dedent.Dedent(`
+			  eiam query-permissions organization --organization 123456789012
+			
+			  eiam query-permissions organization --organization 123456789012 \
+			    --service-account-email example@my-project.iam.gserviceaccount.com
+		`),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := options.CheckRequired(cmd.Flags()); err != nil {
+				return err
+			}
+			queryPermsCmdConfig.Organization = strings.TrimPrefix(queryPermsCmdConfig.Organization, "organizations/")
+			resourceString = fmt.Sprintf(organizationsRes, queryPermsCmdConfig.Organization)
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			util.Logger.Infof("Querying permissions granted on %s", resourceString)
+			testablePerms, err := queryiam.QueryTestablePermissionsOnResource(resourceString)
+			if err != nil {
+				return err
+			}
+			userPerms, err := queryiam.QueryOrganizationPermissions(
+				testablePerms,
+				queryPermsCmdConfig.Organization,
+				queryPermsCmdConfig.ServiceAccountEmail,
+				queryPermsCmdConfig.Reason,
+			)
+			if err != nil {
+				return err
+			}
+			if queryPermsCmdConfig.ServiceAccountEmail != "" {
+				return printPermissions(resourceString, util.Uniq(testablePerms), userPerms, queryPermsCmdConfig.ServiceAccountEmail)
+			}
+			userAcct, err := gcpclient.CheckActiveAccountSet()
+			if err != nil {
+				return err
+			}
+			return printPermissions(resourceString, util.Uniq(testablePerms), userPerms, userAcct)
+		},
+	}
+
+	options.AddOrganizationFlag(cmd.Flags(), &queryPermsCmdConfig.Organization, true)
+	options.AddServiceAccountEmailFlag(cmd.Flags(), &queryPermsCmdConfig.ServiceAccountEmail, false)
+	options.AddReasonFlag(cmd.Flags(), &queryPermsCmdConfig.Reason, false)
+
+	return cmd
+}
+
 func newCmdQueryProjectPermissions() *cobra.Command {
 	var resourceString string
 	cmd := &cobra.Command{
@@ -201,13 +465,13 @@ func newCmdQueryProjectPermissions() *cobra.Command {
 				return err
 			}
 			if queryPermsCmdConfig.ServiceAccountEmail != "" {
-				return printPermissions(util.Uniq(testablePerms), userPerms, queryPermsCmdConfig.ServiceAccountEmail)
+				return printPermissions(resourceString, util.Uniq(testablePerms), userPerms, queryPermsCmdConfig.ServiceAccountEmail)
 			}
 			userAcct, err := gcpclient.CheckActiveAccountSet()
 			if err != nil {
 				return err
 			}
-			return printPermissions(util.Uniq(testablePerms), userPerms, userAcct)
+			return printPermissions(resourceString, util.Uniq(testablePerms), userPerms, userAcct)
 		},
 	}
 
@@ -253,13 +517,13 @@ func newCmdQueryPubSubPermissions() *cobra.Command {
 				return err
 			}
 			if queryPermsCmdConfig.ServiceAccountEmail != "" {
-				return printPermissions(util.Uniq(testablePerms), userPerms, queryPermsCmdConfig.ServiceAccountEmail)
+				return printPermissions(resourceString, util.Uniq(testablePerms), userPerms, queryPermsCmdConfig.ServiceAccountEmail)
 			}
 			userAcct, err := gcpclient.CheckActiveAccountSet()
 			if err != nil {
 				return err
 			}
-			return printPermissions(util.Uniq(testablePerms), userPerms, userAcct)
+			return printPermissions(resourceString, util.Uniq(testablePerms), userPerms, userAcct)
 		},
 	}
 
@@ -271,6 +535,77 @@ func newCmdQueryPubSubPermissions() *cobra.Command {
 	return cmd
 }
 
+func newCmdQueryResourcePermissions() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "resource [FULL_RESOURCE_NAME]",
+		Short: "Query the permissions you are granted on any supported resource",
+		Long: dedent.Dedent(`
+			Query the permissions you are granted on a resource by its full resource name.
+			
+			The following resource types are supported:
+			
+				//bigquery.googleapis.com/projects/PROJECT/datasets/DATASET/tables/TABLE
+				//cloudkms.googleapis.com/projects/PROJECT/locations/LOCATION/keyRings/KEY_RING
+				//cloudkms.googleapis.com/projects/PROJECT/locations/LOCATION/keyRings/KEY_RING/cryptoKeys/KEY
+				//cloudresourcemanager.googleapis.com/folders/FOLDER
+				//cloudresourcemanager.googleapis.com/organizations/ORGANIZATION
+				//cloudresourcemanager.googleapis.com/projects/PROJECT
+				//compute.googleapis.com/projects/PROJECT/zones/ZONE/instances/INSTANCE
+				//iam.googleapis.com/projects/PROJECT/serviceAccounts/EMAIL
+				//pubsub.googleapis.com/projects/PROJECT/subscriptions/SUBSCRIPTION
+				//pubsub.googleapis.com/projects/PROJECT/topics/TOPIC
+				//secretmanager.googleapis.com/projects/PROJECT/secrets/SECRET
+				//storage.googleapis.com/projects/_/buckets/BUCKET
+			
+			BigQuery datasets control access with dataset ACLs instead of IAM policies, so
+			their permissions can't be tested.
+		`),
+		Example: dedent.Dedent(`
+			  eiam query-permissions resource //storage.googleapis.com/projects/_/buckets/my-bucket
+			
+			  eiam query-permissions resource \
+			    //secretmanager.googleapis.com/projects/my-project/secrets/my-secret \
+			    --service-account-email example@my-project.iam.gserviceaccount.com
+		`),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return argsError(fmt.Errorf("expected exactly one full resource name, got %d", len(args)))
+			}
+			return queryiam.CheckResourceSupported(args[0])
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			resourceString := args[0]
+			util.Logger.Infof("Querying permissions granted on %s", resourceString)
+			testablePerms, err := queryiam.QueryTestablePermissionsOnResource(resourceString)
+			if err != nil {
+				return err
+			}
+			userPerms, err := queryiam.QueryResourcePermissions(
+				testablePerms,
+				resourceString,
+				queryPermsCmdConfig.ServiceAccountEmail,
+				queryPermsCmdConfig.Reason,
+			)
+			if err != nil {
+				return err
+			}
+			if queryPermsCmdConfig.ServiceAccountEmail != "" {
+				return printPermissions(resourceString, util.Uniq(testablePerms), userPerms, queryPermsCmdConfig.ServiceAccountEmail)
+			}
+			userAcct, err := gcpclient.CheckActiveAccountSet()
+			if err != nil {
+				return err
+			}
+			return printPermissions(resourceString, util.Uniq(testablePerms), userPerms, userAcct)
+		},
+	}
+
+	options.AddServiceAccountEmailFlag(cmd.Flags(), &queryPermsCmdConfig.ServiceAccountEmail, false)
+	options.AddReasonFlag(cmd.Flags(), &queryPermsCmdConfig.Reason, false)
+
+	return cmd
+}
+
 func newCmdQueryServiceAccountPermissions() *cobra.Command {
 	var resourceString string
 	cmd := &cobra.Command{
@@ -301,18 +636,19 @@ func newCmdQueryServiceAccountPermissions() *cobra.Command {
 				testablePerms,
 				queryPermsCmdConfig.Project,
 				queryPermsCmdConfig.ServiceAccountEmail,
+				"", "",
 			)
 			if err != nil {
 				return err
 			}
 			if queryPermsCmdConfig.ServiceAccountEmail != "" {
-				return printPermissions(util.Uniq(testablePerms), userPerms, queryPermsCmdConfig.ServiceAccountEmail)
+				return printPermissions(resourceString, util.Uniq(testablePerms), userPerms, queryPermsCmdConfig.ServiceAccountEmail)
 			}
 			userAcct, err := gcpclient.CheckActiveAccountSet()
 			if err != nil {
 				return err
 			}
-			return printPermissions(util.Uniq(testablePerms), userPerms, userAcct)
+			return printPermissions(resourceString, util.Uniq(testablePerms), userPerms, userAcct)
 		},
 	}
 
@@ -356,13 +692,13 @@ func newCmdQueryStorageBucketPermissions() *cobra.Command {
 				return err
 			}
 			if queryPermsCmdConfig.ServiceAccountEmail != "" {
-				return printPermissions(util.Uniq(testablePerms), userPerms, queryPermsCmdConfig.ServiceAccountEmail)
+				return printPermissions(resourceString, util.Uniq(testablePerms), userPerms, queryPermsCmdConfig.ServiceAccountEmail)
 			}
 			userAcct, err := gcpclient.CheckActiveAccountSet()
 			if err != nil {
 				return err
 			}
-			return printPermissions(util.Uniq(testablePerms), userPerms, userAcct)
+			return printPermissions(resourceString, util.Uniq(testablePerms), userPerms, userAcct)
 		},
 	}
 
@@ -373,8 +709,14 @@ func newCmdQueryStorageBucketPermissions() *cobra.Command {
 	return cmd
 }
 
-func printPermissions(fullPerms, userPerms []string, acctEmail string) error {
+func printPermissions(resource string, fullPerms, userPerms []string, acctEmail string) error {
 	userPermsMap := makePermsMap(userPerms)
+	if !output.IsTable() {
+		return writePermissions(os.Stdout, resource, fullPerms, userPermsMap, acctEmail)
+	}
+	if err := output.CheckFields(&output.Table{Columns: permissionsListColumns}); err != nil {
+		return err
+	}
 	if len(fullPerms) > 100 {
 		// If the list of permissions is really long and the user has the less command
 		// available, pipe the command to less to paginate the output.
@@ -405,25 +747,31 @@ func printPermissions(fullPerms, userPerms []string, acctEmail string) error {
 	return nil
 }
 
+// permissionsListColumns are the columns of the table of whether each
+// permission is granted.
+var permissionsListColumns = []output.Column{
+	{Name: "permission", Header: "AVAILABLE"},
+	{Name: "granted", Header: "GRANTED"},
+}
+
 func printPermissionsList(out io.Writer, fullPerms []string, userPerms map[string]bool, acct string, colorOutput bool) {
 	yes, no := "✔", "✖"
 	if colorOutput {
 		yes, no = green(yes), red(no)
 	}
 
-	var buf bytes.Buffer
-	w := tabwriter.NewWriter(&buf, 0, 4, 4, ' ', 0)
-
-	fmt.Fprintln(w, "AVAILABLE\tGRANTED")
-
+	table := &output.Table{Columns: permissionsListColumns}
 	for _, perm := range fullPerms {
 		if _, ok := userPerms[perm]; ok {
-			fmt.Fprintf(w, "%s\t%s\n", perm, yes)
+			table.Rows = append(table.Rows, []string{perm, yes})
 		} else {
-			fmt.Fprintf(w, "%s\t%s\n", perm, no)
+			table.Rows = append(table.Rows, []string{perm, no})
 		}
 	}
-	w.Flush()
+	// The fields were checked by printPermissions, so the table can't fail to
+	// be written to the buffer.
+	var buf bytes.Buffer
+	_ = output.WriteTable(&buf, table)
 	fmt.Fprintf(out, "\n%s\n\n", buf.String())
 	fmt.Println()
 
@@ -434,6 +782,184 @@ func printPermissionsList(out io.Writer, fullPerms []string, userPerms map[strin
 	}
 }
 
+// printPermissionsDiff lists the permissions that are granted to only one of
+// the user and the service account.
+func printPermissionsDiff(resource string, fullPerms []string, userPerms, svcAcctPerms map[string]bool, userAcct, svcAcct string) error {
+	var gained, lost []string
+	for _, perm := range fullPerms {
+		switch {
+		case svcAcctPerms[perm] && !userPerms[perm]:
+			gained = append(gained, perm)
+		case userPerms[perm] && !svcAcctPerms[perm]:
+			lost = append(lost, perm)
+		}
+	}
+	if !output.IsTable() {
+		return writePermissionsDiff(os.Stdout, resource, gained, lost, userAcct, svcAcct)
+	}
+
+	if len(gained) == 0 && len(lost) == 0 {
+		util.Logger.Infof("%s and %s are granted the same permissions on this resource", userAcct, svcAcct)
+		return nil
+	}
+
+	table := &output.Table{Columns: []output.Column{
+		{Name: "permission", Header: "PERMISSION"},
+		{Name: "change", Header: "CHANGE"},
+	}}
+	for _, perm := range gained {
+		table.Rows = append(table.Rows, []string{perm, green("+ gained")})
+	}
+	for _, perm := range lost {
+		table.Rows = append(table.Rows, []string{perm, red("- lost")})
+	}
+	var buf bytes.Buffer
+	if err := output.WriteTable(&buf, table); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "\n%s\n", buf.String())
+	util.Logger.Infof(
+		"Assuming the privileges of %s gains %d and loses %d of the permissions granted to %s",
+		svcAcct, len(gained), len(lost), userAcct,
+	)
+	return nil
+}
+
+// printExplanation lists the role bindings that grant a permission.
+func printExplanation(explanation *queryiam.PermissionExplanation) error {
+	if !output.IsTable() {
+		table := &output.Table{Columns: []output.Column{
+			{Name: "principal"},
+			{Name: "permission"},
+			{Name: "resource"},
+			{Name: "role"},
+			{Name: "member"},
+			{Name: "condition"},
+			{Name: "access"},
+		}}
+		for _, grant := range explanation.Grants {
+			table.Rows = append(table.Rows, []string{
+				explanation.Principal,
+				explanation.Permission,
+				grant.Resource,
+				grant.Role,
+				grant.Member,
+				grant.Condition,
+				grant.Access,
+			})
+		}
+		return output.Print(explanation, table)
+	}
+
+	switch explanation.Access {
+	case "GRANTED":
+		util.Logger.Infof("%s is granted %s", explanation.Principal, explanation.Permission)
+	case "NOT_GRANTED":
+		util.Logger.Warnf("%s is not granted %s", explanation.Principal, explanation.Permission)
+		return nil
+	default:
+		util.Logger.Warnf(
+			"Whether %s is granted %s can't be fully determined: %s",
+			explanation.Principal, explanation.Permission, explanation.Access,
+		)
+	}
+	if len(explanation.Grants) == 0 {
+		return nil
+	}
+
+	table := &output.Table{Columns: []output.Column{
+		{Name: "role", Header: "ROLE"},
+		{Name: "member", Header: "MEMBER"},
+		{Name: "resource", Header: "INHERITED FROM"},
+		{Name: "condition", Header: "CONDITION"},
+	}}
+	for _, grant := range explanation.Grants {
+		inheritedFrom := ""
+		if grant.Resource != explanation.Resource {
+			inheritedFrom = grant.Resource
+		}
+		condition := grant.Condition
+		if grant.Access == "UNKNOWN_CONDITIONAL" {
+			condition += " (unknown)"
+		}
+		table.Rows = append(table.Rows, []string{grant.Role, grant.Member, inheritedFrom, condition})
+	}
+	var buf bytes.Buffer
+	if err := output.WriteTable(&buf, table); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "\n%s\n", buf.String())
+	return nil
+}
+
+type permissionResult struct {
+	Permission string `json:"permission" yaml:"permission"`
+	Granted    bool   `json:"granted" yaml:"granted"`
+}
+
+type permissionsReport struct {
+	Resource    string             `json:"resource" yaml:"resource"`
+	Member      string             `json:"member" yaml:"member"`
+	Permissions []permissionResult `json:"permissions" yaml:"permissions"`
+}
+
+type permissionsDiffReport struct {
+	Resource       string   `json:"resource" yaml:"resource"`
+	Member         string   `json:"member" yaml:"member"`
+	ServiceAccount string   `json:"serviceAccount" yaml:"serviceAccount"`
+	Gained         []string `json:"gained" yaml:"gained"`
+	Lost           []string `json:"lost" yaml:"lost"`
+}
+
+// writePermissions writes whether each permission is granted in the format set
+// by the -o flag.
+func writePermissions(out io.Writer, resource string, fullPerms []string, userPerms map[string]bool, acct string) error {
+	report := permissionsReport{
+		Resource:    resource,
+		Member:      acct,
+		Permissions: make([]permissionResult, 0, len(fullPerms)),
+	}
+	for _, perm := range fullPerms {
+		report.Permissions = append(report.Permissions, permissionResult{Permission: perm, Granted: userPerms[perm]})
+	}
+	table := &output.Table{Columns: []output.Column{
+		{Name: "resource"},
+		{Name: "member"},
+		{Name: "permission"},
+		{Name: "granted"},
+	}}
+	for _, result := range report.Permissions {
+		table.Rows = append(table.Rows, []string{resource, acct, result.Permission, strconv.FormatBool(result.Granted)})
+	}
+	return output.Write(out, report, table)
+}
+
+// writePermissionsDiff writes the permissions that would be gained and lost in
+// the format set by the -o flag.
+func writePermissionsDiff(out io.Writer, resource string, gained, lost []string, userAcct, svcAcct string) error {
+	report := permissionsDiffReport{
+		Resource:       resource,
+		Member:         userAcct,
+		ServiceAccount: svcAcct,
+		Gained:         append([]string{}, gained...),
+		Lost:           append([]string{}, lost...),
+	}
+	table := &output.Table{Columns: []output.Column{
+		{Name: "resource"},
+		{Name: "member"},
+		{Name: "serviceAccount"},
+		{Name: "permission"},
+		{Name: "change"},
+	}}
+	for _, perm := range gained {
+		table.Rows = append(table.Rows, []string{resource, userAcct, svcAcct, perm, "gained"})
+	}
+	for _, perm := range lost {
+		table.Rows = append(table.Rows, []string{resource, userAcct, svcAcct, perm, "lost"})
+	}
+	return output.Write(out, report, table)
+}
+
 func makePermsMap(perms []string) map[string]bool {
 	m := make(map[string]bool, len(perms))
 	for _, perm := range perms {
@@ -0,0 +1,111 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/proxy"
+)
+
+// proxyEnvVars point gcloud at the auth proxy in privileged sub-shells.
+var proxyEnvVars = []string{"HTTPS_PROXY", "HTTP_PROXY", "https_proxy", "http_proxy", "CLOUDSDK_CORE_CUSTOM_CA_CERTS_FILE"}
+
+// unsetGcloudProxy overrides the auth proxy settings that are written to the
+// gcloud config during a session. gcloud treats empty properties as unset.
+var unsetGcloudProxy = []string{
+	"CLOUDSDK_PROXY_TYPE=",
+	"CLOUDSDK_PROXY_ADDRESS=",
+	"CLOUDSDK_PROXY_PORT=",
+	"CLOUDSDK_CORE_CUSTOM_CA_CERTS_FILE=",
+}
+
+func newCmdReauth() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "reauth",
+		Short: "Renew your application default credentials during a privileged session",
+		Long: dedent.Dedent(`
+			The "reauth" command runs "gcloud auth application-default login" to renew your
+			application default credentials, then tells the running privileged sessions to
+			refresh their access tokens right away.
+
+			Privileged sessions generate new access tokens with your application default
+			credentials before the current ones expire. If your credentials expire or are
+			revoked during a session, the session warns you and the auth proxy answers
+			requests that need a token with an explanation until you run this command. It
+			can be run inside or outside of the privileged sub-shell.`),
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if credFile := viper.GetString(appconfig.AuthCredentialFile); credFile != "" {
+				return fmt.Errorf("eiam authenticates with the credential file %s, renew the credentials that it refers to instead", credFile)
+			}
+
+			gcloud := viper.GetString(appconfig.GcloudPath)
+			c := exec.Command(gcloud, "auth", "application-default", "login", "--no-launch-browser")
+			c.Stdin = os.Stdin
+			c.Stdout = os.Stdout
+			c.Stderr = os.Stderr
+			c.Env = withoutAuthProxy(os.Environ())
+			if err := c.Run(); err != nil {
+				return errorsutil.New("Failed to renew the application default credentials", err)
+			}
+			fmt.Println()
+
+			sessions, err := proxy.Sessions()
+			if err != nil {
+				return err
+			}
+			for _, s := range sessions {
+				if err := s.CredentialsRenewed(); err != nil {
+					util.Logger.WithError(err).Warnf("Failed to refresh the access token of the session for %s", s.ServiceAccount)
+					continue
+				}
+				util.Logger.Infof("Refreshing the access token of the session for %s", s.ServiceAccount)
+			}
+			return nil
+		},
+	}
+	return cmd
+}
+
+// withoutAuthProxy removes the settings that send gcloud's requests through
+// the auth proxy, so that logging in doesn't use the session's access token
+// and saves the credentials to the user's own gcloud config.
+func withoutAuthProxy(env []string) []string {
+	var filtered []string
+	for _, kv := range env {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if util.Contains(proxyEnvVars, name) || strings.HasPrefix(name, "CLOUDSDK_PROXY_") {
+			continue
+		}
+		// The gcloud config of a privileged sub-shell is removed when the
+		// session ends, so credentials must not be saved to it.
+		if name == "CLOUDSDK_CONFIG" && proxy.IsGcloudSandbox(strings.TrimPrefix(kv, name+"=")) {
+			continue
+		}
+		filtered = append(filtered, kv)
+	}
+	return append(filtered, unsetGcloudProxy...)
+}
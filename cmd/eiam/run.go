@@ -0,0 +1,177 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/proxy"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+var (
+	runCmdArgs   []string
+	runCmdConfig options.CmdConfig
+
+	// systemCABundles are where Linux distributions keep the bundle of
+	// trusted CA certificates, in the order that Go looks for them.
+	systemCABundles = []string{
+		"/etc/ssl/certs/ca-certificates.crt",
+		"/etc/pki/tls/certs/ca-bundle.crt",
+		"/etc/ssl/ca-bundle.pem",
+		"/etc/pki/tls/cacert.pem",
+		"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+		"/etc/ssl/cert.pem",
+	}
+)
+
+func newCmdRun() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "run [flags] -- COMMAND [ARGS]",
+		Short: "Run any command with the permissions of the specified service account",
+		Long: dedent.Dedent(`
+			The "run" command runs a command that eiam doesn't wrap, such as pulumi or your own
+			services, with the permissions of the specified service account. The command runs in
+			a short privileged session, with the environment variables that point it at the auth
+			proxy and trust its CA certificate, and the service account's access token in
+			GOOGLE_OAUTH_ACCESS_TOKEN. The session ends when the command exits.
+
+			The access token in GOOGLE_OAUTH_ACCESS_TOKEN isn't refreshed, but the auth proxy
+			replaces it with the session's current token in the requests that go through it.
+
+			SSL_CERT_FILE is set to a bundle of the system's CA certificates and the auth proxy
+			CA, which Go programs and OpenSSL read on Linux. Other tools may need to be configured
+			to trust the auth proxy CA themselves.`),
+		Example: dedent.Dedent(`
+			eiam run -s deployer@my-project.iam.gserviceaccount.com -R "Deploy (JIRA-1234)" \
+			  -- pulumi up --yes
+
+			eiam run --service-account-email reader@my-project.iam.gserviceaccount.com \
+			  --reason "Debugging for (JIRA-1234)" -- go run ./cmd/server`),
+		Args: cobra.MinimumNArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			// Most tools can't use an auth proxy on a Unix socket.
+			if proxy.SocketPath() != "" {
+				return argsError(fmt.Errorf("the run command can't be used when %s is set", appconfig.AuthProxySocketPath))
+			}
+			if err := options.CheckRequired(cmd.Flags()); err != nil {
+				return err
+			}
+			if err := options.CheckServiceAccount(runCmdConfig.ServiceAccountEmail); err != nil {
+				return err
+			}
+			if err := options.CheckDelegates(runCmdConfig.Delegates); err != nil {
+				return err
+			}
+			if err := options.CheckLifetime(runCmdConfig.TokenLifetime); err != nil {
+				return err
+			}
+
+			runCmdArgs = args
+			if err := options.CheckReason(runCmdConfig.Reason); err != nil {
+				return err
+			}
+			if err := util.FormatReason(&runCmdConfig.Reason); err != nil {
+				return err
+			}
+
+			if !options.YesOption {
+				util.Confirm(map[string]string{
+					"Project":         runCmdConfig.Project,
+					"Service Account": runCmdConfig.ServiceAccountEmail,
+					"Delegates":       strings.Join(runCmdConfig.Delegates, ", "),
+					"Reason":          runCmdConfig.Reason,
+					"Command":         util.JoinArgs(runCmdArgs),
+				})
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runRunCommand()
+		},
+	}
+
+	options.AddServiceAccountEmailFlag(cmd.Flags(), &runCmdConfig.ServiceAccountEmail, true)
+	options.AddReasonFlag(cmd.Flags(), &runCmdConfig.Reason, true)
+	options.AddProjectFlag(cmd.Flags(), &runCmdConfig.Project, false)
+	options.AddDelegatesFlag(cmd.Flags(), &runCmdConfig.Delegates)
+	options.AddLifetimeFlag(cmd.Flags(), &runCmdConfig.TokenLifetime)
+
+	return cmd
+}
+
+func runRunCommand() error {
+	return runInSession(&runCmdConfig, runCmdArgs[0], runCmdArgs[1:], func(_, _, accessToken string) ([]string, func(), error) {
+		cleanup := func() {}
+		bundle, err := writeCABundle()
+		if err != nil {
+			return nil, nil, err
+		}
+		if bundle != "" {
+			os.Setenv("SSL_CERT_FILE", bundle)
+			cleanup = func() { os.Remove(bundle) }
+		}
+		// The command inherits the environment of eiam.
+		os.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", accessToken)
+		return runCmdArgs, cleanup, nil
+	})
+}
+
+// writeCABundle writes a temporary bundle of the CA certificates that are
+// trusted already and the auth proxy CA, so that hosts that the auth proxy
+// tunnels are still trusted. It returns "" if no CA bundle is found.
+func writeCABundle() (string, error) {
+	var trusted []byte
+	for _, path := range append([]string{os.Getenv("SSL_CERT_FILE")}, systemCABundles...) {
+		if path == "" {
+			continue
+		}
+		if data, err := ioutil.ReadFile(path); err == nil {
+			trusted = data
+			break
+		}
+	}
+	if trusted == nil {
+		util.Logger.Debug("No CA bundle found, SSL_CERT_FILE won't be set")
+		return "", nil
+	}
+	proxyCA, err := ioutil.ReadFile(viper.GetString(appconfig.AuthProxyCertFile))
+	if err != nil {
+		return "", errorsutil.New("Failed to read the auth proxy CA certificate", err)
+	}
+
+	f, err := ioutil.TempFile("", "eiam-ca-bundle-")
+	if err != nil {
+		return "", errorsutil.New("Failed to create the CA bundle", err)
+	}
+	defer f.Close()
+	bundle := bytes.Join([][]byte{bytes.TrimRight(trusted, "\n"), proxyCA}, []byte("\n"))
+	if _, err := f.Write(bundle); err != nil {
+		os.Remove(f.Name())
+		return "", errorsutil.New("Failed to write the CA bundle", err)
+	}
+	return f.Name(), nil
+}
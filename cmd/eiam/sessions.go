@@ -0,0 +1,319 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	"github.com/rigup/ephemeral-iam/internal/output"
+	"github.com/rigup/ephemeral-iam/internal/proxy"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+// sessionFlagUsage describes the --session flag of the commands that use a
+// running privileged session.
+const sessionFlagUsage = "The privileged session to use, as its PID, its auth proxy port, or its service account. " +
+	"Defaults to the session of the current privileged sub-shell, or the only running session"
+
+func newCmdSessions() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sessions",
+		Short: "Manage the running privileged sessions",
+	}
+
+	cmd.AddCommand(newCmdSessionsList())
+	cmd.AddCommand(newCmdSessionsSuspend())
+	cmd.AddCommand(newCmdSessionsResume())
+	cmd.AddCommand(newCmdSessionsKill())
+
+	return cmd
+}
+
+func newCmdSessionsList() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the running privileged sessions",
+		Long: dedent.Dedent(`
+			The "list" command prints the privileged sessions that are running, the address
+			that the auth proxy of each session listens on, and the service account that it
+			impersonates.
+
+			Several sessions can run at the same time, each with its own auth proxy. Use the
+			PID, port, or service account of a session with the --session flag of the
+			"proxy" commands to choose which session they use.
+
+			Sessions suspended with "eiam sessions suspend" are listed after the running
+			sessions in the 'suspended' state, followed by the sessions that are still
+			running after they expired in the 'expired' state, for example because their
+			terminal stopped responding. End those with "eiam sessions kill".`),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if err := cobra.NoArgs(cmd, args); err != nil {
+				return err
+			}
+			return options.CheckOutput()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			sessions, err := proxy.Sessions()
+			if err != nil {
+				return err
+			}
+			suspended, err := proxy.SuspendedSessions()
+			if err != nil {
+				return err
+			}
+			expired, err := proxy.ExpiredSessions()
+			if err != nil {
+				return err
+			}
+			if len(sessions)+len(suspended)+len(expired) == 0 {
+				util.Logger.Info("No privileged sessions are running")
+				if output.IsTable() {
+					return nil
+				}
+			}
+			if err := printSessions(sessions, suspended, expired); err != nil {
+				return err
+			}
+			if len(expired) > 0 {
+				util.Logger.Warnf("%d sessions are still running after they expired, end them with 'eiam sessions kill PID'", len(expired))
+			}
+			return nil
+		},
+	}
+	options.AddOutputFlags(cmd.Flags())
+	return cmd
+}
+
+// The states of the sessions in "eiam sessions list".
+const (
+	sessionRunning   = "running"
+	sessionSuspended = "suspended"
+	sessionExpired   = "expired"
+)
+
+// sessionInfo is a session in the output of "eiam sessions list".
+type sessionInfo struct {
+	// ID is the PID of a running session, or the ID of a suspended one.
+	ID             string     `json:"id"`
+	State          string     `json:"state"`
+	ListeningOn    string     `json:"listeningOn,omitempty"`
+	ServiceAccount string     `json:"serviceAccount"`
+	Project        string     `json:"project,omitempty"`
+	Started        *time.Time `json:"started,omitempty"`
+	Suspended      *time.Time `json:"suspended,omitempty"`
+	Expires        time.Time  `json:"expires"`
+}
+
+// printSessions lists the running sessions, then the suspended ones, then the
+// ones that are still running after they expired.
+func printSessions(sessions []*proxy.Session, suspended []*proxy.SuspendedSession, expired []*proxy.Session) error {
+	var infos []sessionInfo
+	addRunning := func(s *proxy.Session, state string) {
+		listening := s.Address
+		if s.SocketPath != "" {
+			listening = s.SocketPath
+		}
+		started := s.Started
+		infos = append(infos, sessionInfo{
+			ID:             strconv.Itoa(s.PID),
+			State:          state,
+			ListeningOn:    listening,
+			ServiceAccount: s.ServiceAccount,
+			Project:        s.Project,
+			Started:        &started,
+			Expires:        s.Expires,
+		})
+	}
+	for _, s := range sessions {
+		addRunning(s, sessionRunning)
+	}
+	for _, s := range suspended {
+		suspendedAt := s.Suspended
+		infos = append(infos, sessionInfo{
+			ID:             s.ID,
+			State:          sessionSuspended,
+			ServiceAccount: s.ServiceAccount,
+			Project:        s.Project,
+			Suspended:      &suspendedAt,
+			Expires:        s.Expires,
+		})
+	}
+	for _, s := range expired {
+		addRunning(s, sessionExpired)
+	}
+
+	table := &output.Table{Columns: []output.Column{
+		{Name: "id", Header: "ID"},
+		{Name: "state", Header: "STATE"},
+		{Name: "listeningOn", Header: "LISTENING ON"},
+		{Name: "serviceAccount", Header: "SERVICE ACCOUNT"},
+		{Name: "project", Header: "PROJECT"},
+		{Name: "expires", Header: "EXPIRES"},
+	}}
+	for _, info := range infos {
+		table.Rows = append(table.Rows, []string{
+			info.ID,
+			info.State,
+			valueOrDash(info.ListeningOn),
+			info.ServiceAccount,
+			valueOrDash(info.Project),
+			info.Expires.Local().Format(time.Kitchen),
+		})
+	}
+	return output.Print(infos, table)
+}
+
+// valueOrDash returns "-" in place of an empty value in a table.
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func newCmdSessionsSuspend() *cobra.Command {
+	var sessionID string
+	cmd := &cobra.Command{
+		Use:   "suspend",
+		Short: "Suspend a privileged session to resume it later",
+		Long: dedent.Dedent(`
+			The "suspend" command ends a privileged session, but keeps its access token and
+			settings so that it can be resumed later with "eiam sessions resume", for example
+			before closing your laptop.
+
+			The snapshot is encrypted with a key that is stored in the OS keyring, or in a
+			file next to the snapshot that only you can read if the keyring can't be used.
+			The session still ends at the time that it was started with, and the snapshot
+			is removed once that time has passed.
+
+			Sessions started with --exec can't be suspended.`),
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			session, err := findSession(sessionID)
+			if err != nil {
+				return err
+			}
+			id, err := session.Suspend()
+			if err != nil {
+				return err
+			}
+			util.Logger.Infof("Suspended the privileged session for %s, resume it with 'eiam sessions resume %s'", session.ServiceAccount, id)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&sessionID, "session", "", sessionFlagUsage)
+	return cmd
+}
+
+func newCmdSessionsResume() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "resume [ID]",
+		Short: "Resume a suspended privileged session",
+		Long: dedent.Dedent(`
+			The "resume" command starts a privileged session that was suspended with
+			"eiam sessions suspend" again, with the same service account, reason, and
+			settings. The permissions of the service account aren't checked and no approval
+			is requested again, but the second factor is if security.mfa is set.
+
+			ID can be left out when only one session is suspended. A session can only be
+			resumed once, and not after the time that it was started with has passed.`),
+		Example: dedent.Dedent(`
+			eiam sessions suspend
+			eiam sessions resume 3fa9c2d1`),
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var id string
+			if len(args) == 1 {
+				id = args[0]
+			} else {
+				suspended, err := proxy.SuspendedSessions()
+				if err != nil {
+					return err
+				}
+				switch len(suspended) {
+				case 0:
+					return errors.New("no privileged session is suspended")
+				case 1:
+					id = suspended[0].ID
+				default:
+					return argsError(errors.New("more than one privileged session is suspended, choose one by its ID"))
+				}
+			}
+			if err := confirmMFA(); err != nil {
+				return err
+			}
+			return proxy.ResumeSession(id)
+		},
+	}
+	return cmd
+}
+
+func newCmdSessionsKill() *cobra.Command {
+	var force bool
+	cmd := &cobra.Command{
+		Use:   "kill [ID]",
+		Short: "End a running privileged session",
+		Long: dedent.Dedent(`
+			The "kill" command ends a privileged session from outside of it, for example
+			one whose terminal was closed or stopped responding. The session ends the same
+			way as when its sub-shell exits: its auth proxy stops and its role binding and
+			files are removed. Sessions started with --exec stop their command.
+
+			ID is the PID, auth proxy port, or service account of the session, and can be
+			left out when only one session is running. Sessions that are still running
+			after they expired can be killed too.
+
+			If the auth proxy of the session doesn't respond, --force stops the process of
+			the session instead and removes its role binding and files.`),
+		Example: dedent.Dedent(`
+			eiam sessions list
+			eiam sessions kill 41822`),
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var session *proxy.Session
+			var err error
+			if len(args) == 1 {
+				session, err = proxy.FindKillableSession(args[0])
+			} else {
+				session, err = proxy.CurrentSession()
+			}
+			if err != nil {
+				return err
+			}
+			if err := session.Kill(force); err != nil {
+				return err
+			}
+			util.Logger.Infof("Ended the privileged session for %s (PID %d)", session.ServiceAccount, session.PID)
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&force, "force", false, "Stop the process of the session if its auth proxy doesn't respond")
+	return cmd
+}
+
+// findSession returns the session chosen with --session, or the current
+// session if none was chosen.
+func findSession(id string) (*proxy.Session, error) {
+	if id == "" {
+		return proxy.CurrentSession()
+	}
+	return proxy.FindSession(id)
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	"github.com/rigup/ephemeral-iam/internal/proxy"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+var (
+	sshCmdArgs   []string
+	sshCmdConfig options.CmdConfig
+)
+
+func newCmdSSH() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ssh INSTANCE [GCLOUD_SSH_ARGS] [-- SSH_ARGS]",
+		Short: "SSH to a VM through IAP with the permissions of the specified service account",
+		Long: dedent.Dedent(`
+			The "ssh" command runs "gcloud compute ssh --tunnel-through-iap" with the permissions of
+			the specified service account, so that VMs without an external IP can be reached with
+			the service account's IAP permissions.
+
+			The command runs in a short privileged session: gcloud's API requests and the IAP
+			tunnel's WebSocket both go through the auth proxy, which adds the service account's
+			access token to them. gcloud uses the service account as its account, so on VMs that use
+			OS Login, your SSH key is added to the service account's login profile. The session ends
+			when ssh exits.`),
+		Example: dedent.Dedent(`
+			eiam ssh bastion-1 --zone us-central1-a \
+			  --service-account-email iap-admin@my-project.iam.gserviceaccount.com \
+			  --reason "Debugging for (JIRA-1234)"
+
+			eiam ssh bastion-1 -z us-central1-a -s iap-admin@my-project.iam.gserviceaccount.com -R "JIRA-1234" \
+			  -- -L 8080:localhost:8080`),
+		Args:               cobra.MinimumNArgs(1),
+		FParseErrWhitelist: cobra.FParseErrWhitelist{UnknownFlags: true},
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			// gcloud can't use an auth proxy on a Unix socket.
+			if proxy.SocketPath() != "" {
+				return argsError(fmt.Errorf("the ssh command can't be used when %s is set", appconfig.AuthProxySocketPath))
+			}
+			if err := options.CheckRequired(cmd.Flags()); err != nil {
+				return err
+			}
+			if err := options.CheckServiceAccount(sshCmdConfig.ServiceAccountEmail); err != nil {
+				return err
+			}
+			if err := options.CheckDelegates(sshCmdConfig.Delegates); err != nil {
+				return err
+			}
+			if err := options.CheckLifetime(sshCmdConfig.TokenLifetime); err != nil {
+				return err
+			}
+
+			sshCmdArgs = util.ExtractUnknownArgs(cmd.Flags(), os.Args)
+			if err := options.CheckReason(sshCmdConfig.Reason); err != nil {
+				return err
+			}
+			if err := util.FormatReason(&sshCmdConfig.Reason); err != nil {
+				return err
+			}
+
+			if !options.YesOption {
+				util.Confirm(map[string]string{
+					"Project":         sshCmdConfig.Project,
+					"Service Account": sshCmdConfig.ServiceAccountEmail,
+					"Delegates":       strings.Join(sshCmdConfig.Delegates, ", "),
+					"Zone":            sshCmdConfig.Zone,
+					"Reason":          sshCmdConfig.Reason,
+					"Command":         fmt.Sprintf("gcloud compute ssh %s", strings.Join(sshCmdArgs, " ")),
+				})
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runSSHCommand()
+		},
+	}
+
+	options.AddServiceAccountEmailFlag(cmd.Flags(), &sshCmdConfig.ServiceAccountEmail, true)
+	options.AddReasonFlag(cmd.Flags(), &sshCmdConfig.Reason, true)
+	options.AddProjectFlag(cmd.Flags(), &sshCmdConfig.Project, false)
+	options.AddZoneFlag(cmd.Flags(), &sshCmdConfig.Zone, false)
+	options.AddDelegatesFlag(cmd.Flags(), &sshCmdConfig.Delegates)
+	options.AddLifetimeFlag(cmd.Flags(), &sshCmdConfig.TokenLifetime)
+
+	return cmd
+}
+
+func runSSHCommand() error {
+	return runInSession(&sshCmdConfig, "gcloud compute ssh", sshCmdArgs, func(_, _, accessToken string) ([]string, func(), error) {
+		tokenFile, err := writeTokenFile(accessToken)
+		if err != nil {
+			return nil, nil, err
+		}
+		// gcloud adds the SSH key to the OS Login profile of its account, and
+		// doesn't need credentials for the account when it is given a token.
+		// The auth proxy replaces the token with the session's current one.
+		os.Setenv("CLOUDSDK_CORE_ACCOUNT", sshCmdConfig.ServiceAccountEmail)
+		os.Setenv("CLOUDSDK_AUTH_ACCESS_TOKEN_FILE", tokenFile)
+
+		flags := []string{"--tunnel-through-iap"}
+		if sshCmdConfig.Zone != "" {
+			flags = append(flags, "--zone", sshCmdConfig.Zone)
+		}
+		command := append([]string{viper.GetString(appconfig.GcloudPath), "compute", "ssh"}, withFlags(sshCmdArgs, flags...)...)
+		return command, func() { os.Remove(tokenFile) }, nil
+	})
+}
@@ -0,0 +1,183 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+var (
+	terraformCmdArgs   []string
+	terraformCmdConfig options.CmdConfig
+
+	// terraformCredentialEnvVars are the credentials that the Google provider
+	// and the gcs backend read. They are removed so that the provider doesn't
+	// reject the access token as conflicting with them, or impersonate a
+	// service account with it.
+	terraformCredentialEnvVars = []string{
+		"GOOGLE_APPLICATION_CREDENTIALS",
+		"GOOGLE_BACKEND_CREDENTIALS",
+		"GOOGLE_BACKEND_IMPERSONATE_SERVICE_ACCOUNT",
+		"GOOGLE_CLOUD_KEYFILE_JSON",
+		"GOOGLE_CREDENTIALS",
+		"GOOGLE_IMPERSONATE_SERVICE_ACCOUNT",
+		"GCLOUD_KEYFILE_JSON",
+	}
+)
+
+func newCmdTerraform() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "terraform [TERRAFORM_ARGS]",
+		Short: "Run a terraform command with the permissions of the specified service account",
+		Long: dedent.Dedent(`
+			The "terraform" command runs the provided terraform command with the permissions of the
+			specified service account. The Google provider and the gcs backend are given an access
+			token for the service account in the GOOGLE_OAUTH_ACCESS_TOKEN environment variable,
+			and any credentials that they would otherwise use are removed from terraform's
+			environment. Nothing is written to disk, so nothing is left behind when terraform exits.
+
+			The access token isn't refreshed, so "--lifetime" has to be longer than the command
+			takes to run.`),
+		Example: dedent.Dedent(`
+			eiam terraform plan -out plan.tfplan \
+			  --service-account-email terraform@my-project.iam.gserviceaccount.com \
+			  --reason "Deploying the new bucket (JIRA-1234)"
+
+			eiam terraform apply plan.tfplan --lifetime 2h \
+			  -s terraform@my-project.iam.gserviceaccount.com -R "JIRA-1234"`),
+		Args:               cobra.ArbitraryArgs,
+		FParseErrWhitelist: cobra.FParseErrWhitelist{UnknownFlags: true},
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if viper.GetString(appconfig.TerraformPath) == "" {
+				err := errors.New(`"terraform": executable file not found in $PATH`)
+				return errorsutil.New("Failed to run terraform command", err)
+			}
+			if err := options.CheckRequired(cmd.Flags()); err != nil {
+				return err
+			}
+			if err := options.CheckServiceAccount(terraformCmdConfig.ServiceAccountEmail); err != nil {
+				return err
+			}
+			if err := options.CheckDelegates(terraformCmdConfig.Delegates); err != nil {
+				return err
+			}
+			if err := options.CheckLifetime(terraformCmdConfig.TokenLifetime); err != nil {
+				return err
+			}
+			// A project that terraform is already configured with takes
+			// precedence over the active gcloud project.
+			if googleProject := os.Getenv("GOOGLE_PROJECT"); googleProject != "" && !cmd.Flags().Changed(options.ProjectFlag.Name) {
+				terraformCmdConfig.Project = googleProject
+			}
+
+			terraformCmdArgs = util.ExtractUnknownArgs(cmd.Flags(), os.Args)
+			if err := options.CheckReason(terraformCmdConfig.Reason); err != nil {
+				return err
+			}
+			if err := util.FormatReason(&terraformCmdConfig.Reason); err != nil {
+				return err
+			}
+
+			if !options.YesOption {
+				util.Confirm(map[string]string{
+					"Project":         terraformCmdConfig.Project,
+					"Service Account": terraformCmdConfig.ServiceAccountEmail,
+					"Delegates":       strings.Join(terraformCmdConfig.Delegates, ", "),
+					"Reason":          terraformCmdConfig.Reason,
+					"Command":         fmt.Sprintf("terraform %s", strings.Join(terraformCmdArgs, " ")),
+				})
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runTerraformCommand()
+		},
+	}
+
+	options.AddServiceAccountEmailFlag(cmd.Flags(), &terraformCmdConfig.ServiceAccountEmail, true)
+	options.AddReasonFlag(cmd.Flags(), &terraformCmdConfig.Reason, true)
+	options.AddProjectFlag(cmd.Flags(), &terraformCmdConfig.Project, false)
+	options.AddDelegatesFlag(cmd.Flags(), &terraformCmdConfig.Delegates)
+	options.AddLifetimeFlag(cmd.Flags(), &terraformCmdConfig.TokenLifetime)
+
+	return cmd
+}
+
+func runTerraformCommand() error {
+	if err := checkCanImpersonate(terraformCmdConfig.Project, terraformCmdConfig.ServiceAccountEmail, terraformCmdConfig.Delegates); err != nil {
+		return err
+	}
+	if err := confirmMFA(); err != nil {
+		return err
+	}
+	fullCmd := fmt.Sprintf("terraform %s", strings.Join(terraformCmdArgs, " "))
+	if err := requestApproval(&terraformCmdConfig, fullCmd, terraformCmdConfig.TokenLifetime); err != nil {
+		return err
+	}
+
+	util.Logger.Infof("Fetching access token for %s", terraformCmdConfig.ServiceAccountEmail)
+	accessToken, err := gcpclient.GenerateTemporaryAccessToken(
+		terraformCmdConfig.ServiceAccountEmail,
+		terraformCmdConfig.Reason,
+		terraformCmdConfig.TokenLifetime,
+		terraformCmdConfig.Delegates,
+	)
+	if err != nil {
+		return err
+	}
+
+	c := exec.Command(viper.GetString(appconfig.TerraformPath), terraformCmdArgs...)
+	c.Env = terraformEnv(os.Environ(), accessToken.GetAccessToken())
+
+	util.Logger.Infof("Running: [%s]\n\n", fullCmd)
+	return runForeground(c, fullCmd)
+}
+
+// terraformEnv returns the environment that terraform runs with: the access
+// token replaces any other credentials, and the reason is sent in the
+// X-Goog-Request-Reason header of the provider's API requests.
+func terraformEnv(env []string, accessToken string) []string {
+	var filtered []string
+	for _, kv := range env {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if util.Contains(terraformCredentialEnvVars, name) {
+			util.Logger.Debugf("Removing %s from terraform's environment", name)
+			continue
+		}
+		filtered = append(filtered, kv)
+	}
+	filtered = append(filtered,
+		fmt.Sprintf("GOOGLE_OAUTH_ACCESS_TOKEN=%s", accessToken),
+		fmt.Sprintf("CLOUDSDK_CORE_REQUEST_REASON=%s", terraformCmdConfig.Reason),
+	)
+	if terraformCmdConfig.Project != "" {
+		filtered = append(filtered, fmt.Sprintf("GOOGLE_PROJECT=%s", terraformCmdConfig.Project))
+	}
+	return filtered
+}
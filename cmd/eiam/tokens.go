@@ -0,0 +1,152 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+)
+
+func newCmdTokens() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "tokens",
+		Short: "Inspect access tokens and ID tokens",
+	}
+
+	cmd.AddCommand(newCmdTokensDescribe())
+
+	return cmd
+}
+
+func newCmdTokensDescribe() *cobra.Command {
+	var (
+		asJSON    bool
+		sessionID string
+	)
+	cmd := &cobra.Command{
+		Use:   "describe [TOKEN]",
+		Short: "Show the principal, scopes, and expiry of a token",
+		Long: dedent.Dedent(`
+			The "describe" command prints the principal that a token was issued to, along
+			with its audience, scopes, and expiry.
+
+			Without a TOKEN, the command describes the access token of the running
+			privileged session. The auth proxy describes the token itself, so the token
+			never leaves the session. When more than one session is running, choose one
+			with --session.
+
+			Pass "-" as the TOKEN to read it from stdin. ID tokens, like those written by
+			"generate-id-token", are decoded locally and their signatures are not verified.
+			Access tokens are described by Google's tokeninfo endpoint.`),
+		Example: dedent.Dedent(`
+			eiam tokens describe
+			eiam tokens describe --json
+			eiam generate-id-token -s $SA -R $REASON --audience $URL | eiam tokens describe -`),
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var (
+				info *gcpclient.TokenInfo
+				err  error
+			)
+			if len(args) == 0 {
+				session, err := findSession(sessionID)
+				if err != nil {
+					return err
+				}
+				if info, err = session.TokenInfo(); err != nil {
+					return err
+				}
+			} else {
+				token := args[0]
+				if token == "-" {
+					if token, err = readToken(); err != nil {
+						return err
+					}
+				}
+				if info, err = gcpclient.DescribeToken(token); err != nil {
+					return err
+				}
+			}
+
+			if asJSON {
+				out, err := json.MarshalIndent(info, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(out))
+				return nil
+			}
+			printTokenInfo(info)
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Write the token info to stdout as JSON")
+	cmd.Flags().StringVar(&sessionID, "session", "", sessionFlagUsage)
+	return cmd
+}
+
+// readToken reads a token from the first line of stdin.
+func readToken() (string, error) {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	token := strings.TrimSpace(line)
+	if token == "" {
+		if err == nil {
+			err = fmt.Errorf("the token is empty")
+		}
+		return "", errorsutil.New("Failed to read the token from stdin", err)
+	}
+	return token, nil
+}
+
+func printTokenInfo(info *gcpclient.TokenInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 4, ' ', 0)
+	fmt.Fprintf(w, "Type\t%s\n", info.Type)
+	fmt.Fprintf(w, "Principal\t%s\n", info.Principal())
+	if info.Audience != "" {
+		fmt.Fprintf(w, "Audience\t%s\n", info.Audience)
+	}
+	if info.AuthorizedParty != "" && info.AuthorizedParty != info.Audience {
+		fmt.Fprintf(w, "Authorized party\t%s\n", info.AuthorizedParty)
+	}
+	if info.Issuer != "" {
+		fmt.Fprintf(w, "Issuer\t%s\n", info.Issuer)
+	}
+	if len(info.Scopes) > 0 {
+		fmt.Fprintf(w, "Scopes\t%s\n", strings.Join(info.Scopes, "\n\t"))
+	}
+	if !info.IssuedAt.IsZero() {
+		fmt.Fprintf(w, "Issued\t%s\n", info.IssuedAt.Local().Format(time.RFC1123))
+	}
+	if !info.Expires.IsZero() {
+		expires := info.Expires.Local().Format(time.RFC1123)
+		if remaining := time.Until(info.Expires).Truncate(time.Second); remaining > 0 {
+			fmt.Fprintf(w, "Expires\t%s (%s remaining)\n", expires, remaining)
+		} else {
+			fmt.Fprintf(w, "Expires\t%s (expired)\n", expires)
+		}
+	}
+	w.Flush()
+}
@@ -0,0 +1,199 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+	"github.com/rigup/ephemeral-iam/internal/proxy"
+)
+
+// identity is the output of the whoami command.
+type identity struct {
+	Account      string         `json:"account"`
+	ADCSource    string         `json:"adcSource,omitempty"`
+	ADCPrincipal string         `json:"adcPrincipal,omitempty"`
+	InSubShell   bool           `json:"inPrivilegedSubShell"`
+	Session      *whoamiSession `json:"session,omitempty"`
+	Project      string         `json:"project,omitempty"`
+	Region       string         `json:"region,omitempty"`
+	Zone         string         `json:"zone,omitempty"`
+}
+
+// whoamiSession is the part of a privileged session that whoami reports.
+type whoamiSession struct {
+	PID            int       `json:"pid"`
+	ServiceAccount string    `json:"serviceAccount"`
+	Subject        string    `json:"subject,omitempty"`
+	Delegates      []string  `json:"delegates,omitempty"`
+	Expires        time.Time `json:"expires"`
+}
+
+func newCmdWhoami() *cobra.Command {
+	var (
+		asJSON    bool
+		sessionID string
+	)
+	cmd := &cobra.Command{
+		Use:   "whoami",
+		Short: "Show the identity that eiam and gcloud are using",
+		Long: dedent.Dedent(`
+			The "whoami" command prints the account that you are authenticated as, where
+			the application default credentials come from and who they authenticate as,
+			the service account impersonated by the current privileged session, when the
+			session expires, and the active project, region, and zone.
+
+			Inside a privileged sub-shell, the session of the sub-shell is reported, along
+			with the project that the sub-shell uses. Outside of one, the only running
+			session is reported, or the session chosen with --session.`),
+		Example: dedent.Dedent(`
+			eiam whoami
+			eiam whoami --json`),
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := whoami(sessionID)
+			if err != nil {
+				return err
+			}
+			if asJSON {
+				out, err := json.MarshalIndent(id, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(out))
+				return nil
+			}
+			printIdentity(id)
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Write the identity to stdout as JSON")
+	cmd.Flags().StringVar(&sessionID, "session", "", sessionFlagUsage)
+	return cmd
+}
+
+func whoami(id string) (*identity, error) {
+	account, err := gcpclient.CheckActiveAccountSet()
+	if err != nil {
+		return nil, err
+	}
+	who := &identity{
+		Account:    account,
+		ADCSource:  gcpclient.ADCSource(),
+		InSubShell: os.Getenv(proxy.SessionEnvVar) != "",
+	}
+	if who.ADCSource != "" {
+		if who.ADCPrincipal, err = gcpclient.ADCPrincipal(); err != nil {
+			util.Logger.Warn(err)
+		}
+	}
+
+	session, err := findSession(id)
+	switch {
+	case err == nil:
+		who.Session = &whoamiSession{
+			PID:            session.PID,
+			ServiceAccount: session.ServiceAccount,
+			Subject:        session.Subject,
+			Delegates:      session.Delegates,
+			Expires:        session.Expires,
+		}
+	case errors.Is(err, proxy.ErrNoSession):
+		util.Logger.Debug(err)
+	case id == "":
+		// The session of the sub-shell ended, or one has to be chosen.
+		util.Logger.Warn(err)
+	default:
+		return nil, err
+	}
+
+	// The gcloud properties can be overridden in the environment, which is how
+	// privileged sub-shells set the project.
+	if who.Project, err = gcloudProperty("CLOUDSDK_CORE_PROJECT", gcpclient.GetCurrentProject); err != nil {
+		return nil, err
+	}
+	if who.Region, err = gcloudProperty("CLOUDSDK_COMPUTE_REGION", gcpclient.GetCurrentRegion); err != nil {
+		return nil, err
+	}
+	if who.Zone, err = gcloudProperty("CLOUDSDK_COMPUTE_ZONE", gcpclient.GetCurrentZone); err != nil {
+		return nil, err
+	}
+	if who.Project == "" && session != nil {
+		who.Project = session.Project
+	}
+	return who, nil
+}
+
+// gcloudProperty returns the value of a gcloud property from its environment
+// variable, or from the active gcloud configuration if it isn't set.
+func gcloudProperty(env string, fromConfig func() (string, error)) (string, error) {
+	if val := os.Getenv(env); val != "" {
+		return val, nil
+	}
+	return fromConfig()
+}
+
+func printIdentity(id *identity) {
+	unset := func(val string) string {
+		if val == "" {
+			return "(unset)"
+		}
+		return val
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 4, ' ', 0)
+	fmt.Fprintf(w, "Account\t%s\n", id.Account)
+	if id.ADCSource == "" {
+		fmt.Fprintf(w, "Application default credentials\tnot found\n")
+	} else {
+		fmt.Fprintf(w, "Application default credentials\t%s\n", id.ADCSource)
+		if id.ADCPrincipal != "" && id.ADCPrincipal != id.Account {
+			fmt.Fprintf(w, "ADC principal\t%s\n", id.ADCPrincipal)
+		}
+	}
+	if id.InSubShell {
+		fmt.Fprintf(w, "Privileged sub-shell\tyes\n")
+	} else {
+		fmt.Fprintf(w, "Privileged sub-shell\tno\n")
+	}
+	if id.Session == nil {
+		fmt.Fprintf(w, "Impersonating\t(none)\n")
+	} else {
+		fmt.Fprintf(w, "Impersonating\t%s\n", id.Session.ServiceAccount)
+		if id.Session.Subject != "" {
+			fmt.Fprintf(w, "Acting as\t%s\n", id.Session.Subject)
+		}
+		if len(id.Session.Delegates) > 0 {
+			fmt.Fprintf(w, "Delegates\t%s\n", strings.Join(id.Session.Delegates, ", "))
+		}
+		remaining := time.Until(id.Session.Expires).Truncate(time.Second)
+		fmt.Fprintf(w, "Session expires\t%s (%s remaining)\n", id.Session.Expires.Local().Format(time.RFC1123), remaining)
+	}
+	fmt.Fprintf(w, "Project\t%s\n", unset(id.Project))
+	fmt.Fprintf(w, "Region\t%s\n", unset(id.Region))
+	fmt.Fprintf(w, "Zone\t%s\n", unset(id.Zone))
+	w.Flush()
+}
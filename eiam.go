@@ -15,21 +15,67 @@
 package main
 
 import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+
 	"github.com/rigup/ephemeral-iam/cmd/eiam"
 	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/proxy"
+	"github.com/rigup/ephemeral-iam/pkg/options"
 )
 
 func main() {
 	errorsutil.CheckError(appconfig.InitConfig())
-	errorsutil.CheckError(appconfig.Setup())
+	// Shells run eiam to complete each word of a command line, so completions
+	// skip the checks below, which are slow or prompt the user.
+	completing := runningCommand("completion") ||
+		runningCommand(cobra.ShellCompRequestCmd) ||
+		runningCommand(cobra.ShellCompNoDescRequestCmd)
+	if err := appconfig.ValidateConfig(); err != nil {
+		// Only warn for the config commands so they can be used to fix the problem.
+		if runningCommand("config") {
+			util.Logger.Warn(err)
+		} else {
+			errorsutil.CheckError(errorsutil.New("Invalid configuration", err))
+		}
+	}
+	// Walk new users through the configuration instead of silently using the
+	// detected values, unless they're already running the setup command.
+	if !completing && appconfig.FirstRun() && term.IsTerminal(int(os.Stdin.Fd())) && !runningCommand("config", "setup") {
+		errorsutil.CheckError(eiam.RunConfigSetup())
+	}
+	// The doctor command reports problems with the environment itself instead of
+	// failing before it can run, and the reauth command renews the credentials
+	// that the setup checks.
+	if !completing && !runningCommand("config", "doctor") && !runningCommand("reauth") {
+		errorsutil.CheckError(appconfig.Setup())
+	}
 
-	if appconfig.Version != "v0.0.0" {
+	if !completing && appconfig.Version != "v0.0.0" {
 		appconfig.CheckForNewRelease()
 	}
+	// Restore what privileged sessions that crashed left behind, such as
+	// their role bindings, before anything else uses the sessions.
+	if !completing {
+		proxy.CleanUpCrashedSessions()
+	}
 
 	rootCmd, err := eiam.NewEphemeralIamCommand()
 	errorsutil.CheckError(err)
+	// Record the command in the audit history however it exits, including
+	// when it fails with a fatal error.
+	if !completing {
+		exit := util.Logger.ExitFunc
+		util.Logger.ExitFunc = func(code int) {
+			eiam.RecordCommand(code)
+			exit(code)
+		}
+		defer eiam.RecordCommand(0)
+	}
 	// Kill the loaded plugin clients. This is happening here to ensure that
 	// Kill is called after the command has finished running, but also accounts
 	// for any errors that occur during execution.
@@ -38,3 +84,18 @@ func main() {
 	}
 	errorsutil.CheckError(rootCmd.Execute())
 }
+
+// runningCommand reports whether the command line starts with the given
+// command names. Global flags, such as -v or --config, can come before them.
+func runningCommand(names ...string) bool {
+	args := options.StripGlobalFlags(os.Args[1:])
+	if len(args) < len(names) {
+		return false
+	}
+	for i, name := range names {
+		if args[i] != name {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiamplugin
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// ExpandAliases replaces an alias at the start of the command line with the
+// eiam command line that it is set to in the aliases config section. Any
+// remaining arguments are added after the expanded command line. os.Args is
+// updated so the expanded command is the one that gets dispatched.
+//
+// Aliases are only expanded once, so an alias can't refer to another alias,
+// and an alias can't override a command with the same name.
+func (rc *RootCommand) ExpandAliases() error {
+	args, err := rc.expandAlias(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	if rc.expandedAlias != "" {
+		rc.unexpandedArgs = append([]string{}, os.Args...)
+	}
+	os.Args = append(os.Args[:1], args...)
+	return nil
+}
+
+// IgnorePluginAlias undoes the expansion of an alias that has the same name as
+// a plugin. Plugins aren't known until they are loaded, which happens after
+// aliases are expanded, so the plugins are loaded again with the original
+// command line.
+func (rc *RootCommand) IgnorePluginAlias() error {
+	name := rc.expandedAlias
+	if name == "" || !rc.isPlugin(name) {
+		return nil
+	}
+	util.Logger.Warnf("The %s alias is ignored because there is a plugin with the same name", name)
+	os.Args = rc.unexpandedArgs
+	rc.expandedAlias = ""
+	for _, p := range rc.Plugins {
+		p.Client.Kill()
+	}
+	rc.RemoveCommand(rc.pluginCommands()...)
+	rc.Plugins = nil
+	return rc.LoadPlugins()
+}
+
+func (rc *RootCommand) expandAlias(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return args, nil
+	}
+	aliases := viper.GetStringMapString(appconfig.Aliases)
+	// Config keys are case insensitive.
+	name := strings.ToLower(args[0])
+	expansion, ok := aliases[name]
+	if !ok {
+		return args, nil
+	}
+	if rc.isCommand(name) {
+		util.Logger.Warnf("The %s alias is ignored because there is a command with the same name", name)
+		return args, nil
+	}
+
+	expanded, err := util.SplitArgs(expansion)
+	if err != nil {
+		return nil, errorsutil.New(fmt.Sprintf("Failed to expand the %s alias", name), err)
+	}
+	util.Logger.Debugf("Expanding the %s alias to: %s", name, expansion)
+	rc.expandedAlias = name
+	return append(expanded, args[1:]...), nil
+}
+
+func (rc *RootCommand) isPlugin(name string) bool {
+	for _, cmd := range rc.pluginCommands() {
+		if cmd.Name() == name || cmd.HasAlias(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rc *RootCommand) pluginCommands() []*cobra.Command {
+	var cmds []*cobra.Command
+	for _, cmd := range rc.Commands() {
+		for _, p := range rc.Plugins {
+			if cmd.Name() == p.Name {
+				cmds = append(cmds, cmd)
+			}
+		}
+	}
+	return cmds
+}
+
+func (rc *RootCommand) isCommand(name string) bool {
+	if name == "help" {
+		return true
+	}
+	for _, cmd := range rc.Commands() {
+		if cmd.Name() == name || cmd.HasAlias(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiamplugin
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	"github.com/rigup/ephemeral-iam/internal/plugins"
+)
+
+func TestExpandAlias(t *testing.T) {
+	util.Logger = util.NewLogger()
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set(appconfig.Aliases, map[string]interface{}{
+		"prod-deploy": `assume-privileges -s deployer@prod.iam.gserviceaccount.com --reason "Deploying to prod"`,
+		"version":     "config view logging.level",
+		"broken":      `gcloud --reason "unterminated`,
+	})
+	rc := &RootCommand{}
+	rc.AddCommand(&cobra.Command{Use: "version"})
+
+	tests := []struct {
+		args    []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			args: []string{"prod-deploy", "-y"},
+			want: []string{"assume-privileges", "-s", "deployer@prod.iam.gserviceaccount.com", "--reason", "Deploying to prod", "-y"},
+		},
+		// Commands can't be overridden.
+		{args: []string{"version"}, want: []string{"version"}},
+		{args: []string{"gcloud", "prod-deploy"}, want: []string{"gcloud", "prod-deploy"}},
+		{args: []string{}, want: []string{}},
+		{args: []string{"broken"}, wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := rc.expandAlias(tc.args)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("expected an error expanding %v, got %v", tc.args, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error expanding %v: %v", tc.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("expected %v to expand to %v, got %v", tc.args, tc.want, got)
+		}
+	}
+}
+
+func TestIsPlugin(t *testing.T) {
+	rc := &RootCommand{
+		Plugins: []*plugins.EphemeralIamPlugin{{Name: "deploy"}},
+	}
+	rc.AddCommand(&cobra.Command{Use: "deploy"}, &cobra.Command{Use: "version"})
+
+	if !rc.isPlugin("deploy") {
+		t.Error("expected deploy to be a plugin")
+	}
+	if rc.isPlugin("version") {
+		t.Error("expected version not to be a plugin")
+	}
+	if got := rc.pluginCommands(); len(got) != 1 || got[0].Name() != "deploy" {
+		t.Errorf("expected only the deploy command, got %v", got)
+	}
+}
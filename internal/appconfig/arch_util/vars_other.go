@@ -12,12 +12,13 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// +build !darwin,!linux,!amd64
+// +build !darwin,!linux,!windows
 
 package archutil
 
 const (
 	FormattedOS = ""
+	ConfigPath  = ".config/ephemeral-iam"
 )
 
 var configDir = ""
@@ -20,8 +20,12 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 
 	archutil "github.com/rigup/ephemeral-iam/internal/appconfig/arch_util"
@@ -31,52 +35,190 @@ import (
 
 // The configuration key names.
 const (
-	AuthProxyAddress       = "authproxy.proxyaddress"
-	AuthProxyPort          = "authproxy.proxyport"
-	AuthProxyVerbose       = "authproxy.verbose"
-	AuthProxyLogDir        = "authproxy.logdir"
-	AuthProxyCertFile      = "authproxy.certfile"
-	AuthProxyKeyFile       = "authproxy.keyfile"
-	DefaultServiceAccounts = "serviceaccounts"
-	CloudSQLProxyPath      = "binarypaths.cloudsqlproxy"
-	GcloudPath             = "binarypaths.gcloud"
-	KubectlPath            = "binarypaths.kubectl"
-	GithubAuth             = "github.auth"
-	GithubTokens           = "github.tokens" //nolint:gosec // Not hardcoded credentials
-	LoggingFormat          = "logging.format"
-	LoggingLevel           = "logging.level"
-	LoggingLevelTruncation = "logging.disableleveltruncation"
-	LoggingPadLevelText    = "logging.padleveltext"
+	Aliases                  = "aliases"
+	APIConcurrency           = "api.concurrency"
+	AuditHistory             = "audit.history"
+	AuditPubSubTopic         = "audit.pubsubtopic"
+	AuditWebhook             = "audit.webhook"
+	AuditWebhookToken        = "audit.webhooktoken" //nolint:gosec // Not hardcoded credentials
+	AuthCredentialFile       = "authentication.credentialfile"
+	AuthProxyAddress         = "authproxy.proxyaddress"
+	AuthProxyPort            = "authproxy.proxyport"
+	AuthProxySocketPath      = "authproxy.socketpath"
+	AuthProxyVerbose         = "authproxy.verbose"
+	AuthProxyLogDir          = "authproxy.logdir"
+	AuthProxyAuditLog        = "authproxy.auditlog"
+	AuthProxyCertFile        = "authproxy.certfile"
+	AuthProxyKeyFile         = "authproxy.keyfile"
+	AuthProxyBypassDomains   = "authproxy.bypassdomains"
+	AuthProxyCacheTTL        = "authproxy.cachettl"
+	AuthProxyInterceptAll    = "authproxy.interceptallhosts"
+	AuthProxyClientAuth      = "authproxy.requireclientcert"
+	AuthProxyRotateBefore    = "authproxy.rotatecertsbefore"
+	AuthProxyShutdownTimeout = "authproxy.shutdowntimeout"
+	AuthProxyTLSMinVersion   = "authproxy.tlsminversion"
+	AuthProxyTLSCiphers      = "authproxy.tlsciphersuites"
+	AuthProxyRules           = "authproxy.rules"
+	AuthProxyTokenScopes     = "authproxy.tokenscopes"
+	AuthProxyAccessBounds    = "authproxy.accessboundaries"
+	AuthProxyRateLimit       = "authproxy.ratelimit"
+	AuthProxyHostRateLimit   = "authproxy.hostratelimit"
+	AuthProxyUpstream        = "authproxy.upstreamproxy"
+	AuthProxyUpstreamAuth    = "authproxy.upstreamproxyauth"
+	CacheTTL                 = "cache.ttl"
+	DefaultServiceAccounts   = "serviceaccounts"
+	DefaultsProject          = "defaults.project"
+	DefaultsScopes           = "defaults.scopes"
+	DefaultsServiceAccount   = "defaults.serviceaccount"
+	KeyringEnabled           = "keyring.enabled"
+	BqPath                   = "binarypaths.bq"
+	CloudSQLProxyPath        = "binarypaths.cloudsqlproxy"
+	GcloudPath               = "binarypaths.gcloud"
+	GsutilPath               = "binarypaths.gsutil"
+	KubectlPath              = "binarypaths.kubectl"
+	TerraformPath            = "binarypaths.terraform"
+	GithubAuth               = "github.auth"
+	GithubTokens             = "github.tokens" //nolint:gosec // Not hardcoded credentials
+	LoggingColor             = "logging.color"
+	LoggingFile              = "logging.file"
+	LoggingFormat            = "logging.format"
+	LoggingLevel             = "logging.level"
+	LoggingLevelTruncation   = "logging.disableleveltruncation"
+	LoggingMaxBackups        = "logging.maxbackups"
+	LoggingMaxSize           = "logging.maxsize"
+	LoggingOutput            = "logging.output"
+	LoggingPadLevelText      = "logging.padleveltext"
+	QueryPermsCacheTTL       = "querypermissions.cachettl"
+	SecurityAllowedSAs       = "security.allowedserviceaccounts"
+	SecurityApprovalSAs      = "security.approvalserviceaccounts"
+	SecurityApprovalTimeout  = "security.approvaltimeout"
+	SecurityApprovalToken    = "security.approvaltoken" //nolint:gosec // Not hardcoded credentials
+	SecurityApprovalWebhook  = "security.approvalwebhook"
+	SecurityDeniedSAs        = "security.deniedserviceaccounts"
+	SecurityMaxSession       = "security.maxsessionduration"
+	SecurityMFA              = "security.mfa"
+	SecurityMFACommand       = "security.mfacommand"
+	SecurityMFASecret        = "security.mfasecret" //nolint:gosec // Not hardcoded credentials
+	SecurityReasonPattern    = "security.reasonpattern"
+	SessionBannerTemplate    = "session.bannertemplate"
+	SessionIdleTimeout       = "session.idletimeout"
+	SessionNotifications     = "session.notifications"
+	SessionPromptTemplate    = "session.prompttemplate"
+	SessionTranscript        = "session.transcript"
+	TokenLifetime            = "tokenconfig.lifetime"
+	TokenSessionLength       = "tokenconfig.sessionlength"
 )
 
+// EnvPrefix is prepended to the environment variables that override config
+// values, e.g. EIAM_LOGGING_LEVEL overrides logging.level.
+const EnvPrefix = "EIAM"
+
+// ConfigFileEnv is the environment variable that sets the path to the config
+// file. The --config flag takes precedence over it.
+const ConfigFileEnv = "EIAM_CONFIG"
+
+// ConfigFileFlag is the name of the global flag that sets the path to the
+// config file.
+const ConfigFileFlag = "config"
+
+// The names of the global flags that override logging.level for a single
+// command.
+const (
+	VerboseFlag = "verbose"
+	QuietFlag   = "quiet"
+)
+
+// NoColorFlag is the name of the global flag that disables colored output for
+// a single command.
+const NoColorFlag = "no-color"
+
 var (
 	configDir string
 	once      sync.Once
+	firstRun  bool
+
+	// watchLock is held while the config is reloaded by WatchConfig.
+	watchLock sync.Mutex
+	watching  bool
+
+	envKeyReplacer = strings.NewReplacer(".", "_")
+	// viperEnvKeyReplacer is used by viper to find the environment variable of
+	// a key, after it has added the prefix and upper cased the key. Variable
+	// names with a NUL byte can't be set, so the security keys are never read
+	// from the environment. See EnvOverridable.
+	viperEnvKeyReplacer = strings.NewReplacer(EnvPrefix+"_"+strings.ToUpper(securityPrefix), "\x00", ".", "_")
 
 	binPaths = map[string]string{
+		BqPath:            "bq",
 		CloudSQLProxyPath: "cloud_sql_proxy",
 		GcloudPath:        "gcloud",
+		GsutilPath:        "gsutil",
 		KubectlPath:       "kubectl",
+		TerraformPath:     "terraform",
+	}
+
+	// optionalBinPaths are the binaries that only some commands need, so eiam
+	// runs without them.
+	optionalBinPaths = map[string]bool{
+		BqPath:            true,
+		CloudSQLProxyPath: true,
+		GsutilPath:        true,
+		TerraformPath:     true,
+	}
+
+	// altBinNames are the other names that a binary is installed as, which are
+	// used when it isn't found by its name in binPaths.
+	altBinNames = map[string][]string{
+		// Version 2 of the Cloud SQL Auth Proxy.
+		CloudSQLProxyPath: {"cloud-sql-proxy"},
 	}
 )
 
 // InitConfig performs the initiatization of the users configuration file.
 func InitConfig() error {
-	viper.SetConfigName("config")
-	viper.AddConfigPath(GetConfigDir())
+	if cf := customConfigFile(); cf != "" {
+		viper.SetConfigFile(cf)
+	} else {
+		viper.SetConfigName("config")
+		viper.AddConfigPath(GetConfigDir())
+	}
+	viper.SetEnvPrefix(EnvPrefix)
+	viper.SetEnvKeyReplacer(viperEnvKeyReplacer)
 	viper.AutomaticEnv()
-	viper.SetConfigType("yml")
 
+	setDefaults()
 	if err := viper.ReadInConfig(); err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+		// A config file set with --config or EIAM_CONFIG is created if it
+		// doesn't exist yet.
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok && !os.IsNotExist(err) {
 			return errorsutil.New("Failed to initialize configuration", err)
 		}
-		initConfig()
+		createConfigFile()
+		firstRun = true
 	}
+	projectErr := mergeProjectConfig()
 
 	// Instantiate logger now that the config is loaded.
+	util.LevelOverride = levelFromArgs()
+	if colorDisabledByArgs() {
+		util.ColorOverride = util.ColorNever
+	}
 	util.Logger = util.NewLogger()
 
+	if projectErr != nil {
+		return errorsutil.New(fmt.Sprintf("Failed to read %s", ProjectConfigName), projectErr)
+	}
+	warnIgnoredProjectKeys()
+	warnIgnoredEnvVars()
+
+	if err := loadFileConfig(); err != nil {
+		return err
+	}
+	if err := migrateConfig(); err != nil {
+		return err
+	}
+	resolveSecrets()
+
 	// Find the paths to gcloud, kubectl, and cloud_sql_proxy and write them to the config.
 	if err := getBinPaths(); err != nil {
 		return err
@@ -85,22 +227,95 @@ func InitConfig() error {
 	return nil
 }
 
-func initConfig() {
-	viper.SetDefault(AuthProxyAddress, "127.0.0.1")
-	viper.SetDefault(AuthProxyPort, "8084")
-	viper.SetDefault(AuthProxyVerbose, false)
-	viper.SetDefault(AuthProxyLogDir, filepath.Join(GetConfigDir(), "log"))
-	viper.SetDefault(AuthProxyCertFile, filepath.Join(GetConfigDir(), "server.pem"))
-	viper.SetDefault(AuthProxyKeyFile, filepath.Join(GetConfigDir(), "server.key"))
-	viper.SetDefault(GithubAuth, false)
-	viper.SetDefault(LoggingFormat, "text")
-	viper.SetDefault(LoggingLevel, "info")
-	viper.SetDefault(LoggingLevelTruncation, true)
-	viper.SetDefault(LoggingPadLevelText, true)
-
-	if err := viper.SafeWriteConfig(); err != nil {
+// defaultValues returns the built-in default value for each config key that
+// has one.
+func defaultValues() map[string]interface{} {
+	return map[string]interface{}{
+		APIConcurrency:           10,
+		AuditHistory:             true,
+		AuditPubSubTopic:         "",
+		AuditWebhook:             "",
+		AuditWebhookToken:        "",
+		AuthCredentialFile:       "",
+		AuthProxyAddress:         "127.0.0.1",
+		AuthProxyPort:            "8084",
+		AuthProxySocketPath:      "",
+		AuthProxyVerbose:         false,
+		AuthProxyLogDir:          filepath.Join(GetConfigDir(), "log"),
+		AuthProxyAuditLog:        false,
+		AuthProxyCertFile:        filepath.Join(GetConfigDir(), "server.pem"),
+		AuthProxyKeyFile:         filepath.Join(GetConfigDir(), "server.key"),
+		AuthProxyBypassDomains:   []string{},
+		AuthProxyCacheTTL:        "0s",
+		AuthProxyInterceptAll:    false,
+		AuthProxyClientAuth:      false,
+		AuthProxyRotateBefore:    "720h",
+		AuthProxyShutdownTimeout: "10s",
+		AuthProxyTLSMinVersion:   "1.2",
+		AuthProxyTLSCiphers:      []string{},
+		AuthProxyRateLimit:       0,
+		AuthProxyHostRateLimit:   0,
+		AuthProxyUpstream:        "",
+		AuthProxyUpstreamAuth:    "",
+		CacheTTL:                 "10m",
+		DefaultsProject:          "",
+		DefaultsScopes: []string{
+			"https://www.googleapis.com/auth/cloud-platform",
+			"https://www.googleapis.com/auth/userinfo.email",
+		},
+		DefaultsServiceAccount:  "",
+		GithubAuth:              false,
+		KeyringEnabled:          true,
+		LoggingColor:            util.ColorAuto,
+		LoggingFile:             "",
+		LoggingFormat:           "text",
+		LoggingLevel:            "info",
+		LoggingLevelTruncation:  true,
+		LoggingMaxBackups:       3,
+		LoggingMaxSize:          10,
+		LoggingOutput:           util.OutputStderr,
+		LoggingPadLevelText:     true,
+		QueryPermsCacheTTL:      "24h",
+		SecurityAllowedSAs:      []string{},
+		SecurityApprovalSAs:     []string{},
+		SecurityApprovalTimeout: "15m",
+		SecurityApprovalToken:   "",
+		SecurityApprovalWebhook: "",
+		SecurityDeniedSAs:       []string{},
+		SecurityMaxSession:      "0s",
+		SecurityMFA:             MFANone,
+		SecurityMFACommand:      "",
+		SecurityMFASecret:       "",
+		SecurityReasonPattern:   "",
+		SessionBannerTemplate:   `{{color "yellow" (print "Privileged session as " .ServiceAccount " until " .Expiry)}}`,
+		SessionIdleTimeout:      "0s",
+		SessionNotifications:    false,
+		SessionPromptTemplate:   "\n[{{color \"yellow\" .ServiceAccount}}]\n[{{color \"cyan\" \"eiam\"}}] > ",
+		SessionTranscript:       TranscriptNone,
+		TokenLifetime:           "10m",
+		TokenSessionLength:      "0s",
+	}
+}
+
+// DefaultValue returns the built-in default value for a config key.
+func DefaultValue(key string) (interface{}, bool) {
+	val, ok := defaultValues()[key]
+	return val, ok
+}
+
+// setDefaults registers the default config values. This is done on every run
+// so that keys added in newer releases have a value for existing configs.
+func setDefaults() {
+	for key, val := range defaultValues() {
+		viper.SetDefault(key, val)
+	}
+}
+
+func createConfigFile() {
+	configFile := ConfigFile()
+	if err := viper.SafeWriteConfigAs(configFile); err != nil {
 		if _, ok := err.(viper.ConfigFileAlreadyExistsError); !ok {
-			log.Fatalf("failed to write config file %s/config.yml: %v", GetConfigDir(), err)
+			log.Fatalf("failed to write config file %s: %v", configFile, err)
 		}
 	}
 }
@@ -110,26 +325,119 @@ func getBinPaths() error {
 	for configKey, binName := range binPaths {
 		if viper.GetString(configKey) == "" {
 			updated = true
-			binPath, err := CheckCommandExists(binName)
+			binPath, err := findBinary(configKey)
 			if err != nil {
-				if configKey != CloudSQLProxyPath {
-					// Exit if kubectl or gcloud aren't installed, but continue if cloud_sql_proxy isn't.
+				if !OptionalBinary(configKey) {
+					// Exit if kubectl or gcloud aren't installed, but continue if an optional binary isn't.
 					return err
 				}
-				util.Logger.Debug("Could not find path to cloud_sql_proxy binary")
+				util.Logger.Debugf("Could not find path to %s binary", binName)
 			}
 			viper.Set(configKey, binPath)
 		}
 	}
 
 	if updated {
-		if err := viper.WriteConfig(); err != nil {
+		if err := WriteConfig(); err != nil {
 			return errorsutil.New("Failed to write binary paths to configuration file", err)
 		}
 	}
 	return nil
 }
 
+// reloadConfig reads the config file and the per-project config file again
+// after the config file was replaced.
+func reloadConfig() error {
+	if err := viper.ReadInConfig(); err != nil {
+		return errorsutil.New("Failed to read configuration file", err)
+	}
+	if err := mergeProjectConfig(); err != nil {
+		return errorsutil.New(fmt.Sprintf("Failed to read %s", ProjectConfigName), err)
+	}
+	if err := loadFileConfig(); err != nil {
+		return err
+	}
+	resolveSecrets()
+	return nil
+}
+
+// WatchConfig reloads the configuration whenever the config file changes and
+// reconfigures the logger. If onChange isn't nil, it is called after each
+// reload so that long running commands can apply the new values.
+//
+// The config is reloaded on another goroutine, and viper isn't safe for
+// concurrent use, so onChange must copy the values that other goroutines use
+// while the config is watched instead of letting them read viper.
+// StopWatchingConfig must be called before the caller reads viper again.
+func WatchConfig(onChange func()) {
+	watchLock.Lock()
+	watching = true
+	watchLock.Unlock()
+
+	viper.SetConfigFile(ConfigFile())
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		watchLock.Lock()
+		defer watchLock.Unlock()
+		if !watching {
+			return
+		}
+		if err := reloadConfig(); err != nil {
+			util.Logger.WithError(err).Warn("Failed to reload the configuration")
+			return
+		}
+		if err := ValidateConfig(); err != nil {
+			util.Logger.Warn(err)
+		}
+		util.ConfigureLogger(util.Logger)
+		util.Logger.Infof("Reloaded the configuration from %s", e.Name)
+		if onChange != nil {
+			onChange()
+		}
+	})
+	viper.WatchConfig()
+}
+
+// StopWatchingConfig stops applying changes to the config file. It waits for
+// a reload that is in progress to finish.
+func StopWatchingConfig() {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	watching = false
+}
+
+// FirstRun reports whether the config file was created by this invocation.
+func FirstRun() bool {
+	return firstRun
+}
+
+// DetectBinaryPath searches the PATH for the binary that a binarypaths key
+// refers to.
+func DetectBinaryPath(key string) (string, error) {
+	if _, ok := binPaths[key]; !ok {
+		return "", fmt.Errorf("%s is not a binary path", key)
+	}
+	return findBinary(key)
+}
+
+func findBinary(key string) (string, error) {
+	binPath, err := CheckCommandExists(binPaths[key])
+	for _, altName := range altBinNames[key] {
+		if err == nil {
+			break
+		}
+		if altPath, altErr := CheckCommandExists(altName); altErr == nil {
+			binPath, err = altPath, nil
+		}
+	}
+	return binPath, err
+}
+
+// OptionalBinary reports whether eiam runs without the binary that a
+// binarypaths key refers to.
+func OptionalBinary(key string) bool {
+	return optionalBinPaths[key]
+}
+
 // CheckCommandExists tries to find the location of a given binary.
 func CheckCommandExists(command string) (string, error) {
 	cmdPath, err := exec.LookPath(command)
@@ -139,7 +447,16 @@ func CheckCommandExists(command string) (string, error) {
 	return cmdPath, nil
 }
 
+// ProxyHost returns the host in authproxy.proxyaddress. IPv6 addresses may be
+// written with or without brackets and are returned without them.
+func ProxyHost() string {
+	return strings.TrimSuffix(strings.TrimPrefix(viper.GetString(AuthProxyAddress), "["), "]")
+}
+
 // GetConfigDir returns the directory to use for the ephemeral-iam configurations.
+// When a custom config file is used, the directory that it is in is used.
+// Otherwise $XDG_CONFIG_HOME/ephemeral-iam is used if XDG_CONFIG_HOME is set,
+// falling back to the default location for the OS.
 func GetConfigDir() string {
 	once.Do(func() {
 		dir, err := getConfigDir()
@@ -150,13 +467,139 @@ func GetConfigDir() string {
 }
 
 func getConfigDir() (string, error) {
-	userHomeDir, err := os.UserHomeDir()
-	if err != nil {
-		return "", errorsutil.New("Failed to get user's home directory", err)
+	var confPath string
+	if cf := customConfigFile(); cf != "" {
+		confPath = filepath.Dir(cf)
+	} else if xdgConfigHome := os.Getenv("XDG_CONFIG_HOME"); xdgConfigHome != "" {
+		confPath = filepath.Join(xdgConfigHome, "ephemeral-iam")
+	} else {
+		userHomeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", errorsutil.New("Failed to get user's home directory", err)
+		}
+		confPath = filepath.Join(userHomeDir, archutil.ConfigPath)
 	}
-	confPath := filepath.Join(userHomeDir, archutil.ConfigPath)
-	if err = os.MkdirAll(confPath, 0o755); err != nil {
+	if err := os.MkdirAll(confPath, 0o755); err != nil {
 		return "", errorsutil.New(fmt.Sprintf("Failed to create config directory: %s", confPath), err)
 	}
 	return confPath, nil
 }
+
+// customConfigFile returns the absolute path to the config file set with the
+// --config flag or the EIAM_CONFIG environment variable, or an empty string if
+// neither is set. The config is loaded before the command line is parsed, so
+// the flag is read from os.Args directly.
+func customConfigFile() string {
+	configFile := os.Getenv(ConfigFileEnv)
+	flagName := "--" + ConfigFileFlag
+	args := os.Args[1:]
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == flagName && i+1 < len(args) {
+			configFile = args[i+1]
+			break
+		}
+		if strings.HasPrefix(arg, flagName+"=") {
+			configFile = strings.TrimPrefix(arg, flagName+"=")
+			break
+		}
+	}
+	if configFile == "" {
+		return ""
+	}
+	if abs, err := filepath.Abs(configFile); err == nil {
+		return abs
+	}
+	return configFile
+}
+
+// levelFromArgs returns the logging level set with --verbose or --quiet, or an
+// empty string if neither is set. -v logs at debug level, -vv at trace level,
+// and -q only logs errors. Like --config, the flags are read from os.Args
+// directly so that they apply to the logs written before the command line is
+// parsed.
+func levelFromArgs() string {
+	level := ""
+	for _, arg := range eiamArgs() {
+		switch {
+		case arg == "--"+QuietFlag || arg == "-q":
+			level = "error"
+		case arg == "--"+VerboseFlag || arg == "-v":
+			level = "debug"
+		case strings.HasPrefix(arg, "-vv") && strings.Trim(arg[1:], "v") == "":
+			level = "trace"
+		}
+	}
+	return level
+}
+
+// eiamArgs returns the args that levelFromArgs and colorDisabledByArgs read:
+// the command names and eiam's global flags, up to the first argument that
+// isn't eiam's, such as "--" or a flag of a command that eiam wraps. The flags
+// that come after it are applied once the command line is parsed, see
+// ApplyFlagOverrides.
+func eiamArgs() []string {
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case !strings.HasPrefix(arg, "-"):
+			// A command name, or an argument of the command.
+		case arg == "--"+ConfigFileFlag:
+			i++
+		case arg == "--"+QuietFlag || arg == "-q",
+			arg == "--"+VerboseFlag || strings.Trim(arg, "v") == "-",
+			arg == "--"+NoColorFlag || strings.HasPrefix(arg, "--"+NoColorFlag+"="),
+			strings.HasPrefix(arg, "--"+ConfigFileFlag+"="):
+		default:
+			return args[:i]
+		}
+	}
+	return args
+}
+
+// ApplyFlagOverrides applies the --verbose, --quiet and --no-color flags of the
+// parsed command line when they weren't found before it was parsed, e.g.
+// because they come after the flags of a command that eiam wraps.
+func ApplyFlagOverrides(fs *pflag.FlagSet) {
+	changed := false
+	if noColor, err := fs.GetBool(NoColorFlag); err == nil && noColor && util.ColorOverride == "" {
+		util.ColorOverride = util.ColorNever
+		changed = true
+	}
+	level := ""
+	if verbose, err := fs.GetCount(VerboseFlag); err == nil && verbose > 1 {
+		level = "trace"
+	} else if verbose == 1 {
+		level = "debug"
+	} else if quiet, err := fs.GetBool(QuietFlag); err == nil && quiet {
+		level = "error"
+	}
+	if level != "" && util.LevelOverride == "" {
+		util.LevelOverride = level
+		changed = true
+	}
+	if changed {
+		util.ConfigureLogger(util.Logger)
+	}
+}
+
+// colorDisabledByArgs reports whether --no-color is set. It is read from
+// os.Args directly for the same reason as levelFromArgs. Like pflag, it
+// accepts a value such as --no-color=false, and the last one wins.
+func colorDisabledByArgs() bool {
+	disabled := false
+	for _, arg := range eiamArgs() {
+		if arg == "--"+NoColorFlag {
+			disabled = true
+		} else if value := strings.TrimPrefix(arg, "--"+NoColorFlag+"="); value != arg {
+			// Invalid values are reported when the command line is parsed.
+			if b, err := strconv.ParseBool(value); err == nil {
+				disabled = b
+			}
+		}
+	}
+	return disabled
+}
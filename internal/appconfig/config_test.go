@@ -0,0 +1,73 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appconfig
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLevelFromArgs(t *testing.T) {
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	tests := []struct {
+		args string
+		want string
+	}{
+		{args: "config info", want: ""},
+		{args: "config info -v", want: "debug"},
+		{args: "-vv config info", want: "trace"},
+		{args: "--config eiam.yml config info --quiet", want: "error"},
+		{args: "gcloud compute instances list -q", want: "error"},
+		// The flags of wrapped commands, and what comes after them, aren't
+		// eiam's.
+		{args: "gcloud compute ssh vm --zone us-east1-b -q", want: ""},
+		{args: "kubectl exec pod -- sh -v", want: ""},
+	}
+	for _, tt := range tests {
+		os.Args = append([]string{"eiam"}, strings.Fields(tt.args)...)
+		if got := levelFromArgs(); got != tt.want {
+			t.Errorf("levelFromArgs() with %q = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestColorDisabledByArgs(t *testing.T) {
+	origArgs := os.Args
+	defer func() { os.Args = origArgs }()
+
+	tests := []struct {
+		args string
+		want bool
+	}{
+		{args: "config info", want: false},
+		{args: "config info --no-color", want: true},
+		{args: "config info --no-color=true", want: true},
+		{args: "config info --no-color=1", want: true},
+		{args: "config info --no-color=false", want: false},
+		{args: "config info --no-color --no-color=F", want: false},
+		{args: "config info --no-color=false --no-color", want: true},
+		{args: "config info --no-color=maybe", want: false},
+		{args: "kubectl exec pod -- ls --no-color", want: false},
+	}
+	for _, tt := range tests {
+		os.Args = append([]string{"eiam"}, strings.Fields(tt.args)...)
+		if got := colorDisabledByArgs(); got != tt.want {
+			t.Errorf("colorDisabledByArgs() with %q = %t, want %t", tt.args, got, tt.want)
+		}
+	}
+}
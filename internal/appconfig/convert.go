@@ -0,0 +1,75 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appconfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// ConfigFormats are the file formats that the config file can be written in.
+var ConfigFormats = []string{"yaml", "json", "toml"}
+
+// ConfigFormat returns the format of the config file in use.
+func ConfigFormat() string {
+	ext := strings.TrimPrefix(filepath.Ext(ConfigFile()), ".")
+	if ext == "yml" {
+		return "yaml"
+	}
+	return ext
+}
+
+// FileSettings returns the values stored in the config file as a nested map.
+func FileSettings() map[string]interface{} {
+	return fileConfig.AllSettings()
+}
+
+// ConvertConfig rewrites the config file in the given format and removes the
+// original file. It returns the path to the new config file.
+func ConvertConfig(format string) (string, error) {
+	if !util.Contains(ConfigFormats, format) {
+		return "", fmt.Errorf("unsupported config format %q, must be one of %v", format, ConfigFormats)
+	}
+	if format == ConfigFormat() {
+		return "", fmt.Errorf("the config file is already in the %s format", format)
+	}
+
+	oldFile := ConfigFile()
+	ext := format
+	if format == "yaml" {
+		ext = "yml"
+	}
+	newFile := fmt.Sprintf("%s.%s", strings.TrimSuffix(oldFile, filepath.Ext(oldFile)), ext)
+	if _, err := os.Stat(newFile); err == nil {
+		return "", fmt.Errorf("%s already exists", newFile)
+	}
+
+	viper.SetConfigFile(newFile)
+	if err := WriteConfig(); err != nil {
+		viper.SetConfigFile(oldFile)
+		return "", errorsutil.New(fmt.Sprintf("Failed to write %s", newFile), err)
+	}
+	if err := os.Remove(oldFile); err != nil {
+		return "", errorsutil.New(fmt.Sprintf("Failed to remove %s", oldFile), err)
+	}
+	return newFile, nil
+}
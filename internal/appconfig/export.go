@@ -0,0 +1,166 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cast"
+
+	"github.com/pelletier/go-toml"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// Shareable reports whether a field can be exported and imported on another
+// machine.
+func (f Field) Shareable() bool {
+	return !f.MachineSpecific && !f.Sensitive
+}
+
+// ExportSettings returns the shareable part of the configuration as a nested
+// map. Values that were only overridden for this invocation are left out.
+func ExportSettings() map[string]interface{} {
+	out := viper.New()
+	for _, key := range viper.AllKeys() {
+		f, ok := LookupField(key)
+		if !ok || !f.Shareable() {
+			continue
+		}
+		if val, ok := persistedValue(key); ok {
+			out.Set(key, val)
+		}
+	}
+	return out.AllSettings()
+}
+
+// EffectiveSettings returns the configuration after flag, environment, and
+// per-project overrides are applied as a nested map.
+func EffectiveSettings() map[string]interface{} {
+	out := viper.New()
+	for _, key := range viper.AllKeys() {
+		if _, ok := renamedKey(key); ok {
+			continue
+		}
+		val := viper.Get(key)
+		// List values set with environment variables are comma separated strings.
+		if s, ok := val.(string); ok {
+			if f, ok := LookupField(key); ok && f.Type == ListField {
+				val = util.SplitList(s)
+			}
+		}
+		out.Set(key, val)
+	}
+	return out.AllSettings()
+}
+
+// MarshalSettings encodes a settings map as "yaml", "json", or "toml". The
+// "flat" format writes one key=value pair per line.
+func MarshalSettings(settings map[string]interface{}, format string) ([]byte, error) {
+	switch format {
+	case "json":
+		return json.MarshalIndent(settings, "", "  ")
+	case "yaml", "yml":
+		return yaml.Marshal(settings)
+	case "toml":
+		tree, err := toml.TreeFromMap(settings)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(tree.String()), nil
+	case "flat":
+		var lines []string
+		flattenSettings("", settings, &lines)
+		sort.Strings(lines)
+		return []byte(strings.Join(lines, "\n")), nil
+	default:
+		return nil, fmt.Errorf("unsupported config format %q, must be one of %v", format, ConfigFormats)
+	}
+}
+
+// ImportSettings applies the settings in the provided YAML, JSON, or TOML file
+// to the configuration and writes it to disk. When overwrite is true, every
+// shareable value that isn't in the file is reset to its default; otherwise
+// the imported values are merged into the current configuration. Machine
+// specific and sensitive keys are never imported and are returned so they can
+// be reported.
+func ImportSettings(file string, overwrite bool) (skipped []string, err error) {
+	in := viper.New()
+	in.SetConfigFile(file)
+	if err := in.ReadInConfig(); err != nil {
+		return nil, errorsutil.New(fmt.Sprintf("Failed to read %s", file), err)
+	}
+
+	values := map[string]interface{}{}
+	var problems []string
+	for _, key := range in.AllKeys() {
+		raw := in.Get(key)
+		// Accept files exported by older releases.
+		if m, ok := renamedKey(key); ok {
+			key = m.NewKey
+		}
+		f, ok := LookupField(key)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown config key %s", key))
+			continue
+		}
+		if !f.Shareable() {
+			skipped = append(skipped, key)
+			continue
+		}
+		parsed, err := parseRawValue(f, key, raw)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		values[key] = parsed
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, fmt.Errorf("%s contains invalid settings:\n  - %s", file, strings.Join(problems, "\n  - "))
+	}
+	sort.Strings(skipped)
+
+	exclude := func(key string) bool {
+		f, ok := LookupField(key)
+		return overwrite && ok && f.Shareable()
+	}
+	if err := writeConfig(exclude, values); err != nil {
+		return nil, errorsutil.New("Failed to write updated configuration", err)
+	}
+	return skipped, reloadConfig()
+}
+
+func flattenSettings(prefix string, settings map[string]interface{}, lines *[]string) {
+	for key, val := range settings {
+		if prefix != "" {
+			key = fmt.Sprintf("%s.%s", prefix, key)
+		}
+		switch v := val.(type) {
+		case map[string]interface{}:
+			flattenSettings(key, v, lines)
+		case []interface{}, []string:
+			*lines = append(*lines, fmt.Sprintf("%s=%s", key, strings.Join(cast.ToStringSlice(v), ",")))
+		default:
+			*lines = append(*lines, fmt.Sprintf("%s=%v", key, v))
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appconfig
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+const (
+	// keyringService is the service name that secrets are stored under.
+	keyringService = "ephemeral-iam"
+	// keyringPlaceholder is written to the config file in place of values
+	// that are stored in the OS keyring.
+	keyringPlaceholder = "<stored in OS keyring>"
+	maskedValue        = "**********"
+)
+
+var (
+	errKeyringUnsupported = errors.New("the OS keyring is not supported on this system")
+
+	// resolvedSecrets holds the values read from the keyring so that they
+	// aren't written again when they haven't changed.
+	resolvedSecrets = map[string]string{}
+)
+
+// MaskSensitive replaces the sensitive values in a settings map so that it can
+// be printed.
+func MaskSensitive(settings map[string]interface{}) {
+	for _, f := range schema {
+		if !f.Sensitive {
+			continue
+		}
+		parts := strings.Split(f.Key, ".")
+		parent := settings
+		for _, part := range parts[:len(parts)-1] {
+			if parent, _ = parent[part].(map[string]interface{}); parent == nil {
+				break
+			}
+		}
+		last := parts[len(parts)-1]
+		if parent == nil || parent[last] == nil {
+			continue
+		}
+		parent[last] = MaskValue(f.Key, parent[last])
+	}
+}
+
+// MaskValue masks the value of a sensitive config key.
+func MaskValue(key string, val interface{}) interface{} {
+	f, ok := LookupField(key)
+	if !ok || !f.Sensitive {
+		return val
+	}
+	if items, err := cast.ToStringMapStringE(val); err == nil {
+		masked := make(map[string]interface{}, len(items))
+		for name := range items {
+			masked[name] = maskedValue
+		}
+		return masked
+	}
+	return maskedValue
+}
+
+// resolveSecrets replaces the keyring placeholders in the config with the
+// values stored in the OS keyring.
+func resolveSecrets() {
+	for _, f := range schema {
+		if !f.Sensitive {
+			continue
+		}
+		if f.Type != MapField {
+			if secret, ok := resolveSecret(f.Key, viper.GetString(f.Key)); ok {
+				viper.Set(f.Key, secret)
+			}
+			continue
+		}
+		// Set the whole map so the resolved values don't hide the others.
+		items := viper.GetStringMapString(f.Key)
+		resolved := false
+		for name, val := range items {
+			if secret, ok := resolveSecret(f.Key+"."+name, val); ok {
+				items[name] = secret
+				resolved = true
+			}
+		}
+		if resolved {
+			viper.Set(f.Key, items)
+		}
+	}
+}
+
+func resolveSecret(key, val string) (string, bool) {
+	if val != keyringPlaceholder {
+		return "", false
+	}
+	secret, err := keyringGet(key)
+	if err != nil {
+		util.Logger.Warnf("Failed to read %s from the OS keyring: %v", key, err)
+		return "", false
+	}
+	resolvedSecrets[key] = secret
+	return secret, true
+}
+
+// storeSecret moves a sensitive value to the OS keyring and returns the
+// placeholder to write to the config file instead. If the keyring can't be
+// used, the value is returned unchanged.
+func storeSecret(key string, val interface{}) interface{} {
+	if f, _ := LookupField(key); f.Type == MapField && f.Key == key {
+		items, err := cast.ToStringMapStringE(val)
+		if err != nil {
+			return val
+		}
+		stored := make(map[string]interface{}, len(items))
+		for name, item := range items {
+			stored[name] = storeSecret(key+"."+name, item)
+		}
+		return stored
+	}
+
+	// Keys are read back in lower case.
+	key = strings.ToLower(key)
+	secret, ok := val.(string)
+	if !ok || secret == "" || secret == keyringPlaceholder || !viper.GetBool(KeyringEnabled) {
+		return val
+	}
+	if resolvedSecrets[key] == secret {
+		return keyringPlaceholder
+	}
+	if err := keyringSet(key, secret); err != nil {
+		if errors.Is(err, errKeyringUnsupported) {
+			util.Logger.Debugf("Writing %s to the config file: %v", key, err)
+		} else {
+			util.Logger.Warnf("Failed to store %s in the OS keyring, writing it to the config file instead: %v", key, err)
+		}
+		return val
+	}
+	resolvedSecrets[key] = secret
+	return keyringPlaceholder
+}
+
+// removeStaleSecrets deletes the keyring entries for sensitive values that
+// are no longer in the config file.
+func removeStaleSecrets(written *viper.Viper) {
+	for _, key := range fileConfig.AllKeys() {
+		if fileConfig.GetString(key) != keyringPlaceholder || written.GetString(key) == keyringPlaceholder {
+			continue
+		}
+		if err := keyringDelete(key); err != nil {
+			util.Logger.Debugf("Failed to remove %s from the OS keyring: %v", key, err)
+		}
+		delete(resolvedSecrets, key)
+	}
+}
+
+// SetKeyringSecret stores a secret that isn't part of the config in the OS
+// keyring.
+func SetKeyringSecret(name, secret string) error {
+	if !viper.GetBool(KeyringEnabled) {
+		return errors.New("the OS keyring is disabled by keyring.enabled")
+	}
+	return keyringSet(name, secret)
+}
+
+// KeyringSecret reads a secret stored with SetKeyringSecret.
+func KeyringSecret(name string) (string, error) {
+	return keyringGet(name)
+}
+
+// DeleteKeyringSecret removes a secret stored with SetKeyringSecret.
+func DeleteKeyringSecret(name string) error {
+	return keyringDelete(name)
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin
+// +build darwin
+
+package appconfig
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// The macOS keychain is accessed with the security command.
+
+func keyringGet(key string) (string, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", keyringService, "-a", key, "-w").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+// keyringSet runs security in interactive mode and passes the command on stdin,
+// so that the secret isn't in the arguments of a process that other users can
+// list. The secret is hex encoded so that it doesn't need to be quoted.
+func keyringSet(key, secret string) error {
+	cmd := exec.Command("security", "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf(
+		"add-generic-password -U -s %q -a %q -X %s\n",
+		keyringService, key, hex.EncodeToString([]byte(secret)),
+	))
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	// security doesn't exit with an error when a command that it read from
+	// stdin fails, so check that the secret was stored.
+	if stored, err := keyringGet(key); err != nil || stored != secret {
+		return fmt.Errorf("failed to store %s in the keychain", key)
+	}
+	return nil
+}
+
+func keyringDelete(key string) error {
+	return exec.Command("security", "delete-generic-password", "-s", keyringService, "-a", key).Run()
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package appconfig
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// The Secret Service API (e.g. GNOME Keyring or KWallet) is accessed with the
+// secret-tool command from libsecret.
+
+func secretTool(args ...string) (*exec.Cmd, error) {
+	if _, err := exec.LookPath("secret-tool"); err != nil {
+		return nil, errKeyringUnsupported
+	}
+	return exec.Command("secret-tool", args...), nil
+}
+
+func keyringGet(key string) (string, error) {
+	c, err := secretTool("lookup", "service", keyringService, "account", key)
+	if err != nil {
+		return "", err
+	}
+	out, err := c.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+func keyringSet(key, secret string) error {
+	label := fmt.Sprintf("%s %s", keyringService, key)
+	c, err := secretTool("store", "--label", label, "service", keyringService, "account", key)
+	if err != nil {
+		return err
+	}
+	// secret-tool reads the secret from stdin so it isn't visible in the
+	// process list.
+	c.Stdin = strings.NewReader(secret)
+	return c.Run()
+}
+
+func keyringDelete(key string) error {
+	c, err := secretTool("clear", "service", keyringService, "account", key)
+	if err != nil {
+		return err
+	}
+	return c.Run()
+}
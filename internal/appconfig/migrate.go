@@ -0,0 +1,91 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appconfig
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// migration describes a config key that was renamed.
+type migration struct {
+	OldKey string
+	NewKey string
+	// Since is the release that the key was renamed in, if known.
+	Since string
+}
+
+// String returns the new key name and, if known, the release it was renamed in.
+func (m migration) String() string {
+	if m.Since == "" {
+		return m.NewKey
+	}
+	return fmt.Sprintf("%s in %s", m.NewKey, m.Since)
+}
+
+// migrations lists every renamed config key. When a key is renamed, add an
+// entry here instead of breaking existing config files. Entries should be
+// kept for at least one major release.
+var migrations = []migration{
+	{OldKey: "defaults.tokenlifetime", NewKey: TokenLifetime},
+}
+
+// renamedKey returns the migration for a key that is no longer used.
+func renamedKey(key string) (migration, bool) {
+	key = strings.ToLower(key)
+	for _, m := range migrations {
+		if m.OldKey == key {
+			return m, true
+		}
+	}
+	return migration{}, false
+}
+
+// migrateConfig moves the values of renamed keys in the config file to their
+// new names and rewrites the config file. A backup is written first.
+func migrateConfig() error {
+	var pending []migration
+	for _, m := range migrations {
+		if fileConfig.IsSet(m.OldKey) {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	backupFile, err := BackupConfig()
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		if fileConfig.IsSet(m.NewKey) {
+			util.Logger.Warnf("%s was renamed to %s, removing the old value since %s is already set", m.OldKey, m, m.NewKey)
+			continue
+		}
+		util.Logger.Warnf("%s was renamed to %s, moving the existing value", m.OldKey, m)
+		viper.Set(m.NewKey, fileConfig.Get(m.OldKey))
+	}
+	if err := WriteConfig(); err != nil {
+		return errorsutil.New("Failed to write migrated configuration", err)
+	}
+	util.Logger.Infof("Migrated the configuration file, a backup of the previous version was written to %s", backupFile)
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appconfig
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+func TestMigrateConfig(t *testing.T) {
+	defer func(m []migration) { migrations = m }(migrations)
+	migrations = []migration{{OldKey: "binarypaths.oldgcloud", NewKey: GcloudPath, Since: "v1.0.0"}}
+
+	util.Logger = util.NewLogger()
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	if err := ioutil.WriteFile(configFile, []byte("binarypaths:\n  oldgcloud: /opt/bin/gcloud\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Reset()
+	defer viper.Reset()
+	viper.SetConfigFile(configFile)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadFileConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := fileConfig.GetString(GcloudPath); got != "/opt/bin/gcloud" {
+		t.Errorf("expected %s to be migrated to /opt/bin/gcloud, got %q", GcloudPath, got)
+	}
+	if fileConfig.IsSet("binarypaths.oldgcloud") {
+		t.Error("expected binarypaths.oldgcloud to be removed from the config file")
+	}
+	backups, _ := filepath.Glob(configFile + ".*.bak")
+	if len(backups) != 1 {
+		t.Errorf("expected a backup of the config file to be written, found %d", len(backups))
+	}
+
+	_, err := ParseValue("binarypaths.oldgcloud", "/usr/bin/gcloud")
+	if err == nil || !strings.Contains(err.Error(), "was renamed to binarypaths.gcloud") {
+		t.Errorf("expected a rename error from ParseValue, got %v", err)
+	}
+}
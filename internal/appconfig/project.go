@@ -0,0 +1,101 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appconfig
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+// ProjectConfigName is the name of the per-project config file. When it is
+// found in the current working directory, its values override the values in
+// the global config file.
+const ProjectConfigName = ".eiam.yaml"
+
+// projectKeys are the only keys that the per-project config file can set. The
+// file is read from whatever directory eiam runs in, such as a repository that
+// was just cloned, so it can't change which binaries are run, where
+// credentials and audit records are sent, or how sessions are secured.
+var projectKeys = []string{
+	DefaultsProject,
+	DefaultsServiceAccount,
+	SessionNotifications,
+}
+
+var (
+	// projectConfig holds only the values read from the per-project config file.
+	projectConfig     = viper.New()
+	projectConfigFile string
+	// ignoredProjectKeys are the keys in the per-project config file that
+	// aren't in projectKeys.
+	ignoredProjectKeys []string
+)
+
+// ProjectConfigFile returns the path to the per-project config file in use,
+// or an empty string if there isn't one.
+func ProjectConfigFile() string {
+	return projectConfigFile
+}
+
+// mergeProjectConfig looks for a per-project config file in the current
+// working directory and merges the values of projectKeys on top of the global
+// config. Other keys are ignored.
+func mergeProjectConfig() error {
+	projectConfig = viper.New()
+	projectConfigFile = ""
+	ignoredProjectKeys = nil
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(cwd, ProjectConfigName)
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil
+	}
+
+	fileValues := viper.New()
+	fileValues.SetConfigFile(file)
+	if err := fileValues.ReadInConfig(); err != nil {
+		return err
+	}
+	projectConfigFile = file
+	for _, key := range fileValues.AllKeys() {
+		if !util.Contains(projectKeys, key) {
+			ignoredProjectKeys = append(ignoredProjectKeys, key)
+			continue
+		}
+		projectConfig.Set(key, fileValues.Get(key))
+	}
+	sort.Strings(ignoredProjectKeys)
+	return viper.MergeConfigMap(projectConfig.AllSettings())
+}
+
+// warnIgnoredProjectKeys logs a warning for each key in the per-project config
+// file that was ignored.
+func warnIgnoredProjectKeys() {
+	for _, key := range ignoredProjectKeys {
+		util.Logger.Warnf(
+			"Ignoring %s in %s, only %s can be set per project",
+			key, projectConfigFile, strings.Join(projectKeys, ", "),
+		)
+	}
+}
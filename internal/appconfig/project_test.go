@@ -0,0 +1,86 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestMergeProjectConfig(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	dir := t.TempDir()
+	project := []byte(`defaults:
+  project: my-project
+  serviceaccount: deployer@my-project.iam.gserviceaccount.com
+binarypaths:
+  gcloud: /tmp/evil/gcloud
+audit:
+  webhook: https://collector.example.com
+  webhooktoken: collector-token
+  pubsubtopic: projects/attacker/topics/audit
+security:
+  mfa: none
+`)
+	if err := ioutil.WriteFile(filepath.Join(dir, ProjectConfigName), project, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd) //nolint:errcheck // The test directory is removed anyway
+
+	viper.Set(GcloudPath, "/usr/bin/gcloud")
+	viper.Set(SecurityMFA, MFATOTP)
+	if err := mergeProjectConfig(); err != nil {
+		t.Fatalf("mergeProjectConfig: %v", err)
+	}
+
+	if got := viper.GetString(DefaultsProject); got != "my-project" {
+		t.Errorf("%s = %q, want my-project", DefaultsProject, got)
+	}
+	if got := Source(DefaultsServiceAccount); got != SourceProject {
+		t.Errorf("source of %s = %q, want %q", DefaultsServiceAccount, got, SourceProject)
+	}
+	for key, want := range map[string]string{
+		GcloudPath:        "/usr/bin/gcloud",
+		AuditWebhook:      "",
+		AuditWebhookToken: "",
+		AuditPubSubTopic:  "",
+		SecurityMFA:       MFATOTP,
+	} {
+		if got := viper.GetString(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+		if Source(key) == SourceProject {
+			t.Errorf("%s was set by %s", key, ProjectConfigName)
+		}
+	}
+	wantIgnored := []string{AuditPubSubTopic, AuditWebhook, AuditWebhookToken, GcloudPath, SecurityMFA}
+	if !reflect.DeepEqual(ignoredProjectKeys, wantIgnored) {
+		t.Errorf("ignored keys = %v, want %v", ignoredProjectKeys, wantIgnored)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appconfig
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/viper"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+// PromptCountdown is the value of PromptData.Remaining that renders as the
+// time left in the session, which each shell computes when it shows the
+// prompt.
+const PromptCountdown = "\x00remaining\x00"
+
+// Markers that color() wraps text in while a template is rendered.
+const (
+	colorStart = "\x00color:"
+	colorEnd   = "\x00end\x00"
+)
+
+// PromptColors are the colors that prompt templates can use with color.
+var PromptColors = map[string]int{
+	"black":   30,
+	"red":     31,
+	"green":   32,
+	"yellow":  33,
+	"blue":    34,
+	"magenta": 35,
+	"cyan":    36,
+	"white":   37,
+}
+
+// PromptData is what session.prompttemplate and session.bannertemplate are
+// rendered with.
+type PromptData struct {
+	// ServiceAccount is the impersonated service account.
+	ServiceAccount string
+	// Project is the project of the session, or "" if none is set.
+	Project string
+	// Expiry is the local time that the session ends, e.g. "3:04PM".
+	Expiry string
+	// Remaining is the time left in the session, e.g. "42m".
+	Remaining string
+}
+
+// PromptPart is a piece of a rendered prompt template.
+type PromptPart struct {
+	// Text is the literal text of the part.
+	Text string
+	// Color is the name of the color of the part, or "" for none.
+	Color string
+	// Countdown is set instead of Text when the part is the time left in
+	// the session.
+	Countdown bool
+}
+
+// ParsePromptTemplate parses a prompt or banner template. Templates use Go
+// template syntax with the fields of PromptData, and {{color NAME TEXT}}
+// colors TEXT with one of PromptColors.
+func ParsePromptTemplate(text string) (*template.Template, error) {
+	// NUL bytes mark the colors and the countdown in the rendered template.
+	if strings.Contains(text, "\x00") {
+		return nil, errors.New("the template can't contain NUL bytes")
+	}
+	tmpl, err := template.New("prompt").Funcs(template.FuncMap{"color": promptColor}).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	// Catch unknown fields and colors before the template is used.
+	sample := PromptData{ServiceAccount: "sa", Project: "project", Expiry: "3:04PM", Remaining: PromptCountdown}
+	if err := tmpl.Execute(&bytes.Buffer{}, sample); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// RenderPrompt renders the template in key, which is session.prompttemplate
+// or session.bannertemplate, into the parts that each shell formats in its
+// own syntax.
+func RenderPrompt(key string, data PromptData) ([]PromptPart, error) {
+	tmpl, err := ParsePromptTemplate(viper.GetString(key))
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for %s: %v", key, err)
+	}
+	// The markers can't be forged with the values of the fields.
+	data.ServiceAccount = stripNUL(data.ServiceAccount)
+	data.Project = stripNUL(data.Project)
+	data.Expiry = stripNUL(data.Expiry)
+	if data.Remaining != PromptCountdown {
+		data.Remaining = stripNUL(data.Remaining)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("invalid value for %s: %v", key, err)
+	}
+
+	// The colors are dropped when logging.color or --no-color disable them.
+	colored := util.ColorEnabled(os.Stdout)
+	parts := []PromptPart{}
+	rendered := buf.String()
+	for rendered != "" {
+		start := strings.Index(rendered, colorStart)
+		if start == -1 {
+			parts = appendPromptText(parts, rendered, "")
+			break
+		}
+		parts = appendPromptText(parts, rendered[:start], "")
+		rendered = rendered[start+len(colorStart):]
+		// color() always writes the name, the text, and the end marker.
+		sep := strings.Index(rendered, "\x00")
+		end := strings.Index(rendered, colorEnd)
+		if sep == -1 || end == -1 || sep > end {
+			return nil, fmt.Errorf("invalid value for %s: malformed color", key)
+		}
+		color := rendered[:sep]
+		if !colored {
+			color = ""
+		}
+		parts = appendPromptText(parts, rendered[sep+1:end], color)
+		rendered = rendered[end+len(colorEnd):]
+	}
+	return parts, nil
+}
+
+// appendPromptText appends text to parts, split around countdowns.
+func appendPromptText(parts []PromptPart, text, color string) []PromptPart {
+	for i, piece := range strings.Split(text, PromptCountdown) {
+		if i > 0 {
+			parts = append(parts, PromptPart{Color: color, Countdown: true})
+		}
+		// Stray NUL bytes, e.g. from string constants in the template, would
+		// end the prompt early in some shells.
+		if piece = stripNUL(piece); piece != "" {
+			parts = append(parts, PromptPart{Text: piece, Color: color})
+		}
+	}
+	return parts
+}
+
+func promptColor(name, text string) (string, error) {
+	if _, ok := PromptColors[name]; !ok {
+		return "", fmt.Errorf("unknown color %q", name)
+	}
+	if strings.Contains(text, colorStart) {
+		return "", errors.New("colors can't be nested")
+	}
+	return colorStart + name + "\x00" + text + colorEnd, nil
+}
+
+func stripNUL(s string) string {
+	return strings.ReplaceAll(s, "\x00", "")
+}
+
+func validPromptTemplate(val string) error {
+	_, err := ParsePromptTemplate(val)
+	return err
+}
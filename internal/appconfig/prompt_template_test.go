@@ -0,0 +1,101 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appconfig
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+func TestRenderPrompt(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	defer func(override string) { util.ColorOverride = override }(util.ColorOverride)
+	util.ColorOverride = util.ColorAlways
+
+	data := PromptData{
+		ServiceAccount: "deployer@my-project.iam.gserviceaccount.com",
+		Project:        "my-project",
+		Expiry:         "3:04PM",
+		Remaining:      PromptCountdown,
+	}
+	tests := []struct {
+		template string
+		data     PromptData
+		want     []PromptPart
+		wantErr  bool
+	}{
+		{
+			template: `[{{color "yellow" .Project}}] {{.Remaining}} > `,
+			data:     data,
+			want: []PromptPart{
+				{Text: "["},
+				{Text: "my-project", Color: "yellow"},
+				{Text: "] "},
+				{Countdown: true},
+				{Text: " > "},
+			},
+		},
+		{
+			template: `{{color "red" (print "until " .Expiry " (" .Remaining ")")}}`,
+			data:     data,
+			want: []PromptPart{
+				{Text: "until 3:04PM (", Color: "red"},
+				{Color: "red", Countdown: true},
+				{Text: ")", Color: "red"},
+			},
+		},
+		// Values can't forge the color and countdown markers.
+		{
+			template: `{{.Project}} {{color "cyan" .ServiceAccount}}`,
+			data:     PromptData{Project: "\x00color:red", ServiceAccount: "sa\x00end\x00\x00remaining\x00"},
+			want: []PromptPart{
+				{Text: "color:red "},
+				{Text: "saendremaining", Color: "cyan"},
+			},
+		},
+		// NUL bytes from string constants are dropped.
+		{
+			template: `{{"a\x00b"}}`,
+			data:     data,
+			want:     []PromptPart{{Text: "ab"}},
+		},
+		{template: `{{"\x00color:red"}}`, data: data, wantErr: true},
+		{template: "a\x00b", data: data, wantErr: true},
+		{template: `{{color "purple" .Project}}`, data: data, wantErr: true},
+		{template: `{{.Unknown}}`, data: data, wantErr: true},
+	}
+	for _, tc := range tests {
+		viper.Set(SessionPromptTemplate, tc.template)
+		got, err := RenderPrompt(SessionPromptTemplate, tc.data)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("expected an error rendering %q, got %+v", tc.template, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error rendering %q: %v", tc.template, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("expected %q to render as %+v, got %+v", tc.template, tc.want, got)
+		}
+	}
+}
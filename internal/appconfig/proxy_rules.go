@@ -0,0 +1,139 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appconfig
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// The actions that an auth proxy rule can take.
+const (
+	// RuleInject replaces the credentials of the request with the access
+	// token of the impersonated service account.
+	RuleInject = "inject"
+	// RulePassthrough forwards the request without changing its headers.
+	RulePassthrough = "passthrough"
+)
+
+// regexPrefix marks a rule pattern as a regular expression instead of a glob.
+const regexPrefix = "~"
+
+// ProxyRule decides whether the auth proxy injects the impersonated token
+// into the requests that it matches.
+type ProxyRule struct {
+	Name   string
+	Action string
+
+	host matcher
+	path matcher
+}
+
+// matcher matches a string against a glob or a regular expression. The zero
+// value matches everything.
+type matcher struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// ParseProxyRule parses a rule in the form "ACTION HOST [PATH]". HOST and PATH
+// are glob patterns, or regular expressions when they start with "~".
+func ParseProxyRule(name, spec string) (ProxyRule, error) {
+	args := strings.Fields(spec)
+	if len(args) < 2 || len(args) > 3 {
+		return ProxyRule{}, fmt.Errorf("rules must be in the form 'ACTION HOST [PATH]', got %q", spec)
+	}
+
+	var err error
+	rule := ProxyRule{Name: name, Action: strings.ToLower(args[0])}
+	if rule.Action != RuleInject && rule.Action != RulePassthrough {
+		return ProxyRule{}, fmt.Errorf("the rule action must be %q or %q, got %q", RuleInject, RulePassthrough, args[0])
+	}
+	if rule.host, err = newMatcher(args[1]); err != nil {
+		return ProxyRule{}, err
+	}
+	if len(args) == 3 {
+		if rule.path, err = newMatcher(args[2]); err != nil {
+			return ProxyRule{}, err
+		}
+	}
+	return rule, nil
+}
+
+// ProxyRules returns the rules in the authproxy.rules config section sorted by
+// name.
+func ProxyRules() ([]ProxyRule, error) {
+	specs := viper.GetStringMapString(AuthProxyRules)
+	rules := make([]ProxyRule, 0, len(specs))
+	for _, name := range sortedKeys(specs) {
+		rule, err := ParseProxyRule(name, specs[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s.%s: %v", AuthProxyRules, name, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Matches reports whether the rule applies to a request to the given host and
+// path. The port is ignored when matching the host.
+func (r ProxyRule) Matches(host, urlPath string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if urlPath == "" {
+		urlPath = "/"
+	}
+	return r.host.match(strings.ToLower(host)) && r.path.match(urlPath)
+}
+
+// MatchesHost reports whether the rule applies to any request to the given
+// host. The port is ignored.
+func (r ProxyRule) MatchesHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return r.host.match(strings.ToLower(host))
+}
+
+func newMatcher(pattern string) (matcher, error) {
+	if strings.HasPrefix(pattern, regexPrefix) {
+		re, err := regexp.Compile(strings.TrimPrefix(pattern, regexPrefix))
+		if err != nil {
+			return matcher{}, fmt.Errorf("%q is not a valid regular expression: %v", pattern, err)
+		}
+		return matcher{pattern: pattern, re: re}, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return matcher{}, fmt.Errorf("%q is not a valid pattern", pattern)
+	}
+	return matcher{pattern: pattern}, nil
+}
+
+func (m matcher) match(s string) bool {
+	if m.re != nil {
+		return m.re.MatchString(s)
+	}
+	if m.pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(m.pattern, s)
+	return matched
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appconfig
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestProxyRules(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	viper.Set(AuthProxyRules, map[string]interface{}{
+		"10-registry": `passthrough ~^[a-z0-9-]+\.pkg\.dev$`,
+		"20-storage":  "passthrough storage.googleapis.com /upload/*",
+		"30-internal": "inject api.internal.example.com",
+		"40-example":  "passthrough *.example.com",
+	})
+	rules, err := ProxyRules()
+	if err != nil {
+		t.Fatalf("failed to load rules: %v", err)
+	}
+
+	tests := []struct {
+		host string
+		path string
+		want string
+	}{
+		{host: "us-docker.pkg.dev:443", path: "/v2/", want: RulePassthrough},
+		{host: "storage.googleapis.com", path: "/upload/storage", want: RulePassthrough},
+		{host: "storage.googleapis.com", path: "/storage/v1/b", want: ""},
+		{host: "API.internal.example.com", path: "/v1/things", want: RuleInject},
+		{host: "other.example.com", path: "/", want: RulePassthrough},
+		{host: "example.com", path: "/", want: ""},
+	}
+	for _, tc := range tests {
+		var got string
+		for _, rule := range rules {
+			if rule.Matches(tc.host, tc.path) {
+				got = rule.Action
+				break
+			}
+		}
+		if got != tc.want {
+			t.Errorf("%s%s: got action %q, want %q", tc.host, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestParseProxyRuleInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"inject",
+		"rewrite example.com",
+		"inject ~[a-z example.com",
+		"inject example.com /a /b",
+		"passthrough [example.com",
+	} {
+		if _, err := ParseProxyRule("test", spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appconfig
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/spf13/viper"
+
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// BackupConfig copies the current config file to a timestamped backup file in
+// the same directory and returns the path of the backup.
+func BackupConfig() (string, error) {
+	configFile := ConfigFile()
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return "", errorsutil.New("Failed to read configuration file", err)
+	}
+
+	backupFile := fmt.Sprintf("%s.%s.bak", configFile, time.Now().Format("20060102150405"))
+	if err := ioutil.WriteFile(backupFile, data, 0o600); err != nil {
+		return "", errorsutil.New(fmt.Sprintf("Failed to write configuration backup %s", backupFile), err)
+	}
+	return backupFile, nil
+}
+
+// ResetKey restores a single config key to its built-in default value.
+func ResetKey(key string) error {
+	if binName, ok := binPaths[key]; ok {
+		// Binary paths don't have a static default, so look them up again.
+		binPath, err := DetectBinaryPath(key)
+		if err != nil && !OptionalBinary(key) {
+			return errorsutil.New(fmt.Sprintf("Failed to find the %s binary", binName), err)
+		}
+		viper.Set(key, binPath)
+	} else if val, ok := DefaultValue(key); ok {
+		viper.Set(key, val)
+	} else {
+		return fmt.Errorf("%s does not have a default value", key)
+	}
+
+	if err := WriteConfig(); err != nil {
+		return errorsutil.New("Failed to write updated configuration", err)
+	}
+	return nil
+}
+
+// ResetConfig replaces the config file with one containing only the built-in
+// defaults and reloads the configuration. The format of the config file is
+// kept.
+func ResetConfig() error {
+	format := ConfigFormat()
+	if err := os.Remove(ConfigFile()); err != nil && !os.IsNotExist(err) {
+		return errorsutil.New("Failed to remove configuration file", err)
+	}
+	viper.Reset()
+	if err := InitConfig(); err != nil {
+		return err
+	}
+	if format != ConfigFormat() {
+		_, err := ConvertConfig(format)
+		return err
+	}
+	return nil
+}
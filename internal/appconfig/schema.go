@@ -0,0 +1,876 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appconfig
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+)
+
+// The types of values that config fields can hold.
+const (
+	StringField   = "string"
+	BoolField     = "bool"
+	IntField      = "int"
+	DurationField = "duration"
+	ListField     = "list"
+	MapField      = "map"
+)
+
+// Field describes a single config key.
+type Field struct {
+	Key         string
+	Type        string
+	Description string
+	// MachineSpecific fields, like binary paths, only make sense on the
+	// machine they were set on and are not exported.
+	MachineSpecific bool
+	// Sensitive fields hold credentials. They are stored in the OS keyring when
+	// it is available, masked when printed, and never exported.
+	Sensitive bool
+	// Validate performs additional checks (e.g. range checks) on the string
+	// representation of the value after its type has been checked.
+	Validate func(val string) error
+}
+
+// The ways that security.mfa can confirm that a person is present.
+const (
+	MFANone    = "none"
+	MFATOTP    = "totp"
+	MFACommand = "command"
+)
+
+// What session.transcript records in the privileged sub-shell.
+const (
+	TranscriptNone     = "none"
+	TranscriptCommands = "commands"
+	TranscriptFull     = "full"
+)
+
+var (
+	loggingLevels  = []string{"trace", "debug", "info", "warn", "error", "fatal", "panic"}
+	loggingFormats = []string{"text", "json", "debug"}
+	loggingOutputs = []string{util.OutputStderr, util.OutputSyslog, util.OutputJournald}
+	loggingColors  = []string{util.ColorAuto, util.ColorAlways, util.ColorNever}
+	mfaMethods     = []string{MFANone, MFATOTP, MFACommand}
+	transcripts    = []string{TranscriptNone, TranscriptCommands, TranscriptFull}
+)
+
+var schema = []Field{
+	{
+		Key:             AuthCredentialFile,
+		Type:            StringField,
+		MachineSpecific: true,
+		Description: "The path to a credential file, such as a Workload Identity Federation credential " +
+			"configuration file, that eiam authenticates with instead of the gcloud account and application " +
+			"default credentials",
+		Validate: validCredentialFile,
+	},
+	{
+		Key:             AuthProxyCertFile,
+		Type:            StringField,
+		MachineSpecific: true,
+		Description:     "The path to the auth proxy's TLS certificate",
+	},
+	{
+		Key:             AuthProxyKeyFile,
+		Type:            StringField,
+		MachineSpecific: true,
+		Description:     "The path to the auth proxy's x509 key",
+	},
+	{
+		Key:             AuthProxyLogDir,
+		Type:            StringField,
+		MachineSpecific: true,
+		Description:     "The directory that auth proxy logs will be written to",
+		Validate:        notEmpty,
+	},
+	{
+		Key:  AuthProxyAuditLog,
+		Type: BoolField,
+		Description: "When set to 'true', the auth proxy writes a JSON line for every intercepted request to an " +
+			"audit log in authproxy.logdir",
+	},
+	{
+		Key:  AuthProxyAddress,
+		Type: StringField,
+		Description: "The address that the auth proxy is hosted on. IPv6 addresses such as '::1' are supported, " +
+			"and 'localhost' listens on both the IPv4 and IPv6 loopback addresses",
+		Validate: validProxyAddress,
+	},
+	{
+		Key:         AuthProxyPort,
+		Type:        IntField,
+		Description: "The port that the auth proxy runs on",
+		Validate:    intRange(1, 65535),
+	},
+	{
+		Key:             AuthProxySocketPath,
+		Type:            StringField,
+		MachineSpecific: true,
+		Description: "When set, the auth proxy listens on a Unix socket at this path instead of a TCP port. " +
+			"Only the current user can connect to the socket",
+	},
+	{
+		Key:         AuthProxyVerbose,
+		Type:        BoolField,
+		Description: "When set to 'true', verbose output for proxy logs will be enabled",
+	},
+	{
+		Key:  AuthProxyClientAuth,
+		Type: BoolField,
+		Description: "When set to 'true', the auth proxy only accepts HTTPS connections from clients that " +
+			"present the client certificate generated in the config directory",
+	},
+	{
+		Key:  AuthProxyRotateBefore,
+		Type: DurationField,
+		Description: "The auth proxy CA is rotated when a privileged session starts less than this long before " +
+			"it expires. Set to '0s' to only rotate expired certificates",
+		Validate: durationRange(0, 365*24*time.Hour),
+	},
+	{
+		Key:  AuthProxyShutdownTimeout,
+		Type: DurationField,
+		Description: "How long the auth proxy waits for requests in flight to finish when the session ends " +
+			"before canceling them",
+		Validate: durationRange(0, 5*time.Minute),
+	},
+	{
+		Key:  AuthProxyTLSMinVersion,
+		Type: StringField,
+		Description: "The minimum TLS version that the auth proxy accepts from clients and uses with upstream " +
+			"servers. Can be '1.2' or '1.3'",
+		Validate: validTLSVersion,
+	},
+	{
+		Key:  AuthProxyTLSCiphers,
+		Type: ListField,
+		Description: "A comma separated list of the TLS 1.2 cipher suites that the auth proxy allows, e.g. " +
+			"'TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384'. When empty, Go's secure defaults are used. TLS 1.3 " +
+			"cipher suites can't be configured",
+		Validate: validCipherSuites,
+	},
+	{
+		Key:  AuthProxyBypassDomains,
+		Type: ListField,
+		Description: "A comma separated list of hosts that the auth proxy passes traffic to without adding " +
+			"credentials, e.g. internal artifact mirrors. Patterns such as '*.example.com' are supported",
+		Validate: patternList,
+	},
+	{
+		Key:  AuthProxyInterceptAll,
+		Type: BoolField,
+		Description: "When set to 'true', the auth proxy intercepts HTTPS traffic to every host. By default, " +
+			"traffic to hosts other than '*.googleapis.com' and 'tunnel.cloudproxy.app' is tunneled unless an " +
+			"authproxy.rules 'inject' rule matches the host",
+	},
+	{
+		Key:  AuthProxyCacheTTL,
+		Type: DurationField,
+		Description: "How long the auth proxy caches the responses to read-only requests such as GET requests " +
+			"and testIamPermissions calls. Set to '0s' to disable the cache",
+		Validate: durationRange(0, time.Hour),
+	},
+	{
+		Key:  AuthProxyRules,
+		Type: MapField,
+		Description: "Rules that decide which requests the auth proxy adds the access token to, in the form " +
+			"'ACTION HOST [PATH]' where ACTION is 'inject' or 'passthrough'. Patterns starting with '~' are " +
+			"regular expressions. Rules are checked in order of their names and the first match wins",
+		Validate: validProxyRule,
+	},
+	{
+		Key:  AuthProxyTokenScopes,
+		Type: MapField,
+		Description: "OAuth scopes that limit the access token sent to matching hosts, in the form " +
+			"'HOST SCOPE [SCOPE...]'. Scopes that aren't URLs are relative to https://www.googleapis.com/auth/. " +
+			"Entries are checked in order of their names and the first match wins",
+		Validate: validTokenScope,
+	},
+	{
+		Key:  AuthProxyAccessBounds,
+		Type: MapField,
+		Description: "Credential Access Boundaries for requests to Cloud Storage, in the form 'BUCKET ROLE'. " +
+			"When set, Cloud Storage requests can only use the permissions of ROLE on the listed buckets",
+		Validate: validAccessBoundary,
+	},
+	{
+		Key:  AuthProxyRateLimit,
+		Type: IntField,
+		Description: "The number of requests per second that the auth proxy forwards. Requests over the limit " +
+			"are delayed. Set to 0 to disable the limit",
+		Validate: intRange(0, 100000),
+	},
+	{
+		Key:  AuthProxyHostRateLimit,
+		Type: IntField,
+		Description: "The number of requests per second that the auth proxy forwards to each host. Requests " +
+			"over the limit are delayed. Set to 0 to disable the limit",
+		Validate: intRange(0, 100000),
+	},
+	{
+		Key:  AuthProxyUpstream,
+		Type: StringField,
+		Description: "The URL of an HTTP or HTTPS proxy that the auth proxy sends its traffic through, e.g. " +
+			"'http://proxy.example.com:3128'. Defaults to the HTTPS_PROXY environment variable",
+		Validate: validProxyURL,
+	},
+	{
+		Key:         AuthProxyUpstreamAuth,
+		Type:        StringField,
+		Sensitive:   true,
+		Description: "The 'USER:PASSWORD' to authenticate to authproxy.upstreamproxy with",
+		Validate:    validBasicAuth,
+	},
+	{
+		Key:             BqPath,
+		Type:            StringField,
+		MachineSpecific: true,
+		Description:     "The path to the bq binary on your filesystem",
+	},
+	{
+		Key:             CloudSQLProxyPath,
+		Type:            StringField,
+		MachineSpecific: true,
+		Description:     "The path to the cloud_sql_proxy or cloud-sql-proxy binary on your filesystem",
+	},
+	{
+		Key:             GcloudPath,
+		Type:            StringField,
+		MachineSpecific: true,
+		Description:     "The path to the gcloud binary on your filesystem",
+	},
+	{
+		Key:             GsutilPath,
+		Type:            StringField,
+		MachineSpecific: true,
+		Description:     "The path to the gsutil binary on your filesystem",
+	},
+	{
+		Key:             KubectlPath,
+		Type:            StringField,
+		MachineSpecific: true,
+		Description:     "The path to the kubectl binary on your filesystem",
+	},
+	{
+		Key:             TerraformPath,
+		Type:            StringField,
+		MachineSpecific: true,
+		Description:     "The path to the terraform binary on your filesystem",
+	},
+	{
+		Key:  GithubAuth,
+		Type: BoolField,
+		Description: "When set to 'true', the \"plugins install\" command will use a configured personal " +
+			"access token to authenticate to the Github API.",
+	},
+	{
+		Key:         GithubTokens,
+		Type:        MapField,
+		Sensitive:   true,
+		Description: "The configured Github personal access tokens",
+	},
+	{
+		Key:             KeyringEnabled,
+		Type:            BoolField,
+		MachineSpecific: true,
+		Description: "When set to 'true', sensitive values such as Github access tokens are stored in the OS " +
+			"keyring instead of the config file",
+	},
+	{
+		Key:  LoggingColor,
+		Type: StringField,
+		Description: "When to color logs and tables: 'auto', only when writing to a terminal and NO_COLOR " +
+			"is unset, 'always', or 'never'. The --no-color flag sets 'never' for a single command",
+		Validate: oneOf("color mode", loggingColors),
+	},
+	{
+		Key:             LoggingFile,
+		Type:            StringField,
+		MachineSpecific: true,
+		Description: "A file that every log is also written to, with timestamps and the PID of the command, to " +
+			"debug failures after the fact. When empty, logs are only written to the console",
+	},
+	{
+		Key:         LoggingFormat,
+		Type:        StringField,
+		Description: "The format for which to write console logs. Can be 'json', 'text', or 'debug'",
+		Validate:    oneOf("logging format", loggingFormats),
+	},
+	{
+		Key:  LoggingLevel,
+		Type: StringField,
+		Description: "The logging level to write to the console. Can be one of 'trace', 'debug', 'info', " +
+			"'warn', 'error', 'fatal', or 'panic'",
+		Validate: oneOf("logging level", loggingLevels),
+	},
+	{
+		Key:         LoggingLevelTruncation,
+		Type:        BoolField,
+		Description: "When set to 'true', the level indicator for logs will not be truncated",
+	},
+	{
+		Key:         LoggingMaxBackups,
+		Type:        IntField,
+		Description: "The number of rotated logging.file files that are kept",
+		Validate:    intRange(0, 100),
+	},
+	{
+		Key:         LoggingMaxSize,
+		Type:        IntField,
+		Description: "The size in MB that logging.file is rotated at. Set to 0 to never rotate it",
+		Validate:    intRange(0, 10000),
+	},
+	{
+		Key:  LoggingOutput,
+		Type: StringField,
+		Description: "Where logs are written: 'stderr', the console, or 'syslog' or 'journald', the systemd " +
+			"journal, for logging agents to pick up instead",
+		Validate: oneOf("log output", loggingOutputs),
+	},
+	{
+		Key:         LoggingPadLevelText,
+		Type:        BoolField,
+		Description: "When set to 'true', output logs will align evenly with their output level indicator",
+	},
+	{
+		Key:  SecurityAllowedSAs,
+		Type: ListField,
+		Description: "A comma separated list of service accounts that can be impersonated. Patterns such as " +
+			"'*@my-project.iam.gserviceaccount.com' are supported. When empty, every account is allowed",
+		Validate: patternList,
+	},
+	{
+		Key:  SecurityDeniedSAs,
+		Type: ListField,
+		Description: "A comma separated list of service accounts that can never be impersonated. Patterns are " +
+			"supported and this list takes precedence over security.allowedserviceaccounts",
+		Validate: patternList,
+	},
+	{
+		Key:  SecurityMaxSession,
+		Type: DurationField,
+		Description: "The longest that a privileged session can last (e.g. '2h'). The sub-shell and the auth proxy " +
+			"are shut down when it is reached, even if the session was started with a longer --duration. When " +
+			"'0s', sessions aren't limited",
+		Validate: durationRange(0, 24*time.Hour),
+	},
+	{
+		Key:  SecurityApprovalWebhook,
+		Type: StringField,
+		Description: "When set, commands that impersonate a service account post a request to this URL and wait " +
+			"for an approver to allow it",
+		Validate: validWebhookURL,
+	},
+	{
+		Key:         SecurityApprovalToken,
+		Type:        StringField,
+		Sensitive:   true,
+		Description: "The bearer token to authenticate to security.approvalwebhook with",
+	},
+	{
+		Key:  SecurityApprovalSAs,
+		Type: ListField,
+		Description: "A comma separated list of service accounts that need approval when security.approvalwebhook " +
+			"is set. Patterns are supported. When empty, every account needs approval",
+		Validate: patternList,
+	},
+	{
+		Key:  APIConcurrency,
+		Type: IntField,
+		Description: "The most GCP API requests that commands such as query-permissions and list-service-accounts " +
+			"make at a time. Requests that are rate limited are tried again with exponential backoff",
+		Validate: intRange(1, 100),
+	},
+	{
+		Key:  AuditHistory,
+		Type: BoolField,
+		Description: "When set to 'true', every eiam command is recorded in the local audit history, which is " +
+			"read with 'eiam audit list' and 'eiam audit export'",
+	},
+	{
+		Key:  AuditPubSubTopic,
+		Type: StringField,
+		Description: "A Pub/Sub topic, as 'projects/PROJECT/topics/TOPIC', that an event is published to when " +
+			"an eiam command starts and ends, for central monitoring",
+		Validate: validPubSubTopic,
+	},
+	{
+		Key:         AuditWebhook,
+		Type:        StringField,
+		Description: "A URL that an event is posted to as JSON when an eiam command starts and ends, for central monitoring",
+		Validate:    validWebhookURL,
+	},
+	{
+		Key:         AuditWebhookToken,
+		Type:        StringField,
+		Sensitive:   true,
+		Description: "The bearer token to authenticate to audit.webhook with",
+	},
+	{
+		Key:  CacheTTL,
+		Type: DurationField,
+		Description: "How long the service accounts and IAM policies read by commands such as list-service-accounts " +
+			"and paths are cached. Set to '0s' to disable the cache, or use the --no-cache flag for a single command",
+		Validate: durationRange(0, 24*time.Hour),
+	},
+	{
+		Key:  QueryPermsCacheTTL,
+		Type: DurationField,
+		Description: "How long the permissions that can be tested on each type of resource are cached for the " +
+			"query-permissions commands. Set to '0s' to always fetch them from the IAM API",
+		Validate: durationRange(0, 30*24*time.Hour),
+	},
+	{
+		Key:         SecurityApprovalTimeout,
+		Type:        DurationField,
+		Description: "How long to wait for an approver to respond to an approval request",
+		Validate:    durationRange(time.Minute, 24*time.Hour),
+	},
+	{
+		Key:  SecurityReasonPattern,
+		Type: StringField,
+		Description: "A regular expression that the --reason of commands that impersonate a service account must " +
+			"match, e.g. '[A-Z]+-[0-9]+' to require a ticket ID. When empty, any reason is accepted",
+		Validate: validRegexp,
+	},
+	{
+		Key:  SecurityMFA,
+		Type: StringField,
+		Description: "How to confirm that a person is present before a service account is impersonated. Can be " +
+			"'none', 'totp' to ask for a code from an authenticator app, or 'command' to run security.mfacommand",
+		Validate: oneOf("MFA method", mfaMethods),
+	},
+	{
+		Key:  SecurityMFACommand,
+		Type: StringField,
+		Description: "A command that asks for a second factor, such as Touch ID or a security key, when " +
+			"security.mfa is 'command'. It is run with bash, or cmd.exe on Windows, and must exit with a zero status",
+	},
+	{
+		Key:         SecurityMFASecret,
+		Type:        StringField,
+		Sensitive:   true,
+		Description: "The base32 TOTP secret that codes are checked against when security.mfa is 'totp'. Set it with 'eiam mfa enroll'",
+	},
+	{
+		Key:         DefaultsProject,
+		Type:        StringField,
+		Description: "The GCP project to use when the --project flag isn't set. Defaults to the active gcloud config",
+	},
+	{
+		Key:         DefaultsScopes,
+		Type:        ListField,
+		Description: "A comma separated list of OAuth scopes to request for generated access tokens",
+		Validate:    notEmpty,
+	},
+	{
+		Key:  DefaultsServiceAccount,
+		Type: StringField,
+		Description: "The service account to impersonate when the --service-account-email flag isn't set and the " +
+			"project doesn't have a default service account",
+	},
+	{
+		Key:  SessionPromptTemplate,
+		Type: StringField,
+		Description: "The prompt of the privileged sub-shell, as a Go template with the fields .ServiceAccount, " +
+			".Project, .Expiry, and .Remaining, the time left in the session. {{color NAME TEXT}} colors TEXT " +
+			"black, red, green, yellow, blue, magenta, cyan, or white",
+		Validate: validPromptTemplate,
+	},
+	{
+		Key:  SessionBannerTemplate,
+		Type: StringField,
+		Description: "The banner shown when the privileged sub-shell starts, as a template with the same fields " +
+			"and functions as session.prompttemplate",
+		Validate: validPromptTemplate,
+	},
+	{
+		Key:  SessionIdleTimeout,
+		Type: DurationField,
+		Description: "How long a privileged sub-shell can go without input or requests through the auth proxy " +
+			"(e.g. '30m') before the session is ended. When '0s', idle sessions aren't ended",
+		Validate: durationRange(0, 24*time.Hour),
+	},
+	{
+		Key:  SessionNotifications,
+		Type: BoolField,
+		Description: "When set to 'true', a desktop notification is shown 5 minutes before a privileged session " +
+			"ends and when it is ended by eiam",
+	},
+	{
+		Key:  SessionTranscript,
+		Type: StringField,
+		Description: "What is recorded in the audit directory of a privileged sub-shell: 'none', 'commands', the " +
+			"commands that are run, or 'full', the commands and everything that the sub-shell prints",
+		Validate: oneOf("transcript", transcripts),
+	},
+	{
+		Key:  TokenLifetime,
+		Type: DurationField,
+		Description: "How long generated access tokens are valid for (e.g. '10m' or '1h'). GCP limits tokens to 1 hour " +
+			"unless the iam.allowServiceAccountCredentialLifetimeExtension org policy allows up to 12 hours",
+		Validate: durationRange(time.Second, 12*time.Hour),
+	},
+	{
+		Key:  TokenSessionLength,
+		Type: DurationField,
+		Description: "How long privileged sessions last (e.g. '4h'). The access token is refreshed shortly before it " +
+			"expires until the session has lasted this long. When '0s', the session ends when the first access " +
+			"token expires",
+		Validate: durationRange(0, 24*time.Hour),
+	},
+	{
+		Key:         DefaultServiceAccounts,
+		Type:        MapField,
+		Description: "The default service accounts set via the 'default-service-accounts' command",
+	},
+	{
+		Key:  Aliases,
+		Type: MapField,
+		Description: "Short names for eiam commands, e.g. 'aliases.prod-deploy' set to 'assume-privileges -s " +
+			"deployer@prod.iam.gserviceaccount.com' lets you run 'eiam prod-deploy'",
+		Validate: validAlias,
+	},
+}
+
+// Fields returns the description of every config key, sorted by key.
+func Fields() []Field {
+	fields := make([]Field, len(schema))
+	copy(fields, schema)
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Key < fields[j].Key })
+	return fields
+}
+
+// LookupField returns the schema entry for a config key. Keys nested under a
+// map field (e.g. serviceaccounts.my-project) resolve to the map field.
+func LookupField(key string) (Field, bool) {
+	key = strings.ToLower(key)
+	for _, f := range schema {
+		if f.Key == key || (f.Type == MapField && strings.HasPrefix(key, f.Key+".")) {
+			return f, true
+		}
+	}
+	return Field{}, false
+}
+
+// ParseValue validates the string representation of a value for the given key
+// and converts it to the type that the key holds.
+func ParseValue(key, val string) (interface{}, error) {
+	f, ok := LookupField(key)
+	if !ok {
+		if m, renamed := renamedKey(key); renamed {
+			return nil, fmt.Errorf("%s was renamed to %s", key, m)
+		}
+		return nil, fmt.Errorf("invalid config key %s", key)
+	}
+
+	var parsed interface{} = val
+	var err error
+	switch f.Type {
+	case BoolField:
+		parsed, err = cast.ToBoolE(val)
+		if err != nil {
+			return nil, fmt.Errorf("the %s value must be either true or false", key)
+		}
+	case IntField:
+		if _, err = cast.ToIntE(val); err != nil {
+			return nil, fmt.Errorf("the %s value must be an integer", key)
+		}
+	case DurationField:
+		if _, err = time.ParseDuration(val); err != nil {
+			return nil, fmt.Errorf("the %s value must be a duration such as 10m or 1h", key)
+		}
+	case ListField:
+		parsed = util.SplitList(val)
+	}
+
+	if f.Validate != nil {
+		if err := f.Validate(val); err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %v", key, err)
+		}
+	}
+	return parsed, nil
+}
+
+// ValidateConfig checks the effective configuration against the schema. It
+// reports unknown keys, values of the wrong type, and out of range values.
+func ValidateConfig() error {
+	var problems []string
+	for _, key := range fileConfig.AllKeys() {
+		if _, ok := LookupField(key); !ok {
+			problems = append(problems, fmt.Sprintf("unknown config key %s", key))
+		}
+	}
+	for _, key := range viper.AllKeys() {
+		f, ok := LookupField(key)
+		if !ok || f.Type == MapField {
+			continue
+		}
+		if _, err := parseRawValue(f, key, viper.Get(key)); err != nil {
+			problems = append(problems, fmt.Sprintf("%v (source: %s)", err, Source(key)))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf(
+		"the configuration in %s is invalid:\n  - %s\nUse 'eiam config set' or 'eiam config reset' to fix it",
+		ConfigFile(),
+		strings.Join(problems, "\n  - "),
+	)
+}
+
+// CheckConfigFile validates every value in a config file without loading it.
+func CheckConfigFile(file string) error {
+	in := viper.New()
+	in.SetConfigFile(file)
+	if err := in.ReadInConfig(); err != nil {
+		return err
+	}
+
+	var problems []string
+	for _, key := range in.AllKeys() {
+		f, ok := LookupField(key)
+		if !ok {
+			if m, renamed := renamedKey(key); renamed {
+				problems = append(problems, fmt.Sprintf("%s was renamed to %s", key, m))
+			} else {
+				problems = append(problems, fmt.Sprintf("unknown config key %s", key))
+			}
+			continue
+		}
+		if _, err := parseRawValue(f, key, in.Get(key)); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("%s is invalid:\n  - %s", file, strings.Join(problems, "\n  - "))
+}
+
+// parseRawValue validates a value read from a config source and converts it
+// to the type that the key holds.
+func parseRawValue(f Field, key string, raw interface{}) (interface{}, error) {
+	if f.Type == MapField && key == f.Key {
+		// Only empty maps show up under the field's own key, the items in
+		// other maps are checked individually.
+		if _, err := cast.ToStringMapE(raw); err != nil {
+			return nil, fmt.Errorf("the %s value must be a %s", key, f.Type)
+		}
+		return raw, nil
+	}
+	val, err := stringValue(f, raw)
+	if err != nil {
+		return nil, fmt.Errorf("the %s value must be a %s", key, f.Type)
+	}
+	return ParseValue(key, val)
+}
+
+// stringValue returns the string representation of a config value that
+// ParseValue accepts. Lists are joined with commas.
+func stringValue(f Field, val interface{}) (string, error) {
+	if s, ok := val.(string); ok {
+		return s, nil
+	}
+	if f.Type != ListField {
+		return cast.ToStringE(val)
+	}
+	items, err := cast.ToStringSliceE(val)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(items, ","), nil
+}
+
+func notEmpty(val string) error {
+	if val == "" {
+		return errors.New("value cannot be empty")
+	}
+	return nil
+}
+
+func validCredentialFile(val string) error {
+	if val == "" {
+		return nil
+	}
+	return gcpclient.ReadCredentialFile(val)
+}
+
+func validRegexp(val string) error {
+	_, err := regexp.Compile(val)
+	return err
+}
+
+func validAlias(val string) error {
+	args, err := util.SplitArgs(val)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errors.New("value cannot be empty")
+	}
+	return nil
+}
+
+func validProxyRule(val string) error {
+	_, err := ParseProxyRule("", val)
+	return err
+}
+
+func validTokenScope(val string) error {
+	_, err := ParseTokenScope("", val)
+	return err
+}
+
+func validAccessBoundary(val string) error {
+	_, err := ParseAccessBoundary(val)
+	return err
+}
+
+func validProxyAddress(val string) error {
+	if err := notEmpty(val); err != nil {
+		return err
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(val, "["), "]")
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return fmt.Errorf("%q is not a valid IPv6 address", val)
+	}
+	if strings.ContainsAny(host, "[]/ ") {
+		return fmt.Errorf("%q is not a valid address", val)
+	}
+	return nil
+}
+
+func validTLSVersion(val string) error {
+	if _, ok := tlsVersions[val]; !ok {
+		return fmt.Errorf("the TLS version must be '1.2' or '1.3', got %q", val)
+	}
+	return nil
+}
+
+func validCipherSuites(val string) error {
+	_, err := parseCipherSuites(util.SplitList(val))
+	return err
+}
+
+func validProxyURL(val string) error {
+	if val == "" {
+		return nil
+	}
+	u, err := url.Parse(val)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("the proxy URL must start with http:// or https://, got %q", val)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("the proxy URL must include a host, got %q", val)
+	}
+	if u.User != nil {
+		return fmt.Errorf("set the proxy credentials with %s instead of in the URL", AuthProxyUpstreamAuth)
+	}
+	return nil
+}
+
+func validBasicAuth(val string) error {
+	if val != "" && !strings.Contains(val, ":") {
+		return errors.New("the value must be in the form USER:PASSWORD")
+	}
+	return nil
+}
+
+func validWebhookURL(val string) error {
+	if val == "" {
+		return nil
+	}
+	u, err := url.Parse(val)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("the webhook URL must start with http:// or https://, got %q", val)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("the webhook URL must include a host, got %q", val)
+	}
+	return nil
+}
+
+var pubSubTopicPattern = regexp.MustCompile(`^projects/[^/]+/topics/[^/]+$`)
+
+func validPubSubTopic(val string) error {
+	if val != "" && !pubSubTopicPattern.MatchString(val) {
+		return fmt.Errorf("the topic must be a resource name like projects/my-project/topics/my-topic, got %q", val)
+	}
+	return nil
+}
+
+func patternList(val string) error {
+	for _, pattern := range util.SplitList(val) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%q is not a valid pattern", pattern)
+		}
+	}
+	return nil
+}
+
+func intRange(min, max int) func(string) error {
+	return func(val string) error {
+		i := cast.ToInt(val)
+		if i < min || i > max {
+			return fmt.Errorf("must be between %d and %d, got %s", min, max, val)
+		}
+		return nil
+	}
+}
+
+func durationRange(min, max time.Duration) func(string) error {
+	return func(val string) error {
+		d, _ := time.ParseDuration(val)
+		if d < min || d > max {
+			return fmt.Errorf("must be between %s and %s, got %s", min, max, val)
+		}
+		return nil
+	}
+}
+
+func oneOf(name string, values []string) func(string) error {
+	return func(val string) error {
+		if !util.Contains(values, val) {
+			return fmt.Errorf("%s must be one of %v", name, values)
+		}
+		return nil
+	}
+}
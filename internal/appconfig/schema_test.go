@@ -0,0 +1,86 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appconfig
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		key     string
+		val     string
+		want    interface{}
+		wantErr string
+	}{
+		{key: AuthProxyPort, val: "8084", want: "8084"},
+		{key: AuthProxyPort, val: "70000", wantErr: "must be between 1 and 65535"},
+		{key: AuthProxyPort, val: "http", wantErr: "must be an integer"},
+		{key: AuthProxyVerbose, val: "true", want: true},
+		{key: AuthProxyVerbose, val: "yes", wantErr: "must be either true or false"},
+		{key: LoggingLevel, val: "debug", want: "debug"},
+		{key: LoggingLevel, val: "verbose", wantErr: "logging level must be one of"},
+		{key: TokenLifetime, val: "1h", want: "1h"},
+		{key: TokenLifetime, val: "600", wantErr: "must be a duration"},
+		{key: TokenLifetime, val: "13h", wantErr: "must be between 1s and 12h0m0s"},
+		{key: SecurityMaxSession, val: "0s", want: "0s"},
+		{key: SecurityMaxSession, val: "25h", wantErr: "must be between 0s and 24h0m0s"},
+		{key: AuthCredentialFile, val: "", want: ""},
+		{key: AuthCredentialFile, val: "testdata/missing.json", wantErr: "no such file or directory"},
+		{key: SecurityReasonPattern, val: "[A-Z]+-[0-9]+", want: "[A-Z]+-[0-9]+"},
+		{key: SecurityReasonPattern, val: "JIRA-(", wantErr: "missing closing )"},
+		{key: SecurityMFA, val: "totp", want: "totp"},
+		{key: SecurityMFA, val: "sms", wantErr: "MFA method must be one of"},
+		{key: SecurityApprovalWebhook, val: "https://approvals.example.com/eiam", want: "https://approvals.example.com/eiam"},
+		{key: SecurityApprovalWebhook, val: "approvals.example.com", wantErr: "must start with http:// or https://"},
+		{key: SecurityApprovalTimeout, val: "30s", wantErr: "must be between 1m0s and 24h0m0s"},
+		{key: DefaultsScopes, val: "scope-a, scope-b,", want: []string{"scope-a", "scope-b"}},
+		{key: DefaultsScopes, val: "", wantErr: "value cannot be empty"},
+		{key: AuthProxyAddress, val: "[::1]", want: "[::1]"},
+		{key: AuthProxyAddress, val: "::g", wantErr: "not a valid IPv6 address"},
+		{key: AuthProxyTLSMinVersion, val: "1.3", want: "1.3"},
+		{key: AuthProxyTLSMinVersion, val: "1.1", wantErr: "must be '1.2' or '1.3'"},
+		{key: AuthProxyTLSCiphers, val: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", want: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}},
+		{key: AuthProxyTLSCiphers, val: "TLS_RSA_WITH_RC4_128_SHA", wantErr: "insecure cipher suite"},
+		{key: "notakey.thatexists", val: "value", wantErr: "invalid config key notakey.thatexists"},
+	}
+
+	for _, tc := range tests {
+		got, err := ParseValue(tc.key, tc.val)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("ParseValue(%q, %q): expected error containing %q, got %v", tc.key, tc.val, tc.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseValue(%q, %q): unexpected error: %v", tc.key, tc.val, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseValue(%q, %q) = %v, expected %v", tc.key, tc.val, got, tc.want)
+		}
+	}
+}
+
+func TestLookupFieldMapKeys(t *testing.T) {
+	f, ok := LookupField("serviceaccounts.my-project")
+	if !ok || f.Key != DefaultServiceAccounts {
+		t.Errorf("expected serviceaccounts.my-project to resolve to %s, got %q", DefaultServiceAccounts, f.Key)
+	}
+	if _, ok := LookupField("serviceaccountsfoo"); ok {
+		t.Error("expected serviceaccountsfoo to be an unknown key")
+	}
+}
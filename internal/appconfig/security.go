@@ -0,0 +1,95 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appconfig
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// CheckServiceAccountAllowed returns an error if the configuration doesn't
+// allow the service account to be impersonated. Accounts that match the
+// denylist are always rejected. When the allowlist isn't empty, the account
+// must also match one of its entries.
+func CheckServiceAccountAllowed(serviceAccountEmail string) error {
+	email := strings.ToLower(serviceAccountEmail)
+	if pattern, ok := matchServiceAccount(SecurityDeniedSAs, email); ok {
+		return fmt.Errorf("impersonating %s is not allowed, it matches %q in %s", serviceAccountEmail, pattern, SecurityDeniedSAs)
+	}
+	allowed := GetStringList(SecurityAllowedSAs)
+	if len(allowed) == 0 {
+		return nil
+	}
+	if _, ok := matchServiceAccount(SecurityAllowedSAs, email); !ok {
+		return fmt.Errorf("impersonating %s is not allowed, it isn't in %s", serviceAccountEmail, SecurityAllowedSAs)
+	}
+	return nil
+}
+
+// ApprovalRequired reports whether impersonating the service account, directly
+// or through the delegates, has to be approved through the approval webhook.
+func ApprovalRequired(serviceAccountEmail string, delegates []string) bool {
+	if viper.GetString(SecurityApprovalWebhook) == "" {
+		return false
+	}
+	if len(GetStringList(SecurityApprovalSAs)) == 0 {
+		return true
+	}
+	for _, email := range append([]string{serviceAccountEmail}, delegates...) {
+		if _, ok := matchServiceAccount(SecurityApprovalSAs, strings.ToLower(email)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchServiceAccount returns the first pattern in the list held by key that
+// matches the email.
+func matchServiceAccount(key, email string) (string, bool) {
+	for _, pattern := range GetStringList(key) {
+		if matched, _ := path.Match(strings.ToLower(pattern), email); matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// CheckReason returns an error if the reason doesn't match the pattern in
+// security.reasonpattern.
+func CheckReason(reason string) error {
+	pattern := viper.GetString(SecurityReasonPattern)
+	if pattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid value for %s: %v", SecurityReasonPattern, err)
+	}
+	if !re.MatchString(reason) {
+		return fmt.Errorf("the reason %q doesn't match %q in %s", reason, pattern, SecurityReasonPattern)
+	}
+	return nil
+}
+
+// MaxSessionDuration returns the longest that a privileged session can last, or
+// 0 if sessions aren't limited.
+func MaxSessionDuration() time.Duration {
+	return viper.GetDuration(SecurityMaxSession)
+}
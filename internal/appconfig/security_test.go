@@ -0,0 +1,156 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appconfig
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestCheckServiceAccountAllowed(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	tests := []struct {
+		allowed []string
+		denied  interface{}
+		email   string
+		wantErr bool
+	}{
+		{email: "any@my-project.iam.gserviceaccount.com"},
+		{
+			denied:  []string{"breakglass@my-project.iam.gserviceaccount.com"},
+			email:   "Breakglass@my-project.iam.gserviceaccount.com",
+			wantErr: true,
+		},
+		{
+			allowed: []string{"*@dev-project.iam.gserviceaccount.com"},
+			email:   "deploy@dev-project.iam.gserviceaccount.com",
+		},
+		{
+			allowed: []string{"*@dev-project.iam.gserviceaccount.com"},
+			email:   "deploy@prod-project.iam.gserviceaccount.com",
+			wantErr: true,
+		},
+		{
+			allowed: []string{"*@dev-project.iam.gserviceaccount.com"},
+			denied:  "admin-*@dev-project.iam.gserviceaccount.com, other@dev-project.iam.gserviceaccount.com",
+			email:   "admin-1@dev-project.iam.gserviceaccount.com",
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		viper.Set(SecurityAllowedSAs, tc.allowed)
+		viper.Set(SecurityDeniedSAs, tc.denied)
+		err := CheckServiceAccountAllowed(tc.email)
+		if tc.wantErr && err == nil {
+			t.Errorf("expected %s to be rejected (allowed: %v, denied: %v)", tc.email, tc.allowed, tc.denied)
+		} else if !tc.wantErr && err != nil {
+			t.Errorf("unexpected error for %s: %v", tc.email, err)
+		}
+	}
+}
+
+func TestSecurityKeysIgnoreEnv(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.SetEnvPrefix(EnvPrefix)
+	viper.SetEnvKeyReplacer(viperEnvKeyReplacer)
+	viper.AutomaticEnv()
+	viper.SetConfigType("yaml")
+	config := `
+security:
+  allowedserviceaccounts: ["*@dev-project.iam.gserviceaccount.com"]
+  deniedserviceaccounts: ["breakglass@dev-project.iam.gserviceaccount.com"]
+  approvalwebhook: https://approvals.example.com
+authproxy:
+  proxyport: 8084
+`
+	if err := viper.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"EIAM_SECURITY_ALLOWEDSERVICEACCOUNTS": "*",
+		"EIAM_SECURITY_DENIEDSERVICEACCOUNTS":  "nobody@dev-project.iam.gserviceaccount.com",
+		"EIAM_SECURITY_APPROVALWEBHOOK":        "https://approve-all.example.com",
+		"EIAM_AUTHPROXY_PROXYPORT":             "9090",
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	if err := CheckServiceAccountAllowed("admin@prod-project.iam.gserviceaccount.com"); err == nil {
+		t.Error("CheckServiceAccountAllowed() allowed an account that the environment added to the allowlist")
+	}
+	if err := CheckServiceAccountAllowed("breakglass@dev-project.iam.gserviceaccount.com"); err == nil {
+		t.Error("CheckServiceAccountAllowed() allowed an account that the environment removed from the denylist")
+	}
+	if got := viper.GetString(SecurityApprovalWebhook); got != "https://approvals.example.com" {
+		t.Errorf("viper.GetString(%s) = %q, want the webhook from the config file", SecurityApprovalWebhook, got)
+	}
+	if got := Source(SecurityAllowedSAs); got == SourceEnv {
+		t.Errorf("Source(%s) = %s, want the config file", SecurityAllowedSAs, got)
+	}
+	// Other keys can still be overridden.
+	if got := viper.GetInt(AuthProxyPort); got != 9090 {
+		t.Errorf("viper.GetInt(%s) = %d, want the 9090 from the environment", AuthProxyPort, got)
+	}
+}
+
+func TestMFAIgnoresEnv(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.SetEnvPrefix(EnvPrefix)
+	viper.SetEnvKeyReplacer(viperEnvKeyReplacer)
+	viper.AutomaticEnv()
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(strings.NewReader("security:\n  mfa: totp\n")); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("EIAM_SECURITY_MFA", MFANone)
+	defer os.Unsetenv("EIAM_SECURITY_MFA")
+
+	if got := viper.GetString(SecurityMFA); got != MFATOTP {
+		t.Errorf("viper.GetString(%s) = %q with EIAM_SECURITY_MFA=%s, want %q", SecurityMFA, got, MFANone, MFATOTP)
+	}
+}
+
+func TestCheckReason(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	tests := []struct {
+		pattern string
+		reason  string
+		wantErr bool
+	}{
+		{reason: "Debugging"},
+		{pattern: `\b[A-Z]+-[0-9]+\b`, reason: "Emergency security patch (JIRA-1234)"},
+		{pattern: `\b[A-Z]+-[0-9]+\b`, reason: "Emergency security patch", wantErr: true},
+	}
+	for _, tc := range tests {
+		viper.Set(SecurityReasonPattern, tc.pattern)
+		err := CheckReason(tc.reason)
+		if tc.wantErr && err == nil {
+			t.Errorf("expected %q to be rejected by %q", tc.reason, tc.pattern)
+		} else if !tc.wantErr && err != nil {
+			t.Errorf("unexpected error for %q: %v", tc.reason, err)
+		}
+	}
+}
@@ -19,9 +19,9 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/manifoldco/promptui"
 	"github.com/spf13/viper"
@@ -30,11 +30,17 @@ import (
 	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
 	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/apilog"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/cache"
 )
 
+// cacheDirName is the directory in the config directory that the results of
+// GCP API queries are cached in.
+const cacheDirName = "cache"
+
 // Setup ensures that the prequisites for running ephemeral-iam are met.
 func Setup() error {
-	if err := checkValidADCExists(); err != nil {
+	if err := checkCredentials(); err != nil {
 		return err
 	}
 	if err := createLogDir(); err != nil {
@@ -46,6 +52,30 @@ func Setup() error {
 	if err := createPluginDir(); err != nil {
 		return err
 	}
+	util.APIConcurrency = viper.GetInt(APIConcurrency)
+	cache.Configure(filepath.Join(GetConfigDir(), cacheDirName), map[string]time.Duration{
+		cache.IAMPolicies:         viper.GetDuration(CacheTTL),
+		cache.ServiceAccounts:     viper.GetDuration(CacheTTL),
+		cache.TestablePermissions: viper.GetDuration(QueryPermsCacheTTL),
+	})
+	return nil
+}
+
+// checkCredentials checks the credentials that eiam authenticates with. A
+// credential file set in authentication.credentialfile is used instead of the
+// application default credentials, so that eiam can be used where gcloud isn't
+// logged in, e.g. with Workload Identity Federation in CI pipelines.
+func checkCredentials() error {
+	credFile := viper.GetString(AuthCredentialFile)
+	if credFile == "" {
+		return checkValidADCExists()
+	}
+	util.Logger.Debugf("Authenticating with the credential file %s", credFile)
+	principal, err := gcpclient.UseCredentialFile(credFile)
+	if err != nil {
+		return err
+	}
+	util.Logger.Debugf("Credential file principal: %s", principal)
 	return nil
 }
 
@@ -53,7 +83,7 @@ func Setup() error {
 // they are valid, and that they are for the correct user.
 func checkValidADCExists() error {
 	ctx := context.Background()
-	oauth2Service, err := oauth2.NewService(ctx)
+	oauth2Service, err := oauth2.NewService(ctx, apilog.Options(ctx)...)
 	if err != nil {
 		if strings.Contains(err.Error(), "could not find default credentials") {
 			util.Logger.Warn("No Application Default Credentials were found, attempting to generate them\n")
@@ -135,7 +165,7 @@ func createLogDir() error {
 // used in the assume-privileges command.
 func createTempKubeConfigDir() error {
 	configDir := GetConfigDir()
-	kubeConfigDir := path.Join(configDir, "tmp_kube_config")
+	kubeConfigDir := filepath.Join(configDir, "tmp_kube_config")
 	_, err := os.Stat(kubeConfigDir)
 	if os.IsNotExist(err) {
 		if err = os.MkdirAll(kubeConfigDir, 0o755); err != nil {
@@ -0,0 +1,191 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appconfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// The sources that a config value can come from, in order of precedence.
+const (
+	SourceFlag    = "flag"
+	SourceEnv     = "env"
+	SourceProject = "project"
+	SourceFile    = "file"
+	SourceDefault = "default"
+)
+
+var (
+	// fileConfig holds only the values read from the config file. It is used
+	// to determine where a value came from and to avoid persisting values that
+	// were overridden for a single invocation.
+	fileConfig = viper.New()
+
+	boundFlags = map[string]*pflag.Flag{}
+)
+
+// ConfigFile returns the path to the config file in use. The config file can
+// be written in YAML, JSON, or TOML and its format is determined by its
+// extension. New config files are written as YAML.
+func ConfigFile() string {
+	if cf := viper.ConfigFileUsed(); cf != "" {
+		return cf
+	}
+	return filepath.Join(GetConfigDir(), "config.yml")
+}
+
+// BindFlag binds a command line flag to a config key. When the flag is set,
+// its value takes precedence over the environment and the config file.
+func BindFlag(key string, flag *pflag.Flag) error {
+	if err := viper.BindPFlag(key, flag); err != nil {
+		return err
+	}
+	boundFlags[key] = flag
+	return nil
+}
+
+// securityPrefix is the prefix of the keys that can't be overridden by
+// environment variables.
+const securityPrefix = "security."
+
+// EnvOverridable reports whether an environment variable can override the
+// config key. The security keys let administrators restrict what eiam does,
+// and whatever runs eiam controls its environment, so they can only be set in
+// the config file.
+func EnvOverridable(key string) bool {
+	return !strings.HasPrefix(strings.ToLower(key), securityPrefix)
+}
+
+// warnIgnoredEnvVars logs a warning for each environment variable that sets a
+// key that can't be overridden.
+func warnIgnoredEnvVars() {
+	prefix := EnvVarName(securityPrefix)
+	for _, env := range os.Environ() {
+		name := strings.SplitN(env, "=", 2)[0]
+		if strings.HasPrefix(strings.ToUpper(name), prefix) {
+			util.Logger.Warnf("Ignoring %s, the %s* settings can only be set in the config file", name, securityPrefix)
+		}
+	}
+}
+
+// EnvVarName returns the name of the environment variable that overrides
+// the given config key.
+func EnvVarName(key string) string {
+	return fmt.Sprintf("%s_%s", EnvPrefix, strings.ToUpper(envKeyReplacer.Replace(key)))
+}
+
+// GetStringList returns the value of a list key. List values set with
+// environment variables are comma separated strings.
+func GetStringList(key string) []string {
+	if val, ok := viper.Get(key).(string); ok {
+		return util.SplitList(val)
+	}
+	return viper.GetStringSlice(key)
+}
+
+// Source reports where the effective value of a config key came from.
+func Source(key string) string {
+	if flag, ok := boundFlags[key]; ok && flag.Changed {
+		return SourceFlag
+	}
+	if EnvOverridable(key) && os.Getenv(EnvVarName(key)) != "" {
+		return SourceEnv
+	}
+	if projectConfig.IsSet(key) {
+		return SourceProject
+	}
+	if fileConfig.IsSet(key) {
+		return SourceFile
+	}
+	return SourceDefault
+}
+
+// WriteConfig writes the current configuration to the config file. Values
+// that were only overridden for this invocation by a flag, an environment
+// variable, or the per-project config file are not persisted unless they were
+// changed afterwards. Sensitive values are moved to the OS keyring when it is
+// available.
+func WriteConfig() error {
+	return writeConfig(nil, nil)
+}
+
+// writeConfig writes the config file. Keys that exclude returns true for are
+// left out and values replaces the current values.
+func writeConfig(exclude func(key string) bool, values map[string]interface{}) error {
+	out := viper.New()
+	for _, key := range viper.AllKeys() {
+		if _, ok := renamedKey(key); ok || (exclude != nil && exclude(key)) {
+			continue
+		}
+		if val, ok := persistedValue(key); ok {
+			out.Set(key, val)
+		}
+	}
+	for key, val := range values {
+		out.Set(key, val)
+	}
+	for _, key := range out.AllKeys() {
+		if f, ok := LookupField(key); ok && f.Sensitive {
+			out.Set(key, storeSecret(key, out.Get(key)))
+		}
+	}
+
+	if err := out.WriteConfigAs(ConfigFile()); err != nil {
+		return err
+	}
+	removeStaleSecrets(out)
+	return loadFileConfig()
+}
+
+func persistedValue(key string) (interface{}, bool) {
+	val := viper.Get(key)
+	var override string
+	switch Source(key) {
+	case SourceFlag:
+		override = boundFlags[key].Value.String()
+	case SourceEnv:
+		override = os.Getenv(EnvVarName(key))
+	case SourceProject:
+		override = fmt.Sprint(projectConfig.Get(key))
+	default:
+		return val, true
+	}
+	// The value was explicitly changed after the override was applied.
+	if fmt.Sprint(val) != override {
+		return val, true
+	}
+	if fileConfig.IsSet(key) {
+		return fileConfig.Get(key), true
+	}
+	return nil, false
+}
+
+func loadFileConfig() error {
+	fileConfig = viper.New()
+	fileConfig.SetConfigFile(ConfigFile())
+	if err := fileConfig.ReadInConfig(); err != nil && !os.IsNotExist(err) {
+		return errorsutil.New("Failed to read configuration file", err)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appconfig
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// tlsVersions are the values that authproxy.tlsminversion can be set to. TLS
+// 1.0 and 1.1 are deprecated and aren't allowed.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSMinVersion returns the minimum TLS version in authproxy.tlsminversion.
+func TLSMinVersion() uint16 {
+	if version, ok := tlsVersions[viper.GetString(AuthProxyTLSMinVersion)]; ok {
+		return version
+	}
+	return tls.VersionTLS12
+}
+
+// TLSCipherSuites returns the IDs of the cipher suites in
+// authproxy.tlsciphersuites, or nil if Go's defaults should be used.
+func TLSCipherSuites() []uint16 {
+	ids, err := parseCipherSuites(viper.GetStringSlice(AuthProxyTLSCiphers))
+	if err != nil || len(ids) == 0 {
+		return nil
+	}
+	return ids
+}
+
+// parseCipherSuites converts cipher suite names to their IDs. Suites that Go
+// considers insecure are rejected.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	secure := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite.ID
+	}
+	insecure := make(map[string]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := secure[name]
+		switch {
+		case insecure[name]:
+			return nil, fmt.Errorf("%s is an insecure cipher suite", name)
+		case !ok:
+			return nil, fmt.Errorf("%q is not a supported cipher suite", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appconfig
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+)
+
+// scopePrefix is prepended to OAuth scopes that aren't full URLs, e.g.
+// "devstorage.read_only".
+const scopePrefix = "https://www.googleapis.com/auth/"
+
+// TokenScope limits the access token that the auth proxy sends to the hosts
+// that it matches to a set of OAuth scopes.
+type TokenScope struct {
+	Name   string
+	Scopes []string
+
+	host matcher
+}
+
+// ParseTokenScope parses a token scope in the form "HOST SCOPE [SCOPE...]".
+// HOST is a glob pattern, or a regular expression when it starts with "~".
+func ParseTokenScope(name, spec string) (TokenScope, error) {
+	args := strings.Fields(spec)
+	if len(args) < 2 {
+		return TokenScope{}, fmt.Errorf("token scopes must be in the form 'HOST SCOPE [SCOPE...]', got %q", spec)
+	}
+
+	host, err := newMatcher(args[0])
+	if err != nil {
+		return TokenScope{}, err
+	}
+	scope := TokenScope{Name: name, host: host}
+	for _, s := range args[1:] {
+		scope.Scopes = append(scope.Scopes, ExpandScope(s))
+	}
+	return scope, nil
+}
+
+// ExpandScope returns the full URL of an OAuth scope, which can be given
+// relative to https://www.googleapis.com/auth/.
+func ExpandScope(scope string) string {
+	if strings.Contains(scope, "://") {
+		return scope
+	}
+	return scopePrefix + scope
+}
+
+// TokenScopes returns the entries in the authproxy.tokenscopes config section
+// sorted by name.
+func TokenScopes() ([]TokenScope, error) {
+	specs := viper.GetStringMapString(AuthProxyTokenScopes)
+	scopes := make([]TokenScope, 0, len(specs))
+	for _, name := range sortedKeys(specs) {
+		scope, err := ParseTokenScope(name, specs[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s.%s: %v", AuthProxyTokenScopes, name, err)
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
+
+// Matches reports whether the scopes apply to requests to the given host. The
+// port is ignored.
+func (t TokenScope) Matches(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return t.host.match(strings.ToLower(host))
+}
+
+// AccessBoundary grants a down-scoped Cloud Storage token the permissions of a
+// role on a single bucket.
+type AccessBoundary struct {
+	Bucket string
+	Role   string
+}
+
+// ParseAccessBoundary parses an access boundary in the form "BUCKET ROLE".
+func ParseAccessBoundary(spec string) (AccessBoundary, error) {
+	args := strings.Fields(spec)
+	if len(args) != 2 {
+		return AccessBoundary{}, fmt.Errorf("access boundaries must be in the form 'BUCKET ROLE', got %q", spec)
+	}
+	bucket := strings.TrimSuffix(strings.TrimPrefix(args[0], "gs://"), "/")
+	if bucket == "" || strings.Contains(bucket, "/") {
+		return AccessBoundary{}, fmt.Errorf("%q is not a bucket name", args[0])
+	}
+	if !strings.HasPrefix(args[1], "roles/") {
+		return AccessBoundary{}, fmt.Errorf("the role must start with 'roles/', got %q", args[1])
+	}
+	return AccessBoundary{Bucket: bucket, Role: args[1]}, nil
+}
+
+// Rule returns the Credential Access Boundary rule that grants the role on the
+// bucket.
+func (b AccessBoundary) Rule() gcpclient.AccessBoundaryRule {
+	return gcpclient.AccessBoundaryRule{
+		AvailableResource:    fmt.Sprintf("//storage.googleapis.com/projects/_/buckets/%s", b.Bucket),
+		AvailablePermissions: []string{fmt.Sprintf("inRole:%s", b.Role)},
+	}
+}
+
+// AccessBoundaries returns the entries in the authproxy.accessboundaries config
+// section sorted by name.
+func AccessBoundaries() ([]AccessBoundary, error) {
+	specs := viper.GetStringMapString(AuthProxyAccessBounds)
+	boundaries := make([]AccessBoundary, 0, len(specs))
+	for _, name := range sortedKeys(specs) {
+		boundary, err := ParseAccessBoundary(specs[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s.%s: %v", AuthProxyAccessBounds, name, err)
+		}
+		boundaries = append(boundaries, boundary)
+	}
+	return boundaries, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
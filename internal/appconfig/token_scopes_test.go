@@ -0,0 +1,54 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appconfig
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTokenScope(t *testing.T) {
+	scope, err := ParseTokenScope("storage", "*.storage.googleapis.com devstorage.read_only https://example.com/auth/x")
+	if err != nil {
+		t.Fatalf("failed to parse token scope: %v", err)
+	}
+	want := []string{"https://www.googleapis.com/auth/devstorage.read_only", "https://example.com/auth/x"}
+	if !reflect.DeepEqual(scope.Scopes, want) {
+		t.Errorf("got scopes %v, want %v", scope.Scopes, want)
+	}
+	if !scope.Matches("bucket.storage.googleapis.com:443") || scope.Matches("compute.googleapis.com") {
+		t.Errorf("scope matched the wrong hosts")
+	}
+
+	if _, err := ParseTokenScope("storage", "storage.googleapis.com"); err == nil {
+		t.Errorf("expected a token scope without scopes to be rejected")
+	}
+}
+
+func TestParseAccessBoundary(t *testing.T) {
+	boundary, err := ParseAccessBoundary("gs://my-bucket/ roles/storage.objectViewer")
+	if err != nil {
+		t.Fatalf("failed to parse access boundary: %v", err)
+	}
+	if boundary.Bucket != "my-bucket" || boundary.Role != "roles/storage.objectViewer" {
+		t.Errorf("got %+v", boundary)
+	}
+
+	for _, spec := range []string{"my-bucket", "my-bucket storage.objectViewer", "gs://my-bucket/dir roles/storage.admin"} {
+		if _, err := ParseAccessBoundary(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
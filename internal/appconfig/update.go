@@ -86,5 +86,5 @@ func installNewVersion(release *github.RepositoryRelease) {
 		return
 	}
 	util.Logger.Info("Update completed successfully")
-	os.Exit(0)
+	util.Logger.Exit(0)
 }
@@ -0,0 +1,206 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package approval asks an approval webhook to allow a service account to be
+// impersonated, and waits for an approver to respond.
+package approval
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// The statuses that the webhook can respond with.
+const (
+	StatusApproved = "approved"
+	StatusDenied   = "denied"
+	StatusPending  = "pending"
+)
+
+// pollInterval is how long to wait before asking the webhook for the status of
+// a pending request again.
+var pollInterval = 5 * time.Second
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Request is the JSON body that is posted to the webhook.
+type Request struct {
+	ID             string    `json:"id"`
+	Principal      string    `json:"principal"`
+	ServiceAccount string    `json:"serviceAccount,omitempty"`
+	Role           string    `json:"role,omitempty"`
+	Subject        string    `json:"subject,omitempty"`
+	Delegates      []string  `json:"delegates,omitempty"`
+	Project        string    `json:"project"`
+	Reason         string    `json:"reason"`
+	Command        string    `json:"command"`
+	Duration       string    `json:"duration,omitempty"`
+	RequestedAt    time.Time `json:"requestedAt"`
+}
+
+// Decision is the JSON body that the webhook responds with. StatusURL is where
+// the status of a pending request is polled. It can be relative to the webhook
+// URL, and has to be an HTTPS URL on the same host as the webhook since the
+// bearer token is sent to it. When it is empty, the webhook URL is polled with
+// the ID of the request in the "id" query parameter.
+type Decision struct {
+	Status    string `json:"status"`
+	Approver  string `json:"approver,omitempty"`
+	Message   string `json:"message,omitempty"`
+	StatusURL string `json:"statusUrl,omitempty"`
+}
+
+// NewID returns a random ID for a request.
+func NewID() (string, error) {
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(idBytes), nil
+}
+
+// Wait posts the request to the webhook and polls it until the request is
+// approved or denied, or ctx is done. If token isn't empty, it is sent as a
+// bearer token. An error is returned unless the request was approved.
+func Wait(ctx context.Context, webhook, token string, req Request) (*Decision, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, errorsutil.New("Failed to encode the approval request", err)
+	}
+	decision, err := send(ctx, http.MethodPost, webhook, token, body)
+	if err != nil {
+		return nil, errorsutil.New("Failed to send the approval request", err)
+	}
+
+	var statusURL string
+	if decision.StatusURL == "" {
+		statusURL, err = withID(webhook, req.ID)
+	} else {
+		statusURL, err = checkStatusURL(webhook, decision.StatusURL)
+	}
+	if err != nil {
+		return nil, errorsutil.New("Failed to read the approval decision", err)
+	}
+	for decision.Status == StatusPending {
+		select {
+		case <-ctx.Done():
+			return nil, errorsutil.New("Timed out waiting for approval", ctx.Err())
+		case <-time.After(pollInterval):
+		}
+		if decision, err = send(ctx, http.MethodGet, statusURL, token, nil); err != nil {
+			return nil, errorsutil.New("Failed to check the status of the approval request", err)
+		}
+	}
+
+	switch decision.Status {
+	case StatusApproved:
+		return decision, nil
+	case StatusDenied:
+		err := fmt.Errorf("denied by %s", orUnknown(decision.Approver))
+		if decision.Message != "" {
+			err = fmt.Errorf("%v: %s", err, decision.Message)
+		}
+		return nil, errorsutil.New("The approval request was denied", err)
+	default:
+		err := fmt.Errorf("unknown status %q", decision.Status)
+		return nil, errorsutil.New("Failed to read the approval decision", err)
+	}
+}
+
+func send(ctx context.Context, method, target, token string, body []byte) (*Decision, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	decision := &Decision{}
+	if err := json.Unmarshal(data, decision); err != nil {
+		return nil, fmt.Errorf("failed to parse the response: %v", err)
+	}
+	if decision.Status == "" {
+		return nil, errors.New("the response doesn't have a status")
+	}
+	return decision, nil
+}
+
+// withID adds the request ID to the webhook URL.
+func withID(webhook, id string) (string, error) {
+	u, err := url.Parse(webhook)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("id", id)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// checkStatusURL resolves the status URL that the webhook responded with, and
+// checks that it is an HTTPS URL on the same host as the webhook.
+func checkStatusURL(webhook, statusURL string) (string, error) {
+	base, err := url.Parse(webhook)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(statusURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid status URL: %v", err)
+	}
+	u := base.ResolveReference(ref)
+	if u.Scheme != "https" {
+		return "", fmt.Errorf("the status URL %s isn't an HTTPS URL", u.Redacted())
+	}
+	if !strings.EqualFold(u.Host, base.Host) {
+		return "", fmt.Errorf("the status URL %s isn't on the webhook's host %s", u.Redacted(), base.Host)
+	}
+	return u.String(), nil
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "an unknown approver"
+	}
+	return s
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package approval
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+func TestCheckStatusURL(t *testing.T) {
+	webhook := "https://approvals.example.com/requests"
+	tests := []struct {
+		statusURL string
+		want      string
+		wantErr   bool
+	}{
+		{statusURL: "https://approvals.example.com/requests/123", want: "https://approvals.example.com/requests/123"},
+		{statusURL: "/requests/123", want: "https://approvals.example.com/requests/123"},
+		{statusURL: "123?poll=1", want: "https://approvals.example.com/123?poll=1"},
+		{statusURL: "https://APPROVALS.example.com/status", want: "https://APPROVALS.example.com/status"},
+		{statusURL: "http://approvals.example.com/requests/123", wantErr: true},
+		{statusURL: "https://attacker.example.net/collect", wantErr: true},
+		{statusURL: "https://approvals.example.com:8443/requests/123", wantErr: true},
+		{statusURL: "//attacker.example.net/collect", wantErr: true},
+		{statusURL: "ftp://approvals.example.com/requests/123", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := checkStatusURL(webhook, tc.statusURL)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("expected an error for %s, got %s", tc.statusURL, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", tc.statusURL, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("expected %s to resolve to %s, got %s", tc.statusURL, tc.want, got)
+		}
+	}
+}
+
+func TestWait(t *testing.T) {
+	util.Logger = util.NewLogger()
+	defer func(interval time.Duration, client *http.Client) {
+		pollInterval, httpClient = interval, client
+	}(pollInterval, httpClient)
+	pollInterval = time.Millisecond
+
+	var polls int
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("expected the bearer token to be sent, got %q", got)
+		}
+		switch {
+		case r.Method == http.MethodPost:
+			json.NewEncoder(w).Encode(Decision{Status: StatusPending, StatusURL: "/status/" + r.URL.Query().Get("case")})
+		case r.URL.Path == "/status/approve" && polls < 2:
+			polls++
+			json.NewEncoder(w).Encode(Decision{Status: StatusPending})
+		case r.URL.Path == "/status/approve":
+			json.NewEncoder(w).Encode(Decision{Status: StatusApproved, Approver: "lead@example.com"})
+		case r.URL.Path == "/status/deny":
+			json.NewEncoder(w).Encode(Decision{Status: StatusDenied, Approver: "lead@example.com", Message: "not now"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	httpClient = srv.Client()
+
+	decision, err := Wait(context.Background(), srv.URL+"?case=approve", "secret", Request{ID: "1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if decision.Approver != "lead@example.com" || polls != 2 {
+		t.Errorf("expected approval by lead@example.com after 2 polls, got %+v after %d polls", decision, polls)
+	}
+
+	if _, err := Wait(context.Background(), srv.URL+"?case=deny", "secret", Request{ID: "2"}); err == nil || !strings.Contains(err.Error(), "not now") {
+		t.Errorf("expected the request to be denied, got %v", err)
+	}
+}
+
+func TestWaitRejectsForeignStatusURL(t *testing.T) {
+	util.Logger = util.NewLogger()
+	defer func(client *http.Client) { httpClient = client }(httpClient)
+
+	var leaked bool
+	other := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaked = true
+	}))
+	defer other.Close()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"status": "pending", "statusUrl": %q}`, other.URL+"/status")
+	}))
+	defer srv.Close()
+	httpClient = srv.Client()
+
+	if _, err := Wait(context.Background(), srv.URL, "secret", Request{ID: "1"}); err == nil {
+		t.Error("expected a status URL on another host to be rejected")
+	}
+	if leaked {
+		t.Error("expected the bearer token not to be sent to the other host")
+	}
+}
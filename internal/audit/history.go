@@ -0,0 +1,131 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// auditDirName is the name of the directory in the config directory that has
+// the local audit records.
+const auditDirName = "audit"
+
+// sessionsDirName is the name of the directory in the audit directory that
+// has the records of each privileged session.
+const sessionsDirName = "sessions"
+
+// historyFileName is the name of the file in the audit directory that every
+// eiam command is appended to.
+const historyFileName = "history.jsonl"
+
+// maxEntrySize is the longest line of the audit history that can be read.
+// Entries are usually far smaller, but the command line of a wrapped command
+// can be long.
+const maxEntrySize = 16 * 1024 * 1024
+
+// Entry is a command in the audit history. Ended, Duration, and ExitStatus are
+// only unset in the events sent to the audit sinks when a command starts.
+type Entry struct {
+	// PID is the process ID of the command, which is also the ID of the
+	// privileged session if it started one.
+	PID            int        `json:"pid"`
+	Command        string     `json:"command"`
+	User           string     `json:"user,omitempty"`
+	Principal      string     `json:"principal,omitempty"`
+	ServiceAccount string     `json:"serviceAccount,omitempty"`
+	Project        string     `json:"project,omitempty"`
+	Reason         string     `json:"reason,omitempty"`
+	Started        time.Time  `json:"started"`
+	Ended          *time.Time `json:"ended,omitempty"`
+	Duration       string     `json:"duration,omitempty"`
+	ExitStatus     *int       `json:"exitStatus,omitempty"`
+}
+
+// Dir returns the directory that has the local audit records.
+func Dir() string {
+	return filepath.Join(appconfig.GetConfigDir(), auditDirName)
+}
+
+// SessionDir returns the audit directory of the privileged session with the
+// PID.
+func SessionDir(pid int) string {
+	return filepath.Join(Dir(), sessionsDirName, strconv.Itoa(pid))
+}
+
+// HistoryFile returns the path of the audit history.
+func HistoryFile() string {
+	return filepath.Join(Dir(), historyFileName)
+}
+
+// Record appends an entry to the audit history. Entries are only ever
+// appended, so the history is a complete record of the commands that were run.
+func Record(entry *Entry) error {
+	if err := os.MkdirAll(Dir(), 0o700); err != nil {
+		return errorsutil.New("Failed to create the audit directory", err)
+	}
+	f, err := os.OpenFile(HistoryFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return errorsutil.New("Failed to open the audit history", err)
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(entry); err != nil {
+		return errorsutil.New("Failed to write to the audit history", err)
+	}
+	return nil
+}
+
+// History returns the entries in the audit history that started at or after
+// since, oldest first.
+func History(since time.Time) ([]*Entry, error) {
+	f, err := os.Open(HistoryFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errorsutil.New("Failed to open the audit history", err)
+	}
+	defer f.Close()
+
+	var entries []*Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxEntrySize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		entry := &Entry{}
+		// A line can be cut short if eiam was killed while writing it, which
+		// shouldn't hide the rest of the history.
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			util.Logger.Warnf("Skipping line %d of %s: %v", line, HistoryFile(), err)
+			continue
+		}
+		if !entry.Started.Before(since) {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errorsutil.New("Failed to read the audit history", err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "eiam-audit-")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	util.Logger = util.NewLogger()
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func resetHistory(t *testing.T) {
+	t.Helper()
+	if err := os.RemoveAll(Dir()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordHistory(t *testing.T) {
+	resetHistory(t)
+	start := time.Date(2021, 3, 25, 9, 0, 0, 0, time.UTC)
+	for i, command := range []string{"eiam list", "eiam assume-privileges", "eiam gcloud projects list"} {
+		entry := &Entry{PID: i + 1, Command: command, Started: start.Add(time.Duration(i) * time.Hour)}
+		if err := Record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := History(start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Command != "eiam assume-privileges" || entries[1].Command != "eiam gcloud projects list" {
+		t.Errorf("expected the last 2 commands, oldest first, got %+v", entries)
+	}
+}
+
+func TestHistoryMissing(t *testing.T) {
+	resetHistory(t)
+	entries, err := History(time.Time{})
+	if err != nil || entries != nil {
+		t.Errorf("History() = %v, %v, want no entries", entries, err)
+	}
+}
+
+func TestHistorySkipsBadLines(t *testing.T) {
+	resetHistory(t)
+	if err := Record(&Entry{PID: 1, Command: "eiam list"}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(HistoryFile(), os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A line that was cut short, and an empty line.
+	if _, err := f.WriteString("{\"pid\": 2, \"comm\n\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := Record(&Entry{PID: 3, Command: "eiam version"}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := History(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].PID != 1 || entries[1].PID != 3 {
+		t.Errorf("expected the valid entries to be read, got %+v", entries)
+	}
+}
+
+func TestHistoryLongLine(t *testing.T) {
+	resetHistory(t)
+	command := "eiam gcloud " + strings.Repeat("a", 1024*1024)
+	if err := Record(&Entry{PID: 1, Command: command}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := History(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Command != command {
+		t.Errorf("expected the long entry to be read, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+)
+
+// The types of the events that are sent to the audit sinks.
+const (
+	EventCommandStarted  = "command.started"
+	EventCommandFinished = "command.finished"
+)
+
+// sinkTimeout is how long sending an event to each sink can take, so that a
+// sink that is down doesn't hold up eiam.
+const sinkTimeout = 10 * time.Second
+
+// flushTimeout is how long Flush waits for the events that are still being
+// sent when eiam exits. It is a variable so that tests don't have to wait.
+var flushTimeout = 2 * time.Second
+
+// sending tracks the events that Ship is still sending.
+var sending sync.WaitGroup
+
+// Event is sent to the audit sinks when a command starts and when it ends.
+type Event struct {
+	Type     string `json:"type"`
+	Hostname string `json:"hostname,omitempty"`
+	*Entry
+}
+
+// SinksEnabled reports whether audit.webhook or audit.pubsubtopic is set.
+func SinksEnabled() bool {
+	return viper.GetString(appconfig.AuditWebhook) != "" || viper.GetString(appconfig.AuditPubSubTopic) != ""
+}
+
+// Ship sends an event for the entry to the webhook in audit.webhook and the
+// Pub/Sub topic in audit.pubsubtopic, if they are set. The event is sent in
+// the background so that the command isn't held up, and Flush waits for it
+// before eiam exits. Failures are logged rather than returned, so that they
+// don't fail the command, and both sinks are tried even if the first fails.
+func Ship(eventType string, entry *Entry) {
+	event := Event{Type: eventType, Entry: entry}
+	if hostname, err := os.Hostname(); err == nil {
+		event.Hostname = hostname
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		util.Logger.WithError(err).Warn("Failed to encode the audit event")
+		return
+	}
+
+	if webhook := viper.GetString(appconfig.AuditWebhook); webhook != "" {
+		token := viper.GetString(appconfig.AuditWebhookToken)
+		sending.Add(1)
+		go func() {
+			defer sending.Done()
+			if err := postEvent(webhook, token, data); err != nil {
+				util.Logger.WithError(err).Warnf("Failed to send the audit event to %s", appconfig.AuditWebhook)
+			}
+		}()
+	}
+	if topic := viper.GetString(appconfig.AuditPubSubTopic); topic != "" {
+		sending.Add(1)
+		go func() {
+			defer sending.Done()
+			if err := publishEvent(topic, data, map[string]string{"type": eventType}, sinkTimeout); err != nil {
+				util.Logger.WithError(err).Warnf("Failed to send the audit event to %s", appconfig.AuditPubSubTopic)
+			}
+		}()
+	}
+}
+
+// Flush waits up to flushTimeout for the events that Ship is still sending.
+// It is called before eiam exits, and the events that haven't been sent by
+// then are dropped.
+func Flush() {
+	done := make(chan struct{})
+	go func() {
+		sending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(flushTimeout):
+		util.Logger.Warn("Timed out sending the audit events")
+	}
+}
+
+// publishEvent publishes an event to a Pub/Sub topic. It is a variable so that
+// tests can replace it.
+var publishEvent = gcpclient.PublishMessage
+
+func postEvent(webhook, token string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sinkTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
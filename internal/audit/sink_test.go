@@ -0,0 +1,111 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+)
+
+func TestShip(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	var (
+		lock      sync.Mutex
+		events    []Event
+		auth      string
+		published map[string]string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		event := Event{}
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("invalid event: %v", err)
+		}
+		lock.Lock()
+		events = append(events, event)
+		auth = r.Header.Get("Authorization")
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	saved := publishEvent
+	defer func() { publishEvent = saved }()
+	publishEvent = func(topic string, data []byte, attributes map[string]string, timeout time.Duration) error {
+		lock.Lock()
+		published = attributes
+		lock.Unlock()
+		return nil
+	}
+
+	viper.Set(appconfig.AuditWebhook, server.URL)
+	viper.Set(appconfig.AuditWebhookToken, "token")
+	viper.Set(appconfig.AuditPubSubTopic, "projects/project/topics/audit")
+	if !SinksEnabled() {
+		t.Fatal("expected the sinks to be enabled")
+	}
+
+	Ship(EventCommandStarted, &Entry{PID: 42, Command: "eiam assume-privileges"})
+	Flush()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(events) != 1 || events[0].Type != EventCommandStarted || events[0].Entry == nil || events[0].PID != 42 {
+		t.Errorf("expected the started event to be sent to the webhook, got %+v", events)
+	}
+	if auth != "Bearer token" {
+		t.Errorf("expected the webhook token to be sent, got %q", auth)
+	}
+	if published["type"] != EventCommandStarted {
+		t.Errorf("expected the event to be published with its type, got %v", published)
+	}
+}
+
+func TestFlushTimeout(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	savedTimeout := flushTimeout
+	defer func() { flushTimeout = savedTimeout }()
+	flushTimeout = 50 * time.Millisecond
+
+	viper.Set(appconfig.AuditWebhook, server.URL)
+	start := time.Now()
+	Ship(EventCommandFinished, &Entry{PID: 42})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected Ship not to wait for the sink, it took %s", elapsed)
+	}
+	Flush()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected Flush to give up after %s, it took %s", flushTimeout, elapsed)
+	}
+}
@@ -19,7 +19,6 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
-	"os"
 	"sort"
 	"strings"
 	"text/tabwriter"
@@ -73,10 +72,34 @@ func Confirm(vals map[string]string) {
 
 	if _, err := prompt.Run(); err != nil {
 		Logger.Warn("Abandoning Command...")
-		os.Exit(0)
+		// Exit through the logger so that the command is still recorded in
+		// the audit history.
+		Logger.Exit(0)
 	}
 }
 
+// Prompt asks the user to enter a value. The input is pre-filled with
+// defaultVal so it can be accepted by pressing enter.
+func Prompt(label, defaultVal string, validate func(string) error) (string, error) {
+	prompt := promptui.Prompt{
+		Label:     label,
+		Default:   defaultVal,
+		AllowEdit: true,
+		Validate:  validate,
+	}
+	return prompt.Run()
+}
+
+// PromptConfirm asks the user a yes or no question.
+func PromptConfirm(label string) bool {
+	prompt := promptui.Prompt{
+		Label:     label,
+		IsConfirm: true,
+	}
+	_, err := prompt.Run()
+	return err == nil
+}
+
 // SelectToken prompts the user to select an existing Github personal access token.
 func SelectToken(tokenConfig map[string]string) (string, error) {
 	tokenNames := []string{}
@@ -122,6 +145,11 @@ func ExtractUnknownArgs(flags *pflag.FlagSet, args []string) []string {
 	unknownArgs := []string{}
 	for i := 0; i < len(trimmed); i++ {
 		currArg := trimmed[i]
+		// Everything after "--" belongs to the invoked command, e.g. the
+		// command run by kubectl exec.
+		if currArg == "--" {
+			return append(unknownArgs, trimmed[i:]...)
+		}
 
 		var currFlag *pflag.Flag
 		if currArg[0] == '-' && len(currArg) > 1 {
@@ -158,6 +186,60 @@ func Contains(values []string, val string) bool {
 	return false
 }
 
+// SplitList splits a comma separated list, ignoring whitespace and empty items.
+func SplitList(val string) []string {
+	items := []string{}
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// SplitArgs splits a command line into arguments the way a POSIX shell would,
+// without expanding variables or globs. Single quotes, double quotes, and
+// backslash escapes are supported.
+func SplitArgs(line string) ([]string, error) {
+	var args []string
+	var curr strings.Builder
+	var quote rune
+	inArg, escaped := false, false
+	for _, r := range line {
+		switch {
+		case escaped:
+			curr.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				curr.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, curr.String())
+				curr.Reset()
+				inArg = false
+			}
+		default:
+			curr.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in %q", line)
+	}
+	if inArg {
+		args = append(args, curr.String())
+	}
+	return args, nil
+}
+
 // Uniq removes duplicate items from the input slice.
 func Uniq(a []string) []string {
 	mb := make(map[string]struct{}, len(a))
@@ -171,3 +253,25 @@ func Uniq(a []string) []string {
 	sort.Strings(set)
 	return set
 }
+
+// JoinArgs joins arguments into a command line that SplitArgs and POSIX shells
+// split into the same arguments. Arguments are only quoted when they need to be.
+func JoinArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && strings.IndexFunc(arg, needsQuote) == -1 {
+			quoted[i] = arg
+			continue
+		}
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+func needsQuote(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return false
+	}
+	return !strings.ContainsRune("-_./:=@,+%", r)
+}
@@ -0,0 +1,53 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiamutil
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestExtractUnknownArgs(t *testing.T) {
+	tests := []struct {
+		args string
+		want []string
+	}{
+		{args: "gcloud", want: []string{}},
+		{
+			args: "gcloud compute instances list --format=json -s sa@my-project.iam.gserviceaccount.com -v",
+			want: []string{"compute", "instances", "list", "--format=json"},
+		},
+		{args: "gcloud -q storage ls --quiet", want: []string{"storage", "ls"}},
+		{args: "kubectl exec pod -vv -- sh -v", want: []string{"exec", "pod", "--", "sh", "-v"}},
+	}
+	for _, tt := range tests {
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		fs.ParseErrorsWhitelist.UnknownFlags = true
+		fs.StringP("service-account-email", "s", "", "")
+		fs.CountP("verbose", "v", "")
+		fs.BoolP("quiet", "q", false, "")
+		args := append([]string{"eiam"}, strings.Fields(tt.args)...)
+		if err := fs.Parse(args[2:]); err != nil {
+			t.Fatalf("Parse(%q) failed: %v", tt.args, err)
+		}
+
+		if got := ExtractUnknownArgs(fs, args); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ExtractUnknownArgs(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
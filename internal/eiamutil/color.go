@@ -0,0 +1,84 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiamutil
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/fatih/color"
+	"github.com/spf13/viper"
+	"golang.org/x/term"
+)
+
+// The values of logging.color.
+const (
+	ColorAuto   = "auto"
+	ColorAlways = "always"
+	ColorNever  = "never"
+)
+
+// ColorOverride replaces logging.color for a single command when it is set,
+// e.g. by the --no-color flag.
+var ColorOverride string
+
+// colorMode holds logging.color as of the last time the logger was
+// configured, so that output can be colored while the config is reloaded on
+// another goroutine.
+var colorMode atomic.Value // string
+
+// ColorEnabled reports whether output written to f should be colored. In
+// 'auto' mode, colors are only used when f is a terminal and the NO_COLOR
+// environment variable is unset, so that piped output and CI logs are plain
+// text.
+func ColorEnabled(f *os.File) bool {
+	mode, ok := colorMode.Load().(string)
+	if !ok {
+		mode = viper.GetString("logging.color")
+	}
+	if ColorOverride != "" {
+		mode = ColorOverride
+	}
+	switch mode {
+	case ColorAlways:
+		return true
+	case ColorNever:
+		return false
+	}
+	if _, ok := os.LookupEnv("NO_COLOR"); ok || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	return f != nil && term.IsTerminal(int(f.Fd()))
+}
+
+// Colorize wraps text in the ANSI color code if output written to f should be
+// colored.
+func Colorize(f *os.File, code int, text string) string {
+	if !ColorEnabled(f) {
+		return text
+	}
+	return fmt.Sprintf("\x1b[%dm%s\x1b[0m", code, text)
+}
+
+// configureColor applies logging.color to the tables that are colored with
+// fatih/color, which are written to stderr like the logs.
+func configureColor() {
+	// The value is only written when it changes, since the tables may be
+	// printed while the config is reloaded.
+	if noColor := !ColorEnabled(os.Stderr); color.NoColor != noColor {
+		color.NoColor = noColor
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package eiamutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// journaldSocket is the socket that the journal receives native messages on.
+const journaldSocket = "/run/systemd/journal/socket"
+
+// invalidJournalField matches the characters that journal field names can't
+// have.
+var invalidJournalField = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// journaldHook sends every log entry to the systemd journal, with the fields
+// of the entry as EIAM_* journal fields.
+type journaldHook struct {
+	conn *net.UnixConn
+}
+
+func newJournaldHook() (logrus.Hook, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldHook{conn: conn}, nil
+}
+
+func (h *journaldHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *journaldHook) Fire(entry *logrus.Entry) error {
+	var msg bytes.Buffer
+	writeJournalField(&msg, "MESSAGE", strings.TrimRight(entry.Message, "\n"))
+	writeJournalField(&msg, "PRIORITY", fmt.Sprint(journalPriority(entry.Level)))
+	writeJournalField(&msg, "SYSLOG_IDENTIFIER", syslogTag)
+	for key, value := range entry.Data {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		name := "EIAM_" + invalidJournalField.ReplaceAllString(strings.ToUpper(key), "_")
+		writeJournalField(&msg, name, fmt.Sprint(value))
+	}
+	_, err := h.conn.Write(msg.Bytes())
+	return err
+}
+
+func (h *journaldHook) Close() error {
+	return h.conn.Close()
+}
+
+// writeJournalField appends a field in the journal's native protocol, with
+// the length before values that span several lines.
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	value = string(Redact([]byte(value)))
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", name, value)
+		return
+	}
+	buf.WriteString(name + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value))) //nolint:errcheck // Writes to a buffer don't fail
+	buf.WriteString(value + "\n")
+}
+
+// journalPriority returns the syslog priority of a logrus level.
+func journalPriority(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	default:
+		return 7
+	}
+}
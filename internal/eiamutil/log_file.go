@@ -0,0 +1,174 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiamutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// rotatingFile is a log file that is renamed to FILE.1 once it grows past
+// maxSize bytes, keeping up to maxBackups of the older files as FILE.2, and so
+// on. Several eiam processes can append to the same file, so its size is read
+// again before each write, and it is reopened once another process rotated it.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSizeMB, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    int64(maxSizeMB) * 1024 * 1024,
+		maxBackups: maxBackups,
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		// Entries that are logged after the file was closed are dropped.
+		return len(p), nil
+	}
+	if f.maxSize > 0 {
+		if err := f.sync(); err != nil {
+			return 0, err
+		}
+		if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+			if err := f.rotate(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// sync reads the size of the file that is at the path now, and reopens it if
+// another process rotated or removed the file that is open.
+func (f *rotatingFile) sync() error {
+	info, err := os.Stat(f.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if open, err := f.file.Stat(); err == nil && os.SameFile(info, open) {
+			f.size = info.Size()
+			return nil
+		}
+	}
+	f.file.Close()
+	return f.open()
+}
+
+// rotate shifts the backups by one, dropping the oldest, and starts a new
+// file.
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxBackups))
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if f.maxBackups > 0 {
+		os.Rename(f.path, f.path+".1")
+	} else {
+		os.Remove(f.path)
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// fileHook copies every log entry to a rotating file, with timestamps and the
+// PID of the eiam process so that the entries of concurrent commands can be
+// told apart.
+type fileHook struct {
+	file      *rotatingFile
+	formatter logrus.Formatter
+}
+
+func newFileHook(path string, maxSizeMB, maxBackups int, json bool) (*fileHook, error) {
+	file, err := openRotatingFile(path, maxSizeMB, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	var formatter logrus.Formatter = &logrus.TextFormatter{
+		DisableColors: true,
+		FullTimestamp: true,
+	}
+	if json {
+		formatter = NewJSONFormatter()
+	}
+	return &fileHook{file: file, formatter: &redactingFormatter{Formatter: formatter}}, nil
+}
+
+func (h *fileHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *fileHook) Fire(entry *logrus.Entry) error {
+	e := entry.WithField("pid", os.Getpid())
+	e.Level, e.Message, e.Caller = entry.Level, entry.Message, entry.Caller
+	line, err := h.formatter.Format(e)
+	if err != nil {
+		return err
+	}
+	_, err = h.file.Write(line)
+	return err
+}
+
+func (h *fileHook) Close() error {
+	return h.file.Close()
+}
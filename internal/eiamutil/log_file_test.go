@@ -0,0 +1,103 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiamutil
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRotatingFileSharedByProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "eiam.log")
+	// Each file stands in for another eiam process that logs to the same path.
+	first, err := openRotatingFile(path, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := openRotatingFile(path, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	line := []byte(strings.Repeat("a", 1023) + "\n")
+	for i := 0; i < 600; i++ {
+		if _, err := first.Write(line); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := second.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{path, path + ".1"} {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := len(data); size > 1024*1024 {
+			t.Errorf("expected %s to be rotated at 1 MB, it is %d bytes", filepath.Base(name), size)
+		}
+	}
+}
+
+func TestRotatingFileWriteAfterClose(t *testing.T) {
+	f, err := openRotatingFile(filepath.Join(t.TempDir(), "eiam.log"), 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("dropped\n")); err != nil {
+		t.Errorf("expected writes after Close to be dropped, got %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("expected closing twice not to fail, got %v", err)
+	}
+}
+
+func TestClosableHookFireWhileClosing(t *testing.T) {
+	Logger = NewLogger()
+	hook, err := newFileHook(filepath.Join(t.TempDir(), "eiam.log"), 1, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closable := &closableHook{Hook: hook}
+	entry := logrus.NewEntry(Logger)
+	entry.Message = "message"
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := closable.Fire(entry); err != nil {
+					t.Errorf("Fire() = %v", err)
+					return
+				}
+			}
+		}()
+	}
+	closeHooks(logrus.LevelHooks{logrus.InfoLevel: {closable}})
+	wg.Wait()
+}
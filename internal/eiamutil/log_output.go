@@ -0,0 +1,52 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiamutil
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The places that logs can be written to, set with logging.output.
+const (
+	OutputStderr   = "stderr"
+	OutputSyslog   = "syslog"
+	OutputJournald = "journald"
+)
+
+// syslogTag identifies eiam's logs in syslog and the journal.
+const syslogTag = "eiam"
+
+// newOutputHook returns the hook that sends logs to output, or nil if they are
+// written to the console.
+func newOutputHook(output string) (logrus.Hook, error) {
+	switch output {
+	case OutputSyslog:
+		return newSyslogHook()
+	case OutputJournald:
+		return newJournaldHook()
+	case OutputStderr, "":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown log output %q", output)
+}
+
+// plainFormatter formats the entries sent to syslog, which adds its own
+// timestamps.
+var plainFormatter = &redactingFormatter{Formatter: &logrus.TextFormatter{
+	DisableColors:    true,
+	DisableTimestamp: true,
+}}
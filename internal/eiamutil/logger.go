@@ -15,8 +15,10 @@
 package eiamutil
 
 import (
-	"log"
+	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 
 	rt "github.com/banzaicloud/logrus-runtime-formatter"
 	"github.com/sirupsen/logrus"
@@ -26,39 +28,176 @@ import (
 // Logger is the global logging instance.
 var Logger *logrus.Logger
 
+// LevelOverride replaces logging.level for a single command when it is set,
+// e.g. by the --verbose and --quiet flags.
+var LevelOverride string
+
 // NewLogger instantiates a new logging instance.
 func NewLogger() *logrus.Logger {
 	logger := logrus.New()
+	// Logs are written above the progress spinner while one is shown.
+	logger.Out = &progressWriter{out: os.Stderr}
+	ConfigureLogger(logger)
+	return logger
+}
 
-	level, err := logrus.ParseLevel(viper.GetString("logging.level"))
+// ConfigureLogger applies the logging level and format from the config to a
+// logger.
+func ConfigureLogger(logger *logrus.Logger) {
+	colorMode.Store(viper.GetString("logging.color"))
+	levelName := viper.GetString("logging.level")
+	if LevelOverride != "" {
+		levelName = LevelOverride
+	}
+	level, err := logrus.ParseLevel(levelName)
 	if err != nil {
-		log.Fatalf("Failed to create logger instance: %v", err)
-		os.Exit(1)
+		// Invalid levels are reported by the config validation, fall back to
+		// the default level until it's fixed.
+		level = logrus.InfoLevel
 	}
 
-	logger.Level = level
-	logger.Out = os.Stderr
+	logger.SetLevel(level)
 
+	var formatter logrus.Formatter
 	switch viper.GetString("logging.format") {
 	case "json":
-		logger.Formatter = NewJSONFormatter()
+		formatter = NewJSONFormatter()
 	case "debug":
 		// The 'debug' formatter will include the filename, function, and line number
 		// that a log entry is written from.
-		logger.Formatter = NewRuntimeFormatter()
+		formatter = NewRuntimeFormatter()
 	default:
-		logger.Formatter = NewTextFormatter()
+		formatter = NewTextFormatter()
+	}
+	// Debug logs often end up in bug reports, so credentials are scrubbed
+	// from every line.
+	formatter = &redactingFormatter{Formatter: formatter}
+	if reloadable, ok := logger.Formatter.(*reloadableFormatter); ok {
+		reloadable.set(formatter)
+	} else {
+		reloadable = &reloadableFormatter{}
+		reloadable.set(formatter)
+		logger.SetFormatter(reloadable)
 	}
 
-	return logger
+	// The hooks are replaced, since the file that logs are copied to may
+	// have changed.
+	hooks := make(logrus.LevelHooks)
+	if path := viper.GetString("logging.file"); path != "" {
+		hook, err := newFileHook(path, viper.GetInt("logging.maxsize"), viper.GetInt("logging.maxbackups"),
+			viper.GetString("logging.format") == "json")
+		if err != nil {
+			logger.WithError(err).Warnf("Failed to open the log file %s", path)
+		} else {
+			hooks.Add(&closableHook{Hook: hook})
+		}
+	}
+	// logging.output chooses where the logs are written: the console, or
+	// syslog or the journal instead of it.
+	console := logger.Out
+	if silenced, ok := console.(*silencedOutput); ok {
+		console = silenced.console
+	}
+	out := console
+	output := viper.GetString("logging.output")
+	hook, outputErr := newOutputHook(output)
+	if hook != nil {
+		hooks.Add(&closableHook{Hook: hook})
+		out = &silencedOutput{console: console}
+	}
+	logger.SetOutput(out)
+	if outputErr != nil {
+		logger.WithError(outputErr).Warnf("Failed to send logs to %s, writing them to %s instead", output, OutputStderr)
+	}
+	closeHooks(logger.ReplaceHooks(hooks))
+	configureColor()
+}
+
+// reloadableFormatter lets the formatter change when the config is reloaded
+// while other goroutines log. logrus reads Logger.Formatter without holding
+// its lock, so the field isn't changed once the logger is configured.
+type reloadableFormatter struct {
+	current atomic.Value // formatterValue
+}
+
+// formatterValue wraps formatters of different types so that they can be
+// stored in the same atomic.Value.
+type formatterValue struct {
+	logrus.Formatter
+}
+
+func (f *reloadableFormatter) set(formatter logrus.Formatter) {
+	f.current.Store(formatterValue{formatter})
+}
+
+func (f *reloadableFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	return f.current.Load().(formatterValue).Format(entry)
+}
+
+// silencedOutput is the output of a logger whose logs are sent to syslog or
+// the journal instead of the console. It keeps the console's writer so that it
+// is restored if logging.output is changed back.
+type silencedOutput struct {
+	console io.Writer
+}
+
+func (*silencedOutput) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// closableHook lets a hook that holds a file or connection open be closed
+// while other goroutines log. logrus fires a copy of the hooks without holding
+// its lock, so a hook can still be fired after ConfigureLogger replaced and
+// closed it. Those entries are dropped.
+type closableHook struct {
+	logrus.Hook
+	mu     sync.RWMutex
+	closed bool
+}
+
+func (h *closableHook) Fire(entry *logrus.Entry) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.closed {
+		return nil
+	}
+	return h.Hook.Fire(entry)
+}
+
+func (h *closableHook) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	if c, ok := h.Hook.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// closeHooks closes the hooks that hold files open.
+func closeHooks(hooks logrus.LevelHooks) {
+	closed := map[logrus.Hook]bool{}
+	for _, levelHooks := range hooks {
+		for _, hook := range levelHooks {
+			if c, ok := hook.(io.Closer); ok && !closed[hook] {
+				c.Close()
+				closed[hook] = true
+			}
+		}
+	}
 }
 
 // NewTextFormatter creates a new TextFormatter logrus instance.
 func NewTextFormatter() *logrus.TextFormatter {
 	return &logrus.TextFormatter{
 		DisableLevelTruncation: viper.GetBool("logging.disableleveltruncation"),
+		DisableColors:          !ColorEnabled(os.Stderr),
 		DisableQuote:           true,
 		DisableTimestamp:       true,
+		ForceColors:            ColorEnabled(os.Stderr),
 		PadLevelText:           viper.GetBool("logging.padleveltext"),
 	}
 }
@@ -73,8 +212,10 @@ func NewRuntimeFormatter() *rt.Formatter {
 	return &rt.Formatter{
 		ChildFormatter: &logrus.TextFormatter{
 			DisableLevelTruncation: viper.GetBool("logging.disableleveltruncation"),
+			DisableColors:          !ColorEnabled(os.Stderr),
 			DisableQuote:           true,
 			DisableTimestamp:       true,
+			ForceColors:            ColorEnabled(os.Stderr),
 			PadLevelText:           viper.GetBool("logging.padleveltext"),
 		},
 		Line: true,
@@ -0,0 +1,57 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiamutil
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// notifyTimeout is how long showing a desktop notification can take.
+const notifyTimeout = 5 * time.Second
+
+// toastScript shows a Windows toast notification with the title and message
+// in the environment, so that they don't have to be quoted.
+const toastScript = `
+[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$template = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $template.GetElementsByTagName('text')
+$text.Item(0).AppendChild($template.CreateTextNode($env:EIAM_NOTIFY_TITLE)) > $null
+$text.Item(1).AppendChild($template.CreateTextNode($env:EIAM_NOTIFY_MESSAGE)) > $null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('ephemeral-iam').Show([Windows.UI.Notifications.ToastNotification]::new($template))
+`
+
+// Notify shows a desktop notification: in the notification center on macOS, a
+// toast on Windows, and with libnotify's notify-send elsewhere.
+func Notify(title, message string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.CommandContext(ctx, "osascript", "-e",
+			`display notification (system attribute "EIAM_NOTIFY_MESSAGE") with title (system attribute "EIAM_NOTIFY_TITLE")`)
+	case "windows":
+		cmd = exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", toastScript)
+	default:
+		cmd = exec.CommandContext(ctx, "notify-send", "--app-name", "ephemeral-iam", title, message) //nolint:gosec // Not run through a shell
+	}
+	cmd.Env = append(os.Environ(), "EIAM_NOTIFY_TITLE="+title, "EIAM_NOTIFY_MESSAGE="+message)
+	return cmd.Run()
+}
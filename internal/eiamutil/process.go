@@ -0,0 +1,61 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiamutil
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+// ShellCommand returns the command that runs a command line with the system
+// shell: bash, or cmd.exe on Windows.
+func ShellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		comspec := os.Getenv("COMSPEC")
+		if comspec == "" {
+			comspec = "cmd.exe"
+		}
+		return exec.Command(comspec, "/C", command) //nolint:gosec // The user provides the command to run
+	}
+	return exec.Command("bash", "-c", command) //nolint:gosec // The user provides the command to run
+}
+
+// Terminate asks a process to stop. Windows can't deliver SIGTERM, so the
+// process is killed there instead.
+func Terminate(p *os.Process) error {
+	if runtime.GOOS == "windows" {
+		return p.Kill()
+	}
+	return p.Signal(syscall.SIGTERM)
+}
+
+// ProcessRunning reports whether a process with the PID exists. Finding a
+// process fails on Windows once it has exited, while elsewhere it is sent the
+// null signal to check.
+func ProcessRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		p.Release() //nolint:errcheck // The handle is only used to find the process
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,174 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiamutil
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/term"
+)
+
+// progressFrames are the frames of the spinner that Progress draws.
+var progressFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// progressInterval is how often the spinner is redrawn.
+const progressInterval = 100 * time.Millisecond
+
+var (
+	// progressLock guards the line that the active progress indicator is
+	// drawn on, which logs are also written over.
+	progressLock   sync.Mutex
+	activeProgress *Progress
+	// progressWidth is the width of the line that is drawn, or 0 if it was
+	// cleared.
+	progressWidth int
+)
+
+// Progress is a spinner that is shown on stderr while a long operation runs,
+// with the number of steps that are done and an estimate of the time left if
+// the operation has a known number of steps. It is only drawn when stderr is
+// a terminal and info logs are enabled, so piped output, CI logs, and --quiet
+// commands are unchanged. Only one is drawn at a time, so the progress of an
+// operation that is part of a longer one isn't shown.
+type Progress struct {
+	message string
+	total   int
+	done    int
+	started time.Time
+	stop    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+// StartProgress shows a spinner with the message until Stop is called.
+func StartProgress(message string) *Progress {
+	return startProgress(message, 0)
+}
+
+// StartProgressCount shows a spinner with the message and the number of the
+// total steps that are done until Stop is called. Call Add as each step is
+// done.
+func StartProgressCount(message string, total int) *Progress {
+	return startProgress(message, total)
+}
+
+func startProgress(message string, total int) *Progress {
+	p := &Progress{message: message, total: total, started: time.Now()}
+	if Logger == nil || !Logger.IsLevelEnabled(logrus.InfoLevel) || !term.IsTerminal(int(os.Stderr.Fd())) {
+		return p
+	}
+	progressLock.Lock()
+	defer progressLock.Unlock()
+	if activeProgress != nil {
+		return p
+	}
+	activeProgress = p
+	p.stop = make(chan struct{})
+	p.stopped = make(chan struct{})
+	go p.run()
+	return p
+}
+
+// Add marks n more steps as done. It is safe to call from multiple goroutines.
+func (p *Progress) Add(n int) {
+	progressLock.Lock()
+	p.done += n
+	progressLock.Unlock()
+}
+
+// Stop clears the spinner. It can be called more than once.
+func (p *Progress) Stop() {
+	if p.stop == nil {
+		return
+	}
+	p.once.Do(func() {
+		close(p.stop)
+		<-p.stopped
+	})
+}
+
+func (p *Progress) run() {
+	defer close(p.stopped)
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for frame := 0; ; frame++ {
+		progressLock.Lock()
+		clearProgressLine()
+		text := p.text()
+		// The line has to fit in the terminal to be cleared with "\r".
+		if width, _, err := term.GetSize(int(os.Stderr.Fd())); err == nil && width > 3 && len([]rune(text)) > width-3 {
+			text = string([]rune(text)[:width-3])
+		}
+		spinner := Colorize(os.Stderr, 36, progressFrames[frame%len(progressFrames)])
+		fmt.Fprintf(os.Stderr, "%s %s", spinner, text)
+		progressWidth = len([]rune(text)) + 2
+		progressLock.Unlock()
+
+		select {
+		case <-p.stop:
+			progressLock.Lock()
+			clearProgressLine()
+			activeProgress = nil
+			progressLock.Unlock()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// text returns the message with the steps that are done and the time left.
+// The caller must hold progressLock.
+func (p *Progress) text() string {
+	if p.total <= 0 {
+		return p.message
+	}
+	text := fmt.Sprintf("%s (%d/%d", p.message, p.done, p.total)
+	if p.done > 0 && p.done < p.total {
+		left := time.Since(p.started) / time.Duration(p.done) * time.Duration(p.total-p.done)
+		if left >= time.Second {
+			text += fmt.Sprintf(", about %s left", left.Round(time.Second))
+		}
+	}
+	return text + ")"
+}
+
+// clearProgressLine erases the spinner, which is drawn again on the next
+// frame. The caller must hold progressLock.
+func clearProgressLine() {
+	if progressWidth == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\r%s\r", strings.Repeat(" ", progressWidth))
+	progressWidth = 0
+}
+
+// progressWriter is the output of the logger, which clears the spinner before
+// a log is written so that logs are printed above it.
+type progressWriter struct {
+	out io.Writer
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	progressLock.Lock()
+	defer progressLock.Unlock()
+	clearProgressLine()
+	return w.out.Write(b)
+}
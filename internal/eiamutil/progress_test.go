@@ -0,0 +1,85 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiamutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProgressText(t *testing.T) {
+	tests := []struct {
+		total   int
+		done    int
+		elapsed time.Duration
+		want    string
+	}{
+		{want: "Fetching policies"},
+		{total: 10, want: "Fetching policies (0/10)"},
+		{total: 10, done: 4, elapsed: 8 * time.Second, want: "Fetching policies (4/10, about 12s left)"},
+		{total: 10, done: 5, elapsed: 90 * time.Second, want: "Fetching policies (5/10, about 1m30s left)"},
+		// Estimates under a second aren't shown.
+		{total: 10, done: 9, elapsed: time.Second, want: "Fetching policies (9/10)"},
+		{total: 10, done: 10, elapsed: time.Minute, want: "Fetching policies (10/10)"},
+	}
+	for _, tt := range tests {
+		p := &Progress{
+			message: "Fetching policies",
+			total:   tt.total,
+			done:    tt.done,
+			started: time.Now().Add(-tt.elapsed),
+		}
+		if got := p.text(); got != tt.want {
+			t.Errorf("text() with %d/%d after %s = %q, want %q", tt.done, tt.total, tt.elapsed, got, tt.want)
+		}
+	}
+}
+
+func TestProgressWithoutTerminal(t *testing.T) {
+	Logger = NewLogger()
+	stderr, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	origStderr := os.Stderr
+	os.Stderr = stderr
+	defer func() { os.Stderr = origStderr }()
+
+	p := StartProgressCount("Fetching policies", 2)
+	p.Add(1)
+	if p.stop != nil {
+		t.Error("StartProgressCount() started a spinner when stderr isn't a terminal")
+	}
+	progressLock.Lock()
+	active := activeProgress
+	progressLock.Unlock()
+	if active != nil {
+		t.Error("StartProgressCount() set the active progress when stderr isn't a terminal")
+	}
+	p.Stop()
+	p.Stop()
+
+	out, err := ioutil.ReadFile(stderr.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 0 {
+		t.Errorf("Progress wrote %q to stderr, want nothing", out)
+	}
+}
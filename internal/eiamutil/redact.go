@@ -0,0 +1,88 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiamutil
+
+import (
+	"io"
+	"regexp"
+
+	"github.com/sirupsen/logrus"
+)
+
+// redacted replaces the secrets that are scrubbed from logs.
+const redacted = "[REDACTED]"
+
+// secretPatterns match credentials in log output. Patterns with a group keep
+// the text before the secret, such as the name of the field, and replace the
+// rest of the match.
+var secretPatterns = []*regexp.Regexp{
+	// PEM private keys, such as the ones in service account keys.
+	regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`),
+	// Authorization headers.
+	regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/-]+=*`),
+	// JSON and form encoded credential fields.
+	regexp.MustCompile(`(?i)("(?:access_token|refresh_token|id_token|client_secret|private_key|token)\\?"\s*:\s*\\?")[^"\\]+`),
+	regexp.MustCompile(`(?i)((?:access_token|refresh_token|id_token|client_secret|assertion|subject_token)=)[^&\s"]+`),
+	// Google access tokens and OAuth refresh tokens.
+	regexp.MustCompile(`ya29\.[0-9A-Za-z_-]+`),
+	regexp.MustCompile(`1//[0-9A-Za-z_-]{20,}`),
+	// JWTs, such as ID tokens.
+	regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`),
+	// GitHub personal access tokens.
+	regexp.MustCompile(`gh[pousr]_[A-Za-z0-9]{36,}`),
+}
+
+// Redact replaces bearer tokens, OAuth tokens, and private keys in b.
+func Redact(b []byte) []byte {
+	for _, re := range secretPatterns {
+		if re.NumSubexp() > 0 {
+			b = re.ReplaceAll(b, []byte("${1}"+redacted))
+		} else {
+			b = re.ReplaceAll(b, []byte(redacted))
+		}
+	}
+	return b
+}
+
+// redactingFormatter scrubs secrets from the log lines of another formatter.
+type redactingFormatter struct {
+	logrus.Formatter
+}
+
+func (f *redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	line, err := f.Formatter.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+	return Redact(line), nil
+}
+
+// RedactWriter returns a writer that scrubs secrets from each write to w,
+// for logs that aren't written with logrus. Secrets split across writes
+// aren't found, so each write should be a whole line.
+func RedactWriter(w io.Writer) io.Writer {
+	return &redactingWriter{w: w}
+}
+
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := r.w.Write(Redact(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
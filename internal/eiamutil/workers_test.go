@@ -0,0 +1,104 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiamutil
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunWorkers(t *testing.T) {
+	saved := APIConcurrency
+	defer func() { APIConcurrency = saved }()
+
+	for _, concurrency := range []int{0, 1, 3, 10} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			APIConcurrency = concurrency
+			limit := concurrency
+			if limit < 1 {
+				limit = 1
+			}
+
+			var (
+				lock    sync.Mutex
+				running int
+				most    int
+				done    = make([]bool, 20)
+			)
+			err := RunWorkers(len(done), func(i int) error {
+				lock.Lock()
+				running++
+				if running > most {
+					most = running
+				}
+				lock.Unlock()
+
+				time.Sleep(time.Millisecond)
+
+				lock.Lock()
+				running--
+				done[i] = true
+				lock.Unlock()
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if most > limit {
+				t.Errorf("expected at most %d calls at a time, got %d", limit, most)
+			}
+			for i, ok := range done {
+				if !ok {
+					t.Errorf("expected work to be called for %d", i)
+				}
+			}
+		})
+	}
+}
+
+func TestRunWorkersError(t *testing.T) {
+	errFailed := errors.New("failed")
+	var (
+		lock  sync.Mutex
+		calls int
+	)
+	err := RunWorkers(5, func(i int) error {
+		lock.Lock()
+		calls++
+		lock.Unlock()
+		if i == 2 {
+			return errFailed
+		}
+		return nil
+	})
+	if err != errFailed {
+		t.Errorf("RunWorkers() error = %v, want %v", err, errFailed)
+	}
+	if calls != 5 {
+		t.Errorf("expected every call to be made after an error, got %d", calls)
+	}
+}
+
+func TestRunWorkersNone(t *testing.T) {
+	if err := RunWorkers(0, func(int) error {
+		t.Error("expected work not to be called")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
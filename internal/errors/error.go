@@ -45,9 +45,23 @@ func (e EiamError) Error() string {
 	return errStr
 }
 
+// ExitError is returned when a command that eiam runs exits with a non-zero
+// status, so that eiam exits with the same status.
+type ExitError struct {
+	Code int
+}
+
+func (e ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
 // CheckError is the top-level error handler.
 func CheckError(err error) {
 	if err != nil {
+		if exitErr, ok := err.(ExitError); ok {
+			// The command has already reported why it failed.
+			util.Logger.Exit(exitErr.Code)
+		}
 		if googleErr := checkGoogleAPIError(err); (googleErr != EiamError{}) {
 			err = googleErr
 		} else if grpcError := checkGoogleRPCError(err); (grpcError != EiamError{}) {
@@ -60,18 +74,3 @@ func CheckError(err error) {
 		util.Logger.Fatal(err)
 	}
 }
-
-// CheckRevertGcloudConfigError prompts the user to manually reset their gcloud
-// config if eiam failed to do so.
-func CheckRevertGcloudConfigError(err error) {
-	if err != nil {
-		util.Logger.WithError(err).Error("failed to revert gcloud configuration")
-		util.Logger.Warn("Please run the following command to manually fix this issue:")
-		fmt.Println(`
-    gcloud config unset proxy/address \
-	  && gcloud config unset proxy/port \
-	  && gcloud config unset proxy/type \
-	  && gcloud config unset core/custom_ca_certs_file
-		`)
-	}
-}
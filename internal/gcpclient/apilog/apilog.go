@@ -0,0 +1,131 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package apilog logs every GCP API call that eiam makes at debug level, with
+// the service, method, resource, latency, and status of the call as fields.
+package apilog
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+// RequestTimeout is how long the GCP API calls that the auth proxy waits on
+// can take.
+const RequestTimeout = 30 * time.Second
+
+// HTTPClient is used for the GCP API calls that aren't made with a client
+// library.
+var HTTPClient = &http.Client{Transport: Transport(http.DefaultTransport), Timeout: RequestTimeout}
+
+// cloudPlatformScope is the scope that the transports of REST clients are
+// authorized with, which every API that eiam uses accepts.
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// Options returns the client options of a REST client library, with its
+// requests sent through a logging transport that applies opts. If the
+// transport can't be created, opts are returned as they are so that creating
+// the client reports the error.
+func Options(ctx context.Context, opts ...option.ClientOption) []option.ClientOption {
+	// Client libraries add their default scopes, but the transport is created
+	// before they see the options.
+	opts = append([]option.ClientOption{option.WithScopes(cloudPlatformScope)}, opts...)
+	t, err := htransport.NewTransport(ctx, Transport(http.DefaultTransport), opts...)
+	if err != nil {
+		return opts
+	}
+	return []option.ClientOption{option.WithHTTPClient(&http.Client{Transport: t})}
+}
+
+// GRPCOptions returns the client options of a gRPC client library, with an
+// interceptor that logs its calls.
+func GRPCOptions(opts ...option.ClientOption) []option.ClientOption {
+	return append(opts, option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(logUnaryCall)))
+}
+
+// Transport returns a RoundTripper that logs the requests sent with base.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return &transport{base: base}
+}
+
+type transport struct {
+	base http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	callStatus := "error"
+	if err == nil {
+		callStatus = strconv.Itoa(resp.StatusCode)
+	}
+	// Query strings can have credentials, so only the path is logged.
+	logCall(req.URL.Host, req.Method, req.URL.Path, time.Since(start), callStatus, err)
+	return resp, err
+}
+
+func logUnaryCall(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	// Methods look like "/google.container.v1.ClusterManager/GetCluster".
+	service, name := cc.Target(), strings.TrimPrefix(method, "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	logCall(service, name, grpcResource(req), time.Since(start), status.Code(err).String(), err)
+	return err
+}
+
+// grpcResource returns the resource that a gRPC request is for, if it has a
+// field that names it.
+func grpcResource(req interface{}) string {
+	switch r := req.(type) {
+	case interface{ GetName() string }:
+		return r.GetName()
+	case interface{ GetResource() string }:
+		return r.GetResource()
+	case interface{ GetParent() string }:
+		return r.GetParent()
+	}
+	return ""
+}
+
+func logCall(service, method, resource string, latency time.Duration, callStatus string, err error) {
+	if util.Logger == nil || !util.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		return
+	}
+	entry := util.Logger.WithFields(logrus.Fields{
+		"service":  service,
+		"method":   method,
+		"resource": resource,
+		"latency":  latency.Round(time.Millisecond).String(),
+		"status":   callStatus,
+	})
+	if err != nil {
+		entry = entry.WithError(err)
+	}
+	entry.Debug("GCP API call")
+}
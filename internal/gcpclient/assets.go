@@ -0,0 +1,119 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/cloudasset/v1"
+	"google.golang.org/api/iam/v1"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/apilog"
+	queryiam "github.com/rigup/ephemeral-iam/internal/gcpclient/query_iam"
+)
+
+const serviceAccountAssetType = "iam.googleapis.com/ServiceAccount"
+
+// SearchServiceAccounts uses Cloud Asset Inventory to find the service accounts
+// in scope, which is a project, folder, or organization such as
+// "folders/123456789012", that match query, e.g. "displayName:deploy*".
+func SearchServiceAccounts(scope, query string) ([]*iam.ServiceAccount, error) {
+	assetService, err := cloudasset.NewService(ctx, apilog.Options(ctx)...)
+	if err != nil {
+		return nil, errorsutil.NewSDKError("Cloud Asset", "", err)
+	}
+
+	progress := util.StartProgress(fmt.Sprintf("Searching for service accounts in %s", scope))
+	defer progress.Stop()
+
+	var serviceAccounts []*iam.ServiceAccount
+	req := assetService.V1.SearchAllResources(scope).AssetTypes(serviceAccountAssetType).Query(query).PageSize(500)
+	if err := req.Pages(ctx, func(page *cloudasset.SearchAllResourcesResponse) error {
+		for _, result := range page.Results {
+			email := serviceAccountEmail(result)
+			if email == "" {
+				util.Logger.Debugf("Skipping %s, its email could not be determined", result.Name)
+				continue
+			}
+			serviceAccounts = append(serviceAccounts, &iam.ServiceAccount{
+				Name:        fmt.Sprintf("projects/-/serviceAccounts/%s", email),
+				Email:       email,
+				DisplayName: result.DisplayName,
+				Description: result.Description,
+			})
+		}
+		return nil
+	}); err != nil {
+		return nil, errorsutil.New(fmt.Sprintf("Failed to search for service accounts in %s", scope), err)
+	}
+	return serviceAccounts, nil
+}
+
+// serviceAccountEmail returns the email of a service account asset, which is
+// one of its additional attributes, or the last part of its name.
+func serviceAccountEmail(result *cloudasset.ResourceSearchResult) string {
+	var attrs struct {
+		Email string `json:"email"`
+	}
+	if len(result.AdditionalAttributes) > 0 {
+		if err := json.Unmarshal(result.AdditionalAttributes, &attrs); err == nil && attrs.Email != "" {
+			return attrs.Email
+		}
+	}
+	name := result.Name[strings.LastIndex(result.Name, "/")+1:]
+	if strings.Contains(name, "@") {
+		return name
+	}
+	return ""
+}
+
+// FilterImpersonable returns the service accounts that the authenticated user
+// can impersonate. The service accounts can be in any project.
+func FilterImpersonable(serviceAccounts []*iam.ServiceAccount) []*iam.ServiceAccount {
+	var lock sync.Mutex
+	available := make([]*iam.ServiceAccount, 0, len(serviceAccounts))
+	progress := util.StartProgressCount("Checking which service accounts can be impersonated", len(serviceAccounts))
+	defer progress.Stop()
+	_ = util.RunWorkers(len(serviceAccounts), func(i int) error {
+		defer progress.Add(1)
+		perms, err := queryiam.QueryServiceAccountPermissions(
+			[]string{"iam.serviceAccounts.getAccessToken"},
+			"-",
+			serviceAccounts[i].Email,
+			"", "",
+		)
+		if err != nil {
+			util.Logger.Errorf("error checking IAM permissions: %v", err)
+			return nil
+		}
+		if len(perms) > 0 {
+			lock.Lock()
+			available = append(available, serviceAccounts[i])
+			lock.Unlock()
+		}
+		return nil
+	})
+
+	sort.Slice(available, func(i, j int) bool {
+		return available[i].Email < available[j].Email
+	})
+	return available
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	logging "google.golang.org/api/logging/v2"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/apilog"
+)
+
+// AuditLogEntry is an API call recorded in Cloud Audit Logs. Reason is the
+// reason that eiam sent with the call.
+type AuditLogEntry struct {
+	Timestamp string `json:"timestamp"`
+	Principal string `json:"principal"`
+	Service   string `json:"service"`
+	Method    string `json:"method"`
+	Resource  string `json:"resource,omitempty"`
+	CallerIP  string `json:"callerIp,omitempty"`
+	Status    string `json:"status"`
+	Reason    string `json:"reason,omitempty"`
+	LogName   string `json:"logName"`
+}
+
+// auditLogPayload is the part of the AuditLog protoPayload of an entry that
+// AuditLogEntry has.
+type auditLogPayload struct {
+	AuthenticationInfo struct {
+		PrincipalEmail string `json:"principalEmail"`
+	} `json:"authenticationInfo"`
+	RequestMetadata struct {
+		CallerIP          string `json:"callerIp"`
+		RequestAttributes struct {
+			Reason string `json:"reason"`
+		} `json:"requestAttributes"`
+	} `json:"requestMetadata"`
+	ServiceName  string `json:"serviceName"`
+	MethodName   string `json:"methodName"`
+	ResourceName string `json:"resourceName"`
+	Status       *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+// FetchAuditLogEntries gets the Cloud Audit Logs entries of the project for
+// the API calls that principal made between start and end, oldest first. Data
+// Access audit logs are only included if they are enabled in the project.
+func FetchAuditLogEntries(project, principal string, start, end time.Time) ([]*AuditLogEntry, error) {
+	loggingService, err := logging.NewService(ctx, apilog.Options(ctx)...)
+	if err != nil {
+		return nil, errorsutil.NewSDKError("Cloud Logging", "", err)
+	}
+
+	filter := strings.Join([]string{
+		fmt.Sprintf(`logName:"projects/%s/logs/cloudaudit.googleapis.com"`, project),
+		fmt.Sprintf(`protoPayload.authenticationInfo.principalEmail=%q`, principal),
+		fmt.Sprintf(`timestamp>=%q`, start.UTC().Format(time.RFC3339)),
+		fmt.Sprintf(`timestamp<=%q`, end.UTC().Format(time.RFC3339)),
+	}, " AND ")
+	util.Logger.Debugf("Listing log entries matching: %s", filter)
+	req := loggingService.Entries.List(&logging.ListLogEntriesRequest{
+		ResourceNames: []string{fmt.Sprintf("projects/%s", project)},
+		Filter:        filter,
+		OrderBy:       "timestamp asc",
+		PageSize:      1000,
+	})
+
+	var entries []*AuditLogEntry
+	if err := req.Pages(ctx, func(page *logging.ListLogEntriesResponse) error {
+		for _, e := range page.Entries {
+			var payload auditLogPayload
+			if err := json.Unmarshal(e.ProtoPayload, &payload); err != nil {
+				util.Logger.WithError(err).Debugf("Skipping log entry %s, it isn't an audit log", e.InsertId)
+				continue
+			}
+			entry := &AuditLogEntry{
+				Timestamp: e.Timestamp,
+				Principal: payload.AuthenticationInfo.PrincipalEmail,
+				Service:   payload.ServiceName,
+				Method:    payload.MethodName,
+				Resource:  payload.ResourceName,
+				CallerIP:  payload.RequestMetadata.CallerIP,
+				Status:    "OK",
+				Reason:    payload.RequestMetadata.RequestAttributes.Reason,
+				LogName:   e.LogName,
+			}
+			if payload.Status != nil && payload.Status.Code != 0 {
+				entry.Status = fmt.Sprintf("%d %s", payload.Status.Code, payload.Status.Message)
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	}); err != nil {
+		return nil, errorsutil.New(fmt.Sprintf("Failed to read the audit logs of %s", project), err)
+	}
+	return entries, nil
+}
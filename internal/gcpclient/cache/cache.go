@@ -0,0 +1,175 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cache stores the results of GCP API queries on disk, so that
+// commands that are run again and again during an investigation don't query
+// the APIs every time.
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+// The kinds of cached results. Each kind is stored in its own file and can have
+// its own TTL.
+const (
+	IAMPolicies         = "iam_policies"
+	ServiceAccounts     = "service_accounts"
+	TestablePermissions = "testable_permissions"
+)
+
+// Bypass skips reading cached results when set, so that they are fetched again
+// and the cache is refreshed. It is set by the --no-cache flag.
+var Bypass bool
+
+var (
+	cacheDir string
+	ttls     map[string]time.Duration
+	lock     sync.Mutex
+)
+
+type entry struct {
+	Stored time.Time       `json:"stored"`
+	Value  json.RawMessage `json:"value"`
+}
+
+// Configure stores the cache in dir and sets how long each kind of result is
+// cached for. A kind without a TTL, or with a TTL of zero, isn't cached.
+func Configure(dir string, kindTTLs map[string]time.Duration) {
+	lock.Lock()
+	defer lock.Unlock()
+	cacheDir = dir
+	ttls = kindTTLs
+}
+
+// Get reads the cached result of kind with key into v. It returns false if
+// there is no result, or it is older than the TTL of kind.
+func Get(kind, key string, v interface{}) bool {
+	if Bypass || !enabled(kind) {
+		return false
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	e, ok := read(kind)[key]
+	if !ok || time.Since(e.Stored) > ttls[kind] {
+		return false
+	}
+	if err := json.Unmarshal(e.Value, v); err != nil {
+		util.Logger.Debugf("Ignoring the invalid cached %s of %s: %v", kind, key, err)
+		return false
+	}
+	util.Logger.Debugf("Using the cached %s of %s", kind, key)
+	return true
+}
+
+// Put caches v as the result of kind with key. The cache is only an
+// optimization, so failing to write it isn't an error.
+func Put(kind, key string, v interface{}) {
+	if !enabled(kind) {
+		return
+	}
+	value, err := json.Marshal(v)
+	if err != nil {
+		util.Logger.Debugf("Failed to encode the %s of %s for the cache: %v", kind, key, err)
+		return
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	entries := read(kind)
+	entries[key] = entry{Stored: time.Now(), Value: value}
+	write(kind, entries)
+}
+
+// Delete removes the cached result of kind with key, e.g. after it was changed.
+func Delete(kind, key string) {
+	lock.Lock()
+	defer lock.Unlock()
+	if cacheDir == "" {
+		return
+	}
+	entries := read(kind)
+	if _, ok := entries[key]; ok {
+		delete(entries, key)
+		write(kind, entries)
+	}
+}
+
+// Clear removes every cached result.
+func Clear() error {
+	lock.Lock()
+	defer lock.Unlock()
+	if cacheDir == "" {
+		return nil
+	}
+	return os.RemoveAll(cacheDir)
+}
+
+func enabled(kind string) bool {
+	return cacheDir != "" && ttls[kind] > 0
+}
+
+func cacheFile(kind string) string {
+	return filepath.Join(cacheDir, kind+".json")
+}
+
+func read(kind string) map[string]entry {
+	entries := map[string]entry{}
+	data, err := ioutil.ReadFile(cacheFile(kind))
+	if err != nil {
+		return entries
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		util.Logger.Debugf("Ignoring the invalid cache file %s: %v", cacheFile(kind), err)
+		return map[string]entry{}
+	}
+	return entries
+}
+
+// write replaces the cache file of kind with entries. The file is written to a
+// temp file that is renamed over it, so that other eiam processes never read a
+// partly written file.
+func write(kind string, entries map[string]entry) {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		util.Logger.Debugf("Failed to encode the cache file %s: %v", cacheFile(kind), err)
+		return
+	}
+	if err := os.MkdirAll(cacheDir, 0o700); err != nil {
+		util.Logger.Debugf("Failed to create the cache directory %s: %v", cacheDir, err)
+		return
+	}
+	tmp, err := ioutil.TempFile(cacheDir, kind+".*.tmp")
+	if err != nil {
+		util.Logger.Debugf("Failed to create a temp file for the cache file %s: %v", cacheFile(kind), err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), cacheFile(kind))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		util.Logger.Debugf("Failed to write the cache file %s: %v", cacheFile(kind), err)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+func setupCache(t *testing.T) string {
+	t.Helper()
+	util.Logger = util.NewLogger()
+	dir, err := ioutil.TempDir("", "eiam-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+		Configure("", nil)
+		Bypass = false
+	})
+	Configure(dir, map[string]time.Duration{
+		IAMPolicies:     time.Hour,
+		ServiceAccounts: time.Nanosecond,
+	})
+	return dir
+}
+
+func TestPutGet(t *testing.T) {
+	setupCache(t)
+
+	Put(IAMPolicies, "projects/project", []string{"roles/owner"})
+	var got []string
+	if !Get(IAMPolicies, "projects/project", &got) {
+		t.Fatal("expected the cached result to be found")
+	}
+	if len(got) != 1 || got[0] != "roles/owner" {
+		t.Errorf("Get() = %v, want [roles/owner]", got)
+	}
+	if Get(IAMPolicies, "projects/other", &got) {
+		t.Error("expected a key that wasn't cached not to be found")
+	}
+
+	Bypass = true
+	if Get(IAMPolicies, "projects/project", &got) {
+		t.Error("expected the cache to be bypassed")
+	}
+	Bypass = false
+
+	Delete(IAMPolicies, "projects/project")
+	if Get(IAMPolicies, "projects/project", &got) {
+		t.Error("expected the deleted result not to be found")
+	}
+}
+
+func TestGetExpired(t *testing.T) {
+	setupCache(t)
+
+	Put(ServiceAccounts, "project", []string{"sa@project.iam.gserviceaccount.com"})
+	time.Sleep(time.Millisecond)
+	var got []string
+	if Get(ServiceAccounts, "project", &got) {
+		t.Error("expected a result older than the TTL not to be found")
+	}
+}
+
+func TestPutDisabledKind(t *testing.T) {
+	dir := setupCache(t)
+
+	Put(TestablePermissions, "storage", []string{"storage.buckets.get"})
+	if _, err := os.Stat(filepath.Join(dir, TestablePermissions+".json")); !os.IsNotExist(err) {
+		t.Errorf("expected a kind without a TTL not to be written, got %v", err)
+	}
+}
+
+func TestGetInvalidFile(t *testing.T) {
+	dir := setupCache(t)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, IAMPolicies+".json"), []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	if Get(IAMPolicies, "projects/project", &got) {
+		t.Error("expected an invalid cache file to be ignored")
+	}
+	Put(IAMPolicies, "projects/project", []string{"roles/owner"})
+	if !Get(IAMPolicies, "projects/project", &got) {
+		t.Error("expected an invalid cache file to be replaced")
+	}
+}
+
+func TestConcurrentPut(t *testing.T) {
+	dir := setupCache(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			Put(IAMPolicies, fmt.Sprintf("projects/project-%d", i), i)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 50; i++ {
+		var got int
+		if !Get(IAMPolicies, fmt.Sprintf("projects/project-%d", i), &got) || got != i {
+			t.Errorf("expected projects/project-%d to be cached as %d, got %d", i, i, got)
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		t.Errorf("expected only the cache file to be left, got %v", names)
+	}
+}
@@ -21,12 +21,13 @@ import (
 	"google.golang.org/api/option"
 
 	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/apilog"
 )
 
 // ClientWithReason creates a client SDK with the provided reason field.
 func ClientWithReason(reason string) (*credentials.IamCredentialsClient, error) {
 	ctx := context.Background()
-	gcpClientWithReason, err := credentials.NewIamCredentialsClient(ctx, option.WithRequestReason(reason))
+	gcpClientWithReason, err := credentials.NewIamCredentialsClient(ctx, apilog.GRPCOptions(option.WithRequestReason(reason))...)
 	if err != nil {
 		return nil, errorsutil.NewSDKError("Credentials", "", err)
 	}
@@ -0,0 +1,168 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+
+	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/oauth2/google"
+
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// The environment variables that point the Google Cloud client libraries and
+// gcloud at a credential file.
+const (
+	adcFileEnv        = "GOOGLE_APPLICATION_CREDENTIALS"
+	gcloudCredFileEnv = "CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE"
+)
+
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+var impersonationURLPattern = regexp.MustCompile(`serviceAccounts/([^/:]+):generateAccessToken$`)
+
+// credentialFile is the credential configuration file that eiam authenticates
+// with instead of the gcloud account, if one is used.
+var credentialFile *credentialConfig
+
+// credentialConfig holds the fields of a credential file that identify who it
+// authenticates as.
+type credentialConfig struct {
+	Type                           string `json:"type"`
+	Audience                       string `json:"audience"`
+	ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+	ClientEmail                    string `json:"client_email"`
+}
+
+// principal returns the identity that the credentials authenticate as. For
+// Workload Identity Federation this is the service account that the external
+// identity impersonates, or the workload identity pool provider when it uses
+// the federated token directly.
+func (c *credentialConfig) principal() string {
+	if m := impersonationURLPattern.FindStringSubmatch(c.ServiceAccountImpersonationURL); m != nil {
+		return m[1]
+	}
+	if c.ClientEmail != "" {
+		return c.ClientEmail
+	}
+	return c.Audience
+}
+
+// ReadCredentialFile checks that the file is a credential file that the Google
+// Cloud client libraries can use, such as a Workload Identity Federation
+// credential configuration file.
+func ReadCredentialFile(path string) error {
+	_, _, err := readCredentialFile(path)
+	return err
+}
+
+func readCredentialFile(path string) (*credentialConfig, []byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := &credentialConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, nil, fmt.Errorf("%s is not a valid credential file: %v", path, err)
+	}
+	if config.Type == "" {
+		return nil, nil, fmt.Errorf("%s is not a valid credential file: no credential type is set", path)
+	}
+	return config, data, nil
+}
+
+// UseCredentialFile makes eiam, and the gcloud commands that it runs,
+// authenticate with the credential file instead of the gcloud account and
+// application default credentials. It returns the identity that the file
+// authenticates as once it has checked that an access token can be obtained.
+func UseCredentialFile(path string) (string, error) {
+	config, data, err := readCredentialFile(path)
+	if err != nil {
+		return "", errorsutil.New("Failed to read credential file", err)
+	}
+	creds, err := google.CredentialsFromJSON(context.Background(), data, cloudPlatformScope)
+	if err != nil {
+		return "", errorsutil.New("Failed to load credential file", err)
+	}
+	if _, err := creds.TokenSource.Token(); err != nil {
+		return "", errorsutil.New(fmt.Sprintf("Failed to get an access token with the credentials in %s", path), err)
+	}
+
+	for _, env := range []string{adcFileEnv, gcloudCredFileEnv} {
+		if err := os.Setenv(env, path); err != nil {
+			return "", errorsutil.New(fmt.Sprintf("Failed to set %s", env), err)
+		}
+	}
+	credentialFile = config
+	return config.principal(), nil
+}
+
+// ADCSource describes where the application default credentials are found,
+// checking the same locations as the Google Cloud client libraries in the same
+// order. An empty string is returned if there are none.
+func ADCSource() string {
+	if path := os.Getenv(adcFileEnv); path != "" {
+		return fmt.Sprintf("%s (%s)", path, adcFileEnv)
+	}
+	if usr, err := user.Current(); err == nil {
+		path := filepath.Join(usr.HomeDir, ".config", "gcloud", "application_default_credentials.json")
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Sprintf("%s (gcloud auth application-default login)", path)
+		}
+	}
+	if metadata.OnGCE() {
+		return "the GCE metadata server"
+	}
+	return ""
+}
+
+// ADCPrincipal returns the identity that the application default credentials
+// authenticate as.
+func ADCPrincipal() (string, error) {
+	creds, err := google.FindDefaultCredentials(context.Background(), cloudPlatformScope)
+	if err != nil {
+		return "", errorsutil.New("Failed to find the application default credentials", err)
+	}
+	token, err := creds.TokenSource.Token()
+	if err != nil {
+		return "", errorsutil.New("Failed to get an access token with the application default credentials", err)
+	}
+	info, err := DescribeToken(token.AccessToken)
+	if err != nil {
+		return "", err
+	}
+	return info.Principal(), nil
+}
+
+// reauthError matches the OAuth error codes that are returned when the user's
+// credentials can't be used to get an access token anymore, e.g. because they
+// expired, were revoked, or the organization requires the user to log in
+// again. Other errors fetching a token, like network errors, aren't fixed by
+// logging in again.
+var reauthError = regexp.MustCompile(`\binvalid_(grant|rapt)\b`)
+
+// IsReauthError reports whether err was caused by credentials that have to be
+// renewed by logging in again.
+func IsReauthError(err error) bool {
+	return err != nil && reauthError.MatchString(err.Error())
+}
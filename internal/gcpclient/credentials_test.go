@@ -0,0 +1,43 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestIsReauthError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New(`oauth2: cannot fetch token: 400 Bad Request Response: {"error": "invalid_grant", "error_description": "Bad Request"}`), true},
+		{errors.New(`oauth2: cannot fetch token: 400 Bad Request Response: {"error": "invalid_grant", "error_description": "reauth related error (invalid_rapt)"}`), true},
+		{status.Error(codes.Unauthenticated, `transport: oauth2: cannot fetch token: {"error":"invalid_grant"}`), true},
+		{errors.New(`oauth2: cannot fetch token: Post "https://oauth2.googleapis.com/token": dial tcp: i/o timeout`), false},
+		{status.Error(codes.Unauthenticated, "Request had invalid authentication credentials"), false},
+		{errors.New("invalid_granted"), false},
+		{nil, false},
+	}
+	for _, tc := range tests {
+		if got := IsReauthError(tc.err); got != tc.want {
+			t.Errorf("IsReauthError(%v) = %t, expected %t", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	credentialspb "google.golang.org/genproto/googleapis/iam/credentials/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/apilog"
+)
+
+const (
+	oauthTokenURL = "https://oauth2.googleapis.com/token"
+	jwtBearerType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+)
+
+// MaxDelegatedLifetime is the longest that access tokens generated through
+// domain-wide delegation can be valid for.
+const MaxDelegatedLifetime = time.Hour
+
+// GenerateDelegatedAccessToken generates an access token for a Google Workspace
+// user through domain-wide delegation. The service account must be allowed to
+// act as users in the domain for the requested scopes in the Workspace admin
+// console. The service account signs the assertion with the IAM Credentials
+// API, so no key is needed. Lifetimes longer than MaxDelegatedLifetime are
+// shortened.
+func GenerateDelegatedAccessToken(
+	svcAcct,
+	subject,
+	reason string,
+	lifetime time.Duration,
+	scopes,
+	delegates []string,
+) (*credentialspb.GenerateAccessTokenResponse, error) {
+	if lifetime > MaxDelegatedLifetime {
+		lifetime = MaxDelegatedLifetime
+	}
+	client, err := ClientWithReason(reason)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   svcAcct,
+		"sub":   subject,
+		"scope": strings.Join(scopes, " "),
+		"aud":   oauthTokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(lifetime).Unix(),
+	})
+	if err != nil {
+		return nil, errorsutil.New("Failed to encode the delegation assertion", err)
+	}
+	req := credentialspb.SignJwtRequest{
+		Name:    fmt.Sprintf("projects/-/serviceAccounts/%s", svcAcct),
+		Payload: string(claims),
+	}
+	for _, delegate := range delegates {
+		req.Delegates = append(req.Delegates, fmt.Sprintf("projects/-/serviceAccounts/%s", delegate))
+	}
+	signed, err := client.SignJwt(ctx, &req)
+	if err != nil {
+		util.Logger.Errorf("Failed to sign the delegation assertion with service account %s", svcAcct)
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type": {jwtBearerType},
+		"assertion":  {signed.GetSignedJwt()},
+	}
+	resp, err := apilog.HTTPClient.PostForm(oauthTokenURL, form) //nolint:gosec,noctx // The URL is constant
+	if err != nil {
+		return nil, errorsutil.New(fmt.Sprintf("Failed to request an access token for %s", subject), err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errorsutil.New("Failed to read the delegated access token", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		// The most common cause is that the service account isn't allowed to
+		// use domain-wide delegation with the scopes, which Google reports as
+		// unauthorized_client.
+		err := fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+		return nil, errorsutil.New(fmt.Sprintf("Failed to request an access token for %s", subject), err)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, errorsutil.New("Failed to parse the delegated access token", err)
+	}
+	return &credentialspb.GenerateAccessTokenResponse{
+		AccessToken: token.AccessToken,
+		ExpireTime:  timestamppb.New(now.Add(time.Duration(token.ExpiresIn) * time.Second)),
+	}, nil
+}
@@ -0,0 +1,312 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	crmv3 "google.golang.org/api/cloudresourcemanager/v3"
+	"google.golang.org/api/iam/v1"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/apilog"
+)
+
+// impersonationRoles are the roles that let their members act as a service
+// account, either by generating tokens or keys for it, attaching it to
+// resources that they create, or granting themselves access to it.
+var impersonationRoles = map[string]bool{
+	"roles/editor":                         true,
+	"roles/iam.serviceAccountAdmin":        true,
+	"roles/iam.serviceAccountKeyAdmin":     true,
+	"roles/iam.serviceAccountTokenCreator": true,
+	"roles/iam.serviceAccountUser":         true,
+	"roles/iam.workloadIdentityUser":       true,
+	"roles/owner":                          true,
+}
+
+// privilegedRoles are the roles that make a service account a target of
+// privilege escalation.
+var privilegedRoles = map[string]bool{
+	"roles/editor":                            true,
+	"roles/iam.organizationRoleAdmin":         true,
+	"roles/iam.securityAdmin":                 true,
+	"roles/iam.serviceAccountAdmin":           true,
+	"roles/iam.serviceAccountTokenCreator":    true,
+	"roles/owner":                             true,
+	"roles/resourcemanager.folderAdmin":       true,
+	"roles/resourcemanager.organizationAdmin": true,
+	"roles/resourcemanager.projectIamAdmin":   true,
+}
+
+// EscalationEdge is a role binding that lets From act as the service account To.
+type EscalationEdge struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Role      string `json:"role"`
+	GrantedOn string `json:"grantedOn"`
+}
+
+// EscalationPath is a chain of service accounts that a member can impersonate
+// one after the other to reach a privileged service account.
+type EscalationPath struct {
+	Target string `json:"target"`
+	// Privileges are the privileged roles of the target, e.g.
+	// "roles/owner on projects/my-project".
+	Privileges []string         `json:"privileges"`
+	Hops       []EscalationEdge `json:"hops"`
+}
+
+// PrivilegeGraph holds who can act as which service accounts, and which service
+// accounts are privileged, in the resources that were crawled.
+type PrivilegeGraph struct {
+	// edges maps a member to the edges leaving it, by the service account that
+	// they lead to.
+	edges      map[string]map[string]EscalationEdge
+	privileged map[string][]string
+}
+
+func newPrivilegeGraph() *PrivilegeGraph {
+	return &PrivilegeGraph{
+		edges:      map[string]map[string]EscalationEdge{},
+		privileged: map[string][]string{},
+	}
+}
+
+func (g *PrivilegeGraph) addEdge(edge EscalationEdge) {
+	if edge.From == edge.To {
+		return
+	}
+	if g.edges[edge.From] == nil {
+		g.edges[edge.From] = map[string]EscalationEdge{}
+	}
+	// A later binding replaces an earlier one, so that a grant on the service
+	// account itself is shown instead of one inherited from its project.
+	g.edges[edge.From][edge.To] = edge
+}
+
+func (g *PrivilegeGraph) addPrivilege(member, role, resource string) {
+	g.privileged[member] = append(g.privileged[member], fmt.Sprintf("%s on %s", role, resource))
+}
+
+// PathsFrom finds the shortest chain of at most maxDepth service accounts that
+// the sources can impersonate to reach each privileged service account. Groups
+// that the sources belong to aren't expanded, so they should be given as
+// sources too.
+//
+// The graph is searched breadth first from all of the sources at once, so each
+// member is only visited once and the paths are found in order of length.
+func (g *PrivilegeGraph) PathsFrom(sources []string, maxDepth int) []EscalationPath {
+	// via holds the edge that each visited member was first reached through.
+	via := map[string]EscalationEdge{}
+	visited := map[string]bool{}
+	var queue []string
+	for _, source := range sources {
+		if !visited[source] {
+			visited[source] = true
+			queue = append(queue, source)
+		}
+	}
+
+	var paths []EscalationPath
+	for depth := 1; depth <= maxDepth && len(queue) > 0; depth++ {
+		var next []string
+		for _, member := range queue {
+			targets := make([]string, 0, len(g.edges[member]))
+			for to := range g.edges[member] {
+				targets = append(targets, to)
+			}
+			sort.Strings(targets)
+			for _, to := range targets {
+				if visited[to] {
+					continue
+				}
+				visited[to] = true
+				via[to] = g.edges[member][to]
+				next = append(next, to)
+				if len(g.privileged[to]) > 0 {
+					paths = append(paths, EscalationPath{
+						Target:     strings.TrimPrefix(to, "serviceAccount:"),
+						Privileges: g.privileged[to],
+						Hops:       g.hopsTo(to, via, depth),
+					})
+				}
+			}
+		}
+		queue = next
+	}
+	return paths
+}
+
+// hopsTo follows the edges in via back from member to the source that it was
+// reached from.
+func (g *PrivilegeGraph) hopsTo(member string, via map[string]EscalationEdge, depth int) []EscalationEdge {
+	hops := make([]EscalationEdge, depth)
+	for i := depth - 1; i >= 0; i-- {
+		hops[i] = via[member]
+		member = hops[i].From
+	}
+	return hops
+}
+
+// CrawlProjectPrivileges builds the privilege graph of the service accounts in
+// a project. Policies inherited from the project's folders and organization
+// aren't read.
+func CrawlProjectPrivileges(project string) (*PrivilegeGraph, error) {
+	c, err := newPrivilegeCrawler()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.crawlProject("projects/"+project, nil); err != nil {
+		return nil, err
+	}
+	return c.graph, nil
+}
+
+// CrawlFolderPrivileges builds the privilege graph of the service accounts in
+// every project under a folder, including the projects in its subfolders.
+func CrawlFolderPrivileges(folder string) (*PrivilegeGraph, error) {
+	c, err := newPrivilegeCrawler()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.crawlFolder("folders/"+strings.TrimPrefix(folder, "folders/"), nil); err != nil {
+		return nil, err
+	}
+	return c.graph, nil
+}
+
+type privilegeCrawler struct {
+	crm   *crmv3.Service
+	iam   *iam.Service
+	graph *PrivilegeGraph
+}
+
+// inheritedBinding is a binding of an impersonation role on a project or
+// folder, which applies to every service account below it.
+type inheritedBinding struct {
+	role, member, resource string
+}
+
+func newPrivilegeCrawler() (*privilegeCrawler, error) {
+	crmService, err := crmv3.NewService(ctx, apilog.Options(ctx)...)
+	if err != nil {
+		return nil, errorsutil.NewSDKError("Cloud Resource Manager", "", err)
+	}
+	iamService, err := iam.NewService(ctx, apilog.Options(ctx)...)
+	if err != nil {
+		return nil, errorsutil.NewSDKError("Cloud IAM", "", err)
+	}
+	return &privilegeCrawler{crm: crmService, iam: iamService, graph: newPrivilegeGraph()}, nil
+}
+
+func (c *privilegeCrawler) crawlFolder(folder string, inherited []inheritedBinding) error {
+	util.Logger.Debugf("Reading the IAM policies under %s", folder)
+	policy, err := getContainerPolicy(c.crm, folder)
+	if err != nil {
+		return errorsutil.New(fmt.Sprintf("Failed to get the IAM policy of %s", folder), err)
+	}
+	inherited = c.readContainerPolicy(folder, policy.Bindings, inherited)
+
+	if err := c.crm.Projects.List().Parent(folder).Pages(ctx, func(page *crmv3.ListProjectsResponse) error {
+		for _, project := range page.Projects {
+			if project.State != "ACTIVE" {
+				continue
+			}
+			if err := c.crawlProject("projects/"+project.ProjectId, inherited); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return errorsutil.New(fmt.Sprintf("Failed to list the projects in %s", folder), err)
+	}
+
+	return c.crm.Folders.List().Parent(folder).Pages(ctx, func(page *crmv3.ListFoldersResponse) error {
+		for _, subfolder := range page.Folders {
+			if subfolder.State != "ACTIVE" {
+				continue
+			}
+			if err := c.crawlFolder(subfolder.Name, inherited); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *privilegeCrawler) crawlProject(project string, inherited []inheritedBinding) error {
+	util.Logger.Debugf("Reading the IAM policies in %s", project)
+	policy, err := getContainerPolicy(c.crm, project)
+	if err != nil {
+		return errorsutil.New(fmt.Sprintf("Failed to get the IAM policy of %s", project), err)
+	}
+	inherited = c.readContainerPolicy(project, policy.Bindings, inherited)
+
+	serviceAccounts, err := getServiceAccounts(strings.TrimPrefix(project, "projects/"))
+	if err != nil {
+		return err
+	}
+	// The service account policies are read in parallel, then added to the
+	// graph in order.
+	saPolicies := make([]*iam.Policy, len(serviceAccounts))
+	if err := util.RunWorkers(len(serviceAccounts), func(i int) error {
+		policy, err := getServiceAccountPolicy(c.iam, serviceAccounts[i].Name)
+		if err != nil {
+			return errorsutil.New(fmt.Sprintf("Failed to get the IAM policy of %s", serviceAccounts[i].Email), err)
+		}
+		saPolicies[i] = policy
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for i, svcAcct := range serviceAccounts {
+		member := "serviceAccount:" + svcAcct.Email
+		for _, binding := range inherited {
+			c.graph.addEdge(EscalationEdge{From: binding.member, To: member, Role: binding.role, GrantedOn: binding.resource})
+		}
+		for _, binding := range saPolicies[i].Bindings {
+			if !impersonationRoles[binding.Role] {
+				continue
+			}
+			for _, from := range binding.Members {
+				c.graph.addEdge(EscalationEdge{From: from, To: member, Role: binding.Role, GrantedOn: svcAcct.Name})
+			}
+		}
+	}
+	return nil
+}
+
+// readContainerPolicy records the privileged roles of service accounts in the
+// policy of a project or folder, and returns the inherited bindings with the
+// policy's impersonation roles added.
+func (c *privilegeCrawler) readContainerPolicy(resource string, bindings []*crmv3.Binding, inherited []inheritedBinding) []inheritedBinding {
+	inherited = append([]inheritedBinding{}, inherited...)
+	for _, binding := range bindings {
+		for _, member := range binding.Members {
+			if privilegedRoles[binding.Role] && strings.HasPrefix(member, "serviceAccount:") {
+				c.graph.addPrivilege(member, binding.Role, resource)
+			}
+			if impersonationRoles[binding.Role] {
+				inherited = append(inherited, inheritedBinding{role: binding.Role, member: member, resource: resource})
+			}
+		}
+	}
+	return inherited
+}
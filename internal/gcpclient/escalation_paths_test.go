@@ -0,0 +1,155 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testGraph(edges [][2]string, privileged ...string) *PrivilegeGraph {
+	g := newPrivilegeGraph()
+	for _, edge := range edges {
+		g.addEdge(EscalationEdge{From: edge[0], To: edge[1], Role: TokenCreatorRole, GrantedOn: "projects/project"})
+	}
+	for _, member := range privileged {
+		g.addPrivilege(member, "roles/owner", "projects/project")
+	}
+	return g
+}
+
+func pathMembers(path EscalationPath) []string {
+	members := []string{path.Hops[0].From}
+	for _, hop := range path.Hops {
+		members = append(members, hop.To)
+	}
+	return members
+}
+
+func TestPathsFrom(t *testing.T) {
+	const (
+		me    = "user:me@example.com"
+		group = "group:sre@example.com"
+		a     = "serviceAccount:a@project.iam.gserviceaccount.com"
+		b     = "serviceAccount:b@project.iam.gserviceaccount.com"
+		c     = "serviceAccount:c@project.iam.gserviceaccount.com"
+		owner = "serviceAccount:owner@project.iam.gserviceaccount.com"
+	)
+	tests := []struct {
+		name       string
+		edges      [][2]string
+		privileged []string
+		sources    []string
+		maxDepth   int
+		want       [][]string
+	}{
+		{
+			name:       "direct",
+			edges:      [][2]string{{me, owner}},
+			privileged: []string{owner},
+			sources:    []string{me},
+			maxDepth:   4,
+			want:       [][]string{{me, owner}},
+		},
+		{
+			name:       "shortest path only",
+			edges:      [][2]string{{me, a}, {a, b}, {b, owner}, {me, c}, {c, owner}},
+			privileged: []string{owner},
+			sources:    []string{me},
+			maxDepth:   4,
+			want:       [][]string{{me, c, owner}},
+		},
+		{
+			name:       "through a privileged account",
+			edges:      [][2]string{{me, a}, {a, owner}},
+			privileged: []string{a, owner},
+			sources:    []string{me},
+			maxDepth:   4,
+			want:       [][]string{{me, a}, {me, a, owner}},
+		},
+		{
+			name:       "too deep",
+			edges:      [][2]string{{me, a}, {a, b}, {b, owner}},
+			privileged: []string{owner},
+			sources:    []string{me},
+			maxDepth:   2,
+			want:       nil,
+		},
+		{
+			name:       "cycle",
+			edges:      [][2]string{{me, a}, {a, b}, {b, a}, {b, owner}},
+			privileged: []string{owner},
+			sources:    []string{me},
+			maxDepth:   4,
+			want:       [][]string{{me, a, b, owner}},
+		},
+		{
+			name:       "nearest source",
+			edges:      [][2]string{{me, a}, {a, owner}, {group, owner}},
+			privileged: []string{owner},
+			sources:    []string{me, group},
+			maxDepth:   4,
+			want:       [][]string{{group, owner}},
+		},
+		{
+			name:       "sources aren't targets",
+			edges:      [][2]string{{me, a}, {a, me}},
+			privileged: []string{me},
+			sources:    []string{me},
+			maxDepth:   4,
+			want:       nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths := testGraph(tt.edges, tt.privileged...).PathsFrom(tt.sources, tt.maxDepth)
+			var got [][]string
+			for _, path := range paths {
+				got = append(got, pathMembers(path))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("PathsFrom() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPathsFromDenseGraph(t *testing.T) {
+	// Every service account can impersonate every other one, which has more
+	// simple paths than could ever be listed.
+	var members []string
+	for i := 0; i < 200; i++ {
+		members = append(members, fmt.Sprintf("serviceAccount:sa-%d@project.iam.gserviceaccount.com", i))
+	}
+	var edges [][2]string
+	edges = append(edges, [2]string{"user:me@example.com", members[0]})
+	for _, from := range members {
+		for _, to := range members {
+			edges = append(edges, [2]string{from, to})
+		}
+	}
+	g := testGraph(edges, members[len(members)-1])
+
+	start := time.Now()
+	paths := g.PathsFrom([]string{"user:me@example.com"}, 10)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("PathsFrom took %s", elapsed)
+	}
+	if len(paths) != 1 || len(paths[0].Hops) != 2 {
+		t.Errorf("expected a single path of 2 hops, got %+v", paths)
+	}
+}
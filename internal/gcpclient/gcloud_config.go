@@ -19,7 +19,8 @@ import (
 	"io/ioutil"
 	"os"
 	"os/user"
-	"path"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 
@@ -33,18 +34,33 @@ import (
 )
 
 var (
-	gcloudConfig   *ini.File
-	pathToConfig   string
-	initialProjVal string
-	once           sync.Once
+	gcloudConfig *ini.File
+	pathToConfig string
+	once         sync.Once
 )
 
-func readGcloudConfigFromFile() error {
+// GcloudConfigDir returns the directory of the gcloud config, which the
+// CLOUDSDK_CONFIG environment variable overrides. On Windows gcloud keeps its
+// config in %APPDATA%\gcloud.
+func GcloudConfigDir() (string, error) {
+	if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return dir, nil
+	}
+	if appData := os.Getenv("APPDATA"); runtime.GOOS == "windows" && appData != "" {
+		return filepath.Join(appData, "gcloud"), nil
+	}
 	usr, err := user.Current()
 	if err != nil {
-		return errorsutil.New("Failed to get current system user", err)
+		return "", errorsutil.New("Failed to get current system user", err)
+	}
+	return filepath.Join(usr.HomeDir, ".config", "gcloud"), nil
+}
+
+func readGcloudConfigFromFile() error {
+	configDir, err := GcloudConfigDir()
+	if err != nil {
+		return err
 	}
-	configDir := path.Join(usr.HomeDir, ".config", "gcloud")
 
 	activeConfig, err := getActiveConfig(configDir)
 	if err != nil {
@@ -52,26 +68,25 @@ func readGcloudConfigFromFile() error {
 	}
 
 	configName := fmt.Sprintf("config_%s", activeConfig)
-	pathToConfig = path.Join(configDir, "configurations", configName)
+	pathToConfig = filepath.Join(configDir, "configurations", configName)
 
 	gcloudConfig, err = ini.Load(pathToConfig)
 	if err != nil {
 		return errorsutil.New("Failed to parse gcloud config", err)
 	}
-	initialProjVal = gcloudConfig.Section("core").Key("project").String()
 	return nil
 }
 
 func getActiveConfig(configDir string) (string, error) {
-	activeConfigFile := path.Join(configDir, "active_config")
+	activeConfigFile := filepath.Join(configDir, "active_config")
 	if _, err := os.Stat(activeConfigFile); os.IsNotExist(err) {
 		util.Logger.Warn("No active gcloud config is set. Attempting to set one")
-		configurationsDir := path.Join(configDir, "configurations")
+		configurationsDir := filepath.Join(configDir, "configurations")
 		if _, err := os.Stat(configurationsDir); os.IsNotExist(err) {
 			if err := os.Mkdir(configurationsDir, 0o755); err != nil {
 				return "", errorsutil.New("Failed to create file while extracting release archive", err)
 			}
-			defaultConfig := path.Join(configurationsDir, "config_default")
+			defaultConfig := filepath.Join(configurationsDir, "config_default")
 			if _, err := os.Create(defaultConfig); err != nil {
 				return "", errorsutil.New("Failed to create file while extracting release archive", err)
 			}
@@ -144,46 +159,86 @@ func getGcloudConfig() (configErr error) {
 	return configErr
 }
 
-// ConfigureGcloudProxy configures the current gcloud configuration to use the auth proxy.
-func ConfigureGcloudProxy(project string) error {
+// gcloudCredentialFiles are the files in the gcloud config directory that hold
+// the user's credentials. They aren't copied to sandboxes.
+var gcloudCredentialFiles = []string{
+	"access_tokens.db",
+	adcFileName,
+	"credentials.db",
+	"legacy_credentials",
+}
+
+// adcFileName is the application default credentials file in the gcloud
+// config directory.
+const adcFileName = "application_default_credentials.json"
+
+// CreateGcloudSandbox copies the gcloud config directory to dir and points the
+// active configuration of the copy at the auth proxy, so that gcloud can use the
+// auth proxy with CLOUDSDK_CONFIG set to dir while the user's own config is left
+// unchanged. The project isn't changed; privileged sessions set it in the
+// environment of the sub-shell instead. The user's credentials aren't copied,
+// gcloud reads the session's access token from tokenFile instead.
+func CreateGcloudSandbox(dir, tokenFile string) error {
 	if err := getGcloudConfig(); err != nil {
 		return err
 	}
+	configDir, err := GcloudConfigDir()
+	if err != nil {
+		return err
+	}
+	// gcloud's logs are only appended to, and can be large.
+	skip := append([]string{"logs"}, gcloudCredentialFiles...)
+	if err := util.CopyDir(configDir, dir, skip...); err != nil {
+		return errorsutil.New("Failed to copy the gcloud config", err)
+	}
 
-	gcloudConfig.Section("proxy").Key("address").SetValue(viper.GetString("authproxy.proxyaddress"))
-	gcloudConfig.Section("proxy").Key("port").SetValue(viper.GetString("authproxy.proxyport"))
-	gcloudConfig.Section("proxy").Key("type").SetValue("http")
-	gcloudConfig.Section("core").Key("custom_ca_certs_file").SetValue(viper.GetString("authproxy.certfile"))
-	// If the user specified a project flag, set it in the gcloud config.
-	if project != "" {
-		gcloudConfig.Section("core").Key("project").SetValue(project)
+	sandboxConfigPath := filepath.Join(dir, "configurations", filepath.Base(pathToConfig))
+	sandboxConfig, err := ini.Load(sandboxConfigPath)
+	if err != nil {
+		return errorsutil.New("Failed to parse gcloud config", err)
 	}
-	if err := gcloudConfig.SaveTo(pathToConfig); err != nil {
+	sandboxConfig.Section("proxy").Key("address").SetValue(proxyAddress())
+	sandboxConfig.Section("proxy").Key("port").SetValue(viper.GetString("authproxy.proxyport"))
+	sandboxConfig.Section("proxy").Key("type").SetValue("http")
+	sandboxConfig.Section("core").Key("custom_ca_certs_file").SetValue(viper.GetString("authproxy.certfile"))
+	sandboxConfig.Section("auth").Key("access_token_file").SetValue(tokenFile)
+	if err := sandboxConfig.SaveTo(sandboxConfigPath); err != nil {
 		return errorsutil.New("Failed to save gcloud config to file", err)
 	}
 	return nil
 }
 
-// UnsetGcloudProxy restores the auth proxy changes made to the gcloud config.
-func UnsetGcloudProxy() error {
-	if err := getGcloudConfig(); err != nil {
-		return err
+// UserADCFile returns the application default credentials file in the user's
+// gcloud config directory, or an empty string if there isn't one.
+func UserADCFile() string {
+	configDir, err := GcloudConfigDir()
+	if err != nil {
+		return ""
+	}
+	file := filepath.Join(configDir, adcFileName)
+	if _, err := os.Stat(file); err != nil {
+		return ""
 	}
+	return file
+}
 
-	gcloudConfig.Section("proxy").DeleteKey("address")
-	gcloudConfig.Section("proxy").DeleteKey("port")
-	gcloudConfig.Section("proxy").DeleteKey("type")
-	gcloudConfig.Section("core").DeleteKey("custom_ca_certs_file")
-	gcloudConfig.Section("core").Key("project").SetValue(initialProjVal)
-	if err := gcloudConfig.SaveTo(pathToConfig); err != nil {
-		return errorsutil.New("Failed to save gcloud config to file", err)
+// proxyAddress returns the auth proxy address in the form that gcloud puts in
+// proxy URLs, with IPv6 addresses in brackets.
+func proxyAddress() string {
+	host := strings.TrimSuffix(strings.TrimPrefix(viper.GetString("authproxy.proxyaddress"), "["), "]")
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
 	}
-	return nil
+	return host
 }
 
 // CheckActiveAccountSet ensures that the current gcloud config has an active account value
-// and if an account is set, it returns the value.
+// and if an account is set, it returns the value. When a credential file is used, the
+// identity that it authenticates as is returned instead.
 func CheckActiveAccountSet() (string, error) {
+	if credentialFile != nil {
+		return credentialFile.principal(), nil
+	}
 	if err := getGcloudConfig(); err != nil {
 		return "", err
 	}
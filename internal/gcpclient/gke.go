@@ -19,16 +19,19 @@ import (
 	"fmt"
 
 	container "cloud.google.com/go/container/apiv1"
+	"golang.org/x/oauth2"
 	"google.golang.org/api/option"
 	containerpb "google.golang.org/genproto/googleapis/container/v1"
+	"gopkg.in/yaml.v2"
 
 	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/apilog"
 )
 
 // GetClusters gets the list of clusters in the current project.
 func GetClusters(project, reason string) ([]map[string]string, error) {
-	gkeClient, err := container.NewClusterManagerClient(context.Background(), option.WithRequestReason(reason))
+	gkeClient, err := container.NewClusterManagerClient(context.Background(), apilog.GRPCOptions(option.WithRequestReason(reason))...)
 	if err != nil {
 		return []map[string]string{}, errorsutil.NewSDKError("Container", "", err)
 	}
@@ -48,3 +51,88 @@ func GetClusters(project, reason string) ([]map[string]string, error) {
 	}
 	return clusterNames, nil
 }
+
+// Cluster holds what kubectl needs to connect to a GKE cluster.
+type Cluster struct {
+	Project       string
+	Name          string
+	Location      string
+	Endpoint      string
+	CACertificate string
+}
+
+// FindCluster looks up the GKE cluster with the given name using the access
+// token. If location is empty, the cluster is looked for in all locations of
+// the project.
+func FindCluster(project, location, name, accessToken, reason string) (*Cluster, error) {
+	gkeClient, err := container.NewClusterManagerClient(
+		context.Background(),
+		apilog.GRPCOptions(
+			option.WithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: accessToken})),
+			option.WithRequestReason(reason),
+		)...,
+	)
+	if err != nil {
+		return nil, errorsutil.NewSDKError("Container", "", err)
+	}
+	defer gkeClient.Close()
+
+	if location == "" {
+		location = "-"
+	}
+	resp, err := gkeClient.ListClusters(ctx, &containerpb.ListClustersRequest{
+		Parent: fmt.Sprintf("projects/%s/locations/%s", project, location),
+	})
+	if err != nil {
+		return nil, errorsutil.New(fmt.Sprintf("Failed to list the GKE clusters in %s", project), err)
+	}
+	var found *Cluster
+	for _, cl := range resp.Clusters {
+		if cl.Name != name {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("more than one cluster in %s is named %s, choose one with --region", project, name)
+		}
+		found = &Cluster{
+			Project:       project,
+			Name:          cl.Name,
+			Location:      cl.Location,
+			Endpoint:      cl.Endpoint,
+			CACertificate: cl.GetMasterAuth().GetClusterCaCertificate(),
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no cluster named %s was found in %s", name, project)
+	}
+	return found, nil
+}
+
+// Kubeconfig returns a kubeconfig that only has the cluster and authenticates
+// to it with the access token.
+func (c *Cluster) Kubeconfig(accessToken string) ([]byte, error) {
+	// Contexts are named like the ones that gcloud creates.
+	name := fmt.Sprintf("gke_%s_%s_%s", c.Project, c.Location, c.Name)
+	type item map[string]interface{}
+	config := item{
+		"apiVersion":      "v1",
+		"kind":            "Config",
+		"current-context": name,
+		"clusters": []item{{
+			"name": name,
+			"cluster": item{
+				"server":                     "https://" + c.Endpoint,
+				"certificate-authority-data": c.CACertificate,
+			},
+		}},
+		"users": []item{{
+			"name": name,
+			"user": item{"token": accessToken},
+		}},
+		"contexts": []item{{
+			"name":    name,
+			"context": item{"cluster": name, "user": name},
+		}},
+	}
+	return yaml.Marshal(config)
+}
@@ -16,46 +16,67 @@ package gcpclient
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
+	"net/http"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/golang/protobuf/ptypes/duration"
+	"github.com/spf13/viper"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iam/v1"
+	"google.golang.org/api/option"
 	credentialspb "google.golang.org/genproto/googleapis/iam/credentials/v1"
 
 	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/apilog"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/cache"
 	queryiam "github.com/rigup/ephemeral-iam/internal/gcpclient/query_iam"
 )
 
-var (
-	sessionDuration int64 = 600
-	ctx                   = context.Background()
+var ctx = context.Background()
 
-	wg sync.WaitGroup
-)
+// GenerateTemporaryAccessToken generates short-lived credentials for the given service account
+// that are valid for the provided lifetime. If delegates is not empty, the token is generated
+// through the delegation chain, starting with the first delegate.
+func GenerateTemporaryAccessToken(svcAcct, reason string, lifetime time.Duration, delegates []string) (*credentialspb.GenerateAccessTokenResponse, error) {
+	return GenerateScopedAccessToken(svcAcct, reason, lifetime, tokenScopes(), delegates)
+}
 
-// GenerateTemporaryAccessToken generates short-lived credentials for the given service account.
-func GenerateTemporaryAccessToken(svcAcct, reason string) (*credentialspb.GenerateAccessTokenResponse, error) {
+// GenerateScopedAccessToken generates short-lived credentials for the given
+// service account that are limited to the provided OAuth scopes.
+func GenerateScopedAccessToken(
+	svcAcct,
+	reason string,
+	lifetime time.Duration,
+	scopes,
+	delegates []string,
+) (*credentialspb.GenerateAccessTokenResponse, error) {
 	client, err := ClientWithReason(reason)
 	if err != nil {
 		return nil, err
 	}
 
 	sessionDuration := &duration.Duration{
-		Seconds: sessionDuration, // Expire after 10 minutes.
+		Seconds: int64(lifetime.Seconds()),
 	}
 
 	req := credentialspb.GenerateAccessTokenRequest{
 		Name:     fmt.Sprintf("projects/-/serviceAccounts/%s", svcAcct),
 		Lifetime: sessionDuration,
-		Scope: []string{
-			iam.CloudPlatformScope,
-			"https://www.googleapis.com/auth/userinfo.email",
-		},
+		Scope:    scopes,
+	}
+	for _, delegate := range delegates {
+		req.Delegates = append(req.Delegates, fmt.Sprintf("projects/-/serviceAccounts/%s", delegate))
 	}
 
-	resp, err := client.GenerateAccessToken(ctx, &req)
+	// The auth proxy holds requests while scoped tokens are generated.
+	reqCtx, cancel := context.WithTimeout(ctx, apilog.RequestTimeout)
+	defer cancel()
+	resp, err := client.GenerateAccessToken(reqCtx, &req)
 	if err != nil {
 		util.Logger.Errorf("Failed to generate GCP access token for service account %s", svcAcct)
 		return nil, err
@@ -63,6 +84,129 @@ func GenerateTemporaryAccessToken(svcAcct, reason string) (*credentialspb.Genera
 	return resp, nil
 }
 
+// GenerateIDToken generates an OpenID Connect ID token for the given service
+// account with the audience set to the provided value, such as the URL of a
+// Cloud Run service or the client ID of an IAP-protected resource.
+func GenerateIDToken(svcAcct, reason, audience string, includeEmail bool, delegates []string) (string, error) {
+	client, err := ClientWithReason(reason)
+	if err != nil {
+		return "", err
+	}
+
+	req := credentialspb.GenerateIdTokenRequest{
+		Name:         fmt.Sprintf("projects/-/serviceAccounts/%s", svcAcct),
+		Audience:     audience,
+		IncludeEmail: includeEmail,
+	}
+	for _, delegate := range delegates {
+		req.Delegates = append(req.Delegates, fmt.Sprintf("projects/-/serviceAccounts/%s", delegate))
+	}
+
+	resp, err := client.GenerateIdToken(ctx, &req)
+	if err != nil {
+		util.Logger.Errorf("Failed to generate an ID token for service account %s", svcAcct)
+		return "", err
+	}
+	return resp.GetToken(), nil
+}
+
+// tokenScopes returns the configured OAuth scopes for generated access tokens.
+// Scopes set with the EIAM_DEFAULTS_SCOPES environment variable are a comma
+// separated string rather than a list.
+func tokenScopes() []string {
+	if scopes, ok := viper.Get("defaults.scopes").(string); ok {
+		return util.SplitList(scopes)
+	}
+	return viper.GetStringSlice("defaults.scopes")
+}
+
+// ScopesOrDefault returns the OAuth scopes, or the configured scopes for
+// generated access tokens if there are none.
+func ScopesOrDefault(scopes []string) []string {
+	if len(scopes) > 0 {
+		return scopes
+	}
+	return tokenScopes()
+}
+
+// FirstHop returns the service account that the authenticated user has to be
+// able to impersonate directly: the first delegate, or the target service
+// account when there are no delegates.
+func FirstHop(serviceAccountEmail string, delegates []string) string {
+	if len(delegates) > 0 {
+		return delegates[0]
+	}
+	return serviceAccountEmail
+}
+
+// ImpersonationChain returns the delegates and the service account in the
+// comma separated form that gcloud's --impersonate-service-account flag and
+// auth/impersonate_service_account property accept.
+func ImpersonationChain(serviceAccountEmail string, delegates []string) string {
+	return strings.Join(append(append([]string{}, delegates...), serviceAccountEmail), ",")
+}
+
+// CheckServiceAccountExists returns an error if the service account doesn't
+// exist in the project.
+func CheckServiceAccountExists(project, serviceAccountEmail string) error {
+	iamService, err := iam.NewService(ctx, apilog.Options(ctx)...)
+	if err != nil {
+		return errorsutil.NewSDKError("Cloud IAM", "", err)
+	}
+	name := fmt.Sprintf("projects/%s/serviceAccounts/%s", project, serviceAccountEmail)
+	svcAcct, err := iam.NewProjectsServiceAccountsService(iamService).Get(name).Context(ctx).Do()
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusNotFound {
+		err := fmt.Errorf("%s doesn't exist in project %s", serviceAccountEmail, project)
+		return errorsutil.New("Failed to find service account", err)
+	} else if err != nil {
+		return errorsutil.New(fmt.Sprintf("Failed to look up service account %s", serviceAccountEmail), err)
+	}
+	// The service account is found by its email regardless of the project in
+	// the resource name.
+	if svcAcct.ProjectId != project {
+		err := fmt.Errorf("%s is in project %s, not %s. Use --project %s", serviceAccountEmail, svcAcct.ProjectId, project, svcAcct.ProjectId)
+		return errorsutil.New("Failed to find service account", err)
+	}
+	return nil
+}
+
+// CreateServiceAccountKey creates a key for the service account with the
+// credentials of the authenticated user. It returns the resource name of the
+// key and the contents of its JSON key file.
+func CreateServiceAccountKey(serviceAccountEmail, reason string) (string, []byte, error) {
+	iamService, err := iam.NewService(ctx, apilog.Options(ctx, option.WithRequestReason(reason))...)
+	if err != nil {
+		return "", nil, errorsutil.NewSDKError("Cloud IAM", "", err)
+	}
+	name := fmt.Sprintf("projects/-/serviceAccounts/%s", serviceAccountEmail)
+	req := &iam.CreateServiceAccountKeyRequest{PrivateKeyType: "TYPE_GOOGLE_CREDENTIALS_FILE"}
+	key, err := iam.NewProjectsServiceAccountsKeysService(iamService).Create(name, req).Context(ctx).Do()
+	if err != nil {
+		return "", nil, errorsutil.New(fmt.Sprintf("Failed to create a key for %s", serviceAccountEmail), err)
+	}
+	keyFile, err := base64.StdEncoding.DecodeString(key.PrivateKeyData)
+	if err != nil {
+		// The key can't be used, so don't leave it behind.
+		if _, delErr := iam.NewProjectsServiceAccountsKeysService(iamService).Delete(key.Name).Context(ctx).Do(); delErr != nil {
+			util.Logger.WithError(delErr).Errorf("Failed to delete the service account key %s", key.Name)
+		}
+		return "", nil, errorsutil.New("Failed to decode the service account key", err)
+	}
+	return key.Name, keyFile, nil
+}
+
+// DeleteServiceAccountKey deletes a service account key by its resource name.
+func DeleteServiceAccountKey(keyName, reason string) error {
+	iamService, err := iam.NewService(ctx, apilog.Options(ctx, option.WithRequestReason(reason))...)
+	if err != nil {
+		return errorsutil.NewSDKError("Cloud IAM", "", err)
+	}
+	if _, err := iam.NewProjectsServiceAccountsKeysService(iamService).Delete(keyName).Context(ctx).Do(); err != nil {
+		return errorsutil.New(fmt.Sprintf("Failed to delete the service account key %s", keyName), err)
+	}
+	return nil
+}
+
 // CanImpersonate checks if a given service account can be impersonated by the
 // authenticated user.
 func CanImpersonate(project, serviceAccountEmail string) (bool, error) {
@@ -72,7 +216,7 @@ func CanImpersonate(project, serviceAccountEmail string) (bool, error) {
 		return false, err
 	}
 
-	perms, err := queryiam.QueryServiceAccountPermissions(testablePerms, project, serviceAccountEmail)
+	perms, err := queryiam.QueryServiceAccountPermissions(testablePerms, project, serviceAccountEmail, "", "")
 	if err != nil {
 		return false, err
 	}
@@ -95,27 +239,35 @@ func FetchAvailableServiceAccounts(project string) ([]*iam.ServiceAccount, error
 	}
 	util.Logger.Infof("Checking %d service accounts in %s", len(serviceAccounts), project)
 
-	wg.Add(len(serviceAccounts))
-
-	var availableSAs []*iam.ServiceAccount
-	for _, svcAcct := range serviceAccounts {
-		go func(serviceAccount *iam.ServiceAccount) {
-			hasAccess, err := CanImpersonate(project, serviceAccount.Email)
-			if err != nil {
-				util.Logger.Errorf("error checking IAM permissions: %v", err)
-			} else if hasAccess {
-				availableSAs = append(availableSAs, serviceAccount)
-			}
-			wg.Done()
-		}(svcAcct)
-	}
-	wg.Wait()
+	var (
+		lock         sync.Mutex
+		availableSAs []*iam.ServiceAccount
+	)
+	progress := util.StartProgressCount("Checking which service accounts can be impersonated", len(serviceAccounts))
+	defer progress.Stop()
+	_ = util.RunWorkers(len(serviceAccounts), func(i int) error {
+		defer progress.Add(1)
+		hasAccess, err := CanImpersonate(project, serviceAccounts[i].Email)
+		if err != nil {
+			util.Logger.Errorf("error checking IAM permissions: %v", err)
+		} else if hasAccess {
+			lock.Lock()
+			availableSAs = append(availableSAs, serviceAccounts[i])
+			lock.Unlock()
+		}
+		return nil
+	})
 
 	return availableSAs, nil
 }
 
 func getServiceAccounts(project string) ([]*iam.ServiceAccount, error) {
-	iamService, err := iam.NewService(context.Background())
+	var cached []*iam.ServiceAccount
+	if cache.Get(cache.ServiceAccounts, project, &cached) {
+		return cached, nil
+	}
+
+	iamService, err := iam.NewService(context.Background(), apilog.Options(context.Background())...)
 	if err != nil {
 		return nil, errorsutil.NewSDKError("Cloud IAM", "", err)
 	}
@@ -133,5 +285,6 @@ func getServiceAccounts(project string) ([]*iam.ServiceAccount, error) {
 		util.Logger.Error("Failed to list service accounts")
 		return []*iam.ServiceAccount{}, err
 	}
+	cache.Put(cache.ServiceAccounts, project, serviceAccounts)
 	return serviceAccounts, nil
 }
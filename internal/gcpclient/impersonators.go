@@ -0,0 +1,256 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	crmv3 "google.golang.org/api/cloudresourcemanager/v3"
+	"google.golang.org/api/iam/v1"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/apilog"
+)
+
+// TokenCreatorRole is the role that allows its members to generate access
+// tokens for, and so impersonate, a service account.
+const TokenCreatorRole = "roles/iam.serviceAccountTokenCreator"
+
+// getAccessTokenPermission is the permission that allows a member to generate
+// access tokens for a service account. Any role that includes it, such as the
+// basic Owner and Editor roles or a custom role, allows impersonation.
+const getAccessTokenPermission = "iam.serviceAccounts.getAccessToken"
+
+// Impersonator is a member that can impersonate a service account.
+type Impersonator struct {
+	Member string `json:"member" yaml:"member"`
+	// Role is the role of the binding that allows the member to impersonate
+	// the service account.
+	Role string `json:"role" yaml:"role"`
+	// GrantedOn is where the role is granted, either on the service account
+	// itself or on its project or one of the project's folders or organization,
+	// which applies to every service account below it.
+	GrantedOn string `json:"grantedOn" yaml:"grantedOn"`
+	// Condition is the title or expression of the binding's condition, if it
+	// has one.
+	Condition string `json:"condition,omitempty" yaml:"condition,omitempty"`
+}
+
+// ServiceAccountImpersonators lists the members that can impersonate a service
+// account.
+type ServiceAccountImpersonators struct {
+	ServiceAccount string         `json:"serviceAccount" yaml:"serviceAccount"`
+	Impersonators  []Impersonator `json:"impersonators" yaml:"impersonators"`
+}
+
+// FetchImpersonators finds the members that are granted a role that includes
+// iam.serviceAccounts.getAccessToken on each service account in the project,
+// either directly or on the project, its folders or its organization. The
+// policies of the folders and organization are skipped with a warning if they
+// can't be read.
+func FetchImpersonators(project string) ([]ServiceAccountImpersonators, error) {
+	serviceAccounts, err := getServiceAccounts(project)
+	if err != nil {
+		return nil, err
+	}
+
+	crmService, err := crmv3.NewService(ctx, apilog.Options(ctx)...)
+	if err != nil {
+		return nil, errorsutil.NewSDKError("Cloud Resource Manager", "", err)
+	}
+	iamService, err := iam.NewService(ctx, apilog.Options(ctx)...)
+	if err != nil {
+		return nil, errorsutil.NewSDKError("Cloud IAM", "", err)
+	}
+	roles := newRoleChecker(iamService)
+
+	var inherited []Impersonator
+	for _, resource := range projectAncestry(crmService, project) {
+		policy, err := getContainerPolicy(crmService, resource)
+		if err != nil {
+			if resource == "projects/"+project {
+				return nil, errorsutil.New(fmt.Sprintf("Failed to get the IAM policy of %s", project), err)
+			}
+			util.Logger.Warnf("Skipping the IAM policy of %s: %v", resource, err)
+			continue
+		}
+		for _, binding := range policy.Bindings {
+			ok, err := roles.grantsImpersonation(binding.Role)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			for _, member := range binding.Members {
+				inherited = append(inherited, Impersonator{
+					Member:    member,
+					Role:      binding.Role,
+					GrantedOn: resource,
+					Condition: crmConditionString(binding.Condition),
+				})
+			}
+		}
+	}
+
+	results := make([]ServiceAccountImpersonators, len(serviceAccounts))
+	err = util.RunWorkers(len(serviceAccounts), func(i int) error {
+		svcAcct := serviceAccounts[i]
+		policy, err := getServiceAccountPolicy(iamService, svcAcct.Name)
+		if err != nil {
+			return errorsutil.New(fmt.Sprintf("Failed to get the IAM policy of %s", svcAcct.Email), err)
+		}
+		impersonators := append([]Impersonator{}, inherited...)
+		for _, binding := range policy.Bindings {
+			ok, err := roles.grantsImpersonation(binding.Role)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			for _, member := range binding.Members {
+				impersonators = append(impersonators, Impersonator{
+					Member:    member,
+					Role:      binding.Role,
+					GrantedOn: svcAcct.Name,
+					Condition: iamConditionString(binding.Condition),
+				})
+			}
+		}
+		results[i] = ServiceAccountImpersonators{ServiceAccount: svcAcct.Email, Impersonators: impersonators}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].ServiceAccount < results[j].ServiceAccount
+	})
+	return results, nil
+}
+
+// projectAncestry returns the project's resource name followed by those of
+// its folders, from the nearest one up, and its organization. Only the project
+// is returned if its ancestors can't be read.
+func projectAncestry(svc *crmv3.Service, project string) []string {
+	ancestry := []string{"projects/" + project}
+	p, err := svc.Projects.Get("projects/" + project).Do()
+	if err != nil {
+		util.Logger.Warnf("Skipping the IAM policies of the ancestors of %s: %v", project, err)
+		return ancestry
+	}
+	parent := p.Parent
+	for strings.HasPrefix(parent, "folders/") {
+		ancestry = append(ancestry, parent)
+		folder, err := svc.Folders.Get(parent).Do()
+		if err != nil {
+			util.Logger.Warnf("Skipping the IAM policies of the ancestors of %s: %v", parent, err)
+			return ancestry
+		}
+		parent = folder.Parent
+	}
+	if strings.HasPrefix(parent, "organizations/") {
+		ancestry = append(ancestry, parent)
+	}
+	return ancestry
+}
+
+// rolePermissions returns the permissions that a predefined or custom role
+// includes. It is a variable so that tests can replace it.
+var rolePermissions = func(svc *iam.Service, role string) ([]string, error) {
+	var (
+		r   *iam.Role
+		err error
+	)
+	switch {
+	case strings.HasPrefix(role, "projects/"):
+		r, err = svc.Projects.Roles.Get(role).Do()
+	case strings.HasPrefix(role, "organizations/"):
+		r, err = svc.Organizations.Roles.Get(role).Do()
+	default:
+		r, err = svc.Roles.Get(role).Do()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.IncludedPermissions, nil
+}
+
+// roleChecker reports which roles allow their members to impersonate service
+// accounts. Each role is only looked up once.
+type roleChecker struct {
+	svc *iam.Service
+
+	mu     sync.Mutex
+	grants map[string]bool
+}
+
+func newRoleChecker(svc *iam.Service) *roleChecker {
+	return &roleChecker{
+		svc:    svc,
+		grants: map[string]bool{TokenCreatorRole: true},
+	}
+}
+
+// grantsImpersonation reports whether role includes
+// iam.serviceAccounts.getAccessToken.
+func (r *roleChecker) grantsImpersonation(role string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ok, found := r.grants[role]; found {
+		return ok, nil
+	}
+	perms, err := rolePermissions(r.svc, role)
+	if err != nil {
+		return false, errorsutil.New(fmt.Sprintf("Failed to get the permissions of %s", role), err)
+	}
+	ok := false
+	for _, perm := range perms {
+		if perm == getAccessTokenPermission {
+			ok = true
+			break
+		}
+	}
+	r.grants[role] = ok
+	return ok, nil
+}
+
+func crmConditionString(condition *crmv3.Expr) string {
+	switch {
+	case condition == nil:
+		return ""
+	case condition.Title != "":
+		return condition.Title
+	default:
+		return condition.Expression
+	}
+}
+
+func iamConditionString(condition *iam.Expr) string {
+	switch {
+	case condition == nil:
+		return ""
+	case condition.Title != "":
+		return condition.Title
+	default:
+		return condition.Expression
+	}
+}
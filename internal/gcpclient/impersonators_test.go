@@ -0,0 +1,78 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"errors"
+	"testing"
+
+	"google.golang.org/api/iam/v1"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+func TestRoleCheckerGrantsImpersonation(t *testing.T) {
+	util.Logger = util.NewLogger()
+	roles := map[string][]string{
+		"roles/owner":                          {"iam.serviceAccounts.actAs", "iam.serviceAccounts.getAccessToken"},
+		"roles/viewer":                         {"iam.serviceAccounts.get"},
+		"projects/project/roles/deployer":      {"iam.serviceAccounts.getAccessToken", "run.services.update"},
+		"organizations/123/roles/impersonator": {"iam.serviceAccounts.getAccessToken"},
+	}
+	lookups := map[string]int{}
+	saved := rolePermissions
+	defer func() { rolePermissions = saved }()
+	rolePermissions = func(_ *iam.Service, role string) ([]string, error) {
+		lookups[role]++
+		perms, ok := roles[role]
+		if !ok {
+			return nil, errors.New("role not found")
+		}
+		return perms, nil
+	}
+
+	checker := newRoleChecker(nil)
+	tests := []struct {
+		role string
+		want bool
+	}{
+		{TokenCreatorRole, true},
+		{"roles/owner", true},
+		{"roles/viewer", false},
+		{"projects/project/roles/deployer", true},
+		{"organizations/123/roles/impersonator", true},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 2; i++ {
+			got, err := checker.grantsImpersonation(tt.role)
+			if err != nil {
+				t.Fatalf("grantsImpersonation(%q): %v", tt.role, err)
+			}
+			if got != tt.want {
+				t.Errorf("grantsImpersonation(%q) = %t, want %t", tt.role, got, tt.want)
+			}
+		}
+	}
+	if lookups[TokenCreatorRole] != 0 {
+		t.Errorf("expected %s not to be looked up, it was looked up %d times", TokenCreatorRole, lookups[TokenCreatorRole])
+	}
+	if lookups["roles/owner"] != 1 {
+		t.Errorf("expected roles/owner to be looked up once, it was looked up %d times", lookups["roles/owner"])
+	}
+
+	if _, err := checker.grantsImpersonation("roles/missing"); err == nil {
+		t.Error("expected an error for a role that can't be read")
+	}
+}
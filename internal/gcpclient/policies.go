@@ -0,0 +1,73 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"strings"
+
+	crmv3 "google.golang.org/api/cloudresourcemanager/v3"
+	"google.golang.org/api/iam/v1"
+
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/cache"
+	queryiam "github.com/rigup/ephemeral-iam/internal/gcpclient/query_iam"
+)
+
+// getContainerPolicy reads the IAM policy of a project, folder or organization,
+// such as "projects/my-project" or "folders/123456789012", from the cache or
+// the API.
+func getContainerPolicy(svc *crmv3.Service, resource string) (*crmv3.Policy, error) {
+	policy := &crmv3.Policy{}
+	if cache.Get(cache.IAMPolicies, resource, policy) {
+		return policy, nil
+	}
+	req := &crmv3.GetIamPolicyRequest{
+		Options: &crmv3.GetPolicyOptions{RequestedPolicyVersion: conditionalPolicyVersion},
+	}
+	err := queryiam.WithRetry(func() (err error) {
+		switch {
+		case strings.HasPrefix(resource, "folders/"):
+			policy, err = svc.Folders.GetIamPolicy(resource, req).Do()
+		case strings.HasPrefix(resource, "organizations/"):
+			policy, err = svc.Organizations.GetIamPolicy(resource, req).Do()
+		default:
+			policy, err = svc.Projects.GetIamPolicy(resource, req).Do()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	cache.Put(cache.IAMPolicies, resource, policy)
+	return policy, nil
+}
+
+// getServiceAccountPolicy reads the IAM policy of a service account, given by
+// its resource name, from the cache or the API.
+func getServiceAccountPolicy(svc *iam.Service, name string) (*iam.Policy, error) {
+	policy := &iam.Policy{}
+	if cache.Get(cache.IAMPolicies, name, policy) {
+		return policy, nil
+	}
+	err := queryiam.WithRetry(func() (err error) {
+		policy, err = svc.Projects.ServiceAccounts.GetIamPolicy(name).
+			OptionsRequestedPolicyVersion(conditionalPolicyVersion).Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	cache.Put(cache.IAMPolicies, name, policy)
+	return policy, nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"fmt"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	queryiam "github.com/rigup/ephemeral-iam/internal/gcpclient/query_iam"
+)
+
+// Prerequisite is a permission that the authenticated user needs on a resource
+// for a command to succeed.
+type Prerequisite struct {
+	Permission string
+	// Resource is the full resource name of the resource, e.g.
+	// //cloudresourcemanager.googleapis.com/projects/my-project.
+	Resource string
+}
+
+func (p Prerequisite) String() string {
+	return fmt.Sprintf("%s on %s", p.Permission, p.Resource)
+}
+
+// ProjectResource returns the full resource name of a project.
+func ProjectResource(project string) string {
+	return fmt.Sprintf("//cloudresourcemanager.googleapis.com/projects/%s", project)
+}
+
+// ServiceAccountResource returns the full resource name of a service account.
+func ServiceAccountResource(project, serviceAccountEmail string) string {
+	return fmt.Sprintf("//iam.googleapis.com/projects/%s/serviceAccounts/%s", project, serviceAccountEmail)
+}
+
+// MissingPrerequisites tests the prerequisites with the authenticated user's
+// credentials and returns the ones that they don't have. The permissions on
+// each resource are tested with a single request.
+func MissingPrerequisites(prereqs []Prerequisite) ([]Prerequisite, error) {
+	var resources []string
+	perms := map[string][]string{}
+	for _, prereq := range prereqs {
+		if _, ok := perms[prereq.Resource]; !ok {
+			resources = append(resources, prereq.Resource)
+		}
+		perms[prereq.Resource] = append(perms[prereq.Resource], prereq.Permission)
+	}
+
+	var missing []Prerequisite
+	for _, resource := range resources {
+		granted, err := queryiam.QueryResourcePermissions(perms[resource], resource, "", "")
+		if err != nil {
+			return nil, err
+		}
+		for _, permission := range perms[resource] {
+			if !util.Contains(granted, permission) {
+				missing = append(missing, Prerequisite{Permission: permission, Resource: resource})
+			}
+		}
+	}
+	return missing, nil
+}
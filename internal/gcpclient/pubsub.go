@@ -0,0 +1,50 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"google.golang.org/api/pubsub/v1"
+
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/apilog"
+)
+
+// PublishMessage publishes a message to the Pub/Sub topic, e.g.
+// "projects/my-project/topics/my-topic", with the authenticated user's
+// credentials. It gives up after timeout.
+func PublishMessage(topic string, data []byte, attributes map[string]string, timeout time.Duration) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	pubsubService, err := pubsub.NewService(timeoutCtx, apilog.Options(timeoutCtx)...)
+	if err != nil {
+		return errorsutil.NewSDKError("Pub/Sub", "", err)
+	}
+	req := &pubsub.PublishRequest{
+		Messages: []*pubsub.PubsubMessage{{
+			Data:       base64.StdEncoding.EncodeToString(data),
+			Attributes: attributes,
+		}},
+	}
+	if _, err := pubsubService.Projects.Topics.Publish(topic, req).Context(timeoutCtx).Do(); err != nil {
+		return errorsutil.New(fmt.Sprintf("Failed to publish to %s", topic), err)
+	}
+	return nil
+}
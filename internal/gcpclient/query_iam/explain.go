@@ -0,0 +1,117 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"fmt"
+	"sort"
+
+	pt "google.golang.org/api/policytroubleshooter/v1"
+
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/apilog"
+)
+
+// PermissionGrant is a role binding that grants a permission to a principal.
+type PermissionGrant struct {
+	// Resource is the resource whose policy has the binding, which is either the
+	// resource that was asked about or one of its ancestors.
+	Resource string `json:"resource" yaml:"resource"`
+	Role     string `json:"role" yaml:"role"`
+	// Member is the binding member that includes the principal, e.g. the
+	// principal itself or a group that it belongs to.
+	Member string `json:"member" yaml:"member"`
+	// Condition is the title or expression of the binding's condition, if it
+	// has one.
+	Condition string `json:"condition,omitempty" yaml:"condition,omitempty"`
+	// Access is GRANTED, or UNKNOWN_CONDITIONAL if whether the condition is met
+	// couldn't be determined.
+	Access string `json:"access" yaml:"access"`
+}
+
+// PermissionExplanation describes why a principal has, or doesn't have, a
+// permission on a resource.
+type PermissionExplanation struct {
+	Principal  string            `json:"principal" yaml:"principal"`
+	Resource   string            `json:"resource" yaml:"resource"`
+	Permission string            `json:"permission" yaml:"permission"`
+	Access     string            `json:"access" yaml:"access"`
+	Grants     []PermissionGrant `json:"grants" yaml:"grants"`
+}
+
+// ExplainPermission uses the Policy Troubleshooter API to find the role
+// bindings, on the resource and the resources it inherits policies from, that
+// grant the permission to the principal.
+func ExplainPermission(principal, resource, permission string) (*PermissionExplanation, error) {
+	ptService, err := pt.NewService(ctx, apilog.Options(ctx)...)
+	if err != nil {
+		return nil, errorsutil.NewSDKError("Policy Troubleshooter", "", err)
+	}
+
+	resp, err := ptService.Iam.Troubleshoot(&pt.GoogleCloudPolicytroubleshooterV1TroubleshootIamPolicyRequest{
+		AccessTuple: &pt.GoogleCloudPolicytroubleshooterV1AccessTuple{
+			Principal:        principal,
+			FullResourceName: resource,
+			Permission:       permission,
+		},
+	}).Do()
+	if err != nil {
+		return nil, errorsutil.New(fmt.Sprintf("Failed to explain %s on %s", permission, resource), err)
+	}
+
+	explanation := &PermissionExplanation{
+		Principal:  principal,
+		Resource:   resource,
+		Permission: permission,
+		Access:     resp.Access,
+		Grants:     []PermissionGrant{},
+	}
+	for _, policy := range resp.ExplainedPolicies {
+		for _, binding := range policy.BindingExplanations {
+			if binding.Access != "GRANTED" && binding.Access != "UNKNOWN_CONDITIONAL" {
+				continue
+			}
+			members := make([]string, 0, len(binding.Memberships))
+			for member := range binding.Memberships {
+				members = append(members, member)
+			}
+			sort.Strings(members)
+			for _, member := range members {
+				if binding.Memberships[member].Membership != "MEMBERSHIP_INCLUDED" {
+					continue
+				}
+				explanation.Grants = append(explanation.Grants, PermissionGrant{
+					Resource:  policy.FullResourceName,
+					Role:      binding.Role,
+					Member:    member,
+					Condition: conditionString(binding.Condition),
+					Access:    binding.Access,
+				})
+			}
+		}
+	}
+	return explanation, nil
+}
+
+func conditionString(condition *pt.GoogleTypeExpr) string {
+	switch {
+	case condition == nil:
+		return ""
+	case condition.Title != "":
+		return condition.Title
+	default:
+		return condition.Expression
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+	"google.golang.org/api/pubsub/v1"
+	"google.golang.org/api/secretmanager/v1"
+
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/apilog"
+)
+
+// resourceQuerier tests permissions on one type of resource, identified by the
+// service that owns it and the pattern of its relative resource name.
+type resourceQuerier struct {
+	service string
+	pattern *regexp.Regexp
+	query   func(permsToTest []string, name string, match []string, svcAcct, reason string) ([]string, error)
+}
+
+// queryServiceAccountPermissions is replaced in tests.
+var queryServiceAccountPermissions = QueryServiceAccountPermissions
+
+var resourceQueriers = []resourceQuerier{
+	{
+		service: "bigquery.googleapis.com",
+		pattern: regexp.MustCompile(`^projects/[^/]+/datasets/[^/]+/tables/[^/]+$`),
+		query:   queryBigQueryTablePermissions,
+	},
+	{
+		service: "cloudkms.googleapis.com",
+		pattern: regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+$`),
+		query:   queryKMSKeyRingPermissions,
+	},
+	{
+		service: "cloudkms.googleapis.com",
+		pattern: regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`),
+		query:   queryKMSCryptoKeyPermissions,
+	},
+	{
+		service: "cloudresourcemanager.googleapis.com",
+		pattern: regexp.MustCompile(`^folders/([^/]+)$`),
+		query: func(permsToTest []string, _ string, match []string, svcAcct, reason string) ([]string, error) {
+			return QueryFolderPermissions(permsToTest, match[1], svcAcct, reason)
+		},
+	},
+	{
+		service: "cloudresourcemanager.googleapis.com",
+		pattern: regexp.MustCompile(`^organizations/([^/]+)$`),
+		query: func(permsToTest []string, _ string, match []string, svcAcct, reason string) ([]string, error) {
+			return QueryOrganizationPermissions(permsToTest, match[1], svcAcct, reason)
+		},
+	},
+	{
+		service: "cloudresourcemanager.googleapis.com",
+		pattern: regexp.MustCompile(`^projects/([^/]+)$`),
+		query: func(permsToTest []string, _ string, match []string, svcAcct, reason string) ([]string, error) {
+			return QueryProjectPermissions(permsToTest, match[1], svcAcct, reason)
+		},
+	},
+	{
+		service: "compute.googleapis.com",
+		pattern: regexp.MustCompile(`^projects/([^/]+)/zones/([^/]+)/instances/([^/]+)$`),
+		query: func(permsToTest []string, _ string, match []string, svcAcct, reason string) ([]string, error) {
+			return QueryComputeInstancePermissions(permsToTest, match[1], match[2], match[3], svcAcct, reason)
+		},
+	},
+	{
+		service: "iam.googleapis.com",
+		pattern: regexp.MustCompile(`^projects/([^/]+)/serviceAccounts/([^/]+)$`),
+		query: func(permsToTest []string, _ string, match []string, svcAcct, reason string) ([]string, error) {
+			return queryServiceAccountPermissions(permsToTest, match[1], match[2], svcAcct, reason)
+		},
+	},
+	{
+		service: "pubsub.googleapis.com",
+		pattern: regexp.MustCompile(`^projects/([^/]+)/topics/([^/]+)$`),
+		query: func(permsToTest []string, _ string, match []string, svcAcct, reason string) ([]string, error) {
+			return QueryPubSubPermissions(permsToTest, match[1], match[2], svcAcct, reason)
+		},
+	},
+	{
+		service: "pubsub.googleapis.com",
+		pattern: regexp.MustCompile(`^projects/[^/]+/subscriptions/[^/]+$`),
+		query:   queryPubSubSubscriptionPermissions,
+	},
+	{
+		service: "secretmanager.googleapis.com",
+		pattern: regexp.MustCompile(`^projects/[^/]+/secrets/[^/]+$`),
+		query:   querySecretPermissions,
+	},
+	{
+		service: "storage.googleapis.com",
+		pattern: regexp.MustCompile(`^projects/_/buckets/([^/]+)$`),
+		query: func(permsToTest []string, _ string, match []string, svcAcct, reason string) ([]string, error) {
+			return QueryStorageBucketPermissions(permsToTest, match[1], svcAcct, reason)
+		},
+	},
+}
+
+// QueryResourcePermissions gets the authenticated members permissions on the
+// resource with the given full resource name, e.g.
+// //storage.googleapis.com/projects/_/buckets/my-bucket.
+func QueryResourcePermissions(permsToTest []string, resource, svcAcct, reason string) ([]string, error) {
+	querier, name, match, err := findResourceQuerier(resource)
+	if err != nil {
+		return []string{}, err
+	}
+	return querier.query(permsToTest, name, match, svcAcct, reason)
+}
+
+// CheckResourceSupported returns an error if permissions can't be queried on
+// the resource with the given full resource name.
+func CheckResourceSupported(resource string) error {
+	_, _, _, err := findResourceQuerier(resource)
+	return err
+}
+
+func findResourceQuerier(resource string) (querier resourceQuerier, name string, match []string, err error) {
+	service, name, err := splitResourceName(resource)
+	if err != nil {
+		return resourceQuerier{}, "", nil, err
+	}
+	for _, querier := range resourceQueriers {
+		if querier.service != service {
+			continue
+		}
+		if match := querier.pattern.FindStringSubmatch(name); match != nil {
+			return querier, name, match, nil
+		}
+	}
+	return resourceQuerier{}, "", nil, errorsutil.New(
+		fmt.Sprintf("Querying permissions on %s is not supported", resource),
+		fmt.Errorf("no supported %s resource type matches %s", service, name),
+	)
+}
+
+// splitResourceName splits a full resource name into the service that owns the
+// resource and the resource's relative name.
+func splitResourceName(resource string) (service, name string, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(resource, "//"), "/", 2)
+	if !strings.HasPrefix(resource, "//") || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errorsutil.New(
+			fmt.Sprintf("Invalid resource name %s", resource),
+			fmt.Errorf("expected a full resource name like //storage.googleapis.com/projects/_/buckets/my-bucket"),
+		)
+	}
+	return parts[0], parts[1], nil
+}
+
+// clientOptions returns the options to impersonate svcAcct with, or none if
+// the request should use the user's own credentials.
+func clientOptions(svcAcct, reason string) []option.ClientOption {
+	if svcAcct == "" {
+		return nil
+	}
+	return []option.ClientOption{
+		option.ImpersonateCredentials(svcAcct),
+		option.WithRequestReason(reason),
+	}
+}
+
+func queryBigQueryTablePermissions(permsToTest []string, name string, _ []string, svcAcct, reason string) ([]string, error) {
+	bqService, err := bigquery.NewService(ctx, apilog.Options(ctx, clientOptions(svcAcct, reason)...)...)
+	if err != nil {
+		return []string{}, errorsutil.NewSDKError("BigQuery", svcAcct, err)
+	}
+	return testPermissionsInChunks(name, permsToTest, func(permissions []string) ([]string, error) {
+		resp, err := bqService.Tables.TestIamPermissions(name, &bigquery.TestIamPermissionsRequest{
+			Permissions: permissions,
+		}).Do()
+		if err != nil {
+			return nil, err
+		}
+		return resp.Permissions, nil
+	})
+}
+
+func queryKMSKeyRingPermissions(permsToTest []string, name string, _ []string, svcAcct, reason string) ([]string, error) {
+	kmsService, err := cloudkms.NewService(ctx, apilog.Options(ctx, clientOptions(svcAcct, reason)...)...)
+	if err != nil {
+		return []string{}, errorsutil.NewSDKError("Cloud KMS", svcAcct, err)
+	}
+	return testPermissionsInChunks(name, permsToTest, func(permissions []string) ([]string, error) {
+		resp, err := kmsService.Projects.Locations.KeyRings.TestIamPermissions(name, &cloudkms.TestIamPermissionsRequest{
+			Permissions: permissions,
+		}).Do()
+		if err != nil {
+			return nil, err
+		}
+		return resp.Permissions, nil
+	})
+}
+
+func queryKMSCryptoKeyPermissions(permsToTest []string, name string, _ []string, svcAcct, reason string) ([]string, error) {
+	kmsService, err := cloudkms.NewService(ctx, apilog.Options(ctx, clientOptions(svcAcct, reason)...)...)
+	if err != nil {
+		return []string{}, errorsutil.NewSDKError("Cloud KMS", svcAcct, err)
+	}
+	return testPermissionsInChunks(name, permsToTest, func(permissions []string) ([]string, error) {
+		resp, err := kmsService.Projects.Locations.KeyRings.CryptoKeys.TestIamPermissions(name, &cloudkms.TestIamPermissionsRequest{
+			Permissions: permissions,
+		}).Do()
+		if err != nil {
+			return nil, err
+		}
+		return resp.Permissions, nil
+	})
+}
+
+func queryPubSubSubscriptionPermissions(permsToTest []string, name string, _ []string, svcAcct, reason string) ([]string, error) {
+	pubsubService, err := pubsub.NewService(ctx, apilog.Options(ctx, clientOptions(svcAcct, reason)...)...)
+	if err != nil {
+		return []string{}, errorsutil.NewSDKError("PubSub", svcAcct, err)
+	}
+	return testPermissionsInChunks(name, permsToTest, func(permissions []string) ([]string, error) {
+		resp, err := pubsubService.Projects.Subscriptions.TestIamPermissions(name, &pubsub.TestIamPermissionsRequest{
+			Permissions: permissions,
+		}).Do()
+		if err != nil {
+			return nil, err
+		}
+		return resp.Permissions, nil
+	})
+}
+
+func querySecretPermissions(permsToTest []string, name string, _ []string, svcAcct, reason string) ([]string, error) {
+	secretService, err := secretmanager.NewService(ctx, apilog.Options(ctx, clientOptions(svcAcct, reason)...)...)
+	if err != nil {
+		return []string{}, errorsutil.NewSDKError("Secret Manager", svcAcct, err)
+	}
+	return testPermissionsInChunks(name, permsToTest, func(permissions []string) ([]string, error) {
+		resp, err := secretService.Projects.Secrets.TestIamPermissions(name, &secretmanager.TestIamPermissionsRequest{
+			Permissions: permissions,
+		}).Do()
+		if err != nil {
+			return nil, err
+		}
+		return resp.Permissions, nil
+	})
+}
@@ -0,0 +1,51 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQueryResourcePermissionsServiceAccount(t *testing.T) {
+	defer func(query func([]string, string, string, string, string) ([]string, error)) {
+		queryServiceAccountPermissions = query
+	}(queryServiceAccountPermissions)
+
+	// The user can only act as the service account, while the deployer can
+	// also get access tokens for it.
+	granted := map[string][]string{
+		"": {"iam.serviceAccounts.actAs"},
+		"deployer@my-project.iam.gserviceaccount.com": {"iam.serviceAccounts.actAs", "iam.serviceAccounts.getAccessToken"},
+	}
+	queryServiceAccountPermissions = func(permsToTest []string, project, email, svcAcct, reason string) ([]string, error) {
+		if project != "my-project" || email != "target@my-project.iam.gserviceaccount.com" {
+			t.Errorf("unexpected service account projects/%s/serviceAccounts/%s", project, email)
+		}
+		return granted[svcAcct], nil
+	}
+
+	resource := "//iam.googleapis.com/projects/my-project/serviceAccounts/target@my-project.iam.gserviceaccount.com"
+	perms := []string{"iam.serviceAccounts.actAs", "iam.serviceAccounts.getAccessToken"}
+	for svcAcct, want := range granted {
+		got, err := QueryResourcePermissions(perms, resource, svcAcct, "reason")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %q to be granted %v, got %v", svcAcct, want, got)
+		}
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"sync"
 
 	crm "google.golang.org/api/cloudresourcemanager/v1"
+	crmv3 "google.golang.org/api/cloudresourcemanager/v3"
 	"google.golang.org/api/compute/v1"
 	"google.golang.org/api/iam/v1"
 	"google.golang.org/api/option"
@@ -28,33 +29,40 @@ import (
 
 	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/apilog"
 )
 
-var (
-	ctx = context.Background()
-
-	wg sync.WaitGroup
-)
+var ctx = context.Background()
 
 // QueryTestablePermissionsOnResource gets the testable permissions on a resource
 // Modified from https://github.com/salrashid123/gcp_iam/blob/main/query/main.go#L71-L108
 func QueryTestablePermissionsOnResource(resource string) ([]string, error) {
-	iamService, err := iam.NewService(ctx)
+	if perms, ok := cachedTestablePermissions(resource); ok {
+		return perms, nil
+	}
+
+	iamService, err := iam.NewService(ctx, apilog.Options(ctx)...)
 	if err != nil {
 		return []string{}, errorsutil.NewSDKError("Cloud IAM", "", err)
 	}
 	permissionsService := iam.NewPermissionsService(iamService)
 
 	util.Logger.Debugf("Fetching testable permissions on %s\n", resource)
+	progress := util.StartProgress(fmt.Sprintf("Fetching the testable permissions on %s", resource))
+	defer progress.Stop()
 
 	var permsToTest []string
 	nextPageToken := ""
 	for {
-		ps, err := permissionsService.QueryTestablePermissions(&iam.QueryTestablePermissionsRequest{
-			FullResourceName: resource,
-			PageToken:        nextPageToken,
-			PageSize:         1000,
-		}).Do()
+		var ps *iam.QueryTestablePermissionsResponse
+		err := WithRetry(func() (err error) {
+			ps, err = permissionsService.QueryTestablePermissions(&iam.QueryTestablePermissionsRequest{
+				FullResourceName: resource,
+				PageToken:        nextPageToken,
+				PageSize:         1000,
+			}).Do()
+			return err
+		})
 		if err != nil {
 			return []string{}, errorsutil.New(fmt.Sprintf("Failed to get testable permissions for %s", resource), err)
 		}
@@ -68,6 +76,7 @@ func QueryTestablePermissionsOnResource(resource string) ([]string, error) {
 			break
 		}
 	}
+	cacheTestablePermissions(resource, permsToTest)
 	return permsToTest, nil
 }
 
@@ -87,13 +96,13 @@ func QueryComputeInstancePermissions(
 			option.ImpersonateCredentials(svcAcct),
 			option.WithRequestReason(reason),
 		}
-		if svc, err := compute.NewService(ctx, clientOptions...); err == nil {
+		if svc, err := compute.NewService(ctx, apilog.Options(ctx, clientOptions...)...); err == nil {
 			computeService = svc
 		} else {
 			return []string{}, errorsutil.NewSDKError("Compute", svcAcct, err)
 		}
 	} else {
-		if svc, err := compute.NewService(ctx); err == nil {
+		if svc, err := compute.NewService(ctx, apilog.Options(ctx)...); err == nil {
 			computeService = svc
 		} else {
 			return []string{}, errorsutil.NewSDKError("Compute", "", err)
@@ -106,9 +115,13 @@ func QueryComputeInstancePermissions(
 		"resourcemanager.resourceTagBindings.list",
 	})
 
-	resp, err := computeService.Instances.TestIamPermissions(project, zone, instance, &compute.TestPermissionsRequest{
-		Permissions: permsToTest,
-	}).Do()
+	var resp *compute.TestPermissionsResponse
+	err := WithRetry(func() (err error) {
+		resp, err = computeService.Instances.TestIamPermissions(project, zone, instance, &compute.TestPermissionsRequest{
+			Permissions: permsToTest,
+		}).Do()
+		return err
+	})
 	if err != nil {
 		return []string{}, errorsutil.EiamError{
 			Log: util.Logger.WithError(err),
@@ -127,58 +140,133 @@ func QueryComputeInstancePermissions(
 
 // QueryProjectPermissions gets the authenticated members permissions on a project
 // Modified from https://github.com/salrashid123/gcp_iam/blob/main/query/main.go#L534-L575
-func QueryProjectPermissions(permsToTest []string, project, svcAcct, reason string) (perms []string, err error) {
+func QueryProjectPermissions(permsToTest []string, project, svcAcct, reason string) ([]string, error) {
 	var crmService *crm.Service
 	if svcAcct != "" {
 		clientOptions := []option.ClientOption{
 			option.ImpersonateCredentials(svcAcct),
 			option.WithRequestReason(reason),
 		}
-		if svc, err := crm.NewService(ctx, clientOptions...); err == nil {
+		if svc, err := crm.NewService(ctx, apilog.Options(ctx, clientOptions...)...); err == nil {
 			crmService = svc
 		} else {
 			return []string{}, errorsutil.NewSDKError("Cloud Resource Manager", svcAcct, err)
 		}
 	} else {
-		if svc, err := crm.NewService(ctx); err == nil {
+		if svc, err := crm.NewService(ctx, apilog.Options(ctx)...); err == nil {
 			crmService = svc
 		} else {
 			return []string{}, errorsutil.NewSDKError("Cloud Resource Manager", "", err)
 		}
 	}
-	crmProjService := crm.NewProjectsService(crmService)
+	resource := fmt.Sprintf("projects/%s", project)
+	return testPermissionsInChunks(resource, permsToTest, func(permissions []string) ([]string, error) {
+		resp, err := crmService.Projects.TestIamPermissions(project, &crm.TestIamPermissionsRequest{
+			Permissions: permissions,
+		}).Do()
+		if err != nil {
+			return nil, err
+		}
+		return resp.Permissions, nil
+	})
+}
 
-	// TestIamPermissions accepts a max of 100 permissions at a time so we split them into chunks.
-	var chunked [][]string
-	numOfChunks := len(permsToTest) / 100
-	for i := 0; i < numOfChunks; i++ {
-		start := i * 100
-		end := start + 100
-		chunked = append(chunked, permsToTest[start:end])
+// QueryFolderPermissions gets the authenticated members permissions on a folder.
+func QueryFolderPermissions(permsToTest []string, folder, svcAcct, reason string) ([]string, error) {
+	crmService, err := newCRMV3Service(svcAcct, reason)
+	if err != nil {
+		return []string{}, err
+	}
+	resource := fmt.Sprintf("folders/%s", folder)
+	return testPermissionsInChunks(resource, permsToTest, func(permissions []string) ([]string, error) {
+		resp, err := crmService.Folders.TestIamPermissions(resource, &crmv3.TestIamPermissionsRequest{
+			Permissions: permissions,
+		}).Do()
+		if err != nil {
+			return nil, err
+		}
+		return resp.Permissions, nil
+	})
+}
+
+// QueryOrganizationPermissions gets the authenticated members permissions on
+// an organization.
+func QueryOrganizationPermissions(permsToTest []string, organization, svcAcct, reason string) ([]string, error) {
+	crmService, err := newCRMV3Service(svcAcct, reason)
+	if err != nil {
+		return []string{}, err
+	}
+	resource := fmt.Sprintf("organizations/%s", organization)
+	return testPermissionsInChunks(resource, permsToTest, func(permissions []string) ([]string, error) {
+		resp, err := crmService.Organizations.TestIamPermissions(resource, &crmv3.TestIamPermissionsRequest{
+			Permissions: permissions,
+		}).Do()
+		if err != nil {
+			return nil, err
+		}
+		return resp.Permissions, nil
+	})
+}
+
+// newCRMV3Service creates a Cloud Resource Manager v3 client, which can test
+// the permissions on folders and organizations, as the service account if one
+// is given.
+func newCRMV3Service(svcAcct, reason string) (*crmv3.Service, error) {
+	if svcAcct != "" {
+		clientOptions := []option.ClientOption{
+			option.ImpersonateCredentials(svcAcct),
+			option.WithRequestReason(reason),
+		}
+		svc, err := crmv3.NewService(ctx, apilog.Options(ctx, clientOptions...)...)
+		if err != nil {
+			return nil, errorsutil.NewSDKError("Cloud Resource Manager", svcAcct, err)
+		}
+		return svc, nil
 	}
-	rem := len(permsToTest) % 100
-	chunked = append(chunked, permsToTest[len(permsToTest)-rem:])
+	svc, err := crmv3.NewService(ctx, apilog.Options(ctx)...)
+	if err != nil {
+		return nil, errorsutil.NewSDKError("Cloud Resource Manager", "", err)
+	}
+	return svc, nil
+}
 
-	wg.Add(len(chunked))
+// testPermissionsInChunks tests the permissions on resource 100 at a time,
+// which is the most that TestIamPermissions accepts, and returns the ones that
+// are granted. The chunks are tested in parallel and tried again if the API is
+// rate limited.
+func testPermissionsInChunks(resource string, permsToTest []string, test func([]string) ([]string, error)) ([]string, error) {
+	var chunks [][]string
+	for start := 0; start < len(permsToTest); start += 100 {
+		end := start + 100
+		if end > len(permsToTest) {
+			end = len(permsToTest)
+		}
+		chunks = append(chunks, permsToTest[start:end])
+	}
 
-	var userPermissions []string
-	for _, permSet := range chunked {
-		go func(permissions []string, granted *[]string) {
-			resp, err := crmProjService.TestIamPermissions(project, &crm.TestIamPermissionsRequest{
-				Permissions: permissions,
-			}).Do()
+	var (
+		lock    sync.Mutex
+		granted []string
+	)
+	progress := util.StartProgressCount(fmt.Sprintf("Testing %d permissions on %s", len(permsToTest), resource), len(chunks))
+	err := util.RunWorkers(len(chunks), func(i int) error {
+		defer progress.Add(1)
+		return WithRetry(func() error {
+			perms, err := test(chunks[i])
 			if err != nil {
-				util.Logger.Errorf("Failed to query permissions on projects/%s", project)
-				return
+				return err
 			}
-			*granted = append(*granted, resp.Permissions...)
-			wg.Done()
-		}(permSet, &userPermissions)
+			lock.Lock()
+			granted = append(granted, perms...)
+			lock.Unlock()
+			return nil
+		})
+	})
+	progress.Stop()
+	if err != nil {
+		return []string{}, errorsutil.New(fmt.Sprintf("Failed to query permissions on %s", resource), err)
 	}
-	// Wait until each of the go routines have finished before returning.
-	wg.Wait()
-
-	return userPermissions, nil
+	return granted, nil
 }
 
 // QueryPubSubPermissions gets the authenticated members permissions on a PubSub topic.
@@ -189,13 +277,13 @@ func QueryPubSubPermissions(permsToTest []string, project, topic, svcAcct, reaso
 			option.ImpersonateCredentials(svcAcct),
 			option.WithRequestReason(reason),
 		}
-		if svc, err := pubsub.NewService(ctx, clientOptions...); err == nil {
+		if svc, err := pubsub.NewService(ctx, apilog.Options(ctx, clientOptions...)...); err == nil {
 			pubsubService = svc
 		} else {
 			return []string{}, errorsutil.NewSDKError("PubSub", svcAcct, err)
 		}
 	} else {
-		if svc, err := pubsub.NewService(ctx); err == nil {
+		if svc, err := pubsub.NewService(ctx, apilog.Options(ctx)...); err == nil {
 			pubsubService = svc
 		} else {
 			return []string{}, errorsutil.NewSDKError("PubSub", "", err)
@@ -205,9 +293,13 @@ func QueryPubSubPermissions(permsToTest []string, project, topic, svcAcct, reaso
 	topicsService := pubsub.NewProjectsTopicsService(pubsubService)
 
 	resource := fmt.Sprintf("projects/%s/topics/%s", project, topic)
-	resp, err := topicsService.TestIamPermissions(resource, &pubsub.TestIamPermissionsRequest{
-		Permissions: permsToTest,
-	}).Do()
+	var resp *pubsub.TestIamPermissionsResponse
+	err := WithRetry(func() (err error) {
+		resp, err = topicsService.TestIamPermissions(resource, &pubsub.TestIamPermissionsRequest{
+			Permissions: permsToTest,
+		}).Do()
+		return err
+	})
 	if err != nil {
 		return []string{}, errorsutil.New(fmt.Sprintf("Failed to query permissions on %s", resource), err)
 	}
@@ -217,17 +309,21 @@ func QueryPubSubPermissions(permsToTest []string, project, topic, svcAcct, reaso
 
 // QueryServiceAccountPermissions gets the authenticated members permissions on a service account
 // Modified from https://github.com/salrashid123/gcp_iam/blob/main/query/main.go#L150-L173
-func QueryServiceAccountPermissions(permsToTest []string, project, email string) ([]string, error) {
-	iamService, err := iam.NewService(ctx)
+func QueryServiceAccountPermissions(permsToTest []string, project, email, svcAcct, reason string) ([]string, error) {
+	iamService, err := iam.NewService(ctx, apilog.Options(ctx, clientOptions(svcAcct, reason)...)...)
 	if err != nil {
-		return []string{}, errorsutil.NewSDKError("Cloud IAM", "", err)
+		return []string{}, errorsutil.NewSDKError("Cloud IAM", svcAcct, err)
 	}
 	saIamService := iam.NewProjectsServiceAccountsService(iamService)
 
 	resource := fmt.Sprintf("projects/%s/serviceAccounts/%s", project, email)
-	resp, err := saIamService.TestIamPermissions(resource, &iam.TestIamPermissionsRequest{
-		Permissions: permsToTest,
-	}).Do()
+	var resp *iam.TestIamPermissionsResponse
+	err = WithRetry(func() (err error) {
+		resp, err = saIamService.TestIamPermissions(resource, &iam.TestIamPermissionsRequest{
+			Permissions: permsToTest,
+		}).Do()
+		return err
+	})
 	if err != nil {
 		return []string{}, err
 	}
@@ -244,13 +340,13 @@ func QueryStorageBucketPermissions(permsToTest []string, bucket, svcAcct, reason
 			option.ImpersonateCredentials(svcAcct),
 			option.WithRequestReason(reason),
 		}
-		if svc, err := storage.NewService(ctx, clientOptions...); err == nil {
+		if svc, err := storage.NewService(ctx, apilog.Options(ctx, clientOptions...)...); err == nil {
 			storageService = svc
 		} else {
 			return []string{}, errorsutil.NewSDKError("Cloud Storage", svcAcct, err)
 		}
 	} else {
-		if svc, err := storage.NewService(ctx); err == nil {
+		if svc, err := storage.NewService(ctx, apilog.Options(ctx)...); err == nil {
 			storageService = svc
 		} else {
 			return []string{}, errorsutil.NewSDKError("Cloud Storage", "", err)
@@ -263,7 +359,11 @@ func QueryStorageBucketPermissions(permsToTest []string, bucket, svcAcct, reason
 		"resourcemanager.resourceTagBindings.list",
 	})
 
-	resp, err := storageService.Buckets.TestIamPermissions(bucket, permsToTest).Do()
+	var resp *storage.TestIamPermissionsResponse
+	err := WithRetry(func() (err error) {
+		resp, err = storageService.Buckets.TestIamPermissions(bucket, permsToTest).Do()
+		return err
+	})
 	if err != nil {
 		return []string{}, errorsutil.New(fmt.Sprintf("Failed to query permissions on storage bucket %s", bucket), err)
 	}
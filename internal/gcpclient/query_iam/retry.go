@@ -0,0 +1,63 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/googleapi"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+const (
+	// maxRetries is how often a request that was rate limited is tried again.
+	maxRetries = 5
+
+	// maxBackoff is the longest time to wait before trying a request again.
+	maxBackoff = 32 * time.Second
+)
+
+// sleep waits before a request is tried again. It is a variable so that tests
+// don't have to wait.
+var sleep = time.Sleep
+
+// WithRetry calls request, and calls it again with exponential backoff while
+// the API responds that it is rate limited or unavailable.
+func WithRetry(request func() error) error {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := request()
+		gerr, ok := err.(*googleapi.Error)
+		if !ok || attempt == maxRetries ||
+			(gerr.Code != http.StatusTooManyRequests && gerr.Code != http.StatusServiceUnavailable) {
+			return err
+		}
+
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)))
+		if seconds, err := strconv.Atoi(gerr.Header.Get("Retry-After")); err == nil {
+			wait = time.Duration(seconds) * time.Second
+		}
+		if wait > maxBackoff {
+			wait = maxBackoff
+		}
+		util.Logger.Debugf("The request was rate limited (%d), trying again in %s", gerr.Code, wait)
+		sleep(wait)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+func TestWithRetry(t *testing.T) {
+	util.Logger = util.NewLogger()
+	var waits []time.Duration
+	saved := sleep
+	defer func() { sleep = saved }()
+	sleep = func(d time.Duration) { waits = append(waits, d) }
+
+	retryAfter := http.Header{}
+	retryAfter.Set("Retry-After", "7")
+	tests := []struct {
+		name     string
+		errs     []error
+		wantErr  bool
+		wantCall int
+	}{
+		{
+			name:     "success",
+			errs:     []error{nil},
+			wantCall: 1,
+		},
+		{
+			name:     "rate limited then success",
+			errs:     []error{&googleapi.Error{Code: http.StatusTooManyRequests}, &googleapi.Error{Code: http.StatusServiceUnavailable}, nil},
+			wantCall: 3,
+		},
+		{
+			name:     "not retried",
+			errs:     []error{&googleapi.Error{Code: http.StatusForbidden}},
+			wantErr:  true,
+			wantCall: 1,
+		},
+		{
+			name:     "other errors aren't retried",
+			errs:     []error{errors.New("connection refused")},
+			wantErr:  true,
+			wantCall: 1,
+		},
+		{
+			name:     "gives up",
+			errs:     []error{&googleapi.Error{Code: http.StatusTooManyRequests}},
+			wantErr:  true,
+			wantCall: maxRetries + 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waits = nil
+			calls := 0
+			err := WithRetry(func() error {
+				err := tt.errs[0]
+				if calls < len(tt.errs) {
+					err = tt.errs[calls]
+				}
+				calls++
+				return err
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("WithRetry() error = %v, want error %t", err, tt.wantErr)
+			}
+			if calls != tt.wantCall {
+				t.Errorf("expected %d calls, got %d", tt.wantCall, calls)
+			}
+			for _, wait := range waits {
+				if wait <= 0 || wait > maxBackoff {
+					t.Errorf("expected waits between 0 and %s, got %s", maxBackoff, wait)
+				}
+			}
+		})
+	}
+
+	waits = nil
+	calls := 0
+	err := WithRetry(func() error {
+		calls++
+		if calls == 1 {
+			return &googleapi.Error{Code: http.StatusTooManyRequests, Header: retryAfter}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(waits) != 1 || waits[0] != 7*time.Second {
+		t.Errorf("expected to wait for Retry-After, got %v", waits)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"strings"
+
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/cache"
+)
+
+// resourceType returns the type of the resource with the given full resource
+// name, e.g. storage.googleapis.com/projects/buckets for
+// //storage.googleapis.com/projects/_/buckets/my-bucket. Every resource of a
+// type has the same testable permissions.
+func resourceType(resource string) string {
+	parts := strings.Split(strings.TrimPrefix(resource, "//"), "/")
+	typeParts := parts[:1]
+	for i := 1; i < len(parts); i += 2 {
+		typeParts = append(typeParts, parts[i])
+	}
+	return strings.Join(typeParts, "/")
+}
+
+// cachedTestablePermissions returns the cached testable permissions on
+// resource, if they were cached less than the TTL ago.
+func cachedTestablePermissions(resource string) ([]string, bool) {
+	var perms []string
+	ok := cache.Get(cache.TestablePermissions, resourceType(resource), &perms)
+	return perms, ok
+}
+
+// cacheTestablePermissions caches the testable permissions on resource.
+func cacheTestablePermissions(resource string, perms []string) {
+	cache.Put(cache.TestablePermissions, resourceType(resource), perms)
+}
@@ -0,0 +1,204 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/google"
+	crm "google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/apilog"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/cache"
+	queryiam "github.com/rigup/ephemeral-iam/internal/gcpclient/query_iam"
+)
+
+const (
+	// conditionalPolicyVersion is the IAM policy version that supports
+	// conditional role bindings.
+	conditionalPolicyVersion = 3
+
+	// policyRetries is how often a policy update is tried again when another
+	// change to the policy was made at the same time.
+	policyRetries = 5
+
+	// maxConditionDescription is the longest description that an IAM
+	// condition can have.
+	maxConditionDescription = 256
+)
+
+// RoleBinding is a role granted on a project until it expires by a binding
+// with an IAM condition.
+type RoleBinding struct {
+	Project string    `json:"project"`
+	Role    string    `json:"role"`
+	Member  string    `json:"member"`
+	Title   string    `json:"title"`
+	Expires time.Time `json:"expires"`
+}
+
+// IAMMember returns the IAM member, e.g. "user:me@example.com", for an email.
+func IAMMember(email string) string {
+	if strings.HasSuffix(email, ".gserviceaccount.com") {
+		return "serviceAccount:" + email
+	}
+	return "user:" + email
+}
+
+// AddTemporaryRoleBinding binds role to member on the project with a condition
+// that stops granting it at expires. The binding is left in the policy when it
+// expires, so it should be removed with RemoveTemporaryRoleBinding.
+func AddTemporaryRoleBinding(project, role, member, reason string, expires time.Time) (*RoleBinding, error) {
+	title, err := bindingTitle()
+	if err != nil {
+		return nil, errorsutil.New("Failed to generate the role binding title", err)
+	}
+	binding := &RoleBinding{
+		Project: project,
+		Role:    role,
+		Member:  member,
+		Title:   title,
+		Expires: expires.UTC().Truncate(time.Second),
+	}
+	if len(reason) > maxConditionDescription {
+		reason = reason[:maxConditionDescription]
+	}
+	err = updateProjectPolicy(project, reason, func(policy *crm.Policy) {
+		addBinding(policy, binding, reason)
+	})
+	if err != nil {
+		return nil, errorsutil.New(fmt.Sprintf("Failed to grant %s to %s on %s", role, member, project), err)
+	}
+	return binding, nil
+}
+
+// RemoveTemporaryRoleBinding removes a binding added with
+// AddTemporaryRoleBinding from the project's IAM policy.
+func RemoveTemporaryRoleBinding(binding *RoleBinding, reason string) error {
+	err := updateProjectPolicy(binding.Project, reason, func(policy *crm.Policy) {
+		removeBinding(policy, binding)
+	})
+	if err != nil {
+		return errorsutil.New(fmt.Sprintf("Failed to remove %s from %s on %s", binding.Role, binding.Member, binding.Project), err)
+	}
+	return nil
+}
+
+// bindingTitle returns a unique title for the condition of a binding, so that
+// bindings added by eiam at the same time aren't mistaken for each other.
+func bindingTitle() (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("eiam-%d-%s", time.Now().Unix(), hex.EncodeToString(suffix)), nil
+}
+
+// expression returns the CEL expression of the binding's condition.
+func (b *RoleBinding) expression() string {
+	return fmt.Sprintf("request.time < timestamp(%q)", b.Expires.Format(time.RFC3339))
+}
+
+// matches reports whether other is the conditional binding that b was added
+// with.
+func (b *RoleBinding) matches(other *crm.Binding) bool {
+	return other.Role == b.Role && other.Condition != nil &&
+		other.Condition.Title == b.Title && other.Condition.Expression == b.expression()
+}
+
+func addBinding(policy *crm.Policy, binding *RoleBinding, reason string) {
+	policy.Bindings = append(policy.Bindings, &crm.Binding{
+		Role:    binding.Role,
+		Members: []string{binding.Member},
+		Condition: &crm.Expr{
+			Title:       binding.Title,
+			Description: reason,
+			Expression:  binding.expression(),
+		},
+	})
+}
+
+// removeBinding removes the binding's member from the matching bindings in
+// the policy. Other members of the same binding are kept.
+func removeBinding(policy *crm.Policy, binding *RoleBinding) {
+	var kept []*crm.Binding
+	for _, b := range policy.Bindings {
+		if binding.matches(b) {
+			var members []string
+			for _, m := range b.Members {
+				if m != binding.Member {
+					members = append(members, m)
+				}
+			}
+			if len(members) == 0 {
+				continue
+			}
+			b.Members = members
+		}
+		kept = append(kept, b)
+	}
+	policy.Bindings = kept
+}
+
+// updateProjectPolicy reads the project's IAM policy, changes it with update,
+// and writes it back. It is tried again if the policy was changed in between.
+func updateProjectPolicy(project, reason string, update func(*crm.Policy)) error {
+	svc, err := crm.NewService(ctx, apilog.Options(ctx, option.WithRequestReason(reason))...)
+	if err != nil {
+		return errorsutil.NewSDKError("Cloud Resource Manager", "", err)
+	}
+	for attempt := 1; ; attempt++ {
+		var policy *crm.Policy
+		err := queryiam.WithRetry(func() (err error) {
+			policy, err = svc.Projects.GetIamPolicy(project, &crm.GetIamPolicyRequest{
+				Options: &crm.GetPolicyOptions{RequestedPolicyVersion: conditionalPolicyVersion},
+			}).Do()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		update(policy)
+		policy.Version = conditionalPolicyVersion
+		_, err = svc.Projects.SetIamPolicy(project, &crm.SetIamPolicyRequest{Policy: policy}).Do()
+		cache.Delete(cache.IAMPolicies, "projects/"+project)
+		if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusConflict && attempt < policyRetries {
+			continue
+		}
+		return err
+	}
+}
+
+// ADCAccessToken returns an access token for the application default
+// credentials and when it expires.
+func ADCAccessToken() (string, time.Time, error) {
+	creds, err := google.FindDefaultCredentials(ctx, cloudPlatformScope)
+	if err != nil {
+		return "", time.Time{}, errorsutil.New("Failed to find the application default credentials", err)
+	}
+	token, err := creds.TokenSource.Token()
+	if err != nil {
+		return "", time.Time{}, errorsutil.New("Failed to get an access token with the application default credentials", err)
+	}
+	return token.AccessToken, token.Expiry, nil
+}
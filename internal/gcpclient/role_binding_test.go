@@ -0,0 +1,84 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	crm "google.golang.org/api/cloudresourcemanager/v1"
+)
+
+func TestBindingTitle(t *testing.T) {
+	first, err := bindingTitle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := bindingTitle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Errorf("expected bindings added at the same time to have different titles, got %s twice", first)
+	}
+}
+
+func TestRemoveBinding(t *testing.T) {
+	expires := time.Date(2021, 5, 10, 6, 0, 0, 0, time.UTC)
+	mine := &RoleBinding{Role: "roles/editor", Member: "user:me@example.com", Title: "eiam-1620626400-0a1b2c3d", Expires: expires}
+	// Another user's binding that was added in the same second.
+	theirs := &RoleBinding{Role: "roles/editor", Member: "user:them@example.com", Title: "eiam-1620626400-4e5f6a7b", Expires: expires}
+
+	policy := &crm.Policy{Bindings: []*crm.Binding{
+		{Role: "roles/viewer", Members: []string{"user:me@example.com"}},
+	}}
+	addBinding(policy, mine, "reason")
+	addBinding(policy, theirs, "reason")
+	// A binding with the same title but another expiry isn't eiam's.
+	policy.Bindings = append(policy.Bindings, &crm.Binding{
+		Role:      "roles/editor",
+		Members:   []string{"user:me@example.com"},
+		Condition: &crm.Expr{Title: mine.Title, Expression: `request.time < timestamp("2030-01-01T00:00:00Z")`},
+	})
+	// IAM merges the members of bindings with the same role and condition.
+	policy.Bindings = append(policy.Bindings, &crm.Binding{
+		Role:      "roles/editor",
+		Members:   []string{"user:me@example.com", "group:team@example.com"},
+		Condition: &crm.Expr{Title: mine.Title, Expression: mine.expression()},
+	})
+
+	removeBinding(policy, mine)
+
+	var got []string
+	for _, b := range policy.Bindings {
+		title := ""
+		if b.Condition != nil {
+			title = b.Condition.Title
+		}
+		for _, m := range b.Members {
+			got = append(got, b.Role+" "+m+" "+title)
+		}
+	}
+	want := []string{
+		"roles/viewer user:me@example.com ",
+		"roles/editor user:them@example.com eiam-1620626400-4e5f6a7b",
+		"roles/editor user:me@example.com eiam-1620626400-0a1b2c3d",
+		"roles/editor group:team@example.com eiam-1620626400-0a1b2c3d",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the bindings %v, got %v", want, got)
+	}
+}
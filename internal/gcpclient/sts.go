@@ -0,0 +1,141 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/apilog"
+)
+
+const (
+	stsTokenURL       = "https://sts.googleapis.com/v1/token"
+	tokenExchangeType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType   = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// AccessBoundaryRule limits a down-scoped token to a set of permissions on a
+// single resource.
+type AccessBoundaryRule struct {
+	AvailableResource     string                 `json:"availableResource"`
+	AvailablePermissions  []string               `json:"availablePermissions"`
+	AvailabilityCondition *AvailabilityCondition `json:"availabilityCondition,omitempty"`
+}
+
+// AvailabilityCondition further limits the objects that an access boundary
+// rule applies to with a CEL expression.
+type AvailabilityCondition struct {
+	Expression  string `json:"expression"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// maxAccessBoundaryRules is the most rules that a Credential Access Boundary
+// can have.
+const maxAccessBoundaryRules = 10
+
+// ReadAccessBoundaryFile reads the rules of a Credential Access Boundary from a
+// JSON file in the format that the STS API accepts:
+//
+//	{"accessBoundary": {"accessBoundaryRules": [...]}}
+func ReadAccessBoundaryFile(path string) ([]AccessBoundaryRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var boundary struct {
+		AccessBoundary struct {
+			AccessBoundaryRules []AccessBoundaryRule `json:"accessBoundaryRules"`
+		} `json:"accessBoundary"`
+	}
+	if err := json.Unmarshal(data, &boundary); err != nil {
+		return nil, fmt.Errorf("%s is not a valid access boundary: %v", path, err)
+	}
+	rules := boundary.AccessBoundary.AccessBoundaryRules
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("%s doesn't have any access boundary rules", path)
+	}
+	for _, rule := range rules {
+		if rule.AvailableResource == "" || len(rule.AvailablePermissions) == 0 {
+			return nil, fmt.Errorf("%s has a rule without an availableResource or availablePermissions", path)
+		}
+	}
+	return rules, nil
+}
+
+// CheckAccessBoundary returns an error if the rules can't be used in a single
+// Credential Access Boundary.
+func CheckAccessBoundary(rules []AccessBoundaryRule) error {
+	if len(rules) > maxAccessBoundaryRules {
+		return fmt.Errorf("access boundaries can have at most %d rules, got %d", maxAccessBoundaryRules, len(rules))
+	}
+	return nil
+}
+
+// DownscopeToken exchanges an access token for one that is limited by a
+// Credential Access Boundary. The returned token can't be used for anything
+// that the original token couldn't. The expiry is zero when STS doesn't return
+// one, in which case the token expires with the original token.
+func DownscopeToken(accessToken string, rules []AccessBoundaryRule) (string, time.Time, error) {
+	boundary, err := json.Marshal(map[string]interface{}{
+		"accessBoundary": map[string]interface{}{
+			"accessBoundaryRules": rules,
+		},
+	})
+	if err != nil {
+		return "", time.Time{}, errorsutil.New("Failed to encode the credential access boundary", err)
+	}
+
+	form := url.Values{
+		"grant_type":           {tokenExchangeType},
+		"subject_token_type":   {accessTokenType},
+		"requested_token_type": {accessTokenType},
+		"subject_token":        {accessToken},
+		"options":              {string(boundary)},
+	}
+	resp, err := apilog.HTTPClient.Post(stsTokenURL, "application/x-www-form-urlencoded", strings.NewReader(form.Encode())) //nolint:gosec,noctx // The URL is constant
+	if err != nil {
+		return "", time.Time{}, errorsutil.New("Failed to request a down-scoped token", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, errorsutil.New("Failed to read the down-scoped token", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+		return "", time.Time{}, errorsutil.New("Failed to request a down-scoped token", err)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", time.Time{}, errorsutil.New("Failed to parse the down-scoped token", err)
+	}
+	if token.ExpiresIn == 0 {
+		return token.AccessToken, time.Time{}, nil
+	}
+	return token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn) * time.Second), nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/apilog"
+)
+
+const tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+
+// The types of tokens that can be described.
+const (
+	AccessTokenType = "access_token"
+	IDTokenType     = "id_token"
+)
+
+// TokenInfo describes an access token or an ID token.
+type TokenInfo struct {
+	Type            string    `json:"type"`
+	Email           string    `json:"email,omitempty"`
+	Subject         string    `json:"subject,omitempty"`
+	Audience        string    `json:"audience,omitempty"`
+	AuthorizedParty string    `json:"authorizedParty,omitempty"`
+	Issuer          string    `json:"issuer,omitempty"`
+	Scopes          []string  `json:"scopes,omitempty"`
+	IssuedAt        time.Time `json:"issuedAt"`
+	Expires         time.Time `json:"expires"`
+}
+
+// Principal returns the email of the account that the token was issued to, or
+// its subject when it doesn't include the email.
+func (t *TokenInfo) Principal() string {
+	if t.Email != "" {
+		return t.Email
+	}
+	return t.Subject
+}
+
+// IsJWT reports whether the token is a JSON Web Token, like ID tokens, rather
+// than an opaque access token.
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2 && strings.HasPrefix(token, "eyJ")
+}
+
+// DescribeToken describes an access token with Google's tokeninfo endpoint,
+// or decodes an ID token. The signature of ID tokens isn't verified, so the
+// result must only be used for debugging.
+func DescribeToken(token string) (*TokenInfo, error) {
+	if IsJWT(token) {
+		return decodeIDToken(token)
+	}
+	return describeAccessToken(token)
+}
+
+// describeAccessToken asks the tokeninfo endpoint about an access token. The
+// token is sent in the body so that it doesn't end up in any logs of URLs.
+func describeAccessToken(token string) (*TokenInfo, error) {
+	form := url.Values{"access_token": {token}}
+	resp, err := apilog.HTTPClient.PostForm(tokenInfoURL, form) //nolint:gosec,noctx // The URL is constant
+	if err != nil {
+		return nil, errorsutil.New("Failed to describe the access token", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errorsutil.New("Failed to read the token info", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+		return nil, errorsutil.New("Failed to describe the access token", err)
+	}
+
+	var claims struct {
+		Email    string `json:"email"`
+		Subject  string `json:"sub"`
+		Audience string `json:"aud"`
+		AZP      string `json:"azp"`
+		Scope    string `json:"scope"`
+		Exp      string `json:"exp"`
+	}
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, errorsutil.New("Failed to parse the token info", err)
+	}
+	info := &TokenInfo{
+		Type:            AccessTokenType,
+		Email:           claims.Email,
+		Subject:         claims.Subject,
+		Audience:        claims.Audience,
+		AuthorizedParty: claims.AZP,
+		Scopes:          strings.Fields(claims.Scope),
+	}
+	if exp, err := strconv.ParseInt(claims.Exp, 10, 64); err == nil {
+		info.Expires = time.Unix(exp, 0)
+	}
+	return info, nil
+}
+
+// decodeIDToken reads the claims of an ID token without verifying it.
+func decodeIDToken(token string) (*TokenInfo, error) {
+	payload, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[1])
+	if err != nil {
+		return nil, errorsutil.New("Failed to decode the ID token", err)
+	}
+	var claims struct {
+		Email    string          `json:"email"`
+		Subject  string          `json:"sub"`
+		Audience json.RawMessage `json:"aud"`
+		AZP      string          `json:"azp"`
+		Issuer   string          `json:"iss"`
+		IssuedAt int64           `json:"iat"`
+		Exp      int64           `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errorsutil.New("Failed to parse the ID token claims", err)
+	}
+	info := &TokenInfo{
+		Type:            IDTokenType,
+		Email:           claims.Email,
+		Subject:         claims.Subject,
+		Audience:        audience(claims.Audience),
+		AuthorizedParty: claims.AZP,
+		Issuer:          claims.Issuer,
+		IssuedAt:        time.Unix(claims.IssuedAt, 0),
+		Expires:         time.Unix(claims.Exp, 0),
+	}
+	return info, nil
+}
+
+// audience reads the aud claim, which can be a string or a list of strings.
+func audience(raw json.RawMessage) string {
+	var aud string
+	if err := json.Unmarshal(raw, &aud); err == nil {
+		return aud
+	}
+	var auds []string
+	if err := json.Unmarshal(raw, &auds); err == nil {
+		return strings.Join(auds, ", ")
+	}
+	return ""
+}
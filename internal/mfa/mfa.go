@@ -0,0 +1,152 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mfa confirms that a person is present before privileges are assumed,
+// with a time-based one-time password or a command that asks for a second
+// factor such as Touch ID or a security key.
+package mfa
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // RFC 6238 uses HMAC-SHA1, which authenticator apps expect
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+const (
+	issuer = "ephemeral-iam"
+
+	// digits is the length of the one-time passwords.
+	digits = 6
+
+	// period is how long each one-time password is valid for.
+	period = 30 * time.Second
+
+	// skew is how many periods before and after the current one are accepted,
+	// to allow for clock drift.
+	skew = 1
+)
+
+var secretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random TOTP secret encoded in base32, the form
+// that authenticator apps accept.
+func GenerateSecret() (string, error) {
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return "", errorsutil.New("Failed to generate the TOTP secret", err)
+	}
+	return secretEncoding.EncodeToString(key), nil
+}
+
+// URI returns the otpauth:// URI that authenticator apps import the secret
+// from, e.g. as a QR code.
+func URI(secret, account string) string {
+	params := url.Values{
+		"secret": {secret},
+		"issuer": {issuer},
+		"digits": {fmt.Sprint(digits)},
+		"period": {fmt.Sprint(int(period.Seconds()))},
+	}
+	label := url.PathEscape(fmt.Sprintf("%s:%s", issuer, account))
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, params.Encode())
+}
+
+// Validate reports whether code is the one-time password for the secret at
+// time t, or in the periods just before or after it. Codes for the period last
+// or earlier are rejected, so that a code can't be used more than once. The
+// period of the accepted code is returned so that it can be recorded as last.
+func Validate(secret, code string, t time.Time, last int64) (int64, bool, error) {
+	key, err := secretEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return 0, false, fmt.Errorf("the TOTP secret isn't valid base32: %v", err)
+	}
+	code = strings.ReplaceAll(code, " ", "")
+	counter := t.Unix() / int64(period.Seconds())
+	for i := int64(-skew); i <= skew; i++ {
+		if counter+i <= last {
+			continue
+		}
+		if hmac.Equal([]byte(code), []byte(password(key, uint64(counter+i)))) {
+			return counter + i, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// ReadCounter returns the period of the last accepted code, which is recorded
+// in filename. It returns 0 if no code has been accepted yet.
+func ReadCounter(filename string) (int64, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errorsutil.New("Failed to read the last TOTP code used", err)
+	}
+	counter, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, errorsutil.New("Failed to read the last TOTP code used", err)
+	}
+	return counter, nil
+}
+
+// WriteCounter records the period of the last accepted code in filename.
+func WriteCounter(filename string, counter int64) error {
+	if err := ioutil.WriteFile(filename, []byte(strconv.FormatInt(counter, 10)+"\n"), 0o600); err != nil {
+		return errorsutil.New("Failed to record the TOTP code used", err)
+	}
+	return nil
+}
+
+// password computes the HOTP value for the counter, as described in RFC 4226.
+func password(key []byte, counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// RunCommand runs a command that asks for a second factor. The confirmation
+// succeeds if it exits with a zero status. The command shares the terminal so
+// that it can prompt the user.
+func RunCommand(command string) error {
+	c := util.ShellCommand(command)
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stderr
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		return errorsutil.New("The MFA command failed", err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mfa
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the key used in the test vectors of RFC 4226 and RFC 6238,
+// "12345678901234567890", encoded in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestPassword(t *testing.T) {
+	// RFC 4226, Appendix D.
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	key := []byte("12345678901234567890")
+	for counter, code := range want {
+		if got := password(key, uint64(counter)); got != code {
+			t.Errorf("expected the password for counter %d to be %s, got %s", counter, code, got)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	// RFC 6238, Appendix B, with the 8 digit SHA1 passwords truncated to 6
+	// digits.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tc := range tests {
+		now := time.Unix(tc.unix, 0)
+		counter, valid, err := Validate(rfcSecret, tc.code, now, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !valid || counter != tc.unix/30 {
+			t.Errorf("expected %s to be valid at %d for counter %d, got %t for counter %d", tc.code, tc.unix, tc.unix/30, valid, counter)
+		}
+		// The same code can't be used again.
+		if _, valid, _ := Validate(rfcSecret, tc.code, now, counter); valid {
+			t.Errorf("expected %s to be rejected after it was used at %d", tc.code, tc.unix)
+		}
+	}
+
+	now := time.Unix(1111111111, 0)
+	// Codes from the periods around the current one are accepted.
+	if _, valid, _ := Validate(rfcSecret, "081804", now, 0); !valid {
+		t.Error("expected the code from the previous period to be accepted")
+	}
+	if _, valid, _ := Validate(rfcSecret, "081804", now.Add(30*time.Second), 0); valid {
+		t.Error("expected the code from two periods ago to be rejected")
+	}
+	if _, valid, _ := Validate(rfcSecret, "000000", now, 0); valid {
+		t.Error("expected an incorrect code to be rejected")
+	}
+	if _, _, err := Validate("not base32!", "000000", now, 0); err == nil {
+		t.Error("expected an error for an invalid secret")
+	}
+}
+
+func TestCounter(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "totp_counter")
+	if counter, err := ReadCounter(filename); err != nil || counter != 0 {
+		t.Fatalf("expected 0 before a code is used, got %d, %v", counter, err)
+	}
+	if err := WriteCounter(filename, 37037037); err != nil {
+		t.Fatal(err)
+	}
+	if counter, err := ReadCounter(filename); err != nil || counter != 37037037 {
+		t.Errorf("expected 37037037, got %d, %v", counter, err)
+	}
+}
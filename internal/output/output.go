@@ -0,0 +1,401 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package output prints the results of the commands that list or query
+// resources in the format set with the -o/--output flag, with only the fields
+// set with the --fields flag.
+package output
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mitchellh/go-wordwrap"
+	"gopkg.in/yaml.v2"
+
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// The formats that results can be printed in.
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+	FormatYAML  = "yaml"
+	FormatCSV   = "csv"
+)
+
+// Formats are the values of the -o/--output flag.
+var Formats = []string{FormatTable, FormatJSON, FormatYAML, FormatCSV}
+
+var (
+	// Format is the format that results are printed in, set with the
+	// -o/--output flag.
+	Format = FormatTable
+	// Fields are the fields of each result that are printed, set with the
+	// --fields flag. Every field is printed if it's empty.
+	Fields []string
+)
+
+// Table is how results are printed as a table or as CSV, with a row for each
+// result.
+type Table struct {
+	Columns []Column
+	Rows    [][]string
+}
+
+// Column is a column of a Table.
+type Column struct {
+	// Name is the name of the field in the JSON and YAML output that has the
+	// value of the column. It is the header of the column in CSV, and what
+	// --fields selects the column with.
+	Name string
+	// Header is the header of the column in the table.
+	Header string
+	// Wrap is the width that the values of the column are wrapped at in the
+	// table, or 0 to not wrap them.
+	Wrap int
+	// Group leaves a value blank in the table if it's the same as the value in
+	// the row above it, so that the rows of one resource are grouped.
+	Group bool
+}
+
+// Check returns an error if the -o/--output flag isn't a known format.
+func Check() error {
+	for _, format := range Formats {
+		if Format == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("the output format must be one of %v, got %q", Formats, Format)
+}
+
+// CheckFields returns an error if the --fields flag selects a field that isn't
+// a column of the table.
+func CheckFields(table *Table) error {
+	_, err := selectColumns(table)
+	return err
+}
+
+// IsTable reports whether results are printed as a table.
+func IsTable() bool {
+	return Format == FormatTable
+}
+
+// Print writes the results to stdout. data is encoded as JSON or YAML, and
+// table is printed as a table or as CSV.
+func Print(data interface{}, table *Table) error {
+	return Write(os.Stdout, data, table)
+}
+
+// Write writes the results to out. See Print.
+func Write(out io.Writer, data interface{}, table *Table) error {
+	switch Format {
+	case FormatJSON, FormatYAML:
+		return writeData(out, data, table)
+	case FormatCSV:
+		return writeCSV(out, table)
+	default:
+		return WriteTable(out, table)
+	}
+}
+
+// WriteTable writes the table to out with aligned columns, whatever the
+// output format is.
+func WriteTable(out io.Writer, table *Table) error {
+	columns, err := selectColumns(table)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 4, 4, ' ', 0)
+	headers := make([]string, len(columns))
+	for i, c := range columns {
+		headers[i] = table.Columns[c].Header
+	}
+	fmt.Fprintln(w, strings.Join(headers, "\t"))
+
+	var previous []string
+	for _, row := range table.Rows {
+		// Wrapped values continue on the lines below the row.
+		cells := make([][]string, len(columns))
+		lines := 1
+		for i, c := range columns {
+			column, value := table.Columns[c], row[c]
+			if column.Group && previous != nil && previous[c] == value {
+				value = ""
+			}
+			if column.Wrap > 0 {
+				value = wordwrap.WrapString(value, uint(column.Wrap))
+			}
+			cells[i] = strings.Split(value, "\n")
+			if len(cells[i]) > lines {
+				lines = len(cells[i])
+			}
+		}
+		for line := 0; line < lines; line++ {
+			values := make([]string, len(columns))
+			for i := range columns {
+				if line < len(cells[i]) {
+					values[i] = cells[i][line]
+				}
+			}
+			fmt.Fprintln(w, strings.Join(values, "\t"))
+		}
+		previous = row
+	}
+	w.Flush()
+	if _, err := out.Write(buf.Bytes()); err != nil {
+		return errorsutil.New("Failed to write the output", err)
+	}
+	return nil
+}
+
+func writeCSV(out io.Writer, table *Table) error {
+	columns, err := selectColumns(table)
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(table.Rows)+1)
+	header := make([]string, len(columns))
+	for i, c := range columns {
+		header[i] = table.Columns[c].Name
+	}
+	rows = append(rows, header)
+	for _, row := range table.Rows {
+		values := make([]string, len(columns))
+		for i, c := range columns {
+			values[i] = row[c]
+		}
+		rows = append(rows, values)
+	}
+	w := csv.NewWriter(out)
+	if err := w.WriteAll(rows); err != nil {
+		return errorsutil.New("Failed to write the output", err)
+	}
+	return nil
+}
+
+// selectColumns returns the indexes of the columns of the table that --fields
+// selects, in the order that they were given.
+func selectColumns(table *Table) ([]int, error) {
+	if len(Fields) == 0 {
+		columns := make([]int, len(table.Columns))
+		for i := range columns {
+			columns[i] = i
+		}
+		return columns, nil
+	}
+	var columns []int
+	for _, field := range Fields {
+		found := false
+		for i, column := range table.Columns {
+			if strings.EqualFold(column.Name, field) {
+				columns = append(columns, i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			names := make([]string, len(table.Columns))
+			for i, column := range table.Columns {
+				names[i] = column.Name
+			}
+			return nil, errorsutil.New(
+				"Invalid value for the --fields flag",
+				fmt.Errorf("unknown field %q, the fields are %v", field, names),
+			)
+		}
+	}
+	return columns, nil
+}
+
+// writeData writes data as JSON or YAML. It is encoded as JSON first, so that
+// both formats have the same field names, in the same order. The fields that
+// --fields selects are checked against the columns of the table, like they are
+// for the other formats.
+func writeData(out io.Writer, data interface{}, table *Table) error {
+	if _, err := selectColumns(table); err != nil {
+		return err
+	}
+	// An empty list is printed as one even if the command has none.
+	if v := reflect.ValueOf(data); v.Kind() == reflect.Slice && v.IsNil() {
+		data = []interface{}{}
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return errorsutil.New("Failed to encode the output", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(encoded))
+	dec.UseNumber()
+	value, err := decodeOrdered(dec)
+	if err != nil {
+		return errorsutil.New("Failed to encode the output", err)
+	}
+	if len(Fields) > 0 {
+		value = selectFields(value)
+	}
+
+	var formatted []byte
+	if Format == FormatJSON {
+		formatted, err = json.MarshalIndent(value, "", "  ")
+		formatted = append(formatted, '\n')
+	} else {
+		formatted, err = yaml.Marshal(value)
+	}
+	if err != nil {
+		return errorsutil.New("Failed to encode the output", err)
+	}
+	if _, err := out.Write(formatted); err != nil {
+		return errorsutil.New("Failed to write the output", err)
+	}
+	return nil
+}
+
+// selectFields keeps only the fields that --fields selects of an object, or of
+// each object in a list. Fields that an object doesn't have are left out. The
+// results of some commands are nested in a list of objects, such as the
+// permissions of a resource, so the fields of those objects are selected too.
+// The list is kept if any of its fields are selected.
+func selectFields(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		selected := make([]interface{}, len(v))
+		for i, item := range v {
+			selected[i] = selectFields(item)
+		}
+		return selected
+	case object:
+		selected := object{}
+		for _, field := range Fields {
+			for _, item := range v {
+				if strings.EqualFold(item.Key.(string), field) {
+					selected = append(selected, item)
+					break
+				}
+			}
+		}
+		for _, item := range v {
+			if selected.has(item.Key.(string)) {
+				continue
+			}
+			if list, ok := item.Value.([]interface{}); ok {
+				if results := selectFields(list).([]interface{}); hasFields(results) {
+					selected = append(selected, yaml.MapItem{Key: item.Key, Value: results})
+				}
+			}
+		}
+		return selected
+	}
+	return value
+}
+
+// hasFields reports whether any of the objects in the list has a field.
+func hasFields(list []interface{}) bool {
+	for _, item := range list {
+		if obj, ok := item.(object); ok && len(obj) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// object is a JSON object that keeps the order of its fields when it is
+// encoded as JSON or YAML.
+type object yaml.MapSlice
+
+func (o object) has(key string) bool {
+	for _, item := range o {
+		if item.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (o object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, item := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(item.Key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(item.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (o object) MarshalYAML() (interface{}, error) {
+	return yaml.MapSlice(o), nil
+}
+
+// decodeOrdered decodes the next JSON value, with objects decoded as object.
+func decodeOrdered(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		if t == '{' {
+			obj := object{}
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := decodeOrdered(dec)
+				if err != nil {
+					return nil, err
+				}
+				obj = append(obj, yaml.MapItem{Key: key, Value: value})
+			}
+			_, err := dec.Token()
+			return obj, err
+		}
+		list := []interface{}{}
+		for dec.More() {
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err := dec.Token()
+		return list, err
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i, nil
+		}
+		return t.Float64()
+	}
+	return tok, nil
+}
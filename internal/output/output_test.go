@@ -0,0 +1,141 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+type testGrant struct {
+	Role   string `json:"role"`
+	Member string `json:"member"`
+}
+
+type testReport struct {
+	Resource string      `json:"resource"`
+	Grants   []testGrant `json:"grants"`
+}
+
+var testTable = &Table{
+	Columns: []Column{
+		{Name: "resource", Header: "RESOURCE"},
+		{Name: "role", Header: "ROLE"},
+		{Name: "member", Header: "MEMBER"},
+	},
+	Rows: [][]string{
+		{"projects/my-project", "roles/owner", "user:a@example.com"},
+		{"projects/my-project", "roles/viewer", "group:b@example.com"},
+	},
+}
+
+var testData = []testReport{{
+	Resource: "projects/my-project",
+	Grants: []testGrant{
+		{Role: "roles/owner", Member: "user:a@example.com"},
+		{Role: "roles/viewer", Member: "group:b@example.com"},
+	},
+}}
+
+func TestWriteFields(t *testing.T) {
+	defer func() { Format, Fields = FormatTable, nil }()
+
+	tests := []struct {
+		format string
+		fields []string
+		want   string
+	}{
+		{
+			format: FormatJSON,
+			want:   `[{"resource":"projects/my-project","grants":[{"role":"roles/owner","member":"user:a@example.com"},{"role":"roles/viewer","member":"group:b@example.com"}]}]`,
+		},
+		{
+			format: FormatJSON,
+			fields: []string{"resource"},
+			want:   `[{"resource":"projects/my-project"}]`,
+		},
+		// The fields of the nested results are selected too.
+		{
+			format: FormatJSON,
+			fields: []string{"member", "resource"},
+			want:   `[{"resource":"projects/my-project","grants":[{"member":"user:a@example.com"},{"member":"group:b@example.com"}]}]`,
+		},
+		{
+			format: FormatJSON,
+			fields: []string{"ROLE"},
+			want:   `[{"grants":[{"role":"roles/owner"},{"role":"roles/viewer"}]}]`,
+		},
+		{
+			format: FormatYAML,
+			fields: []string{"role"},
+			want:   "- grants:\n  - role: roles/owner\n  - role: roles/viewer\n",
+		},
+		{
+			format: FormatCSV,
+			fields: []string{"member", "role"},
+			want:   "member,role\nuser:a@example.com,roles/owner\ngroup:b@example.com,roles/viewer\n",
+		},
+		{
+			format: FormatTable,
+			fields: []string{"role"},
+			want:   "ROLE\nroles/owner\nroles/viewer\n",
+		},
+	}
+	for _, tt := range tests {
+		Format, Fields = tt.format, tt.fields
+		var buf bytes.Buffer
+		if err := Write(&buf, testData, testTable); err != nil {
+			t.Errorf("Write() with -o %s --fields %v failed: %v", tt.format, tt.fields, err)
+			continue
+		}
+		got := buf.String()
+		if tt.format == FormatJSON {
+			got = compactJSON(t, got)
+		}
+		if got != tt.want {
+			t.Errorf("Write() with -o %s --fields %v = %q, want %q", tt.format, tt.fields, got, tt.want)
+		}
+	}
+}
+
+func TestWriteUnknownField(t *testing.T) {
+	util.Logger = util.NewLogger()
+	defer func() { Format, Fields = FormatTable, nil }()
+
+	for _, format := range Formats {
+		Format, Fields = format, []string{"role", "grants"}
+		var buf bytes.Buffer
+		err := Write(&buf, testData, testTable)
+		if err == nil || !strings.Contains(err.Error(), `unknown field "grants"`) {
+			t.Errorf("Write() with -o %s and an unknown field returned %v, want an unknown field error", format, err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("Write() with -o %s and an unknown field wrote %q, want nothing", format, buf.String())
+		}
+	}
+}
+
+func compactJSON(t *testing.T, s string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, []byte(s)); err != nil {
+		t.Fatalf("Write() wrote invalid JSON %q: %v", s, err)
+	}
+	return buf.String()
+}
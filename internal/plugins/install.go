@@ -112,7 +112,7 @@ func handleRepoNotFound(repoOwner, repoName string) error {
 
 	if len(tokenConfig) == 0 {
 		viper.Set(appconfig.GithubAuth, false)
-		if err := viper.WriteConfig(); err != nil {
+		if err := appconfig.WriteConfig(); err != nil {
 			return errorsutil.New("Failed to update 'github.auth' field in config", err)
 		}
 		err := errors.New("no Github access tokens found")
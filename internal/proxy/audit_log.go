@@ -0,0 +1,118 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+)
+
+// audit writes the audit log of the running session. It is nil when the audit
+// log is disabled.
+var audit *auditLogger
+
+// auditEntry is a single line in the audit log.
+type auditEntry struct {
+	Timestamp      string `json:"timestamp"`
+	Method         string `json:"method"`
+	Host           string `json:"host"`
+	Path           string `json:"path"`
+	Status         int    `json:"status"`
+	Principal      string `json:"principal"`
+	ServiceAccount string `json:"serviceAccount"`
+	Reason         string `json:"reason"`
+	TokenInjected  bool   `json:"tokenInjected"`
+}
+
+type auditLogger struct {
+	mu             sync.Mutex
+	f              *os.File
+	enc            *json.Encoder
+	principal      string
+	serviceAccount string
+	reason         string
+}
+
+// newAuditLogger creates the audit log file. Each intercepted request is
+// written to it as a line of JSON, along with the reason for the session so
+// that the requests can be matched with the Cloud Audit Logs entries.
+func newAuditLogger(filename, svcAcct, reason string) (*auditLogger, error) {
+	principal, err := gcpclient.CheckActiveAccountSet()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, errorsutil.New("Failed to create audit log file", err)
+	}
+	return &auditLogger{
+		f:              f,
+		enc:            json.NewEncoder(f),
+		principal:      principal,
+		serviceAccount: svcAcct,
+		reason:         reason,
+	}, nil
+}
+
+// log writes an entry for a request and the status of its response.
+func (a *auditLogger) log(r *http.Request, status int) {
+	if a == nil || r == nil {
+		return
+	}
+	entry := auditEntry{
+		Timestamp:      time.Now().UTC().Format(time.RFC3339Nano),
+		Method:         r.Method,
+		Host:           r.URL.Host,
+		Path:           r.URL.Path,
+		Status:         status,
+		Principal:      a.principal,
+		ServiceAccount: a.serviceAccount,
+		Reason:         a.reason,
+		TokenInjected:  injectToken(r.URL.Host, r.URL.Path),
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return
+	}
+	if err := a.enc.Encode(entry); err != nil {
+		util.Logger.WithError(err).Warn("Failed to write to the audit log")
+	}
+}
+
+// close closes the audit log file. Requests that finish afterwards aren't
+// logged.
+func (a *auditLogger) close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return
+	}
+	if err := a.f.Close(); err != nil {
+		util.Logger.WithError(err).Warn("Failed to close the audit log")
+	}
+	a.f = nil
+}
@@ -64,15 +64,14 @@ func setCa(caCertFile, caKeyFile string) error {
 // See https://github.com/rhaidiz/broxy/blob/master/core/cert.go
 func tlsConfigFromCA(ca *tls.Certificate) func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
 	return func(host string, ctx *goproxy.ProxyCtx) (c *tls.Config, err error) {
-		parts := strings.SplitN(host, ":", 2)
-		hostname := parts[0]
-		port := 443
-		if len(parts) > 1 {
-			port, err = strconv.Atoi(parts[1])
-			if err != nil {
+		hostname, port := host, 443
+		if h, p, splitErr := net.SplitHostPort(host); splitErr == nil {
+			hostname = h
+			if port, err = strconv.Atoi(p); err != nil {
 				port = 443
 			}
 		}
+		hostname = strings.TrimSuffix(strings.TrimPrefix(hostname, "["), "]")
 
 		cert := getCachedCert(hostname, port)
 		if cert == nil {
@@ -83,13 +82,26 @@ func tlsConfigFromCA(ca *tls.Certificate) func(host string, ctx *goproxy.ProxyCt
 			setCachedCert(hostname, port, cert)
 		}
 
-		config := tls.Config{
+		config := applyTLSSettings(&tls.Config{
 			Certificates: []tls.Certificate{*cert},
-			MinVersion:   tls.VersionTLS12,
-		}
+		})
+		requireClientCert(config, ca)
+
+		return config, nil
+	}
+}
 
-		return &config, nil
+// applyTLSSettings returns a copy of cfg with the minimum TLS version and the
+// cipher suites set in authproxy.tlsminversion and authproxy.tlsciphersuites.
+func applyTLSSettings(cfg *tls.Config) *tls.Config {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	} else {
+		cfg = cfg.Clone()
 	}
+	cfg.MinVersion = settings().tlsMinVersion
+	cfg.CipherSuites = settings().tlsCipherSuites
+	return cfg
 }
 
 // See https://github.com/rhaidiz/broxy/blob/master/core/cert.go
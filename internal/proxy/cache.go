@@ -0,0 +1,184 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxCachedBodySize is the size of the largest request or response body
+	// that is cached.
+	maxCachedBodySize = 1 << 20
+	// maxCacheEntries is the number of responses that the cache holds.
+	maxCacheEntries = 1000
+)
+
+// readOnlyMethods are the POST methods of Google APIs that don't change
+// anything, e.g. projects.testIamPermissions.
+var readOnlyMethods = []string{":testIamPermissions", ":getIamPolicy"}
+
+var cache = newResponseCache()
+
+// cacheKeyContext is the request context key that holds the cache key of a
+// request sent over an HTTP/2 connection.
+type cacheKeyContext struct{}
+
+type cachedResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	created time.Time
+	expires time.Time
+}
+
+// responseCache holds the responses to read-only requests for
+// authproxy.cachettl.
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedResponse
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{entries: make(map[string]*cachedResponse)}
+}
+
+// cacheKey returns the key to cache the response to a request under, or false
+// if the response can't be cached. The key includes the credentials that the
+// request is sent with so that passed through requests aren't answered with
+// responses meant for the service account or another user.
+func cacheKey(r *http.Request) (string, bool) {
+	if settings().cacheTTL <= 0 || !readOnlyRequest(r) {
+		return "", false
+	}
+	if strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+		return "", false
+	}
+
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Host+r.URL.RequestURI()+"\n")
+	if injectToken(r.URL.Host, r.URL.Path) {
+		io.WriteString(h, "impersonated\n")
+	} else {
+		io.WriteString(h, r.Header.Get("Authorization")+"\n")
+	}
+	if r.Body != nil && r.Method == http.MethodPost {
+		// Requests with large bodies aren't cached, so that the whole body
+		// doesn't have to be held in memory.
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxCachedBodySize+1))
+		if err != nil || len(body) > maxCachedBodySize {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			return "", false
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		h.Write(body)
+	}
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+func readOnlyRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPost:
+		for _, method := range readOnlyMethods {
+			if strings.HasSuffix(r.URL.Path, method) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// get returns the cached response for key if it hasn't expired.
+func (c *responseCache) get(key string, r *http.Request) *http.Response {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	metrics.cacheHit()
+	header := entry.header.Clone()
+	header.Set("Age", strconv.Itoa(int(time.Since(entry.created).Seconds())))
+	return &http.Response{
+		Status:        strconv.Itoa(entry.status) + " " + http.StatusText(entry.status),
+		StatusCode:    entry.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(entry.body)),
+		ContentLength: int64(len(entry.body)),
+		Request:       r,
+	}
+}
+
+// store caches a successful response under key. The response body is
+// replaced so that it can still be read.
+func (c *responseCache) store(key string, resp *http.Response) {
+	if resp == nil || resp.StatusCode != http.StatusOK || strings.Contains(resp.Header.Get("Cache-Control"), "no-store") {
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCachedBodySize+1))
+	if err != nil || len(body) > maxCachedBodySize {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCacheEntries {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCacheEntries {
+			return
+		}
+	}
+	c.entries[key] = &cachedResponse{
+		status:  resp.StatusCode,
+		header:  resp.Header.Clone(),
+		body:    body,
+		created: now,
+		expires: now.Add(settings().cacheTTL),
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+// orphanGracePeriod is how long the auth proxy of a session can keep running
+// after the session ended before it is stopped as orphaned.
+const orphanGracePeriod = 5 * time.Minute
+
+// staleFileAge is how old the temp files of sessions have to be before they
+// are removed when no session is running, so that the files of a session that
+// is starting are kept.
+const staleFileAge = time.Minute
+
+// CleanUpCrashedSessions restores what sessions that crashed or whose terminal
+// was closed left behind: their role bindings, session files, gcloud and
+// Docker configs, temp kubeconfigs, and sub-shell rc files. Auth proxies that
+// are still running long after their session ended are stopped. It runs
+// before every command, so failures are only logged.
+func CleanUpCrashedSessions() {
+	// Reading the sessions cleans up the ones that aren't running.
+	sessions, err := runningSessions()
+	if err != nil {
+		util.Logger.WithError(err).Warn("Failed to clean up after crashed privileged sessions")
+		return
+	}
+	for _, s := range sessions {
+		if time.Since(s.Expires) < orphanGracePeriod {
+			continue
+		}
+		util.Logger.Warnf("Stopping the privileged session for %s (PID %d), which is still running %s after it expired",
+			s.ServiceAccount, s.PID, time.Since(s.Expires).Round(time.Minute))
+		if err := s.Kill(true); err != nil {
+			util.Logger.WithError(err).Warnf("Failed to stop the privileged session with PID %d", s.PID)
+		}
+	}
+
+	removeOrphanedSessionDirs()
+	if len(sessions) == 0 {
+		removeStaleFiles(filepath.Join(appconfig.GetConfigDir(), kubeConfigDirName), "")
+		removeStaleFiles(os.TempDir(), shellRCDirPrefix)
+	}
+}
+
+// removeOrphanedSessionDirs removes the gcloud and Docker configs of sessions
+// that no longer have a session file.
+func removeOrphanedSessionDirs() {
+	files, err := ioutil.ReadDir(sessionsDir())
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		name := f.Name()
+		if !strings.HasSuffix(name, "-gcloud") && !strings.HasSuffix(name, "-docker") {
+			continue
+		}
+		pid, err := strconv.Atoi(name[:strings.LastIndex(name, "-")])
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(sessionFile(pid)); os.IsNotExist(err) {
+			util.Logger.Debugf("Removing %s, which was left behind by a crashed privileged session", name)
+			os.RemoveAll(filepath.Join(sessionsDir(), name))
+		}
+	}
+}
+
+// removeStaleFiles removes the files and directories in dir whose names start
+// with prefix and that are older than staleFileAge.
+func removeStaleFiles(dir, prefix string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), prefix) || time.Since(f.ModTime()) < staleFileAge {
+			continue
+		}
+		util.Logger.Debugf("Removing %s, which was left behind by a crashed privileged session", f.Name())
+		os.RemoveAll(filepath.Join(dir, f.Name()))
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os/user"
+	"path/filepath"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// The names of the client certificate files in the config directory.
+const (
+	clientCertName = "client.pem"
+	clientKeyName  = "client.key"
+)
+
+// ClientCertFiles returns the paths to the client certificate and key that
+// are presented to the auth proxy when authproxy.requireclientcert is set.
+func ClientCertFiles() (certFile, keyFile string) {
+	return filepath.Join(appconfig.GetConfigDir(), clientCertName), filepath.Join(appconfig.GetConfigDir(), clientKeyName)
+}
+
+// GenerateClientCert creates a client certificate for the current user that
+// is signed by the auth proxy CA.
+func GenerateClientCert() error {
+	ca, err := tls.LoadX509KeyPair(proxyCertFiles())
+	if err != nil {
+		return errorsutil.New("Failed to load the auth proxy CA", err)
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return errorsutil.New("Failed to parse the auth proxy CA certificate", err)
+	}
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return errorsutil.New("Failed to generate RSA key pair", err)
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return errorsutil.New("Failed to generate random serial number limit for x509 cert", err)
+	}
+	username := "unknown"
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+
+	notBefore := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			OrganizationalUnit: []string{"ephemeral-iam"},
+			CommonName:         fmt.Sprintf("ephemeral-iam client %s", username),
+		},
+		NotBefore:   notBefore,
+		NotAfter:    notBefore.AddDate(1, 0, 0),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, caCert, &priv.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return errorsutil.New("Failed to create x509 client cert", err)
+	}
+
+	certFile, keyFile := ClientCertFiles()
+	if err := writeToFile(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes}, certFile, 0o600); err != nil {
+		return errorsutil.New(fmt.Sprintf("Failed to write %s", certFile), err)
+	}
+	keyBlock := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}
+	if err := writeToFile(keyBlock, keyFile, 0o400); err != nil {
+		return errorsutil.New(fmt.Sprintf("Failed to write %s", keyFile), err)
+	}
+	return nil
+}
+
+// checkClientCertificate generates a new client certificate if client
+// certificates are required and the existing one is missing, expired, or
+// wasn't signed by the current auth proxy CA.
+func checkClientCertificate() error {
+	if !viper.GetBool(appconfig.AuthProxyClientAuth) {
+		return nil
+	}
+	certFile, keyFile := ClientCertFiles()
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		util.Logger.Debug("Generating auth proxy client cert and key files")
+		return GenerateClientCert()
+	}
+
+	cert, err := readCert(certFile)
+	if err != nil {
+		return err
+	}
+	caCert, err := readCert(viper.GetString(appconfig.AuthProxyCertFile))
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	opts := x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	if _, err := cert.Verify(opts); err != nil {
+		util.Logger.Debugf("Regenerating the auth proxy client cert: %v", err)
+		return GenerateClientCert()
+	}
+	return nil
+}
+
+// requireClientCert adds client certificate verification to the TLS config
+// that is used for intercepted connections when authproxy.requireclientcert
+// is set.
+func requireClientCert(config *tls.Config, ca *tls.Certificate) {
+	if !settings().clientAuth {
+		return
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.ClientCAs = clientCAs
+}
+
+// rejectPlainHTTP refuses requests that weren't sent over an intercepted TLS
+// connection when client certificates are required, since they can't be
+// verified.
+func rejectPlainHTTP(r *http.Request) *http.Response {
+	if !settings().clientAuth || r.URL.Scheme == "https" {
+		return nil
+	}
+	return goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusForbidden, "The auth proxy requires a client certificate")
+}
@@ -0,0 +1,189 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+const (
+	// DockerCredentialHelper is the name of the Docker credential helper that
+	// the session's Docker config uses. Docker runs it as
+	// "docker-credential-eiam".
+	DockerCredentialHelper = "eiam"
+
+	// DockerUsername is the username that registries expect with an access
+	// token.
+	DockerUsername = "oauth2accesstoken"
+
+	dockerTokenFileName = "token"
+)
+
+// DockerRegistries are the Container Registry and Artifact Registry hosts
+// that use the session's access token in the privileged sub-shell.
+var DockerRegistries = dockerRegistries()
+
+func dockerRegistries() []string {
+	registries := []string{"gcr.io", "us.gcr.io", "eu.gcr.io", "asia.gcr.io", "marketplace.gcr.io"}
+	locations := []string{
+		"africa-south1", "asia", "asia-east1", "asia-east2", "asia-northeast1", "asia-northeast2",
+		"asia-northeast3", "asia-south1", "asia-south2", "asia-southeast1", "asia-southeast2",
+		"australia-southeast1", "australia-southeast2", "europe", "europe-central2", "europe-north1",
+		"europe-southwest1", "europe-west1", "europe-west2", "europe-west3", "europe-west4",
+		"europe-west6", "europe-west8", "europe-west9", "europe-west10", "europe-west12",
+		"me-central1", "me-central2", "me-west1", "northamerica-northeast1", "northamerica-northeast2",
+		"southamerica-east1", "southamerica-west1", "us", "us-central1", "us-east1", "us-east4",
+		"us-east5", "us-south1", "us-west1", "us-west2", "us-west3", "us-west4",
+	}
+	for _, location := range locations {
+		registries = append(registries, location+"-docker.pkg.dev")
+	}
+	return registries
+}
+
+func dockerConfigDir(pid int) string {
+	return filepath.Join(sessionsDir(), fmt.Sprintf("%d-docker", pid))
+}
+
+// userDockerConfigDir returns the Docker config directory that the session's
+// Docker config is based on.
+func userDockerConfigDir() (string, error) {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".docker"), nil
+}
+
+// writeDockerConfig creates the Docker config directory of the session and
+// returns the environment variables that point Docker at it. The directory
+// has the user's Docker config with the eiam credential helper set for the
+// Google registries, a docker-credential-eiam script that runs the helper,
+// and the session's access token, which is rewritten when it is refreshed.
+// The other files in the user's Docker config directory, such as contexts and
+// CLI plugins, are linked into it, or copied on Windows. Docker isn't set up
+// if the user's Docker config can't be parsed.
+func writeDockerConfig() ([]string, error) {
+	eiam, err := os.Executable()
+	if err != nil {
+		return nil, errorsutil.New("Failed to find the eiam executable", err)
+	}
+	userDir, err := userDockerConfigDir()
+	if err != nil {
+		return nil, errorsutil.New("Failed to find the Docker config directory", err)
+	}
+
+	// Don't keep files left behind by an earlier session with the same PID.
+	dir := dockerConfigDir(os.Getpid())
+	removeDockerConfig(os.Getpid())
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errorsutil.New("Failed to create the Docker config directory", err)
+	}
+
+	config := map[string]interface{}{}
+	entries, err := ioutil.ReadDir(userDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errorsutil.New("Failed to read the Docker config directory", err)
+	}
+	for _, entry := range entries {
+		if entry.Name() == "config.json" {
+			data, err := ioutil.ReadFile(filepath.Join(userDir, entry.Name()))
+			if err != nil {
+				return nil, errorsutil.New("Failed to read the Docker config", err)
+			}
+			// eiam's settings can't be merged into a config it can't parse,
+			// so Docker is left to use the user's config as it is.
+			if err := json.Unmarshal(data, &config); err != nil {
+				util.Logger.WithError(err).Warnf("Docker won't use the session's credentials because %s can't be parsed", filepath.Join(userDir, entry.Name()))
+				removeDockerConfig(os.Getpid())
+				return nil, nil
+			}
+			continue
+		}
+		if err := linkDockerConfig(filepath.Join(userDir, entry.Name()), filepath.Join(dir, entry.Name())); err != nil && !os.IsExist(err) {
+			return nil, errorsutil.New("Failed to link the Docker config directory", err)
+		}
+	}
+
+	credHelpers := map[string]interface{}{}
+	if existing, ok := config["credHelpers"].(map[string]interface{}); ok {
+		credHelpers = existing
+	}
+	auths, _ := config["auths"].(map[string]interface{})
+	for _, registry := range DockerRegistries {
+		credHelpers[registry] = DockerCredentialHelper
+		// Credentials saved with "docker login" would be used instead.
+		delete(auths, registry)
+		delete(auths, "https://"+registry)
+	}
+	config["credHelpers"] = credHelpers
+
+	data, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return nil, errorsutil.New("Failed to create the Docker config", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), data, 0o600); err != nil {
+		return nil, errorsutil.New("Failed to write the Docker config", err)
+	}
+
+	if err := writeCredentialHelper(dir, eiam); err != nil {
+		return nil, errorsutil.New("Failed to write the Docker credential helper", err)
+	}
+
+	tokenFile := filepath.Join(dir, dockerTokenFileName)
+	accessToken, _ := sessionToken.get()
+	if err := ioutil.WriteFile(tokenFile, []byte(accessToken), 0o600); err != nil {
+		return nil, errorsutil.New("Failed to write the Docker credentials", err)
+	}
+	sessionToken.onRefresh(func(value string, _ time.Time) {
+		if err := ioutil.WriteFile(tokenFile, []byte(value), 0o600); err != nil {
+			util.Logger.WithError(err).Error("Failed to write the refreshed credentials for Docker")
+		}
+	})
+
+	return []string{
+		"DOCKER_CONFIG=" + dir,
+		fmt.Sprintf("PATH=%s%c%s", dir, os.PathListSeparator, os.Getenv("PATH")),
+	}, nil
+}
+
+func removeDockerConfig(pid int) {
+	if err := os.RemoveAll(dockerConfigDir(pid)); err != nil {
+		util.Logger.WithError(err).Error("Failed to remove the session's Docker config")
+	}
+}
+
+// DockerToken returns the session's access token for the Docker credential
+// helper.
+func (s *Session) DockerToken() (string, error) {
+	token, err := ioutil.ReadFile(filepath.Join(dockerConfigDir(s.PID), dockerTokenFileName))
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("the privileged session with PID %d doesn't have Docker credentials", s.PID)
+	} else if err != nil {
+		return "", errorsutil.New("Failed to read the Docker credentials", err)
+	}
+	return string(token), nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+// linkDockerConfig copies a file from the user's Docker config directory into
+// the session's. Creating symlinks on Windows needs administrator rights or
+// developer mode.
+func linkDockerConfig(src, dst string) error {
+	return util.CopyDir(src, dst)
+}
+
+// writeCredentialHelper writes the docker-credential-eiam.cmd batch file that
+// runs eiam's Docker credential helper. Docker finds it through PATHEXT.
+func writeCredentialHelper(dir, eiam string) error {
+	helper := fmt.Sprintf("@\"%s\" docker-credential %%*\r\n", eiam)
+	helperFile := filepath.Join(dir, "docker-credential-"+DockerCredentialHelper+".cmd")
+	return ioutil.WriteFile(helperFile, []byte(helper), 0o700) //nolint:gosec // The helper has to be executable
+}
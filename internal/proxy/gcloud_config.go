@@ -0,0 +1,88 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+)
+
+// gcloudSandbox is the gcloud config directory of the privileged sub-shell, if
+// the session has one.
+var gcloudSandbox string
+
+func gcloudSandboxDir(pid int) string {
+	return filepath.Join(sessionsDir(), fmt.Sprintf("%d-gcloud", pid))
+}
+
+// gcloudTokenFileName is the file in the sandbox that gcloud reads the
+// session's access token from.
+const gcloudTokenFileName = "eiam_access_token"
+
+// IsGcloudSandbox reports whether dir is the gcloud config directory of a
+// privileged sub-shell.
+func IsGcloudSandbox(dir string) bool {
+	rel, err := filepath.Rel(sessionsDir(), dir)
+	return err == nil && !strings.Contains(rel, string(filepath.Separator)) && strings.HasSuffix(rel, "-gcloud")
+}
+
+// createGcloudSandbox points gcloud in the privileged sub-shell at the auth
+// proxy with a copy of the user's gcloud config. The user's gcloud config isn't
+// changed, so there is nothing to restore if the session ends without cleaning
+// up, and sessions don't overwrite each other's config. The user's credentials
+// aren't copied; gcloud reads the session's access token from a file that is
+// rewritten when the token is refreshed.
+func createGcloudSandbox() error {
+	if SocketPath() != "" {
+		util.Logger.Info("gcloud can't use an auth proxy on a Unix socket, configuring it to impersonate the service account")
+		return nil
+	}
+
+	util.Logger.Info("Configuring gcloud to use auth proxy")
+	dir := gcloudSandboxDir(os.Getpid())
+	// Don't keep files left behind by an earlier session with the same PID.
+	removeGcloudSandbox(os.Getpid())
+	tokenFile := filepath.Join(dir, gcloudTokenFileName)
+	if err := gcpclient.CreateGcloudSandbox(dir, tokenFile); err != nil {
+		removeGcloudSandbox(os.Getpid())
+		return err
+	}
+	accessToken, _ := sessionToken.get()
+	if err := ioutil.WriteFile(tokenFile, []byte(accessToken), 0o600); err != nil {
+		removeGcloudSandbox(os.Getpid())
+		return errorsutil.New("Failed to write the access token for gcloud", err)
+	}
+	sessionToken.onRefresh(func(value string, _ time.Time) {
+		if err := ioutil.WriteFile(tokenFile, []byte(value), 0o600); err != nil {
+			util.Logger.WithError(err).Error("Failed to write the refreshed access token for gcloud")
+		}
+	})
+	gcloudSandbox = dir
+	return nil
+}
+
+func removeGcloudSandbox(pid int) {
+	if err := os.RemoveAll(gcloudSandboxDir(pid)); err != nil {
+		util.Logger.WithError(err).Error("Failed to remove the session's gcloud config")
+	}
+}
@@ -38,7 +38,9 @@ import (
 	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
 )
 
-// GenerateCerts creates the self signed TLS certificate for the HTTPS proxy.
+// GenerateCerts creates the self signed TLS certificate for the HTTPS proxy
+// and writes it to the files referenced by authproxy.certfile and
+// authproxy.keyfile.
 func GenerateCerts() error {
 	priv, err := rsa.GenerateKey(rand.Reader, 4096)
 	if err != nil {
@@ -77,13 +79,14 @@ func GenerateCerts() error {
 		return errorsutil.New("Failed to create x509 Cert", err)
 	}
 
+	certFile, keyFile := proxyCertFiles()
 	pemBlock := &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}
-	if err := writeToFile(pemBlock, "server.pem", 0o640); err != nil {
-		return errorsutil.New("Failed to write server.pem file", err)
+	if err := writeToFile(pemBlock, certFile, 0o640); err != nil {
+		return errorsutil.New(fmt.Sprintf("Failed to write %s", certFile), err)
 	}
 	pemBlock = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}
-	if err := writeToFile(pemBlock, "server.key", 0o400); err != nil {
-		return errorsutil.New("Failed to write server.key file", err)
+	if err := writeToFile(pemBlock, keyFile, 0o400); err != nil {
+		return errorsutil.New(fmt.Sprintf("Failed to write %s", keyFile), err)
 	}
 
 	return nil
@@ -100,15 +103,30 @@ func publicKey(priv interface{}) interface{} {
 	}
 }
 
-func writeToFile(data *pem.Block, filename string, perm os.FileMode) error {
-	fp := filepath.Join(appconfig.GetConfigDir(), filename)
+// proxyCertFiles returns the paths to the auth proxy certificate and key,
+// falling back to the default paths in the config directory.
+func proxyCertFiles() (certFile, keyFile string) {
+	certFile, keyFile = viper.GetString(appconfig.AuthProxyCertFile), viper.GetString(appconfig.AuthProxyKeyFile)
+	if certFile == "" {
+		certFile = filepath.Join(appconfig.GetConfigDir(), "server.pem")
+	}
+	if keyFile == "" {
+		keyFile = filepath.Join(appconfig.GetConfigDir(), "server.key")
+	}
+	return certFile, keyFile
+}
+
+func writeToFile(data *pem.Block, fp string, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(fp), 0o755); err != nil {
+		return errorsutil.New(fmt.Sprintf("Failed to create directory for %s", fp), err)
+	}
 	fd, err := os.Create(fp)
 	if err != nil {
 		if os.IsPermission(err) {
 			if err = os.Remove(fp); err != nil {
 				return errorsutil.New(fmt.Sprintf("Failed to update %s", fp), err)
 			}
-			return writeToFile(data, filename, perm)
+			return writeToFile(data, fp, perm)
 		}
 		return errorsutil.New(fmt.Sprintf("Failed to write file %s", fp), err)
 	}
@@ -139,7 +157,7 @@ func checkProxyCertificate() error {
 			viper.Set(appconfig.AuthProxyCertFile, filepath.Join(appconfig.GetConfigDir(), "server.pem"))
 			certFile = viper.GetString(appconfig.AuthProxyCertFile)
 		}
-		if err := viper.WriteConfig(); err != nil {
+		if err := appconfig.WriteConfig(); err != nil {
 			return errorsutil.New("Failed to write configuration file", err)
 		}
 	}
@@ -189,6 +207,11 @@ func validateProxyCert(certFile string) (err error) {
 		util.Logger.Warn("Regenerating cert due to invalid existing certificate options")
 		return GenerateCerts()
 	}
+
+	if time.Until(cert.NotAfter) < viper.GetDuration(appconfig.AuthProxyRotateBefore) {
+		util.Logger.Warnf("The auth proxy CA expires on %s, rotating it", cert.NotAfter.Format(time.RFC1123))
+		return RotateCerts()
+	}
 	return nil
 }
 
@@ -0,0 +1,370 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// CaptureHAR records the intercepted traffic in a HAR file.
+const CaptureHAR = "har"
+
+// maxCaptureBody is the number of bytes of each request and response body
+// that are recorded.
+const maxCaptureBody = 1 << 20
+
+// redactedHeaders are replaced in the capture so that the file doesn't contain
+// credentials.
+var redactedHeaders = map[string]bool{
+	"authorization":                  true,
+	"proxy-authorization":            true,
+	"cookie":                         true,
+	"set-cookie":                     true,
+	"x-goog-api-key":                 true,
+	"x-goog-iam-authorization-token": true,
+}
+
+// redactedParams are the query parameters that are replaced in the capture.
+var redactedParams = map[string]bool{
+	"access_token": true,
+	"key":          true,
+}
+
+// credentialHosts exchange and mint credentials, so the bodies of their
+// requests and responses, such as refresh tokens and the access tokens that
+// are generated for service accounts, aren't recorded.
+var credentialHosts = map[string]bool{
+	"iamcredentials.googleapis.com": true,
+	"oauth2.googleapis.com":         true,
+	"sts.googleapis.com":            true,
+}
+
+// capture records the traffic of the running session. It is nil when capture
+// is disabled.
+var capture *harRecorder
+
+// harRecorder collects the entries of a HAR file, which is written when the
+// proxy stops. See http://www.softwareishard.com/blog/har-12-spec/.
+type harRecorder struct {
+	filename string
+
+	mu      sync.Mutex
+	entries []harEntry
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// captureContext is the request context key that holds the capturedRequest of
+// a request sent over an HTTP/2 connection.
+type captureContext struct{}
+
+// capturedRequest is an intercepted request that hasn't been recorded yet.
+type capturedRequest struct {
+	started time.Time
+	body    *captureBody
+}
+
+func newHARRecorder(filename string) *harRecorder {
+	return &harRecorder{filename: filename}
+}
+
+// start begins capturing a request. The request body is recorded as it is
+// read so that streaming requests aren't held up.
+func (h *harRecorder) start(r *http.Request) *capturedRequest {
+	if h == nil {
+		return nil
+	}
+	c := &capturedRequest{started: time.Now(), body: &captureBody{}}
+	if r.Body != nil && r.Body != http.NoBody {
+		c.body.ReadCloser = r.Body
+		r.Body = c.body
+	}
+	return c
+}
+
+// finish records the request and its response once the response body has
+// been read. r is the request that was sent upstream and resp is nil if the
+// request failed.
+func (h *harRecorder) finish(c *capturedRequest, r *http.Request, resp *http.Response) {
+	if h == nil || c == nil {
+		return
+	}
+	waited := time.Now()
+	if resp == nil {
+		h.add(c, r, nil, nil, waited)
+		return
+	}
+	body := &captureBody{ReadCloser: resp.Body}
+	body.onDone = func() { h.add(c, r, resp, body, waited) }
+	if resp.Body == nil || resp.Body == http.NoBody {
+		body.ReadCloser = ioutil.NopCloser(bytes.NewReader(nil))
+	}
+	resp.Body = body
+}
+
+func (h *harRecorder) add(c *capturedRequest, r *http.Request, resp *http.Response, body *captureBody, waited time.Time) {
+	now := time.Now()
+	query := r.URL.Query()
+	for name, vals := range query {
+		for i, val := range vals {
+			vals[i] = redactValue(name, val)
+		}
+	}
+	u := *r.URL
+	u.RawQuery = query.Encode()
+	keepBodies := !credentialHosts[strings.ToLower(r.URL.Hostname())]
+	entry := harEntry{
+		StartedDateTime: c.started,
+		Time:            millis(now.Sub(c.started)),
+		Request: harRequest{
+			Method:      r.Method,
+			URL:         u.String(),
+			HTTPVersion: r.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(r.Header),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    c.body.size(),
+		},
+		Response: harResponse{
+			Status:      http.StatusBadGateway,
+			StatusText:  http.StatusText(http.StatusBadGateway),
+			HTTPVersion: r.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			HeadersSize: -1,
+		},
+		Timings: harTimings{Wait: millis(waited.Sub(c.started)), Receive: millis(now.Sub(waited))},
+	}
+	for name, vals := range query {
+		for _, val := range vals {
+			entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: name, Value: val})
+		}
+	}
+	if c.body.size() > 0 && keepBodies {
+		text, encoding := c.body.text()
+		entry.Request.PostData = &harPostData{MimeType: r.Header.Get("Content-Type"), Text: text, Encoding: encoding}
+	}
+	if resp != nil {
+		text, encoding := "", ""
+		if keepBodies {
+			text, encoding = body.text()
+		}
+		entry.Response.Status = resp.StatusCode
+		entry.Response.StatusText = http.StatusText(resp.StatusCode)
+		entry.Response.HTTPVersion = resp.Proto
+		entry.Response.Headers = harHeaders(resp.Header)
+		entry.Response.RedirectURL = resp.Header.Get("Location")
+		entry.Response.BodySize = body.size()
+		entry.Response.Content = harContent{
+			Size:     body.size(),
+			MimeType: resp.Header.Get("Content-Type"),
+			Text:     text,
+			Encoding: encoding,
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = append(h.entries, entry)
+}
+
+// write saves the recorded entries to the HAR file.
+func (h *harRecorder) write() error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	entries := append([]harEntry{}, h.entries...)
+	h.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].StartedDateTime.Before(entries[j].StartedDateTime)
+	})
+	har := map[string]interface{}{
+		"log": map[string]interface{}{
+			"version": "1.2",
+			"creator": map[string]string{"name": "ephemeral-iam", "version": appconfig.Version},
+			"entries": entries,
+		},
+	}
+	data, err := json.MarshalIndent(har, "", "  ")
+	if err != nil {
+		return errorsutil.New("Failed to encode the captured traffic", err)
+	}
+	if err := ioutil.WriteFile(h.filename, data, 0o600); err != nil {
+		return errorsutil.New("Failed to write the captured traffic", err)
+	}
+	return nil
+}
+
+// harHeaders converts headers to HAR name/value pairs, redacting credentials.
+func harHeaders(header http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for name, vals := range header {
+		for _, val := range vals {
+			if redactedHeaders[strings.ToLower(name)] {
+				val = "REDACTED"
+			} else {
+				val = string(util.Redact([]byte(val)))
+			}
+			headers = append(headers, harNameValue{Name: name, Value: val})
+		}
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+	return headers
+}
+
+// redactValue replaces the value of a query parameter that holds a credential,
+// and the credentials that util.Redact finds in other values.
+func redactValue(name, val string) string {
+	if redactedParams[strings.ToLower(name)] {
+		return "REDACTED"
+	}
+	return string(util.Redact([]byte(val)))
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// captureBody records the first maxCaptureBody bytes of a body as it is read.
+// onDone is called once when the body has been read or closed.
+type captureBody struct {
+	io.ReadCloser
+	onDone func()
+
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	total int64
+	once  sync.Once
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	b.total += int64(n)
+	if room := maxCaptureBody - b.buf.Len(); room > 0 {
+		if n < room {
+			room = n
+		}
+		b.buf.Write(p[:room])
+	}
+	b.mu.Unlock()
+	if err != nil {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *captureBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.done()
+	return err
+}
+
+func (b *captureBody) done() {
+	b.once.Do(func() {
+		if b.onDone != nil {
+			b.onDone()
+		}
+	})
+}
+
+func (b *captureBody) size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.total
+}
+
+// text returns the recorded body and the HAR encoding that it is in. The
+// credentials that util.Redact finds in text bodies are replaced.
+func (b *captureBody) text() (string, string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if utf8.Valid(b.buf.Bytes()) {
+		return string(util.Redact(b.buf.Bytes())), ""
+	}
+	return base64.StdEncoding.EncodeToString(b.buf.Bytes()), "base64"
+}
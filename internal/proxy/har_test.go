@@ -0,0 +1,100 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHARRedactsCredentials(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "capture.har")
+	h := newHARRecorder(filename)
+	record := func(method, url string, header http.Header, reqBody, respBody string) {
+		r := httptest.NewRequest(method, url, strings.NewReader(reqBody))
+		for name, vals := range header {
+			r.Header[name] = vals
+		}
+		c := h.start(r)
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			t.Fatal(err)
+		}
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      "HTTP/1.1",
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       ioutil.NopCloser(strings.NewReader(respBody)),
+		}
+		h.finish(c, r, resp)
+		if _, err := ioutil.ReadAll(resp.Body); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// The token exchange that gcloud makes with its refresh token.
+	record(
+		http.MethodPost, "https://oauth2.googleapis.com/token",
+		http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+		"grant_type=refresh_token&client_id=32555940559.apps.googleusercontent.com"+
+			"&client_secret=d-FL95Q19q7MQmFpd7hHD0Ty&refresh_token=1//0gRefreshTokenSecretValue",
+		`{"access_token": "ya29.MintedUserToken", "expires_in": 3599}`,
+	)
+	record(
+		http.MethodPost, "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/sa@my-project.iam.gserviceaccount.com:generateAccessToken",
+		nil,
+		`{"scope": ["https://www.googleapis.com/auth/cloud-platform"]}`,
+		`{"accessToken": "OpaqueMintedServiceAccountToken", "expireTime": "2021-06-01T00:00:00Z"}`,
+	)
+	record(
+		http.MethodGet, "https://storage.googleapis.com/storage/v1/b?project=my-project&key=AIzaApiKeySecret",
+		http.Header{
+			"X-Goog-Api-Key":                 {"AIzaApiKeySecret"},
+			"X-Goog-Iam-Authorization-Token": {"IamAuthorizationTokenSecret"},
+		},
+		"",
+		`{"kind": "storage#buckets", "note": "Bearer ya29.TokenInABody"}`,
+	)
+	if err := h.write(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	har := string(data)
+	for _, secret := range []string{
+		"d-FL95Q19q7MQmFpd7hHD0Ty",
+		"1//0gRefreshTokenSecretValue",
+		"ya29.",
+		"OpaqueMintedServiceAccountToken",
+		"AIzaApiKeySecret",
+		"IamAuthorizationTokenSecret",
+	} {
+		if strings.Contains(har, secret) {
+			t.Errorf("the HAR file contains %q:\n%s", secret, har)
+		}
+	}
+	for _, want := range []string{"project=my-project", "storage#buckets"} {
+		if !strings.Contains(har, want) {
+			t.Errorf("the HAR file doesn't contain %q:\n%s", want, har)
+		}
+	}
+}
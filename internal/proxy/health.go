@@ -0,0 +1,131 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// healthPath is the path that the auth proxy serves its health check on.
+const healthPath = "/healthz"
+
+// The statuses reported by the health check.
+const (
+	HealthOK       = "ok"
+	HealthExpired  = "expired"
+	HealthStopping = "stopping"
+)
+
+// Health is the response of the auth proxy health check.
+type Health struct {
+	Status         string    `json:"status"`
+	ServiceAccount string    `json:"serviceAccount"`
+	Expires        time.Time `json:"expires"`
+	// Remaining is the number of seconds until the access token expires.
+	Remaining int64 `json:"remainingSeconds"`
+	// InFlight is the number of requests that are being forwarded.
+	InFlight int `json:"inFlightRequests"`
+	// PID is the process of the session, which identifies it when its address
+	// is reused by another session.
+	PID int `json:"pid"`
+}
+
+// Live reports whether the session can still be used.
+func (h *Health) Live() bool {
+	return h.Status == HealthOK
+}
+
+// healthHandler serves the health check. It responds with 503 Service
+// Unavailable once the session has ended, the access token has expired
+// without being refreshed, or the proxy is stopping.
+func healthHandler(svcAcct string, expires time.Time) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		health := Health{
+			Status:         HealthOK,
+			ServiceAccount: svcAcct,
+			Expires:        expires,
+			Remaining:      int64(time.Until(expires).Seconds()),
+			PID:            os.Getpid(),
+		}
+		var stopping bool
+		health.InFlight, stopping = requests.state()
+		_, tokenExpires := sessionToken.get()
+		switch {
+		case stopping:
+			health.Status = HealthStopping
+		case health.Remaining <= 0:
+			health.Status = HealthExpired
+			health.Remaining = 0
+		case time.Now().After(tokenExpires):
+			health.Status = HealthExpired
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !health.Live() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(health) //nolint:errcheck // The client went away
+	})
+}
+
+// client returns an HTTP client that connects to the session's auth proxy.
+func (s *Session) client() *http.Client {
+	network, address := "tcp", s.Address
+	if s.SocketPath != "" {
+		network, address = "unix", s.SocketPath
+	}
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, address)
+			},
+		},
+	}
+}
+
+// url returns the URL of an endpoint of the session's auth proxy. Requests
+// over TCP are sent with the proxy's address as their Host, which localOnly
+// checks.
+func (s *Session) url(path string) string {
+	host := s.Address
+	if s.SocketPath != "" {
+		host = "localhost"
+	}
+	return "http://" + host + path
+}
+
+// Health asks the session's auth proxy whether it is live.
+func (s *Session) Health() (*Health, error) {
+	resp, err := s.client().Get(s.url(healthPath))
+	if err != nil {
+		return nil, errorsutil.New("Failed to reach the auth proxy", err)
+	}
+	defer resp.Body.Close()
+
+	health := &Health{}
+	if err := json.NewDecoder(resp.Body).Decode(health); err != nil {
+		return nil, errorsutil.New("Failed to parse the auth proxy health check", err)
+	}
+	return health, nil
+}
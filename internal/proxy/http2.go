@@ -0,0 +1,282 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/elazarl/goproxy"
+	"golang.org/x/net/http2"
+)
+
+var (
+	// interceptConnect intercepts CONNECT requests to the hosts that
+	// interceptHost reports. It is set when the proxy is created.
+	interceptConnect *goproxy.ConnectAction
+
+	// http2Transport forwards HTTP/2 requests to the upstream server.
+	http2Transport http.RoundTripper = &http2.Transport{}
+)
+
+// http2Host reports whether connections to host should be intercepted with
+// HTTP/2 support. Google APIs are the only hosts that gcloud talks gRPC to.
+func http2Host(host string) bool {
+	return googleAPIHost(host)
+}
+
+// googleAPIHost reports whether host serves a Google API.
+func googleAPIHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	return host == "googleapis.com" || strings.HasSuffix(host, ".googleapis.com")
+}
+
+// iapTunnelHost reports whether host serves the WebSockets of IAP TCP
+// forwarding, which gcloud compute ssh and start-iap-tunnel connect through.
+func iapTunnelHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	return host == "tunnel.cloudproxy.app" || strings.HasSuffix(host, ".tunnel.cloudproxy.app")
+}
+
+// interceptHost reports whether connections to host should be intercepted by
+// interceptConnect. Other hosts are intercepted by goproxy, which is enough for
+// clients that neither speak gRPC nor open WebSockets.
+func interceptHost(host string) bool {
+	return http2Host(host) || iapTunnelHost(host)
+}
+
+// newInterceptConnect returns a CONNECT action that terminates TLS itself so
+// that HTTP/2 can be negotiated with Google APIs and connection upgrades can be
+// handled. goproxy only speaks HTTP/1.1 on intercepted connections, which
+// breaks gRPC, dials WebSocket connections directly, which skips the upstream
+// proxy, and doesn't support other upgrades, such as kubectl's SPDY streams.
+//
+// HTTP/2 connections are served by a reverse proxy that streams requests and
+// responses, including the trailers that gRPC uses to send the call status.
+// Requests on HTTP/1.1 connections are handed back to goproxy so that the
+// request handlers are applied as usual.
+func newInterceptConnect(proxy *goproxy.ProxyHttpServer, reason string) *goproxy.ConnectAction {
+	return &goproxy.ConnectAction{
+		Action: goproxy.ConnectHijack,
+		Hijack: func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+			tlsConfig, err := goproxy.MitmConnect.TLSConfig(req.Host, ctx)
+			if err != nil {
+				ctx.Warnf("Cannot create TLS config for %s: %v", req.Host, err)
+				client.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+				client.Close()
+				return
+			}
+			tlsConfig.NextProtos = []string{"http/1.1"}
+			if http2Host(req.Host) {
+				tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+			}
+
+			if _, err := client.Write([]byte("HTTP/1.0 200 OK\r\n\r\n")); err != nil {
+				client.Close()
+				return
+			}
+
+			go func() {
+				conn := tls.Server(client, tlsConfig)
+				if err := conn.Handshake(); err != nil {
+					ctx.Warnf("Cannot handshake client %s: %v", req.Host, err)
+					conn.Close()
+					return
+				}
+
+				if conn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+					ctx.Logf("Serving HTTP/2 connection to %s", req.Host)
+					server := &http2.Server{}
+					server.ServeConn(conn, &http2.ServeConnOpts{
+						Handler: newHTTP2Handler(req.Host, reason, ctx),
+					})
+					return
+				}
+
+				serveHTTP1(conn, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					// Requests on an intercepted connection don't go through
+					// activityHandler.
+					markActive()
+					r.URL.Scheme = "https"
+					r.URL.Host = req.Host
+					r.RemoteAddr = req.RemoteAddr
+					if isUpgrade(r) {
+						ctx.Logf("Got %s upgrade %s %s", r.Header.Get("Upgrade"), r.Method, r.URL.String())
+						serveUpgrade(w, r, ctx, reason)
+						return
+					}
+					proxy.ServeHTTP(&flushWriter{w}, r)
+				}))
+			}()
+		},
+	}
+}
+
+// grpcUnauthenticated is the gRPC status code of calls without valid
+// credentials.
+const grpcUnauthenticated = 16
+
+// newHTTP2Handler returns the handler for requests that are sent over an
+// intercepted HTTP/2 connection to host.
+func newHTTP2Handler(host, reason string, ctx *goproxy.ProxyCtx) http.Handler {
+	reverseProxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "https"
+			r.URL.Host = host
+			ctx.Logf("Got HTTP/2 request %s %s", r.Method, r.URL.String())
+			authorizeRequest(r, reason)
+		},
+		Transport: http2Transport,
+		// Flush immediately so that streaming gRPC calls aren't buffered.
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			recordResponse(resp.Request, resp.StatusCode)
+			if key, ok := resp.Request.Context().Value(cacheKeyContext{}).(string); ok {
+				cache.store(key, resp)
+			}
+			c, _ := resp.Request.Context().Value(captureContext{}).(*capturedRequest)
+			capture.finish(c, resp.Request, resp)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			ctx.Warnf("Cannot read HTTP/2 response from %s: %v", host, err)
+			recordResponse(r, http.StatusBadGateway)
+			c, _ := r.Context().Value(captureContext{}).(*capturedRequest)
+			capture.finish(c, r, nil)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		markActive()
+		r.URL.Scheme = "https"
+		r.URL.Host = host
+		c := capture.start(r)
+		if c != nil {
+			r = r.WithContext(context.WithValue(r.Context(), captureContext{}, c))
+		}
+		if key, ok := cacheKey(r); ok {
+			if resp := cache.get(key, r); resp != nil {
+				recordResponse(r, resp.StatusCode)
+				capture.finish(c, r, resp)
+				writeResponse(w, resp)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), cacheKeyContext{}, key))
+		}
+		if err := throttle(r.Context(), host); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if resp := rejectExpiredCredentials(r); resp != nil {
+			recordResponse(r, resp.StatusCode)
+			capture.finish(c, r, resp)
+			if strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+				// gRPC clients report the status of the call rather than the
+				// body of an HTTP error, so the message is sent as its status.
+				resp.Body.Close()
+				w.Header().Set("Content-Type", "application/grpc")
+				w.Header().Set("Grpc-Status", strconv.Itoa(grpcUnauthenticated))
+				w.Header().Set("Grpc-Message", reauthMessage)
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			writeResponse(w, resp)
+			return
+		}
+		if !requests.start() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		defer requests.done()
+		reverseProxy.ServeHTTP(w, r)
+	})
+}
+
+// writeResponse copies a response that wasn't sent upstream to w.
+func writeResponse(w http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body) //nolint:errcheck // The client went away
+}
+
+// serveHTTP1 serves HTTP/1.1 requests on a single connection until the client
+// closes it.
+func serveHTTP1(conn net.Conn, handler http.Handler) {
+	l := &connListener{conn: conn, done: make(chan struct{})}
+	srv := &http.Server{
+		Handler: handler,
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				l.Close()
+			}
+		},
+	}
+	srv.Serve(l) //nolint:errcheck // Serve always returns an error when the listener is closed
+}
+
+// flushWriter flushes every write to the client, so that streamed responses,
+// such as kubectl logs -f and watches, aren't held back until a buffer fills.
+type flushWriter struct {
+	http.ResponseWriter
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// connListener is a net.Listener that returns a single connection.
+type connListener struct {
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	if c := l.conn; c != nil {
+		l.conn = nil
+		return c, nil
+	}
+	<-l.done
+	return nil, io.EOF
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
@@ -0,0 +1,52 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTP2RejectsExpiredCredentials(t *testing.T) {
+	credentials.setExpired(true)
+	defer credentials.setExpired(false)
+	sessionToken.set("expired-token", time.Now().Add(-time.Minute))
+	defer sessionToken.set("", time.Time{})
+
+	handler := newHTTP2Handler("pubsub.googleapis.com", "Debugging", nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/projects/my-project/topics", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	body, _ := ioutil.ReadAll(w.Body)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(string(body), "eiam reauth") {
+		t.Errorf("HTTP/2 request got %d %q, want 401 with the reauth message", w.Code, body)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/google.pubsub.v1.Publisher/ListTopics", nil)
+	r.Header.Set("Content-Type", "application/grpc")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if got := w.Header().Get("Grpc-Status"); got != "16" {
+		t.Errorf("gRPC call got grpc-status %q, want 16 (UNAUTHENTICATED)", got)
+	}
+	if got := w.Header().Get("Grpc-Message"); !strings.Contains(got, "eiam reauth") {
+		t.Errorf("gRPC call got grpc-message %q, want the reauth message", got)
+	}
+}
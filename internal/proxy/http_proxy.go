@@ -19,11 +19,16 @@ import (
 	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -43,64 +48,269 @@ var (
 
 	wg sync.WaitGroup
 
+	watchConfigOnce sync.Once
+
 	funcHTTPSHandler = func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		// Tunnel traffic to bypassed and third-party hosts without
+		// intercepting it.
+		if tunnelHost(host) {
+			return goproxy.OkConnect, host
+		}
+		// Intercept Google APIs with HTTP/2 and WebSocket support so that
+		// gRPC calls and IAP tunnels work.
+		if interceptConnect != nil && interceptHost(host) {
+			return interceptConnect, host
+		}
 		return goproxy.MitmConnect, host
 	}
 )
 
-// StartProxyServer spins up the proxy that replaces the gcloud auth token.
+// StartProxyServer spins up the proxy that replaces the gcloud auth token. The
+// session lasts for duration, or until the access token expires if duration is
+// 0, and never longer than security.maxsessionduration. Tokens with the given
+// lifetime are generated to replace the access token if it expires before the
+// session ends. If captureFormat is CaptureHAR, the intercepted traffic is
+// saved to a HAR file when the session ends. If execCommand isn't empty, it is
+// run in the session instead of an interactive sub-shell, and the session ends
+// when it exits. If accessBoundary isn't empty, the access token is down-scoped
+// with it, so that it can only use the permissions that the boundary grants.
+// If scopes isn't empty, the access tokens are limited to those OAuth scopes
+// instead of defaults.scopes. If subject isn't empty, the access tokens are
+// generated for that Google Workspace user through domain-wide delegation.
+// If roleBinding isn't nil, svcAcct is the user's own identity, the access
+// tokens are generated with their application default credentials, and the
+// binding is removed from the project when the session ends.
 func StartProxyServer(
 	accessToken,
 	reason,
 	svcAcct,
-	project string,
+	project,
+	subject string,
+	roleBinding *gcpclient.RoleBinding,
+	delegates []string,
+	accessBoundary []gcpclient.AccessBoundaryRule,
+	scopes []string,
 	expirationDate time.Time,
+	lifetime,
+	duration time.Duration,
 	defaultCluster map[string]string,
+	captureFormat,
+	execCommand string,
 ) error {
+	cfg := &sessionConfig{
+		Reason:         reason,
+		ServiceAccount: svcAcct,
+		Project:        project,
+		Subject:        subject,
+		Delegates:      delegates,
+		AccessBoundary: accessBoundary,
+		Scopes:         scopes,
+		Lifetime:       lifetime,
+		DefaultCluster: defaultCluster,
+		CaptureFormat:  captureFormat,
+		ExecCommand:    execCommand,
+		RoleBinding:    roleBinding,
+	}
+	cfg.apply()
+	accessToken, tokenExpires, err := boundToken(accessToken, expirationDate)
+	if err != nil {
+		return err
+	}
+	sessionEnd := endOfSession(time.Now(), expirationDate, duration)
+	if sessionEnd.After(expirationDate) {
+		util.Logger.Infof("The access token will be refreshed before it expires at %s", expirationDate.Format(time.RFC1123))
+	}
+	return runSession(cfg, accessToken, tokenExpires, sessionEnd, nil)
+}
+
+// sessionConfig holds the settings of a privileged session that it needs to
+// be started again when it is resumed.
+type sessionConfig struct {
+	Reason         string                         `json:"reason"`
+	ServiceAccount string                         `json:"serviceAccount"`
+	Project        string                         `json:"project,omitempty"`
+	Subject        string                         `json:"subject,omitempty"`
+	Delegates      []string                       `json:"delegates,omitempty"`
+	AccessBoundary []gcpclient.AccessBoundaryRule `json:"accessBoundary,omitempty"`
+	Scopes         []string                       `json:"scopes,omitempty"`
+	Lifetime       time.Duration                  `json:"lifetime"`
+	DefaultCluster map[string]string              `json:"defaultCluster,omitempty"`
+	CaptureFormat  string                         `json:"captureFormat,omitempty"`
+	ExecCommand    string                         `json:"execCommand,omitempty"`
+	RoleBinding    *gcpclient.RoleBinding         `json:"roleBinding,omitempty"`
+}
+
+// runningSession is the config of the session that this process runs.
+var runningSession *sessionConfig
+
+// apply sets the settings that new access tokens are generated with.
+func (c *sessionConfig) apply() {
+	sessionBoundary = c.AccessBoundary
+	sessionScopes = c.Scopes
+	sessionSubject = c.Subject
+	sessionRoleBinding = c.RoleBinding
+}
+
+// runSession starts the auth proxy with the access token and runs the
+// privileged sub-shell, or the command to execute, until sessionEnd. onStart
+// is called once the session is running, if it is set by a resumed session.
+func runSession(cfg *sessionConfig, accessToken string, tokenExpires, sessionEnd time.Time, onStart func()) error {
+	// Don't leave the role binding behind if the session fails to start. A
+	// session that fails to resume keeps it, since it can be resumed again.
+	started := false
+	defer func() {
+		if !started && cfg.RoleBinding != nil && onStart == nil {
+			removeRoleBinding(cfg.RoleBinding, cfg.Reason)
+		}
+	}()
+	progress := util.StartProgress("Starting the auth proxy")
+	defer progress.Stop()
 	if err := checkProxyCertificate(); err != nil {
 		return err
 	}
+	if err := checkClientCertificate(); err != nil {
+		return err
+	}
+	runningSession = cfg
+	reason, svcAcct, project, delegates := cfg.Reason, cfg.ServiceAccount, cfg.Project, cfg.Delegates
+	defaultCluster, execCommand := cfg.DefaultCluster, cfg.ExecCommand
+	sessionToken.set(accessToken, tokenExpires)
 
-	srv, err := createProxy(accessToken, reason)
+	srv, err := createProxy(reason, svcAcct, delegates, sessionEnd, cfg.CaptureFormat)
 	if err != nil {
 		return err
 	}
+	l, err := listen(srv.Addr)
+	if err != nil {
+		return errorsutil.New("Failed to start the auth proxy", err)
+	}
+	session := &Session{
+		PID:            os.Getpid(),
+		Address:        srv.Addr,
+		SocketPath:     SocketPath(),
+		CertFile:       viper.GetString(appconfig.AuthProxyCertFile),
+		ServiceAccount: svcAcct,
+		Subject:        cfg.Subject,
+		Delegates:      delegates,
+		Project:        project,
+		Reason:         reason,
+		Started:        time.Now(),
+		Expires:        sessionEnd,
+		RoleBinding:    cfg.RoleBinding,
+	}
+	if session.SocketPath != "" {
+		session.Address = ""
+	}
+	if err := writeSession(session); err != nil {
+		l.Close()
+		return err
+	}
+	// Commands run in the session get the auth proxy settings from their
+	// environment instead.
+	if execCommand == "" {
+		if err := createGcloudSandbox(); err != nil {
+			removeSession()
+			l.Close()
+			return err
+		}
+	}
 
-	// Catch interrupts to gracefully shutdown the proxy and restore the gcloud config.
-	idleConnsClosed := make(chan struct{})
-	sigint := make(chan os.Signal, 1)
-	go func() {
-		signal.Notify(sigint, os.Interrupt)
-		<-sigint
+	sessionCtx, cancelSession := context.WithCancel(context.Background())
+	go refreshToken(sessionCtx, svcAcct, delegates, reason, cfg.Lifetime, sessionEnd)
+	go warnBeforeSessionEnd(sessionCtx, sessionEnd)
+	if execCommand == "" {
+		go endWhenIdle(sessionCtx, viper.GetDuration(appconfig.SessionIdleTimeout))
+	}
 
-		// An interrupt signal was received, shutdown the proxy server.
-		if err := srv.Shutdown(context.Background()); err != nil {
-			util.Logger.WithError(err).Error("failed to properly shut down proxy server")
-		}
-		close(idleConnsClosed)
-		util.Logger.Info("Stopping auth proxy and restoring gcloud config")
-		errorsutil.CheckRevertGcloudConfigError(gcpclient.UnsetGcloudProxy())
-		os.Exit(0)
-	}()
+	// Stop the proxy once, whether the session expired or was interrupted.
+	var stopOnce sync.Once
+	stop := func() {
+		stopOnce.Do(func() {
+			appconfig.StopWatchingConfig()
+			cancelSession()
+			// Other eiam commands would clean up after the session once its
+			// auth proxy stops accepting connections, so the session file
+			// records that it is stopping, and whether it was suspended.
+			stopping := time.Now()
+			session.Stopping = &stopping
+			session.Suspended = atomic.LoadInt32(&sessionSuspended) == 1
+			if err := writeSession(session); err != nil {
+				util.Logger.WithError(err).Warn("Failed to mark the privileged session as stopping")
+			}
+			stopProxy(srv)
+			removeDockerConfig(session.PID)
+			// A suspended session keeps its role binding until it is resumed
+			// or the binding's condition expires.
+			if cfg.RoleBinding != nil && atomic.LoadInt32(&sessionSuspended) == 0 {
+				removeRoleBinding(cfg.RoleBinding, reason)
+			}
+		})
+	}
+	started = true
+	if onStart != nil {
+		onStart()
+	}
+	// The spinner has to be cleared before the sub-shell takes the terminal.
+	progress.Stop()
+
+	sigint := make(chan os.Signal, 1)
+	signal.Notify(sigint, os.Interrupt)
 
-	proxyServerExit := &sync.WaitGroup{}
-	proxyServerExit.Add(1)
 	go func() {
-		defer proxyServerExit.Done()
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
 			util.Logger.WithError(err).Fatal("failed to start the auth proxy")
 		}
-		<-idleConnsClosed
 	}()
 
-	sessionLength := time.Until(expirationDate)
-	sessionEnd := time.Now().Add(sessionLength).Format(time.RFC1123)
-	util.Logger.Infof("Starting auth proxy. Privileged session will last until %s", sessionEnd)
+	util.Logger.Infof("Starting auth proxy. Privileged session will last until %s", sessionEnd.Format(time.RFC1123))
+
+	shellEnv := []string{fmt.Sprintf("%s=%d", SessionEnvVar, session.PID)}
+	if socketPath := SocketPath(); socketPath != "" {
+		util.Logger.Infof("The auth proxy is listening on %s", socketPath)
+		shellEnv = append(shellEnv, gcloudSessionEnv(svcAcct, delegates, reason, project)...)
+	} else if gcloudSandbox == "" {
+		util.Logger.Infof("The auth proxy is listening on %s", session.Address)
+		shellEnv = append(shellEnv, session.Env()...)
+	} else {
+		shellEnv = append(shellEnv, fmt.Sprintf("CLOUDSDK_CONFIG=%s", gcloudSandbox))
+		// The sandbox doesn't have the application default credentials, so
+		// client libraries are pointed at the user's own.
+		if adcFile := gcpclient.UserADCFile(); adcFile != "" && os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") == "" {
+			shellEnv = append(shellEnv, fmt.Sprintf("GOOGLE_APPLICATION_CREDENTIALS=%s", adcFile))
+		}
+		if project != "" {
+			// The project is only set for the session so that the active
+			// gcloud project of the copied config isn't changed.
+			shellEnv = append(shellEnv, fmt.Sprintf("CLOUDSDK_CORE_PROJECT=%s", project))
+		}
+	}
+
+	if execCommand != "" {
+		// Interrupts also reach the command, which decides whether to exit.
+		code, err := runCommand(execCommand, svcAcct, defaultCluster, shellEnv, sessionEnd)
+		stop()
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return errorsutil.ExitError{Code: code}
+		}
+		return nil
+	}
+
+	// Catch interrupts to gracefully shutdown the proxy and restore the gcloud config.
+	go func() {
+		<-sigint
+		stop()
+		// Exit through the logger so that the command is still recorded in
+		// the audit history.
+		util.Logger.Exit(0)
+	}()
 
 	wg.Add(1)
 	var oldState *term.State
 	// TODO: Instead of handling errors in the startShell function, handle them here.
-	go startShell(svcAcct, accessToken, expirationDate.Format(time.RFC3339Nano), defaultCluster, &oldState)
+	go startShell(svcAcct, project, sessionEnd, defaultCluster, shellEnv, &oldState)
 
 	// Shut down the auth proxy when the user exits the sub-shell.
 	go func() {
@@ -108,24 +318,56 @@ func StartProxyServer(
 		sigint <- syscall.SIGINT
 	}()
 
-	time.Sleep(sessionLength)
+	time.Sleep(time.Until(sessionEnd))
 
-	if err := term.Restore(int(os.Stdin.Fd()), oldState); err != nil {
-		return errorsutil.New("Failed to restore original shell", err)
+	stopShell()
+	if oldState != nil {
+		if err := term.Restore(int(os.Stdin.Fd()), oldState); err != nil {
+			return errorsutil.New("Failed to restore original shell", err)
+		}
 	}
 
-	util.Logger.Info("Privileged session expired, stopping auth proxy and restoring gcloud config")
-	if err := srv.Shutdown(context.Background()); err != nil {
-		return errorsutil.New("Failed to properly shut down proxy server", err)
-	}
-	errorsutil.CheckRevertGcloudConfigError(gcpclient.UnsetGcloudProxy())
+	util.Logger.Info("Privileged session expired")
+	notify("The privileged session expired.")
+	stop()
 	return nil
 }
 
-func createProxy(accessToken, reason string) (*http.Server, error) {
-	proxy := goproxy.NewProxyHttpServer()
-	proxy.Verbose = viper.GetBool(appconfig.AuthProxyVerbose)
+// watchConfig applies changes made to the config file while the session is
+// running. The config is reloaded on another goroutine, so it is only watched
+// once the sub-shell or command has started and the session is done reading
+// viper. Afterwards, the session reads the values that can change from
+// settings.
+func watchConfig() {
+	watchConfigOnce.Do(func() {
+		appconfig.WatchConfig(func() {
+			loadSettings()
+			if err := loadRules(); err != nil {
+				util.Logger.WithError(err).Warn("Keeping the previous auth proxy rules")
+			}
+			if err := scoper.load(); err != nil {
+				util.Logger.WithError(err).Warn("Keeping the previous auth proxy token scopes")
+			}
+			loadRateLimits()
+		})
+	})
+}
 
+func createProxy(reason, svcAcct string, delegates []string, sessionEnd time.Time, captureFormat string) (*http.Server, error) {
+	proxy := goproxy.NewProxyHttpServer()
+	// authproxy.verbose is applied by verboseLogger.
+	proxy.Verbose = true
+	loadSettings()
+	if err := loadRules(); err != nil {
+		return nil, err
+	}
+	scoper = newTokenScoper(svcAcct, delegates, reason)
+	if err := scoper.load(); err != nil {
+		return nil, err
+	}
+	loadRateLimits()
+	requests = &inFlightRequests{}
+	cache = newResponseCache()
 	// Create log file.
 	timestamp := time.Now().Format("20060102150405")
 	logFilename := filepath.Join(viper.GetString(appconfig.AuthProxyLogDir), fmt.Sprintf("%s_auth_proxy.log", timestamp))
@@ -133,29 +375,194 @@ func createProxy(accessToken, reason string) (*http.Server, error) {
 	if err != nil {
 		return nil, errorsutil.New("Failed to create log file", err)
 	}
-	defer logFile.Close()
 
-	// Set auth proxy to log to file.
-	proxy.Logger = log.New(logFile, "", log.LstdFlags)
+	// Set auth proxy to log to file. The file stays open until the session
+	// ends, and verbose logs include request headers, so credentials are
+	// scrubbed from them.
+	proxy.Logger = verboseLogger{log.New(util.RedactWriter(logFile), "", log.LstdFlags)}
 	util.Logger.Infof("Writing auth proxy logs to %s\n", logFilename)
 
+	if viper.GetBool(appconfig.AuthProxyAuditLog) {
+		auditFilename := filepath.Join(viper.GetString(appconfig.AuthProxyLogDir), fmt.Sprintf("%s_auth_proxy_audit.jsonl", timestamp))
+		if audit, err = newAuditLogger(auditFilename, svcAcct, reason); err != nil {
+			return nil, err
+		}
+		util.Logger.Infof("Writing the auth proxy audit log to %s", auditFilename)
+	}
+	capture = nil
+	if captureFormat == CaptureHAR {
+		captureFilename := filepath.Join(viper.GetString(appconfig.AuthProxyLogDir), fmt.Sprintf("%s_auth_proxy.har", timestamp))
+		capture = newHARRecorder(captureFilename)
+		util.Logger.Infof("Recording the intercepted traffic to %s when the session ends", captureFilename)
+	}
+
 	certFile, keyFile := viper.GetString(appconfig.AuthProxyCertFile), viper.GetString(appconfig.AuthProxyKeyFile)
 	if err := setCa(certFile, keyFile); err != nil {
 		util.Logger.Error("Failed to set proxy certificate authority")
 		return nil, err
 	}
 
+	if err := configureUpstreamProxy(proxy); err != nil {
+		return nil, err
+	}
+	interceptConnect = newInterceptConnect(proxy, reason)
 	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(funcHTTPSHandler))
 
 	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		r.Header.Set("authorization", fmt.Sprintf("Bearer %s", accessToken))
-		r.Header.Set("X-Goog-Request-Reason", reason)
+		if tunnelHost(r.URL.Host) {
+			return r, nil
+		}
+		if resp := rejectPlainHTTP(r); resp != nil {
+			return r, resp
+		}
+		data := &requestData{capture: capture.start(r)}
+		ctx.UserData = data
+		if key, ok := cacheKey(r); ok {
+			if resp := cache.get(key, r); resp != nil {
+				return r, resp
+			}
+			data.cacheKey = key
+		}
+		if err := throttle(r.Context(), r.URL.Host); err != nil {
+			return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusServiceUnavailable, "Request canceled while throttled")
+		}
+		ctx.RoundTripper = trackRoundTrip(proxy.Tr)
+		if resp := rejectExpiredCredentials(r); resp != nil {
+			return r, resp
+		}
+		authorizeRequest(r, reason)
 		return r, nil
 	})
 
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if ctx.Req == nil || tunnelHost(ctx.Req.URL.Host) {
+			return resp
+		}
+		status := http.StatusBadGateway
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		recordResponse(ctx.Req, status)
+		if data, ok := ctx.UserData.(*requestData); ok {
+			if data.cacheKey != "" {
+				cache.store(data.cacheKey, resp)
+			}
+			capture.finish(data.capture, ctx.Req, resp)
+		}
+		return resp
+	})
+
+	// Requests that are sent to the proxy itself rather than through it.
+	metrics = newProxyMetrics()
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, localOnly(metrics))
+	mux.Handle(healthPath, localOnly(healthHandler(svcAcct, sessionEnd)))
+	mux.Handle(tokenInfoPath, localOnly(tokenInfoHandler()))
+	mux.Handle(reauthPath, localOnly(reauthHandler()))
+	mux.Handle(suspendPath, localOnly(suspendHandler(sessionEnd)))
+	mux.Handle(killPath, localOnly(killHandler()))
+	proxy.NonproxyHandler = mux
+
 	srv := &http.Server{
-		Addr:    fmt.Sprintf("%s:%s", viper.GetString(appconfig.AuthProxyAddress), viper.GetString(appconfig.AuthProxyPort)),
-		Handler: proxy,
+		Addr:    Address(),
+		Handler: activityHandler(proxy),
 	}
 	return srv, nil
 }
+
+// requestData is kept in the goproxy context of an intercepted request until
+// its response is handled.
+type requestData struct {
+	cacheKey string
+	capture  *capturedRequest
+}
+
+// authorizeRequest replaces the credentials of an intercepted request with the
+// access token of the impersonated service account, unless an authproxy.rules
+// entry passes the request through untouched. If a scoped token can't be
+// minted for the host, the request is sent without credentials rather than
+// with the full session token.
+func authorizeRequest(r *http.Request, reason string) {
+	if !injectToken(r.URL.Host, r.URL.Path) {
+		return
+	}
+	accessToken, _ := sessionToken.get()
+	token, err := scoper.token(r.URL.Host, accessToken)
+	if err != nil {
+		util.Logger.WithError(err).Warnf("Sending the request to %s without credentials", r.URL.Host)
+		r.Header.Del("authorization")
+		return
+	}
+	r.Header.Set("authorization", fmt.Sprintf("Bearer %s", token))
+	r.Header.Set("X-Goog-Request-Reason", reason)
+}
+
+// recordResponse adds an intercepted request to the audit log and the metrics.
+func recordResponse(r *http.Request, status int) {
+	audit.log(r, status)
+	metrics.observe(status)
+}
+
+// bypassHost reports whether host matches one of the patterns in the
+// authproxy.bypassdomains config list. The list is read on every request so
+// changes made while the proxy is running are applied.
+func bypassHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range settings().bypassDomains {
+		if matched, _ := path.Match(strings.ToLower(pattern), host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// endOfSession returns when a session that starts at start ends.
+func endOfSession(start, expirationDate time.Time, duration time.Duration) time.Time {
+	end := expirationDate
+	if duration > 0 {
+		end = start.Add(duration)
+	}
+	if limit := appconfig.MaxSessionDuration(); limit > 0 && end.After(start.Add(limit)) {
+		util.Logger.Warnf("Limiting the session to %s, the %s config value", limit, appconfig.SecurityMaxSession)
+		end = start.Add(limit)
+	}
+	// Don't generate a new token just to outlast the first one by a few
+	// seconds.
+	if end.After(expirationDate) && end.Sub(expirationDate) < time.Minute {
+		end = expirationDate
+	}
+	return end
+}
+
+// tunnelHost reports whether traffic to host is passed through without adding
+// credentials. Unless authproxy.interceptallhosts is set, this includes hosts
+// other than Google APIs and IAP tunnels that no inject rule names, so that
+// clients that pin the certificates of third-party endpoints keep working
+// during a session.
+func tunnelHost(host string) bool {
+	if bypassHost(host) {
+		return true
+	}
+	if settings().interceptAll {
+		return false
+	}
+	return !googleAPIHost(host) && !iapTunnelHost(host) && !injectRuleFor(host)
+}
+
+// FindFreePort returns the first port, starting at start, that the auth proxy
+// can listen on at the given address.
+func FindFreePort(address string, start int) (int, error) {
+	address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	for port := start; port <= 65535; port++ {
+		l, err := listenTCP(net.JoinHostPort(address, strconv.Itoa(port)))
+		if err != nil {
+			continue
+		}
+		l.Close()
+		return port, nil
+	}
+	return 0, fmt.Errorf("no free port found on %s above %d", address, start)
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// idleWarnBefore is how long before an idle session is ended that a warning
+// is shown in the sub-shell.
+const idleWarnBefore = time.Minute
+
+// lastActivity is when the user last typed in the sub-shell or a request was
+// sent through the auth proxy, in Unix nanoseconds.
+var lastActivity = time.Now().UnixNano()
+
+func markActive() {
+	atomic.StoreInt64(&lastActivity, time.Now().UnixNano())
+}
+
+func idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&lastActivity)))
+}
+
+// activityReader marks the session as active whenever the user types in the
+// sub-shell.
+type activityReader struct {
+	io.Reader
+}
+
+func (r activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		markActive()
+	}
+	return n, err
+}
+
+// activityHandler marks the session as active for every request that is sent
+// through the auth proxy. Requests for the proxy's own endpoints, such as
+// metrics scrapes and health checks, don't use the session, so they aren't
+// counted.
+func activityHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect || r.URL.IsAbs() {
+			markActive()
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// endWhenIdle ends the session once the sub-shell had no input and the auth
+// proxy had no requests for session.idletimeout, warning idleWarnBefore
+// before.
+func endWhenIdle(ctx context.Context, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	markActive()
+	warned := false
+	for {
+		wait := timeout - idleFor()
+		if !warned && timeout > 2*idleWarnBefore {
+			wait -= idleWarnBefore
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		idle := idleFor()
+		switch {
+		case idle >= timeout:
+			printNotice("The privileged session was idle for %s and was ended (session.idletimeout).", idle.Round(time.Second))
+			notify("The privileged session was idle for %s and was ended.", idle.Round(time.Second))
+			stopShell()
+			return
+		case !warned && idle >= timeout-idleWarnBefore && timeout > 2*idleWarnBefore:
+			printNotice("The privileged session has been idle for %s and will end in %s unless it is used.",
+				idle.Round(time.Second), (timeout - idle).Round(time.Second))
+			notify("The privileged session has been idle for %s and will end in %s unless it is used.",
+				idle.Round(time.Second), (timeout - idle).Round(time.Second))
+			warned = true
+		case idle < timeout-idleWarnBefore:
+			// The session was used since the warning.
+			warned = false
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestActivityHandler(t *testing.T) {
+	handler := activityHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		name   string
+		method string
+		target string
+		active bool
+	}{
+		{name: "metrics scrape", method: http.MethodGet, target: metricsPath},
+		{name: "health check", method: http.MethodGet, target: healthPath},
+		{name: "proxied request", method: http.MethodGet, target: "http://metadata.example.com/v1/instance", active: true},
+		{name: "tunnel", method: http.MethodConnect, target: "storage.googleapis.com:443", active: true},
+	}
+	for _, tt := range tests {
+		idleSince := time.Now().Add(-time.Hour)
+		atomic.StoreInt64(&lastActivity, idleSince.UnixNano())
+
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if active := idleFor() < time.Minute; active != tt.active {
+			t.Errorf("%s: marked the session active = %t, want %t", tt.name, active, tt.active)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// killPath is the path that the auth proxy is told on to end its session.
+const killPath = "/kill"
+
+// killHandler ends the running session the same way as when its sub-shell
+// exits, or stops the command run with --exec.
+func killHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+		// End the session once the response was sent.
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			printNotice("The privileged session was ended with 'eiam sessions kill'.")
+			notify("The privileged session was ended with 'eiam sessions kill'.")
+			shellLock.Lock()
+			process := commandProcess
+			shellLock.Unlock()
+			if process != nil {
+				util.Terminate(process) //nolint:errcheck // The command may have exited already
+			}
+			stopShell()
+		}()
+	})
+}
+
+// Kill tells the session's auth proxy to end the session, which removes its
+// role binding and files like when its sub-shell exits. If the auth proxy
+// doesn't respond and force is set, the session's process is stopped instead
+// and its files are removed.
+func (s *Session) Kill(force bool) error {
+	err := s.kill()
+	if err == nil || !force {
+		return err
+	}
+	util.Logger.WithError(err).Warnf("Stopping the process of the privileged session (PID %d) instead", s.PID)
+	p, findErr := os.FindProcess(s.PID)
+	if findErr != nil {
+		return errorsutil.New("Failed to find the process of the session", findErr)
+	}
+	if termErr := util.Terminate(p); termErr != nil {
+		return errorsutil.New("Failed to stop the process of the session", termErr)
+	}
+	s.cleanUp()
+	return nil
+}
+
+func (s *Session) kill() error {
+	resp, err := s.client().Post(s.url(killPath), "text/plain", nil)
+	if err != nil {
+		return errorsutil.New("Failed to reach the auth proxy", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errorsutil.New("Failed to end the session", fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body))))
+	}
+	return nil
+}
+
+// FindKillableSession returns the running session that id refers to, like
+// FindSession, including sessions that expired but are still running.
+func FindKillableSession(id string) (*Session, error) {
+	sessions, err := runningSessions()
+	if err != nil {
+		return nil, err
+	}
+	return matchSession(sessions, id)
+}
@@ -0,0 +1,155 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// dualStackHost is the authproxy.proxyaddress value that listens on both the
+// IPv4 and the IPv6 loopback addresses.
+const dualStackHost = "localhost"
+
+// Address returns the TCP address that the auth proxy listens on.
+func Address() string {
+	return net.JoinHostPort(appconfig.ProxyHost(), viper.GetString(appconfig.AuthProxyPort))
+}
+
+// ChoosePort moves the auth proxy to the next free port when the configured
+// port is taken, e.g. by another privileged session.
+func ChoosePort() error {
+	if SocketPath() != "" {
+		return nil
+	}
+	start, err := strconv.Atoi(viper.GetString(appconfig.AuthProxyPort))
+	if err != nil {
+		return errorsutil.New("Invalid auth proxy port", err)
+	}
+	port, err := FindFreePort(appconfig.ProxyHost(), start)
+	if err != nil {
+		return errorsutil.New("Failed to find a free port for the auth proxy", err)
+	}
+	if port != start {
+		util.Logger.Infof("Port %d is in use, the auth proxy will listen on port %d", start, port)
+		viper.Set(appconfig.AuthProxyPort, strconv.Itoa(port))
+	}
+	return nil
+}
+
+// listenTCP listens on a TCP address. "localhost" listens on both loopback
+// addresses, since it can resolve to either one. The IPv6 loopback address is
+// skipped if IPv6 isn't available.
+func listenTCP(address string) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host != dualStackHost {
+		return net.Listen("tcp", address)
+	}
+
+	l4, err := net.Listen("tcp4", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		return nil, err
+	}
+	// Listen on the same port over IPv6, which matters when the port was 0.
+	_, port, _ = net.SplitHostPort(l4.Addr().String())
+	l6, err := net.Listen("tcp6", net.JoinHostPort("::1", port))
+	if err != nil {
+		if conn, dialErr := net.Dial("tcp6", net.JoinHostPort("::1", port)); dialErr == nil {
+			// The port is taken on the IPv6 loopback address.
+			conn.Close()
+			l4.Close()
+			return nil, err
+		}
+		return l4, nil
+	}
+	return newMultiListener(l4, l6), nil
+}
+
+// multiListener accepts connections from several listeners.
+type multiListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	once      sync.Once
+	done      chan struct{}
+}
+
+func newMultiListener(listeners ...net.Listener) *multiListener {
+	m := &multiListener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error),
+		done:      make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go m.accept(l)
+	}
+	return m
+}
+
+func (m *multiListener) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case m.errs <- err:
+			case <-m.done:
+			}
+			return
+		}
+		select {
+		case m.conns <- conn:
+		case <-m.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case err := <-m.errs:
+		return nil, err
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	var err error
+	m.once.Do(func() {
+		close(m.done)
+		for _, l := range m.listeners {
+			if closeErr := l.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
+// Addr returns the address of the first listener.
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
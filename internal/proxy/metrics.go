@@ -0,0 +1,164 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+)
+
+// metricsPath is the path that the auth proxy serves its metrics on.
+const metricsPath = "/metrics"
+
+var metrics = newProxyMetrics()
+
+// proxyMetrics holds the counters that are exposed in the Prometheus text
+// format on the metrics endpoint.
+type proxyMetrics struct {
+	mu                sync.Mutex
+	start             time.Time
+	requests          uint64
+	tokenRefreshes    uint64
+	throttledRequests uint64
+	cacheHits         uint64
+	errors            map[int]uint64
+}
+
+func newProxyMetrics() *proxyMetrics {
+	return &proxyMetrics{
+		start:  time.Now(),
+		errors: make(map[int]uint64),
+	}
+}
+
+// observe counts an intercepted request and the status of its response.
+func (m *proxyMetrics) observe(status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests++
+	if status >= http.StatusBadRequest {
+		m.errors[status]++
+	}
+}
+
+// tokenRefreshed counts a replacement of the access token used by the proxy.
+func (m *proxyMetrics) tokenRefreshed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokenRefreshes++
+}
+
+// throttled counts a request that was delayed by the rate limits.
+func (m *proxyMetrics) throttled() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.throttledRequests++
+}
+
+// cacheHit counts a request that was answered from the response cache.
+func (m *proxyMetrics) cacheHit() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cacheHits++
+}
+
+func (m *proxyMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+func (m *proxyMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeMetricHeader(w, "eiam_proxy_requests_total", "counter", "The number of requests intercepted by the auth proxy.")
+	fmt.Fprintf(w, "eiam_proxy_requests_total %d\n", m.requests)
+
+	writeMetricHeader(w, "eiam_proxy_token_refreshes_total", "counter", "The number of times the access token was refreshed.")
+	fmt.Fprintf(w, "eiam_proxy_token_refreshes_total %d\n", m.tokenRefreshes)
+
+	writeMetricHeader(w, "eiam_proxy_throttled_requests_total", "counter", "The number of requests delayed by the rate limits.")
+	fmt.Fprintf(w, "eiam_proxy_throttled_requests_total %d\n", m.throttledRequests)
+
+	writeMetricHeader(w, "eiam_proxy_cache_hits_total", "counter", "The number of requests answered from the response cache.")
+	fmt.Fprintf(w, "eiam_proxy_cache_hits_total %d\n", m.cacheHits)
+
+	writeMetricHeader(w, "eiam_proxy_upstream_errors_total", "counter", "The number of error responses by status code.")
+	codes := make([]int, 0, len(m.errors))
+	for code := range m.errors {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "eiam_proxy_upstream_errors_total{code=\"%d\"} %d\n", code, m.errors[code])
+	}
+
+	writeMetricHeader(w, "eiam_proxy_session_duration_seconds", "gauge", "How long the privileged session has been running.")
+	fmt.Fprintf(w, "eiam_proxy_session_duration_seconds %g\n", time.Since(m.start).Seconds())
+}
+
+func writeMetricHeader(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// localOnly rejects requests that don't come from the loopback interface or
+// the Unix socket that the proxy listens on. Browsers send the requests of any
+// web page to the loopback interface too, so requests with an Origin header,
+// which browsers add to cross-site requests, and requests for a Host other than
+// a loopback address, which a DNS rebinding attack would send, are rejected as
+// well.
+func localOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.Network() == "unix" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if r.Header.Get("Origin") != "" || !isProxyHost(r.Host) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// isProxyHost reports whether the Host of a request is localhost, a loopback
+// address, or the address that the proxy listens on, with or without a port.
+func isProxyHost(hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	return host != "" && host == appconfig.ProxyHost()
+}
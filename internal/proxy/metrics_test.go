@@ -0,0 +1,65 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+)
+
+func TestLocalOnly(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set(appconfig.AuthProxyAddress, "192.168.1.20")
+
+	handler := localOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		name       string
+		remoteAddr string
+		host       string
+		origin     string
+		want       int
+	}{
+		{name: "loopback", remoteAddr: "127.0.0.1:50000", host: "127.0.0.1:8084", want: http.StatusOK},
+		{name: "localhost", remoteAddr: "[::1]:50000", host: "localhost:8084", want: http.StatusOK},
+		{name: "proxy address", remoteAddr: "127.0.0.1:50000", host: "192.168.1.20:8084", want: http.StatusOK},
+		{name: "remote client", remoteAddr: "192.168.1.30:50000", host: "192.168.1.20:8084", want: http.StatusForbidden},
+		{
+			name:       "cross-site request",
+			remoteAddr: "127.0.0.1:50000",
+			host:       "127.0.0.1:8084",
+			origin:     "https://attacker.example.com",
+			want:       http.StatusForbidden,
+		},
+		{name: "DNS rebinding", remoteAddr: "127.0.0.1:50000", host: "attacker.example.com:8084", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "http://"+tt.host+killPath, nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: localOnly() responded with %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
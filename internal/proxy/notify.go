@@ -0,0 +1,46 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"os"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+// printNotice prints a notice about the running session in the terminal,
+// yellow unless colors are disabled. The terminal is in raw mode while the
+// session runs, so lines have to end with "\r\n".
+func printNotice(format string, args ...interface{}) {
+	notice := util.Colorize(os.Stderr, 33, "[eiam] "+fmt.Sprintf(format, args...))
+	fmt.Fprintf(os.Stderr, "\r\n%s\r\n", notice)
+}
+
+// notify shows a desktop notification about the running session if
+// session.notifications is set. The session's warnings are also shown in the
+// terminal, so failures are only logged at debug level.
+func notify(format string, args ...interface{}) {
+	if !settings().notifications {
+		return
+	}
+	title := "ephemeral-iam"
+	if runningSession != nil {
+		title = fmt.Sprintf("ephemeral-iam: %s", runningSession.ServiceAccount)
+	}
+	if err := util.Notify(title, fmt.Sprintf(format, args...)); err != nil {
+		util.Logger.WithError(err).Debug("Failed to show a desktop notification")
+	}
+}
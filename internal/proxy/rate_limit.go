@@ -0,0 +1,149 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+// throttleWarningInterval is how often a warning is logged for each host
+// while its requests are being throttled.
+const throttleWarningInterval = 10 * time.Second
+
+var (
+	limiter     = newRateLimiter(0, 0)
+	limiterLock sync.RWMutex
+)
+
+// tokenBucket allows rate requests per second with bursts of up to rate
+// requests.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// reserve takes a token from the bucket and returns how long to wait before it
+// can be used.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimiter throttles requests to the limits set in authproxy.ratelimit and
+// authproxy.hostratelimit. A limit of 0 disables it.
+type rateLimiter struct {
+	mu           sync.Mutex
+	global       *tokenBucket
+	hostRate     int
+	hosts        map[string]*tokenBucket
+	lastWarnings map[string]time.Time
+}
+
+func newRateLimiter(rate, hostRate int) *rateLimiter {
+	l := &rateLimiter{
+		hostRate:     hostRate,
+		hosts:        make(map[string]*tokenBucket),
+		lastWarnings: make(map[string]time.Time),
+	}
+	if rate > 0 {
+		l.global = newTokenBucket(rate)
+	}
+	return l
+}
+
+// loadRateLimits reads the rate limits from the config. It is called again
+// when the config file changes.
+func loadRateLimits() {
+	l := newRateLimiter(viper.GetInt(appconfig.AuthProxyRateLimit), viper.GetInt(appconfig.AuthProxyHostRateLimit))
+	limiterLock.Lock()
+	defer limiterLock.Unlock()
+	limiter = l
+}
+
+// throttle blocks until a request to host is allowed by the rate limits or the
+// context is canceled.
+func throttle(ctx context.Context, host string) error {
+	limiterLock.RLock()
+	l := limiter
+	limiterLock.RUnlock()
+
+	delay := l.reserve(host)
+	if delay <= 0 {
+		return nil
+	}
+	metrics.throttled()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *rateLimiter) reserve(host string) time.Duration {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	var delay time.Duration
+	if l.global != nil {
+		delay = l.global.reserve(now)
+	}
+	if l.hostRate > 0 {
+		bucket, ok := l.hosts[host]
+		if !ok {
+			bucket = newTokenBucket(l.hostRate)
+			l.hosts[host] = bucket
+		}
+		if hostDelay := bucket.reserve(now); hostDelay > delay {
+			delay = hostDelay
+		}
+	}
+
+	if delay > 0 && now.Sub(l.lastWarnings[host]) >= throttleWarningInterval {
+		l.lastWarnings[host] = now
+		util.Logger.Warnf("The auth proxy rate limit was reached, throttling requests to %s", host)
+	}
+	return delay
+}
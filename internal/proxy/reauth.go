@@ -0,0 +1,109 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// reauthPath is the path that the auth proxy is told on that the user's
+// credentials were renewed.
+const reauthPath = "/reauth"
+
+// reauthMessage tells the user how to renew their credentials.
+const reauthMessage = "Your application default credentials expired or were revoked, so the privileged " +
+	"session's access token can't be refreshed. Run 'eiam reauth' to log in again"
+
+// credentials tracks whether the user's credentials have to be renewed before
+// the session token can be refreshed.
+var credentials = &credentialState{renewed: make(chan struct{}, 1)}
+
+type credentialState struct {
+	mu      sync.Mutex
+	expired bool
+	// renewed wakes up the token refresh when the credentials are renewed.
+	renewed chan struct{}
+}
+
+// setExpired records whether the credentials have expired and reports whether
+// that changed.
+func (c *credentialState) setExpired(expired bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changed := c.expired != expired
+	c.expired = expired
+	return changed
+}
+
+func (c *credentialState) isExpired() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.expired
+}
+
+// renew makes the token refresh try again without waiting.
+func (c *credentialState) renew() {
+	select {
+	case c.renewed <- struct{}{}:
+	default:
+	}
+}
+
+// rejectExpiredCredentials responds to requests that would get the session
+// token once it has expired and can't be refreshed until the user logs in
+// again, so that they get an explanation instead of an opaque 401 from the API.
+func rejectExpiredCredentials(r *http.Request) *http.Response {
+	if !credentials.isExpired() || !injectToken(r.URL.Host, r.URL.Path) {
+		return nil
+	}
+	if _, expires := sessionToken.get(); time.Now().Before(expires) {
+		return nil
+	}
+	return goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusUnauthorized, reauthMessage)
+}
+
+// reauthHandler wakes up the token refresh after the user renewed their
+// credentials with 'eiam reauth'.
+func reauthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		credentials.renew()
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
+
+// CredentialsRenewed tells the session's auth proxy that the user's
+// credentials were renewed, so that it refreshes its access token right away.
+func (s *Session) CredentialsRenewed() error {
+	resp, err := s.client().Post(s.url(reauthPath), "text/plain", nil)
+	if err != nil {
+		return errorsutil.New("Failed to reach the auth proxy", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return errorsutil.New("The auth proxy didn't accept the renewed credentials", fmt.Errorf("%s", resp.Status))
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	credentialspb "google.golang.org/genproto/googleapis/iam/credentials/v1"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+)
+
+const (
+	// tokenRefreshBefore is how long before the access token expires that a
+	// new one is generated.
+	tokenRefreshBefore = 5 * time.Minute
+
+	// tokenRetryInterval is how long to wait before trying again when the
+	// access token can't be refreshed.
+	tokenRetryInterval = 30 * time.Second
+)
+
+// sessionToken is the access token of the impersonated service account. It is
+// replaced when the token is refreshed.
+var sessionToken = &accessToken{}
+
+// sessionBoundary is the Credential Access Boundary that the session token is
+// down-scoped with, if any. It is set when the proxy is created.
+var sessionBoundary []gcpclient.AccessBoundaryRule
+
+// sessionScopes are the OAuth scopes that the session token is limited to
+// instead of the configured default scopes, if any. It is set when the proxy
+// is created.
+var sessionScopes []string
+
+// sessionSubject is the Google Workspace user that the session token is
+// generated for through domain-wide delegation, if any. It is set when the
+// proxy is created.
+var sessionSubject string
+
+// sessionRoleBinding is the temporary role binding that grants the session's
+// permissions to the user's own identity, if the session was started with
+// --role. The session token is then an access token for the user's
+// application default credentials. It is set when the proxy is created.
+var sessionRoleBinding *gcpclient.RoleBinding
+
+// boundToken down-scopes an access token with the session's access boundary.
+// The token is returned unchanged when the session doesn't have one.
+func boundToken(value string, expires time.Time) (string, time.Time, error) {
+	if len(sessionBoundary) == 0 {
+		return value, expires, nil
+	}
+	bounded, boundExpires, err := gcpclient.DownscopeToken(value, sessionBoundary)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if !boundExpires.IsZero() && boundExpires.Before(expires) {
+		expires = boundExpires
+	}
+	return bounded, expires, nil
+}
+
+type accessToken struct {
+	mu        sync.RWMutex
+	value     string
+	expires   time.Time
+	listeners []func(value string, expires time.Time)
+}
+
+func (t *accessToken) get() (string, time.Time) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.value, t.expires
+}
+
+func (t *accessToken) set(value string, expires time.Time) {
+	t.mu.Lock()
+	t.value, t.expires = value, expires
+	listeners := t.listeners
+	t.mu.Unlock()
+
+	for _, listener := range listeners {
+		listener(value, expires)
+	}
+}
+
+// onRefresh registers a function that is called with each new access token.
+func (t *accessToken) onRefresh(listener func(value string, expires time.Time)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.listeners = append(t.listeners, listener)
+}
+
+// refreshToken generates a new access token for the service account shortly
+// before the current one expires, until the session ends or ctx is canceled.
+// Tokens are generated with the lifetime of the first one, but never last
+// past the end of the session.
+func refreshToken(ctx context.Context, svcAcct string, delegates []string, reason string, lifetime time.Duration, sessionEnd time.Time) {
+	for {
+		_, expires := sessionToken.get()
+		if !expires.Before(sessionEnd) {
+			return
+		}
+
+		wait := time.Until(expires.Add(-refreshBefore(lifetime)))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		remaining := time.Duration(math.Ceil(time.Until(sessionEnd).Seconds())) * time.Second
+		if remaining < lifetime {
+			lifetime = remaining
+		}
+		value, newExpires, err := newSessionToken(svcAcct, delegates, reason, lifetime)
+		if err != nil {
+			if !gcpclient.IsReauthError(err) {
+				util.Logger.WithError(err).Warnf("Failed to refresh the access token, trying again in %s", tokenRetryInterval)
+			} else if credentials.setExpired(true) {
+				util.Logger.WithError(err).Warn(reauthMessage)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(tokenRetryInterval):
+			case <-credentials.renewed:
+			}
+			continue
+		}
+		if credentials.setExpired(false) {
+			util.Logger.Info("Your credentials were renewed and the access token was refreshed")
+		}
+		sessionToken.set(value, newExpires)
+		util.Logger.Debugf("Refreshed the access token, it expires at %s", newExpires.Format(time.RFC1123))
+	}
+}
+
+// refreshBefore returns how long before they expire that tokens with the given
+// lifetime are refreshed. Short-lived tokens are refreshed halfway through
+// their lifetime instead of tokenRefreshBefore, so that a new token isn't
+// requested as soon as the previous one is issued.
+func refreshBefore(lifetime time.Duration) time.Duration {
+	if lifetime/2 < tokenRefreshBefore {
+		return lifetime / 2
+	}
+	return tokenRefreshBefore
+}
+
+// newSessionToken generates an access token for the service account, or for
+// the session's subject through the service account, with the session's
+// scopes and down-scopes it with the session's access boundary. Sessions with
+// a role binding get a new access token for the user's own credentials.
+func newSessionToken(svcAcct string, delegates []string, reason string, lifetime time.Duration) (string, time.Time, error) {
+	if sessionRoleBinding != nil {
+		return gcpclient.ADCAccessToken()
+	}
+	scopes := sessionScopes
+	if len(scopes) == 0 {
+		scopes = settings().scopes
+	}
+	var (
+		resp *credentialspb.GenerateAccessTokenResponse
+		err  error
+	)
+	if sessionSubject != "" {
+		resp, err = gcpclient.GenerateDelegatedAccessToken(svcAcct, sessionSubject, reason, lifetime, scopes, delegates)
+	} else {
+		resp, err = gcpclient.GenerateScopedAccessToken(svcAcct, reason, lifetime, scopes, delegates)
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return boundToken(resp.GetAccessToken(), resp.GetExpireTime().AsTime())
+}
+
+// removeRoleBinding removes the session's temporary role binding. If it can't
+// be removed, it stops granting the role once its condition expires anyway.
+func removeRoleBinding(binding *gcpclient.RoleBinding, reason string) {
+	util.Logger.Infof("Removing %s from %s", binding.Role, binding.Member)
+	if err := gcpclient.RemoveTemporaryRoleBinding(binding, reason); err != nil {
+		util.Logger.WithError(err).Errorf("The role binding will stop granting %s at %s, but stays in the IAM policy of %s until it is removed",
+			binding.Role, binding.Expires.Local().Format(time.RFC1123), binding.Project)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"os"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+// RotateCerts replaces the auth proxy CA with a new one. The client
+// certificate is reissued by the new CA if it exists, and the host
+// certificates signed by the old CA are discarded.
+func RotateCerts() error {
+	if err := GenerateCerts(); err != nil {
+		return err
+	}
+	clientCertFile, _ := ClientCertFiles()
+	if _, err := os.Stat(clientCertFile); err == nil {
+		if err := GenerateClientCert(); err != nil {
+			return err
+		}
+	}
+
+	certLock.Lock()
+	certCache = make(map[string]*tls.Certificate)
+	certLock.Unlock()
+
+	certFile, _ := proxyCertFiles()
+	util.Logger.Infof("Wrote the new auth proxy CA to %s", certFile)
+	util.Logger.Warn("If you added the previous auth proxy CA to any trust stores, replace it with the new one, e.g. with `eiam proxy trust-ca`")
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"sync"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+var (
+	rules     []appconfig.ProxyRule
+	rulesLock sync.RWMutex
+)
+
+// loadRules reads the authproxy.rules config section. It is called again when
+// the config file changes so that rules can be edited during a session.
+func loadRules() error {
+	loaded, err := appconfig.ProxyRules()
+	if err != nil {
+		return errorsutil.New("Failed to load the auth proxy rules", err)
+	}
+	rulesLock.Lock()
+	defer rulesLock.Unlock()
+	rules = loaded
+	return nil
+}
+
+// injectToken reports whether the access token should be added to a request
+// to the given host and path. The first matching rule decides, and the token
+// is injected when no rule matches.
+func injectToken(host, urlPath string) bool {
+	rulesLock.RLock()
+	defer rulesLock.RUnlock()
+	for _, rule := range rules {
+		if rule.Matches(host, urlPath) {
+			return rule.Action == appconfig.RuleInject
+		}
+	}
+	return true
+}
+
+// injectRuleFor reports whether an inject rule names the host.
+func injectRuleFor(host string) bool {
+	rulesLock.RLock()
+	defer rulesLock.RUnlock()
+	for _, rule := range rules {
+		if rule.Action == appconfig.RuleInject && rule.MatchesHost(host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,314 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+)
+
+// sessionsDirName is the name of the directory in the config directory that
+// has a file describing each running privileged session.
+const sessionsDirName = "sessions"
+
+// stopGracePeriod is how much longer than authproxy.shutdowntimeout a
+// session can take to stop before it is cleaned up as crashed.
+const stopGracePeriod = time.Minute
+
+// SessionEnvVar is set to the PID of the session in its privileged sub-shell,
+// so that commands run there use that session.
+const SessionEnvVar = "EIAM_SESSION"
+
+var (
+	// ErrNoSession is returned when no privileged session is running.
+	ErrNoSession = errors.New("no privileged session is running, start one with 'eiam assume-privileges'")
+
+	// ErrMultipleSessions is returned when a session has to be chosen from
+	// several running sessions.
+	ErrMultipleSessions = errors.New("more than one privileged session is running, choose one with --session")
+)
+
+// Session describes a running privileged session so that other processes can
+// use its auth proxy.
+type Session struct {
+	PID            int       `json:"pid"`
+	Address        string    `json:"address,omitempty"`
+	SocketPath     string    `json:"socketPath,omitempty"`
+	CertFile       string    `json:"certFile"`
+	ServiceAccount string    `json:"serviceAccount"`
+	Subject        string    `json:"subject,omitempty"`
+	Delegates      []string  `json:"delegates,omitempty"`
+	Project        string    `json:"project,omitempty"`
+	Reason         string    `json:"reason"`
+	Started        time.Time `json:"started"`
+	Expires        time.Time `json:"expires"`
+	// RoleBinding is the temporary role binding that the session added, so
+	// that it can be removed if the session ends without removing it.
+	RoleBinding *gcpclient.RoleBinding `json:"roleBinding,omitempty"`
+	// Stopping is when the session started to stop. Its auth proxy no longer
+	// accepts connections, but it is still finishing the requests in flight.
+	Stopping *time.Time `json:"stopping,omitempty"`
+	// Suspended is set when the session stops because it was suspended. Its
+	// role binding is kept until the session is resumed.
+	Suspended bool `json:"suspended,omitempty"`
+}
+
+func sessionsDir() string {
+	return filepath.Join(appconfig.GetConfigDir(), sessionsDirName)
+}
+
+func sessionFile(pid int) string {
+	return filepath.Join(sessionsDir(), fmt.Sprintf("%d.json", pid))
+}
+
+func writeSession(s *Session) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(sessionsDir(), 0o700); err != nil {
+		return errorsutil.New("Failed to create the sessions directory", err)
+	}
+	if err := ioutil.WriteFile(sessionFile(s.PID), data, 0o600); err != nil {
+		return errorsutil.New("Failed to write the session file", err)
+	}
+	return nil
+}
+
+func removeSession() {
+	if err := os.Remove(sessionFile(os.Getpid())); err != nil && !os.IsNotExist(err) {
+		errorsutil.CheckError(errorsutil.New("Failed to remove the session file", err))
+	}
+}
+
+// Sessions returns the running privileged sessions in the order that they were
+// started. Session files left behind by sessions that ended without cleaning
+// up are removed.
+func Sessions() ([]*Session, error) {
+	all, err := runningSessions()
+	if err != nil {
+		return nil, err
+	}
+	var sessions []*Session
+	for _, s := range all {
+		if time.Now().Before(s.Expires) {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, nil
+}
+
+// ExpiredSessions returns the sessions whose auth proxy still runs after the
+// session ended, which happens when a session stops responding. They can only
+// be ended with 'eiam sessions kill'.
+func ExpiredSessions() ([]*Session, error) {
+	all, err := runningSessions()
+	if err != nil {
+		return nil, err
+	}
+	var expired []*Session
+	for _, s := range all {
+		if !time.Now().Before(s.Expires) {
+			expired = append(expired, s)
+		}
+	}
+	return expired, nil
+}
+
+// runningSessions returns the sessions whose auth proxy accepts connections,
+// whether or not they expired, and removes the files of the others.
+func runningSessions() ([]*Session, error) {
+	files, err := ioutil.ReadDir(sessionsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errorsutil.New("Failed to read the sessions directory", err)
+	}
+
+	var sessions []*Session
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		filename := filepath.Join(sessionsDir(), f.Name())
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, errorsutil.New("Failed to read the session file", err)
+		}
+		s := &Session{}
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, errorsutil.New(fmt.Sprintf("Failed to parse %s", filename), err)
+		}
+		if !s.running() {
+			// A session that is stopping cleans up after itself.
+			if !s.stopping() {
+				s.cleanUp()
+			}
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Started.Before(sessions[j].Started) })
+	return sessions, nil
+}
+
+// stopping reports whether the session is finishing its requests in flight
+// before it stops. A session that has been stopping for longer than the
+// shutdown timeout allows crashed while it stopped.
+func (s *Session) stopping() bool {
+	return s.Stopping != nil && time.Since(*s.Stopping) < viper.GetDuration(appconfig.AuthProxyShutdownTimeout)+stopGracePeriod
+}
+
+// cleanUp removes the files and role binding of a session that ended without
+// removing them. The role binding of a suspended session is kept for when it
+// is resumed.
+func (s *Session) cleanUp() {
+	if s.RoleBinding != nil && !s.Suspended && time.Now().Before(s.RoleBinding.Expires) {
+		util.Logger.Warnf("The privileged session for %s (PID %d) ended without cleaning up", s.ServiceAccount, s.PID)
+		removeRoleBinding(s.RoleBinding, s.Reason)
+	}
+	os.Remove(sessionFile(s.PID))
+	removeDockerConfig(s.PID)
+	removeGcloudSandbox(s.PID)
+}
+
+// CurrentSession returns the session that commands should use when none is
+// chosen: the session of the privileged sub-shell that they run in, or the
+// only running session.
+func CurrentSession() (*Session, error) {
+	if pid := os.Getenv(SessionEnvVar); pid != "" {
+		return FindSession(pid)
+	}
+	sessions, err := Sessions()
+	if err != nil {
+		return nil, err
+	}
+	switch len(sessions) {
+	case 0:
+		return nil, ErrNoSession
+	case 1:
+		return sessions[0], nil
+	default:
+		return nil, ErrMultipleSessions
+	}
+}
+
+// FindSession returns the running session that id refers to. id is the PID of
+// the session, the port that its auth proxy listens on, or the email of its
+// service account.
+func FindSession(id string) (*Session, error) {
+	sessions, err := Sessions()
+	if err != nil {
+		return nil, err
+	}
+	return matchSession(sessions, id)
+}
+
+func matchSession(sessions []*Session, id string) (*Session, error) {
+	var found *Session
+	for _, s := range sessions {
+		if !s.matches(id) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("more than one privileged session matches %q, choose one by its PID", id)
+		}
+		found = s
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no privileged session matches %q, list them with 'eiam sessions list'", id)
+	}
+	return found, nil
+}
+
+func (s *Session) matches(id string) bool {
+	if id == strconv.Itoa(s.PID) || strings.EqualFold(id, s.ServiceAccount) {
+		return true
+	}
+	_, port, err := net.SplitHostPort(s.Address)
+	return err == nil && id == port
+}
+
+// running reports whether the session's process is alive and its auth proxy
+// accepts connections. The address of a crashed session can be reused by
+// another session or process, so an auth proxy that reports a different PID in
+// its health check isn't the session's.
+func (s *Session) running() bool {
+	if !util.ProcessRunning(s.PID) {
+		return false
+	}
+	network, address := "tcp", s.Address
+	if s.SocketPath != "" {
+		network, address = "unix", s.SocketPath
+	}
+	conn, err := net.DialTimeout(network, address, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	// A proxy that doesn't answer the health check may just be busy, and
+	// sessions started by older versions don't report their PID.
+	if health, err := s.Health(); err == nil && health.PID != 0 && health.PID != s.PID {
+		return false
+	}
+	return true
+}
+
+// Env returns the environment variables, in the form "KEY=value", that point
+// gcloud and other tools at the session's auth proxy.
+func (s *Session) Env() []string {
+	if s.SocketPath != "" {
+		// Most tools can't use a proxy on a Unix socket, so gcloud
+		// impersonates the service account itself instead.
+		return gcloudSessionEnv(s.ServiceAccount, s.Delegates, s.Reason, s.Project)
+	}
+
+	host, port, _ := net.SplitHostPort(s.Address)
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	proxyURL := fmt.Sprintf("http://%s", s.Address)
+	env := []string{
+		"HTTPS_PROXY=" + proxyURL,
+		"HTTP_PROXY=" + proxyURL,
+		"CLOUDSDK_PROXY_TYPE=http",
+		"CLOUDSDK_PROXY_ADDRESS=" + host,
+		"CLOUDSDK_PROXY_PORT=" + port,
+		"CLOUDSDK_CORE_CUSTOM_CA_CERTS_FILE=" + s.CertFile,
+		"REQUESTS_CA_BUNDLE=" + s.CertFile,
+		"CURL_CA_BUNDLE=" + s.CertFile,
+		"NODE_EXTRA_CA_CERTS=" + s.CertFile,
+	}
+	if s.Project != "" {
+		env = append(env, "CLOUDSDK_CORE_PROJECT="+s.Project)
+	}
+	return env
+}
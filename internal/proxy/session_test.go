@@ -0,0 +1,55 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestSessionRunning(t *testing.T) {
+	proxyPID := os.Getpid()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Health{Status: HealthOK, PID: proxyPID}) //nolint:errcheck // Only used by the test
+	}))
+	defer srv.Close()
+	address := srv.Listener.Addr().String()
+
+	exited := exec.Command("go", "version")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		session *Session
+		want    bool
+	}{
+		{name: "live session", session: &Session{PID: proxyPID, Address: address}, want: true},
+		{name: "exited process", session: &Session{PID: exited.Process.Pid, Address: address}, want: false},
+		// The address of a crashed session was reused by another session.
+		{name: "other session", session: &Session{PID: os.Getppid(), Address: address}, want: false},
+		{name: "nothing listening", session: &Session{PID: proxyPID, Address: "127.0.0.1:1"}, want: false},
+	}
+	for _, tt := range tests {
+		if got := tt.session.running(); got != tt.want {
+			t.Errorf("%s: running() = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+)
+
+// proxySettings are the config values that are read while a session is
+// running, e.g. by the request handlers. The config file is reloaded on
+// another goroutine during a session and viper isn't safe for concurrent use,
+// so the values are copied once per reload and never changed afterwards.
+type proxySettings struct {
+	verbose         bool
+	interceptAll    bool
+	bypassDomains   []string
+	cacheTTL        time.Duration
+	clientAuth      bool
+	tlsMinVersion   uint16
+	tlsCipherSuites []uint16
+	notifications   bool
+	shutdownTimeout time.Duration
+	scopes          []string
+}
+
+// currentSettings holds the *proxySettings of the running session.
+var currentSettings atomic.Value
+
+// loadSettings copies the config values in proxySettings from viper. It must
+// be called on the goroutine that reloads the config.
+func loadSettings() {
+	currentSettings.Store(readSettings())
+}
+
+func readSettings() *proxySettings {
+	return &proxySettings{
+		verbose:         viper.GetBool(appconfig.AuthProxyVerbose),
+		interceptAll:    viper.GetBool(appconfig.AuthProxyInterceptAll),
+		bypassDomains:   appconfig.GetStringList(appconfig.AuthProxyBypassDomains),
+		cacheTTL:        viper.GetDuration(appconfig.AuthProxyCacheTTL),
+		clientAuth:      viper.GetBool(appconfig.AuthProxyClientAuth),
+		tlsMinVersion:   appconfig.TLSMinVersion(),
+		tlsCipherSuites: appconfig.TLSCipherSuites(),
+		notifications:   viper.GetBool(appconfig.SessionNotifications),
+		shutdownTimeout: viper.GetDuration(appconfig.AuthProxyShutdownTimeout),
+		scopes:          gcpclient.ScopesOrDefault(nil),
+	}
+}
+
+// settings returns the config values of the running session. Outside of a
+// session, they are read from viper.
+func settings() *proxySettings {
+	if s, ok := currentSettings.Load().(*proxySettings); ok {
+		return s
+	}
+	return readSettings()
+}
+
+// verboseLogger drops goproxy's INFO logs unless authproxy.verbose is set.
+// goproxy reads its Verbose field without synchronization, so the field is
+// always set and the setting is applied here instead, which lets it change
+// during a session.
+type verboseLogger struct {
+	*log.Logger
+}
+
+func (l verboseLogger) Printf(format string, v ...interface{}) {
+	// goproxy prefixes its messages with the session number, e.g.
+	// "[%03d] INFO: ".
+	if strings.HasPrefix(format, "[%03d] INFO: ") && !settings().verbose {
+		return
+	}
+	l.Logger.Printf(format, v...)
+}
@@ -16,19 +16,18 @@ package proxy
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"io/fs"
 	"io/ioutil"
 	"os"
 	"os/exec"
-	"os/signal"
-	"path"
+	"path/filepath"
+	"sync"
 	"syscall"
+	"time"
 
-	"github.com/creack/pty"
 	"github.com/google/uuid"
-	"golang.org/x/term"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 	clientcmdapilatest "k8s.io/client-go/tools/clientcmd/api/latest"
@@ -38,15 +37,46 @@ import (
 	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
 )
 
-func startShell(svcAcct, accessToken, expiry string, defaultCluster map[string]string, oldState **term.State) {
+// sessionWarnBefore is how long before the session ends that a warning is
+// shown in the sub-shell.
+const sessionWarnBefore = 5 * time.Minute
+
+// shellRCDirPrefix is the prefix of the temp directories that have the rc
+// files of the privileged sub-shells.
+const shellRCDirPrefix = "eiam-shell-"
+
+// kubeConfigDirName is the name of the directory in the config directory that
+// has the temp kubeconfigs of the privileged sessions.
+const kubeConfigDirName = "tmp_kube_config"
+
+var (
+	// shellProcess is the process of the privileged sub-shell once it starts.
+	shellProcess *os.Process
+	// commandProcess is the process of the command run with --exec once it
+	// starts.
+	commandProcess *os.Process
+	shellLock      sync.Mutex
+)
+
+// sessionEnv creates the temp kubeconfig and Docker config of the session and
+// returns a function that removes them, and the environment that commands run
+// in the session use: the user's environment variables, KUBECONFIG, the Docker
+// config, and env. The kubeconfig is authenticated as the service account for
+// the default cluster, and both are updated when the access token is
+// refreshed.
+func sessionEnv(svcAcct string, defaultCluster map[string]string, env []string) (func(), []string, error) {
 	tmpKubeConfig, err := createTempKubeConfig()
 	if err != nil {
-		util.Logger.WithError(err).Fatal("failed to create temp kubeconfig")
+		return nil, nil, errorsutil.New("Failed to create temp kubeconfig", err)
+	}
+	cleanup := func() {
+		os.Remove(tmpKubeConfig.Name())
+		removeDockerConfig(os.Getpid())
 	}
-	defer os.Remove(tmpKubeConfig.Name()) // Remove tmpKubeConfig after priv session ends.
 
-	// Copy environment variables from user, set PS1 prompt, and set the KUBECONFIG env var.
-	cmdEnv := append(os.Environ(), buildPrompt(svcAcct), fmt.Sprintf("KUBECONFIG=%s", tmpKubeConfig.Name()))
+	// Copy environment variables from user and set the KUBECONFIG env var.
+	cmdEnv := append(os.Environ(), fmt.Sprintf("KUBECONFIG=%s", tmpKubeConfig.Name()))
+	cmdEnv = append(cmdEnv, env...)
 
 	if len(defaultCluster) > 0 {
 		// Create the kubeconfig entry for the privileged service account.
@@ -65,80 +95,89 @@ func startShell(svcAcct, accessToken, expiry string, defaultCluster map[string]s
 		}
 	}
 
-	if err = writeCredsToKubeConfig(tmpKubeConfig, accessToken, expiry); err != nil {
-		util.Logger.WithError(err).Fatal("failed to write credentials to temp kubeconfig")
+	accessToken, expiry := sessionToken.get()
+	if err = writeCredsToKubeConfig(tmpKubeConfig, accessToken, expiry.Format(time.RFC3339Nano)); err != nil {
+		cleanup()
+		return nil, nil, err
 	}
+	// Keep kubectl working when the access token is refreshed.
+	sessionToken.onRefresh(func(value string, expires time.Time) {
+		if err := writeCredsToKubeConfig(tmpKubeConfig, value, expires.Format(time.RFC3339Nano)); err != nil {
+			util.Logger.WithError(err).Error("Failed to write the refreshed credentials to temp kubeconfig")
+		}
+	})
 
-	// Create the shell command and copy the environment variables from the previous command.
-	shellCmd := exec.Command("bash")
-	shellCmd.Env = cmdEnv
-
-	util.Logger.Warn("Enter `exit` or press CTRL+D to quit privileged session")
-
-	// Start the pty sub-shell.
-	ptmx, err := pty.Start(shellCmd)
+	dockerEnv, err := writeDockerConfig()
 	if err != nil {
-		util.Logger.WithError(err).Fatal("failed to start privileged sub-shell")
+		cleanup()
+		return nil, nil, err
 	}
-	defer func() {
-		if err = ptmx.Close(); err != nil {
-			util.Logger.WithError(err).Fatal("failed to close privileged sub-shell")
-		}
-	}()
-
-	// Resize the pty shell when the user's terminal is resized.
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGWINCH)
-	go func() {
-		for range ch {
-			if err = pty.InheritSize(os.Stdin, ptmx); err != nil {
-				util.Logger.WithError(err).Fatal("failed to resize pty")
-			}
-		}
-	}()
-	ch <- syscall.SIGWINCH
+	return cleanup, append(cmdEnv, dockerEnv...), nil
+}
 
-	// Save the state of the current shell so it can be restored later.
-	if *oldState, err = term.MakeRaw(int(os.Stdin.Fd())); err != nil {
-		util.Logger.WithError(err).Fatal("failed to save state of current shell")
+// runCommand runs command with the system shell in the session instead of starting an
+// interactive sub-shell, and returns its exit status. The command is stopped
+// if the session ends before it finishes.
+func runCommand(command, svcAcct string, defaultCluster map[string]string, env []string, sessionEnd time.Time) (int, error) {
+	cleanup, cmdEnv, err := sessionEnv(svcAcct, defaultCluster, env)
+	if err != nil {
+		return 0, err
 	}
-	defer func() {
-		if err := term.Restore(int(os.Stdin.Fd()), *oldState); err != nil {
-			util.Logger.WithError(err).Fatal("failed to restore original shell")
-		}
-	}()
+	defer cleanup()
 
-	// Send user input to the sub-shell.
-	go func() {
-		if _, err := io.Copy(ptmx, os.Stdin); err != nil {
-			util.Logger.WithError(err).Error("failed to send user input to the sub-shell")
-		}
-	}()
-
-	// Write the output from the sub-shell to stdout.
-	if _, err := io.Copy(os.Stdout, ptmx); err != nil {
-		// On some linux systems, this error is thrown when CTRL-D is received.
-		if serr, ok := err.(*fs.PathError); ok {
-			if serr.Path == "/dev/ptmx" {
-				wg.Done()
-				return
-			}
-		} else {
-			util.Logger.WithError(err).Error("failed to write the output from the sub-shell to stdout")
+	c := util.ShellCommand(command)
+	c.Env = cmdEnv
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+
+	util.Logger.Infof("Running: [%s]", command)
+	if err := c.Start(); err != nil {
+		return 0, errorsutil.New("Failed to start the command", err)
+	}
+	shellLock.Lock()
+	commandProcess = c.Process
+	shellLock.Unlock()
+	watchConfig()
+	timer := time.AfterFunc(time.Until(sessionEnd), func() {
+		util.Logger.Warn("The privileged session ended before the command finished, stopping it")
+		notify("The privileged session ended before the command finished.")
+		util.Terminate(c.Process) //nolint:errcheck // The command may have exited already
+	})
+	defer timer.Stop()
+
+	err = c.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			// Report the signal the way shells do.
+			return 128 + int(status.Signal()), nil
 		}
+		return exitErr.ExitCode(), nil
+	} else if err != nil {
+		return 0, errorsutil.New("Failed to run the command", err)
 	}
-	wg.Done()
+	return 0, nil
 }
 
-func buildPrompt(svcAcct string) string {
-	yellow := "\\[\\e[33m\\]"
-	green := "\\[\\e[36m\\]"
-	endColor := "\\[\\e[m\\]"
-	return fmt.Sprintf("PS1=\n[%s%s%s]\n[%seiam%s] > ", yellow, svcAcct, endColor, green, endColor)
+// warnBeforeSessionEnd shows a warning in the sub-shell sessionWarnBefore
+// before the session ends.
+func warnBeforeSessionEnd(ctx context.Context, sessionEnd time.Time) {
+	wait := time.Until(sessionEnd.Add(-sessionWarnBefore))
+	if wait <= 0 {
+		return
+	}
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(wait):
+	}
+	printNotice("The privileged session ends in %s, at %s.", sessionWarnBefore, sessionEnd.Local().Format(time.Kitchen))
+	notify("The privileged session ends in %s, at %s.", sessionWarnBefore, sessionEnd.Local().Format(time.Kitchen))
 }
 
 func createTempKubeConfig() (*os.File, error) {
-	kubeConfigDir := path.Join(appconfig.GetConfigDir(), "tmp_kube_config")
+	kubeConfigDir := filepath.Join(appconfig.GetConfigDir(), kubeConfigDirName)
 	tmpFileName := uuid.New().String()
 	tmpKubeConfig, err := os.CreateTemp(kubeConfigDir, tmpFileName)
 	if err != nil {
@@ -170,7 +209,7 @@ func writeCredsToKubeConfig(tmpKubeConfig *os.File, accessToken, expiry string)
 	if err != nil {
 		return errorsutil.New("Failed to serialize updated tmp kubeconfig", err)
 	}
-	if _, err := tmpKubeConfig.Write(newConfigBytes); err != nil {
+	if err := ioutil.WriteFile(tmpKubeConfig.Name(), newConfigBytes, 0o600); err != nil {
 		return errorsutil.New("Failed to write updated tmp kubeconfig", err)
 	}
 	return nil
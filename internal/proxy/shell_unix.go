@@ -0,0 +1,145 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package proxy
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"golang.org/x/term"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+func startShell(svcAcct, project string, sessionEnd time.Time, defaultCluster map[string]string, env []string, oldState **term.State) {
+	t, err := openTranscript(true)
+	if err != nil {
+		util.Logger.WithError(err).Fatal("failed to prepare the privileged sub-shell")
+	}
+	defer t.close()
+
+	shell, err := newSubShell(userShell(), svcAcct, project, sessionEnd, t)
+	if err != nil {
+		util.Logger.WithError(err).Fatal("failed to prepare the privileged sub-shell")
+	}
+	defer shell.remove()
+
+	cleanup, cmdEnv, err := sessionEnv(svcAcct, defaultCluster, env)
+	if err != nil {
+		util.Logger.WithError(err).Fatal("failed to prepare the privileged sub-shell")
+	}
+	defer cleanup() // Remove the temp kubeconfig and Docker config after priv session ends.
+
+	// Copy the environment variables from the previous command, followed by
+	// the ones the shell needs to load its rc files.
+	shellCmd := shell.cmd
+	shellCmd.Env = append(cmdEnv, shellCmd.Env...)
+
+	util.Logger.Warn("Enter `exit` or press CTRL+D to quit privileged session")
+
+	// Start the pty sub-shell.
+	ptmx, err := pty.Start(shellCmd)
+	if err != nil {
+		util.Logger.WithError(err).Fatal("failed to start privileged sub-shell")
+	}
+	shellLock.Lock()
+	shellProcess = shellCmd.Process
+	shellLock.Unlock()
+	watchConfig()
+	defer func() {
+		if err = ptmx.Close(); err != nil {
+			util.Logger.WithError(err).Fatal("failed to close privileged sub-shell")
+		}
+	}()
+
+	// Resize the pty shell when the user's terminal is resized.
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGWINCH)
+	go func() {
+		for range ch {
+			if err = pty.InheritSize(os.Stdin, ptmx); err != nil {
+				util.Logger.WithError(err).Fatal("failed to resize pty")
+			}
+		}
+	}()
+	ch <- syscall.SIGWINCH
+
+	// Save the state of the current shell so it can be restored later.
+	if *oldState, err = term.MakeRaw(int(os.Stdin.Fd())); err != nil {
+		util.Logger.WithError(err).Fatal("failed to save state of current shell")
+	}
+	defer func() {
+		if err := term.Restore(int(os.Stdin.Fd()), *oldState); err != nil {
+			util.Logger.WithError(err).Fatal("failed to restore original shell")
+		}
+	}()
+
+	// Send user input to the sub-shell.
+	go func() {
+		if _, err := io.Copy(ptmx, activityReader{os.Stdin}); err != nil {
+			util.Logger.WithError(err).Error("failed to send user input to the sub-shell")
+		}
+	}()
+
+	// Write the output from the sub-shell to stdout, and to the transcript
+	// when session.transcript is 'full'.
+	var output io.Writer = os.Stdout
+	if t.output != nil {
+		output = io.MultiWriter(os.Stdout, t.output)
+	}
+	if _, err := io.Copy(output, ptmx); err != nil {
+		// On some linux systems, this error is thrown when CTRL-D is received.
+		if serr, ok := err.(*fs.PathError); ok {
+			if serr.Path == "/dev/ptmx" {
+				wg.Done()
+				return
+			}
+		} else {
+			util.Logger.WithError(err).Error("failed to write the output from the sub-shell to stdout")
+		}
+	}
+	wg.Done()
+}
+
+// userShell returns the shell that the sub-shell runs: the user's $SHELL if
+// the sub-shell can decorate it, and bash otherwise.
+func userShell() string {
+	if shellPath := os.Getenv("SHELL"); shellPath != "" {
+		switch shellKind(shellPath) {
+		case bashShell, zshShell, fishShell, powerShellShell:
+			return shellPath
+		}
+		util.Logger.Warnf("The privileged sub-shell doesn't support %s, starting bash instead", shellPath)
+	}
+	return bashShell
+}
+
+// stopShell hangs up the sub-shell, which also stops the jobs running in it,
+// so that the session ends even if the user is idle in the shell.
+func stopShell() {
+	shellLock.Lock()
+	defer shellLock.Unlock()
+	if shellProcess != nil {
+		shellProcess.Signal(syscall.SIGHUP) //nolint:errcheck // The shell may have exited already
+	}
+}
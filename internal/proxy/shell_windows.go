@@ -0,0 +1,110 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package proxy
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/term"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+// The PowerShell executables that the sub-shell prefers over cmd.exe, newest
+// first.
+var powerShells = []string{"pwsh.exe", "powershell.exe"}
+
+// startShell starts the privileged sub-shell in the user's console. Windows
+// consoles have no pty, so the sub-shell shares eiam's standard input and
+// output and oldState is left unset.
+func startShell(svcAcct, project string, sessionEnd time.Time, defaultCluster map[string]string, env []string, oldState **term.State) {
+	// The sub-shell writes to the console itself, so its output can't be
+	// recorded.
+	if viper.GetString(appconfig.SessionTranscript) == appconfig.TranscriptFull {
+		util.Logger.Warn("The output of the privileged sub-shell can't be recorded on Windows, only its commands are")
+	}
+	t, err := openTranscript(false)
+	if err != nil {
+		util.Logger.WithError(err).Fatal("failed to prepare the privileged sub-shell")
+	}
+	defer t.close()
+
+	shell, err := newSubShell(windowsShell(), svcAcct, project, sessionEnd, t)
+	if err != nil {
+		util.Logger.WithError(err).Fatal("failed to prepare the privileged sub-shell")
+	}
+	defer shell.remove()
+
+	cleanup, cmdEnv, err := sessionEnv(svcAcct, defaultCluster, env)
+	if err != nil {
+		util.Logger.WithError(err).Fatal("failed to prepare the privileged sub-shell")
+	}
+	defer cleanup() // Remove the temp kubeconfig and Docker config after priv session ends.
+
+	shellCmd := shell.cmd
+	shellCmd.Env = append(cmdEnv, shellCmd.Env...)
+	shellCmd.Stdin = os.Stdin
+	shellCmd.Stdout = os.Stdout
+	shellCmd.Stderr = os.Stderr
+
+	util.Logger.Warn("Enter `exit` to quit privileged session")
+
+	// CTRL+C is sent to every process in the console, so it is left to the
+	// sub-shell instead of ending the session.
+	signal.Ignore(os.Interrupt)
+
+	if err := shellCmd.Start(); err != nil {
+		util.Logger.WithError(err).Fatal("failed to start privileged sub-shell")
+	}
+	shellLock.Lock()
+	shellProcess = shellCmd.Process
+	shellLock.Unlock()
+	watchConfig()
+
+	shellCmd.Wait() //nolint:errcheck // The exit status of the shell doesn't matter
+	wg.Done()
+}
+
+// windowsShell returns the shell that the sub-shell runs: PowerShell, or
+// cmd.exe if PowerShell isn't installed.
+func windowsShell() string {
+	for _, name := range powerShells {
+		if shellPath, err := exec.LookPath(name); err == nil {
+			return shellPath
+		}
+	}
+	if comspec := os.Getenv("COMSPEC"); comspec != "" {
+		return comspec
+	}
+	return "cmd.exe"
+}
+
+// stopShell stops the sub-shell so that the session ends even if the user is
+// idle in the shell. Windows processes can't be hung up, so it is killed.
+func stopShell() {
+	shellLock.Lock()
+	defer shellLock.Unlock()
+	if shellProcess != nil {
+		shellProcess.Kill() //nolint:errcheck // The shell may have exited already
+	}
+}
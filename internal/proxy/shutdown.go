@@ -0,0 +1,166 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/elazarl/goproxy"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+var errShuttingDown = errors.New("the auth proxy is shutting down")
+
+// requests tracks the intercepted requests that are being forwarded.
+var requests = &inFlightRequests{}
+
+// inFlightRequests counts the requests that haven't finished yet. Intercepted
+// connections are hijacked from the HTTP server, so http.Server.Shutdown
+// doesn't wait for the requests sent over them.
+type inFlightRequests struct {
+	mu       sync.Mutex
+	count    int
+	draining bool
+	idle     chan struct{}
+}
+
+// start counts a new request. It returns false once the proxy is shutting
+// down.
+func (r *inFlightRequests) start() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.draining {
+		return false
+	}
+	r.count++
+	return true
+}
+
+// done marks a request as finished.
+func (r *inFlightRequests) done() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.count--
+	if r.count == 0 && r.idle != nil {
+		close(r.idle)
+		r.idle = nil
+	}
+}
+
+// state returns the number of requests in flight and whether the proxy is
+// shutting down.
+func (r *inFlightRequests) state() (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.count, r.draining
+}
+
+// drain stops new requests from starting and waits for the ones in flight to
+// finish. It returns the number of requests that were still in flight when
+// the context was done.
+func (r *inFlightRequests) drain(ctx context.Context) int {
+	r.mu.Lock()
+	r.draining = true
+	if r.count == 0 {
+		r.mu.Unlock()
+		return 0
+	}
+	idle := make(chan struct{})
+	r.idle = idle
+	r.mu.Unlock()
+
+	select {
+	case <-idle:
+		return 0
+	case <-ctx.Done():
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.count
+	}
+}
+
+// trackRoundTrip counts the requests sent with tr until their response bodies
+// are closed.
+func trackRoundTrip(tr http.RoundTripper) goproxy.RoundTripper {
+	return goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		if !requests.start() {
+			return nil, errShuttingDown
+		}
+		markActive()
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			requests.done()
+			return nil, err
+		}
+		resp.Body = &trackedBody{ReadCloser: resp.Body}
+		return resp, nil
+	})
+}
+
+// trackedBody marks its request as finished when it is read to the end or
+// closed. Intercepted connections only close response bodies when the client
+// disconnects.
+type trackedBody struct {
+	io.ReadCloser
+	once sync.Once
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.once.Do(requests.done)
+	}
+	return n, err
+}
+
+func (b *trackedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(requests.done)
+	return err
+}
+
+// stopProxy stops accepting connections, waits up to authproxy.shutdowntimeout
+// for the requests in flight to finish, and then restores the gcloud config and
+// removes the session file.
+func stopProxy(srv *http.Server) {
+	timeout := settings().shutdownTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	util.Logger.Info("Stopping auth proxy and waiting for requests in flight to finish")
+	if err := srv.Shutdown(ctx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		util.Logger.WithError(err).Error("failed to properly shut down proxy server")
+	}
+	if remaining := requests.drain(ctx); remaining > 0 {
+		util.Logger.Warnf("%d requests were still in flight after %s and will be canceled", remaining, timeout)
+	}
+	srv.Close()
+	if open := upgradedConns.closeAll(); open > 0 {
+		util.Logger.Infof("Closed %d WebSocket and streaming connections", open)
+	}
+	audit.close()
+	if err := capture.write(); err != nil {
+		util.Logger.WithError(err).Error("Failed to save the captured traffic")
+	}
+
+	removeGcloudSandbox(os.Getpid())
+	removeSession()
+}
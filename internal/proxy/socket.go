@@ -0,0 +1,79 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+)
+
+// SocketPath returns the path of the Unix socket that the auth proxy listens
+// on, or an empty string if it listens on a TCP port.
+func SocketPath() string {
+	return viper.GetString(appconfig.AuthProxySocketPath)
+}
+
+// listen creates the listener for the auth proxy. A socket left behind by a
+// previous session is replaced, but one that is still in use isn't.
+func listen(address string) (net.Listener, error) {
+	socketPath := SocketPath()
+	if socketPath == "" {
+		return listenTCP(address)
+	}
+
+	if info, err := os.Lstat(socketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s already exists and is not a socket", socketPath)
+		}
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is already in use", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := listenUnix(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	// Only the current user can connect to the socket.
+	if err := os.Chmod(socketPath, 0o600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// gcloudSessionEnv returns the environment variables that make gcloud
+// impersonate the service account itself. gcloud can only use proxies that
+// listen on a TCP port, so it isn't pointed at a proxy on a Unix socket.
+func gcloudSessionEnv(svcAcct string, delegates []string, reason, project string) []string {
+	env := []string{
+		fmt.Sprintf("CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT=%s", gcpclient.ImpersonationChain(svcAcct, delegates)),
+		fmt.Sprintf("CLOUDSDK_CORE_REQUEST_REASON=%s", reason),
+	}
+	if project != "" {
+		env = append(env, fmt.Sprintf("CLOUDSDK_CORE_PROJECT=%s", project))
+	}
+	return env
+}
@@ -0,0 +1,32 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenUnix listens on a Unix socket that only the current user can connect
+// to. The umask is set while the socket is created, since it can be connected
+// to as soon as it exists.
+func listenUnix(socketPath string) (net.Listener, error) {
+	oldMask := syscall.Umask(0o077)
+	defer syscall.Umask(oldMask)
+	return net.Listen("unix", socketPath)
+}
@@ -0,0 +1,425 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// The kinds of shell that the privileged sub-shell can decorate.
+const (
+	bashShell       = "bash"
+	zshShell        = "zsh"
+	fishShell       = "fish"
+	powerShellShell = "powershell"
+	cmdShell        = "cmd"
+)
+
+// subShell is the command that starts the privileged sub-shell, and the
+// directory of the rc files written for it.
+type subShell struct {
+	cmd   *exec.Cmd
+	rcDir string
+}
+
+// shellKind returns the kind of the shell at shellPath, or "" if the
+// sub-shell doesn't know how to decorate it.
+func shellKind(shellPath string) string {
+	name := strings.TrimSuffix(strings.ToLower(filepath.Base(shellPath)), ".exe")
+	switch name {
+	case bashShell, zshShell, fishShell, cmdShell:
+		return name
+	case "pwsh", powerShellShell:
+		return powerShellShell
+	}
+	return ""
+}
+
+// sessionExpiryEnvVar is set to the Unix time that the session ends in the
+// sub-shell, so that prompts can count down to it.
+const sessionExpiryEnvVar = "EIAM_SESSION_EXPIRY"
+
+// The countdown to the end of the session in the syntax of each shell. They
+// round down to whole minutes, like formatRemaining.
+const (
+	bashCountdown       = `$(( (` + sessionExpiryEnvVar + ` - ${EPOCHSECONDS:-$(date +%s)}) / 60 ))m`
+	zshCountdown        = `$(( (` + sessionExpiryEnvVar + ` - EPOCHSECONDS) / 60 ))m`
+	fishCountdown       = `printf '%sm' (math -s0 "($` + sessionExpiryEnvVar + ` - "(date +%s)") / 60")`
+	powerShellCountdown = `([string][math]::Floor(([DateTimeOffset]::FromUnixTimeSeconds([long]$env:` +
+		sessionExpiryEnvVar + `) - [DateTimeOffset]::UtcNow).TotalMinutes) + 'm')`
+)
+
+// exitBanner is shown when the user leaves the sub-shell.
+func exitBanner(svcAcct string) string {
+	return fmt.Sprintf("Ending privileged session as %s", svcAcct)
+}
+
+// formatRemaining formats the time left in the session in whole minutes.
+func formatRemaining(d time.Duration) string {
+	return fmt.Sprintf("%dm", int(d.Minutes()))
+}
+
+// newSubShell returns the command that starts shellPath as the privileged
+// sub-shell. The user's own rc files are still loaded, and then the prompt is
+// set from session.prompttemplate, the banner from session.bannertemplate is
+// shown, and a trap shows when the session ends, all in the syntax of the
+// shell. Each command is appended to the command log of the transcript when it
+// has one. The rc files are written to a temp directory that remove deletes.
+func newSubShell(shellPath, svcAcct, project string, sessionEnd time.Time, t *transcript) (*subShell, error) {
+	data := appconfig.PromptData{
+		ServiceAccount: svcAcct,
+		Project:        project,
+		Expiry:         sessionEnd.Local().Format(time.Kitchen),
+		Remaining:      appconfig.PromptCountdown,
+	}
+	prompt, err := appconfig.RenderPrompt(appconfig.SessionPromptTemplate, data)
+	if err != nil {
+		return nil, err
+	}
+	data.Remaining = formatRemaining(time.Until(sessionEnd))
+	bannerParts, err := appconfig.RenderPrompt(appconfig.SessionBannerTemplate, data)
+	if err != nil {
+		return nil, err
+	}
+	banner, exit := ansiPrompt(bannerParts), exitBanner(svcAcct)
+	if notice := t.notice(); notice != "" {
+		banner = strings.TrimPrefix(banner+"\n"+notice, "\n")
+	}
+	record := t.commandLog != ""
+
+	s := &subShell{}
+	switch shellKind(shellPath) {
+	case bashShell:
+		if s.rcDir, err = ioutil.TempDir("", shellRCDirPrefix); err != nil {
+			return nil, errorsutil.New("Failed to create the sub-shell rc directory", err)
+		}
+		rcFile := filepath.Join(s.rcDir, "bashrc")
+		rc := []string{`[ -f ~/.bashrc ] && . ~/.bashrc`}
+		rc = append(rc, bashPrompt(prompt)...)
+		if record {
+			rc = append(rc, bashRecordCommands...)
+		}
+		if banner != "" {
+			rc = append(rc, fmt.Sprintf(`printf '%%s\n' %s`, shQuote(banner)))
+		}
+		rc = append(rc, fmt.Sprintf(`__eiam_exit() { printf '%%s\n' %s; }`, shQuote(exit)), `trap __eiam_exit EXIT`)
+		if err := ioutil.WriteFile(rcFile, []byte(strings.Join(rc, "\n")+"\n"), 0o600); err != nil {
+			s.remove()
+			return nil, errorsutil.New("Failed to write the sub-shell rc file", err)
+		}
+		s.cmd = exec.Command(shellPath, "--rcfile", rcFile) //nolint:gosec // The user's own shell
+	case zshShell:
+		if s.rcDir, err = ioutil.TempDir("", shellRCDirPrefix); err != nil {
+			return nil, errorsutil.New("Failed to create the sub-shell rc directory", err)
+		}
+		if err := writeZshRCFiles(s.rcDir, prompt, banner, exit, record); err != nil {
+			s.remove()
+			return nil, err
+		}
+		s.cmd = exec.Command(shellPath) //nolint:gosec // The user's own shell
+		// zsh reads its rc files from ZDOTDIR, which the rc files restore.
+		s.cmd.Env = []string{fmt.Sprintf("ZDOTDIR=%s", s.rcDir)}
+	case fishShell:
+		init := []string{
+			fmt.Sprintf(`function fish_prompt; %s; end`, fishPrompt(prompt)),
+			fmt.Sprintf(`function __eiam_exit --on-event fish_exit; echo %s; end`, fishQuote(exit)),
+		}
+		if record {
+			init = append(init, fishRecordCommands)
+		}
+		if banner != "" {
+			init = append(init, fmt.Sprintf(`echo %s`, fishQuote(banner)))
+		}
+		// The init command runs after the user's config.fish.
+		s.cmd = exec.Command(shellPath, "--init-command", strings.Join(init, "\n")) //nolint:gosec // The user's own shell
+	case powerShellShell:
+		init := []string{
+			fmt.Sprintf("function global:prompt { -join @(%s) }", powerShellPrompt(prompt)),
+			fmt.Sprintf("Register-EngineEvent -SourceIdentifier PowerShell.Exiting -Action { Write-Host %s } | Out-Null", psQuote(exit)),
+		}
+		if record {
+			init = append(init, powerShellRecordCommands)
+		}
+		if banner != "" {
+			init = append(init, fmt.Sprintf("Write-Host %s", psQuote(banner)))
+		}
+		// The command runs after the user's profile. It is encoded so that
+		// Windows doesn't have to quote it on the command line.
+		s.cmd = exec.Command( //nolint:gosec // The user's own shell
+			shellPath, "-NoLogo", "-NoExit", "-EncodedCommand", encodePowerShell(strings.Join(init, "\n")),
+		)
+	case cmdShell:
+		// cmd.exe has no rc files or traps, and can't count down in its
+		// prompt, so it shows the time that the session ends instead.
+		if record {
+			return nil, fmt.Errorf("commands run in %s can't be recorded, set %s to '%s' or use PowerShell", shellPath, appconfig.SessionTranscript, appconfig.TranscriptNone)
+		}
+		if banner != "" {
+			fmt.Println(banner)
+		}
+		s.cmd = exec.Command(shellPath) //nolint:gosec // The user's own shell
+		s.cmd.Env = []string{fmt.Sprintf("PROMPT=%s", cmdPrompt(prompt, data.Expiry))}
+	default:
+		return nil, fmt.Errorf("the privileged sub-shell doesn't support %s", shellPath)
+	}
+	s.cmd.Env = append(s.cmd.Env, fmt.Sprintf("%s=%d", sessionExpiryEnvVar, sessionEnd.Unix()))
+	if record {
+		s.cmd.Env = append(s.cmd.Env, fmt.Sprintf("%s=%s", commandLogEnvVar, t.commandLog))
+	}
+	return s, nil
+}
+
+// writeZshRCFiles writes the .zshenv and .zshrc that zsh reads from ZDOTDIR.
+// They source the user's own rc files and then restore ZDOTDIR, so that
+// nested shells and tools that read it see the user's value.
+func writeZshRCFiles(dir string, prompt []appconfig.PromptPart, banner, exit string, record bool) error {
+	userDir, restore := "$HOME", "unset ZDOTDIR"
+	if zdotdir := os.Getenv("ZDOTDIR"); zdotdir != "" {
+		userDir, restore = shQuote(zdotdir), fmt.Sprintf("ZDOTDIR=%s", shQuote(zdotdir))
+	}
+	zshrc := []string{
+		fmt.Sprintf(`[[ -f %[1]s/.zshrc ]] && source %[1]s/.zshrc`, userDir),
+		restore,
+	}
+	zshrc = append(zshrc, zshPrompt(prompt)...)
+	if banner != "" {
+		zshrc = append(zshrc, fmt.Sprintf(`print -r -- %s`, shQuote(banner)))
+	}
+	zshrc = append(zshrc,
+		`autoload -Uz add-zsh-hook`,
+		fmt.Sprintf(`__eiam_exit() { print -r -- %s; }`, shQuote(exit)),
+		`add-zsh-hook zshexit __eiam_exit`,
+	)
+	if record {
+		zshrc = append(zshrc, zshRecordCommands...)
+	}
+	files := map[string]string{
+		".zshenv": fmt.Sprintf(`[[ -f %[1]s/.zshenv ]] && source %[1]s/.zshenv`, userDir),
+		".zshrc":  strings.Join(zshrc, "\n"),
+	}
+	for name, rc := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(rc+"\n"), 0o600); err != nil {
+			return errorsutil.New("Failed to write the sub-shell rc file", err)
+		}
+	}
+	return nil
+}
+
+// The commands that append each command run in the sub-shell to the file in
+// $EIAM_COMMAND_LOG, with the UTC time that it started, in the syntax of each
+// shell.
+var (
+	// bash has no hook that runs before a command line, so a DEBUG trap
+	// records the first command after each prompt. The whole line is taken
+	// from the history, or just the command if the line wasn't added to it,
+	// e.g. because of HISTCONTROL. A DEBUG trap that the user's bashrc set is
+	// kept and runs after it, with the same exit status in $?.
+	bashRecordCommands = []string{
+		`__eiam_history() {`,
+		`	local line; line=$(HISTTIMEFORMAT= builtin history 1); line=${line#"${line%%[! ]*}"}`,
+		`	__eiam_histnum=${line%%[!0-9]*}; line=${line#"$__eiam_histnum"}; __eiam_histline=${line#"${line%%[! ]*}"}`,
+		`}`,
+		`__eiam_history`,
+		`__eiam_record() {`,
+		`	[ -n "$__eiam_ready" ] || return "$1"`,
+		`	__eiam_ready=`,
+		`	local last=$__eiam_histnum line=$BASH_COMMAND`,
+		`	__eiam_history`,
+		`	[ -n "$__eiam_histnum" ] && [ "$__eiam_histnum" != "$last" ] && line=$__eiam_histline`,
+		`	printf '%s %s\n' "$(date -u +%Y-%m-%dT%H:%M:%SZ)" "$line" >> "$` + commandLogEnvVar + `"`,
+		`	return "$1"`,
+		`}`,
+		// trap -p only lists the DEBUG trap outside of functions.
+		`__eiam_trap() { eval "set -- $1"; trap "__eiam_record \"\$?\"${3:+; $3}" DEBUG; }`,
+		`__eiam_trap "$(trap -p DEBUG)"; unset -f __eiam_trap`,
+		`PROMPT_COMMAND="${PROMPT_COMMAND:+$PROMPT_COMMAND;}__eiam_ready=1"`,
+	}
+	zshRecordCommands = []string{
+		`__eiam_record() { print -r -- "$(date -u +%Y-%m-%dT%H:%M:%SZ) $1" >> "$` + commandLogEnvVar + `"; }`,
+		`add-zsh-hook preexec __eiam_record`,
+	}
+	fishRecordCommands = `function __eiam_record --on-event fish_preexec; ` +
+		`echo (date -u +%Y-%m-%dT%H:%M:%SZ) $argv >> $` + commandLogEnvVar + `; end`
+	// PowerShell records the commands that PSReadLine adds to the history.
+	powerShellRecordCommands = `if (Get-Module PSReadLine) { Set-PSReadLineOption -AddToHistoryHandler { param($line) ` +
+		`Add-Content -LiteralPath $env:` + commandLogEnvVar + ` -Value ('{0} {1}' -f ` +
+		`[DateTime]::UtcNow.ToString('yyyy-MM-ddTHH:mm:ssZ'), $line); $true } }`
+)
+
+// bashPrompt returns the bash commands that set PS1 to prompt. The text of
+// the prompt is kept in variables, as their values aren't decoded or expanded
+// again when the prompt is shown.
+func bashPrompt(prompt []appconfig.PromptPart) []string {
+	var ps1 strings.Builder
+	cmds := []string{}
+	for i, part := range prompt {
+		if part.Color != "" {
+			fmt.Fprintf(&ps1, `\[\e[%dm\]`, appconfig.PromptColors[part.Color])
+		}
+		if part.Countdown {
+			ps1.WriteString(bashCountdown)
+		} else {
+			cmds = append(cmds, fmt.Sprintf("__eiam_prompt_%d=%s", i, shQuote(part.Text)))
+			fmt.Fprintf(&ps1, "${__eiam_prompt_%d}", i)
+		}
+		if part.Color != "" {
+			ps1.WriteString(`\[\e[0m\]`)
+		}
+	}
+	return append(cmds, fmt.Sprintf("PS1=%s", shQuote(ps1.String())))
+}
+
+// zshPrompt returns the zsh commands that set PROMPT to prompt, the same way
+// as bashPrompt. zsh expands prompt escapes in the values of the variables,
+// so "%" is escaped in them.
+func zshPrompt(prompt []appconfig.PromptPart) []string {
+	var ps1 strings.Builder
+	cmds := []string{`setopt PROMPT_SUBST`, `zmodload zsh/datetime`}
+	for i, part := range prompt {
+		if part.Color != "" {
+			fmt.Fprintf(&ps1, `%%F{%s}`, part.Color)
+		}
+		if part.Countdown {
+			ps1.WriteString(zshCountdown)
+		} else {
+			cmds = append(cmds, fmt.Sprintf("__eiam_prompt_%d=%s", i, shQuote(strings.ReplaceAll(part.Text, "%", "%%"))))
+			fmt.Fprintf(&ps1, "${__eiam_prompt_%d}", i)
+		}
+		if part.Color != "" {
+			ps1.WriteString(`%f`)
+		}
+	}
+	return append(cmds, fmt.Sprintf("PROMPT=%s", shQuote(ps1.String())))
+}
+
+// fishPrompt returns the body of the fish_prompt function that prints prompt.
+func fishPrompt(prompt []appconfig.PromptPart) string {
+	cmds := []string{}
+	for _, part := range prompt {
+		if part.Color != "" {
+			cmds = append(cmds, "set_color "+part.Color)
+		}
+		if part.Countdown {
+			cmds = append(cmds, fishCountdown)
+		} else {
+			cmds = append(cmds, fmt.Sprintf(`printf '%%s' %s`, fishQuote(part.Text)))
+		}
+		if part.Color != "" {
+			cmds = append(cmds, "set_color normal")
+		}
+	}
+	if len(cmds) == 0 {
+		return "true"
+	}
+	return strings.Join(cmds, "; ")
+}
+
+// powerShellPrompt returns the list of strings that the PowerShell prompt
+// function joins.
+func powerShellPrompt(prompt []appconfig.PromptPart) string {
+	items := []string{}
+	for _, part := range prompt {
+		if part.Color != "" {
+			items = append(items, fmt.Sprintf(`"$([char]27)[%dm"`, appconfig.PromptColors[part.Color]))
+		}
+		if part.Countdown {
+			items = append(items, powerShellCountdown)
+		} else {
+			items = append(items, psQuote(part.Text))
+		}
+		if part.Color != "" {
+			items = append(items, `"$([char]27)[0m"`)
+		}
+	}
+	return strings.Join(items, ", ")
+}
+
+// cmdPrompt returns the value of PROMPT for cmd.exe, with the time that the
+// session ends in place of the countdown.
+func cmdPrompt(prompt []appconfig.PromptPart, expiry string) string {
+	escape := strings.NewReplacer("$", "$$", "\n", "$_")
+	var b strings.Builder
+	for _, part := range prompt {
+		if part.Color != "" {
+			fmt.Fprintf(&b, "$E[%dm", appconfig.PromptColors[part.Color])
+		}
+		if part.Countdown {
+			b.WriteString(escape.Replace(expiry))
+		} else {
+			b.WriteString(escape.Replace(part.Text))
+		}
+		if part.Color != "" {
+			b.WriteString("$E[0m")
+		}
+	}
+	return b.String()
+}
+
+// ansiPrompt returns a rendered template with ANSI colors, for text that is
+// printed once, like the banner.
+func ansiPrompt(parts []appconfig.PromptPart) string {
+	var b strings.Builder
+	for _, part := range parts {
+		if part.Color != "" {
+			fmt.Fprintf(&b, "\x1b[%dm%s\x1b[0m", appconfig.PromptColors[part.Color], part.Text)
+		} else {
+			b.WriteString(part.Text)
+		}
+	}
+	return b.String()
+}
+
+// encodePowerShell encodes a script for powershell -EncodedCommand.
+func encodePowerShell(script string) string {
+	units := utf16.Encode([]rune(script))
+	buf := make([]byte, 2*len(units))
+	for i, u := range units {
+		buf[2*i], buf[2*i+1] = byte(u), byte(u>>8)
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// remove deletes the rc files of the sub-shell.
+func (s *subShell) remove() {
+	if s.rcDir != "" {
+		os.RemoveAll(s.rcDir)
+	}
+}
+
+// shQuote quotes a value for bash and zsh.
+func shQuote(val string) string {
+	return "'" + strings.ReplaceAll(val, "'", `'\''`) + "'"
+}
+
+// fishQuote quotes a value for fish.
+func fishQuote(val string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(val) + "'"
+}
+
+// psQuote quotes a value for PowerShell.
+func psQuote(val string) string {
+	return "'" + strings.ReplaceAll(val, "'", "''") + "'"
+}
@@ -0,0 +1,370 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+const (
+	// suspendPath is the path that the auth proxy is told on to suspend its
+	// session.
+	suspendPath = "/suspend"
+
+	// suspendedDirName is the name of the directory in the sessions directory
+	// that has the snapshots of the suspended sessions.
+	suspendedDirName = "suspended"
+
+	// snapshotKeyPrefix is the prefix of the names that the keys of the
+	// snapshots are stored in the OS keyring under.
+	snapshotKeyPrefix = "session-snapshot."
+)
+
+// sessionSuspended is set when the running session ends because it was
+// suspended.
+var sessionSuspended int32
+
+// SuspendedSession describes a privileged session that was suspended with
+// 'eiam sessions suspend'. Its token and settings are encrypted, so that only
+// the user that suspended it can resume it.
+type SuspendedSession struct {
+	ID             string    `json:"id"`
+	ServiceAccount string    `json:"serviceAccount"`
+	Subject        string    `json:"subject,omitempty"`
+	Project        string    `json:"project,omitempty"`
+	Reason         string    `json:"reason"`
+	Suspended      time.Time `json:"suspended"`
+	Expires        time.Time `json:"expires"`
+	Data           []byte    `json:"data"`
+}
+
+// snapshot is the encrypted part of a suspended session.
+type snapshot struct {
+	Config       *sessionConfig `json:"config"`
+	Token        string         `json:"token"`
+	TokenExpires time.Time      `json:"tokenExpires"`
+	SessionEnd   time.Time      `json:"sessionEnd"`
+}
+
+func suspendedDir() string {
+	return filepath.Join(sessionsDir(), suspendedDirName)
+}
+
+func snapshotFile(id string) string {
+	return filepath.Join(suspendedDir(), id+".json")
+}
+
+func snapshotKeyFile(id string) string {
+	return filepath.Join(suspendedDir(), id+".key")
+}
+
+// suspendHandler snapshots the running session and then ends it, so that it
+// can be resumed later with ResumeSession.
+func suspendHandler(sessionEnd time.Time) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if runningSession == nil || runningSession.ExecCommand != "" {
+			http.Error(w, "Sessions that run a command can't be suspended", http.StatusConflict)
+			return
+		}
+		token, tokenExpires := sessionToken.get()
+		id, err := writeSnapshot(&snapshot{
+			Config:       runningSession,
+			Token:        token,
+			TokenExpires: tokenExpires,
+			SessionEnd:   sessionEnd,
+		})
+		if err != nil {
+			util.Logger.WithError(err).Error("Failed to suspend the privileged session")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, id)
+		atomic.StoreInt32(&sessionSuspended, 1)
+
+		// End the session once the response was sent.
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			printNotice("The privileged session was suspended, resume it with 'eiam sessions resume %s'.", id)
+			stopShell()
+		}()
+	})
+}
+
+// Suspend tells the session's auth proxy to snapshot the session and end it.
+// It returns the ID to resume the session with.
+func (s *Session) Suspend() (string, error) {
+	resp, err := s.client().Post(s.url(suspendPath), "text/plain", nil)
+	if err != nil {
+		return "", errorsutil.New("Failed to reach the auth proxy", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errorsutil.New("Failed to read the auth proxy's response", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errorsutil.New("Failed to suspend the session", fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body))))
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// writeSnapshot encrypts the snapshot with a new key and writes it to the
+// suspended sessions directory. The key is stored in the OS keyring, or next
+// to the snapshot if the keyring can't be used.
+func writeSnapshot(snap *snapshot) (string, error) {
+	idBytes := make([]byte, 4)
+	key := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", errorsutil.New("Failed to generate the snapshot ID", err)
+	}
+	if _, err := rand.Read(key); err != nil {
+		return "", errorsutil.New("Failed to generate the snapshot key", err)
+	}
+	id := hex.EncodeToString(idBytes)
+
+	plaintext, err := json.Marshal(snap)
+	if err != nil {
+		return "", err
+	}
+	data, err := seal(key, plaintext)
+	if err != nil {
+		return "", errorsutil.New("Failed to encrypt the session snapshot", err)
+	}
+	suspended := &SuspendedSession{
+		ID:             id,
+		ServiceAccount: snap.Config.ServiceAccount,
+		Subject:        snap.Config.Subject,
+		Project:        snap.Config.Project,
+		Reason:         snap.Config.Reason,
+		Suspended:      time.Now(),
+		Expires:        snap.SessionEnd,
+		Data:           data,
+	}
+	contents, err := json.MarshalIndent(suspended, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(suspendedDir(), 0o700); err != nil {
+		return "", errorsutil.New("Failed to create the suspended sessions directory", err)
+	}
+
+	if err := appconfig.SetKeyringSecret(snapshotKeyPrefix+id, hex.EncodeToString(key)); err != nil {
+		util.Logger.Warnf("Failed to store the snapshot key in the OS keyring, writing it next to the snapshot instead: %v", err)
+		if err := ioutil.WriteFile(snapshotKeyFile(id), []byte(hex.EncodeToString(key)), 0o600); err != nil {
+			return "", errorsutil.New("Failed to write the snapshot key", err)
+		}
+	}
+	if err := ioutil.WriteFile(snapshotFile(id), contents, 0o600); err != nil {
+		removeSnapshot(id)
+		return "", errorsutil.New("Failed to write the session snapshot", err)
+	}
+	return id, nil
+}
+
+// SuspendedSessions returns the suspended sessions in the order that they
+// were suspended. Snapshots of sessions that have expired are removed, and
+// snapshots that can't be read are skipped.
+func SuspendedSessions() ([]*SuspendedSession, error) {
+	files, err := ioutil.ReadDir(suspendedDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errorsutil.New("Failed to read the suspended sessions directory", err)
+	}
+
+	var suspended []*SuspendedSession
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		s, err := readSnapshot(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			util.Logger.WithError(err).Warnf("Skipping the session snapshot %s", f.Name())
+			continue
+		}
+		if time.Now().After(s.Expires) {
+			removeSnapshot(s.ID)
+			continue
+		}
+		suspended = append(suspended, s)
+	}
+	sort.Slice(suspended, func(i, j int) bool { return suspended[i].Suspended.Before(suspended[j].Suspended) })
+	return suspended, nil
+}
+
+func readSnapshot(id string) (*SuspendedSession, error) {
+	data, err := ioutil.ReadFile(snapshotFile(id))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no suspended session has the ID %q, list them with 'eiam sessions list'", id)
+	} else if err != nil {
+		return nil, errorsutil.New("Failed to read the session snapshot", err)
+	}
+	s := &SuspendedSession{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, errorsutil.New(fmt.Sprintf("Failed to parse %s", snapshotFile(id)), err)
+	}
+	return s, nil
+}
+
+// removeSnapshot deletes a snapshot and its key.
+func removeSnapshot(id string) {
+	os.Remove(snapshotFile(id))
+	os.Remove(snapshotKeyFile(id))
+	if err := appconfig.DeleteKeyringSecret(snapshotKeyPrefix + id); err != nil {
+		util.Logger.Debugf("Failed to remove the snapshot key from the OS keyring: %v", err)
+	}
+}
+
+func snapshotKey(id string) ([]byte, error) {
+	encoded, err := ioutil.ReadFile(snapshotKeyFile(id))
+	if os.IsNotExist(err) {
+		var secret string
+		if secret, err = appconfig.KeyringSecret(snapshotKeyPrefix + id); err != nil {
+			return nil, errorsutil.New("Failed to read the snapshot key from the OS keyring", err)
+		}
+		encoded = []byte(secret)
+	} else if err != nil {
+		return nil, errorsutil.New("Failed to read the snapshot key", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, errorsutil.New("Invalid snapshot key", err)
+	}
+	return key, nil
+}
+
+// ResumeSession restores a suspended session and runs it until it ends, as
+// StartProxyServer does. The snapshot is removed once the session is running,
+// so the session can only be resumed once, but it is kept if the session fails
+// to resume. The access token is only replaced if it is about to expire.
+func ResumeSession(id string) error {
+	suspended, err := readSnapshot(id)
+	if err != nil {
+		return err
+	}
+	key, err := snapshotKey(id)
+	if err != nil {
+		return err
+	}
+	plaintext, err := open(key, suspended.Data)
+	if err != nil {
+		return errorsutil.New("Failed to decrypt the session snapshot", err)
+	}
+
+	snap := &snapshot{}
+	if err := json.Unmarshal(plaintext, snap); err != nil || snap.Config == nil {
+		return errorsutil.New("Failed to parse the session snapshot", err)
+	}
+	if time.Now().After(snap.SessionEnd) {
+		removeSnapshot(id)
+		return fmt.Errorf("the suspended session expired at %s", snap.SessionEnd.Format(time.RFC1123))
+	}
+
+	// The snapshot is moved aside while the session is resumed, so that it
+	// can't be resumed by another eiam process at the same time.
+	resuming := snapshotFile(id) + ".resuming"
+	if err := os.Rename(snapshotFile(id), resuming); err != nil {
+		return errorsutil.New("Failed to resume the session", err)
+	}
+	resumed := false
+	defer func() {
+		if !resumed {
+			if err := os.Rename(resuming, snapshotFile(id)); err != nil {
+				util.Logger.WithError(err).Errorf("Failed to restore the session snapshot, it was left in %s", resuming)
+			}
+		}
+	}()
+
+	cfg := snap.Config
+	cfg.apply()
+	token, tokenExpires := snap.Token, snap.TokenExpires
+	if time.Until(tokenExpires) < refreshBefore(cfg.Lifetime) {
+		util.Logger.Info("Fetching short-lived access token for ", cfg.ServiceAccount)
+		lifetime := cfg.Lifetime
+		remaining := time.Duration(math.Ceil(time.Until(snap.SessionEnd).Seconds())) * time.Second
+		if remaining < lifetime {
+			lifetime = remaining
+		}
+		if token, tokenExpires, err = newSessionToken(cfg.ServiceAccount, cfg.Delegates, cfg.Reason, lifetime); err != nil {
+			return err
+		}
+	}
+
+	if err := ChoosePort(); err != nil {
+		return err
+	}
+	return runSession(cfg, token, tokenExpires, snap.SessionEnd, func() {
+		resumed = true
+		os.Remove(resuming)
+		removeSnapshot(id)
+	})
+}
+
+// seal encrypts plaintext with AES-GCM and prepends the nonce.
+func seal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open decrypts data encrypted with seal.
+func open(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("the snapshot is truncated")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,199 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+)
+
+// tokenRenewBefore is how long before it expires that a scoped token is
+// replaced.
+const tokenRenewBefore = time.Minute
+
+// scoper mints the limited tokens that are sent instead of the session token.
+// It is set when the proxy is created.
+var scoper *tokenScoper
+
+// tokenScoper mints access tokens that are limited to the OAuth scopes in
+// authproxy.tokenscopes and the access boundaries in
+// authproxy.accessboundaries, and caches them until they expire.
+type tokenScoper struct {
+	svcAcct   string
+	delegates []string
+	reason    string
+
+	mu         sync.Mutex
+	scopes     []appconfig.TokenScope
+	boundaries []gcpclient.AccessBoundaryRule
+	tokens     map[string]scopedToken
+	// generation is incremented each time the config is loaded.
+	generation int
+	// minting holds the tokens that are being minted, so that concurrent
+	// requests for the same scopes wait for a single token.
+	minting map[string]*mintCall
+}
+
+type scopedToken struct {
+	value   string
+	expires time.Time
+}
+
+// mintCall is a token that is being minted. done is closed once token and err
+// are set.
+type mintCall struct {
+	done  chan struct{}
+	token scopedToken
+	err   error
+}
+
+func newTokenScoper(svcAcct string, delegates []string, reason string) *tokenScoper {
+	return &tokenScoper{
+		svcAcct:   svcAcct,
+		delegates: delegates,
+		reason:    reason,
+		tokens:    make(map[string]scopedToken),
+		minting:   make(map[string]*mintCall),
+	}
+}
+
+// load reads the token scopes and access boundaries from the config. It is
+// called again when the config file changes, which discards the tokens that
+// were minted with the previous config.
+func (s *tokenScoper) load() error {
+	scopes, err := appconfig.TokenScopes()
+	if err != nil {
+		return errorsutil.New("Failed to load the auth proxy token scopes", err)
+	}
+	boundaries, err := appconfig.AccessBoundaries()
+	if err != nil {
+		return errorsutil.New("Failed to load the auth proxy access boundaries", err)
+	}
+
+	rules := make([]gcpclient.AccessBoundaryRule, 0, len(boundaries))
+	for _, b := range boundaries {
+		rules = append(rules, b.Rule())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scopes = scopes
+	s.boundaries = rules
+	s.tokens = make(map[string]scopedToken)
+	s.minting = make(map[string]*mintCall)
+	s.generation++
+	return nil
+}
+
+// token returns the token to send to host. The session token is returned
+// unchanged when no token scope or access boundary applies to the host, or
+// when the session token is already limited with --access-boundary or
+// --scopes. Tokens generated for a --subject aren't replaced with the service
+// account's own tokens either, and neither are the user's own tokens in
+// sessions started with --role.
+func (s *tokenScoper) token(host, accessToken string) (string, error) {
+	if s == nil || len(sessionBoundary) > 0 || len(sessionScopes) > 0 || sessionSubject != "" || sessionRoleBinding != nil {
+		return accessToken, nil
+	}
+	s.mu.Lock()
+	var scopes []string
+	for _, scope := range s.scopes {
+		if scope.Matches(host) {
+			scopes = scope.Scopes
+			break
+		}
+	}
+	boundaries := s.boundaries
+	bounded := len(boundaries) > 0 && storageHost(host)
+	if scopes == nil && !bounded {
+		s.mu.Unlock()
+		return accessToken, nil
+	}
+
+	key := fmt.Sprintf("%s|%t", strings.Join(scopes, " "), bounded)
+	if t, ok := s.tokens[key]; ok && time.Until(t.expires) > tokenRenewBefore {
+		s.mu.Unlock()
+		return t.value, nil
+	}
+	if call, ok := s.minting[key]; ok {
+		s.mu.Unlock()
+		<-call.done
+		return call.token.value, call.err
+	}
+	// The lock isn't held while the token is minted, so that requests to
+	// other hosts aren't held up by the network calls.
+	call := &mintCall{done: make(chan struct{})}
+	s.minting[key] = call
+	generation := s.generation
+	s.mu.Unlock()
+
+	call.token, call.err = s.mint(host, accessToken, scopes, bounded, boundaries)
+
+	s.mu.Lock()
+	if s.minting[key] == call {
+		delete(s.minting, key)
+	}
+	// The tokens are discarded if the config was reloaded in the meantime.
+	if call.err == nil && generation == s.generation {
+		s.tokens[key] = call.token
+	}
+	s.mu.Unlock()
+	close(call.done)
+	return call.token.value, call.err
+}
+
+// mint generates a token for host that is limited to scopes, and to
+// boundaries if bounded is set.
+func (s *tokenScoper) mint(host, accessToken string, scopes []string, bounded bool, boundaries []gcpclient.AccessBoundaryRule) (scopedToken, error) {
+	_, expires := sessionToken.get()
+	t := scopedToken{value: accessToken, expires: expires}
+	if scopes != nil {
+		lifetime := time.Duration(math.Ceil(time.Until(expires).Seconds())) * time.Second
+		resp, err := gcpclient.GenerateScopedAccessToken(s.svcAcct, s.reason, lifetime, scopes, s.delegates)
+		if err != nil {
+			return scopedToken{}, errorsutil.New(fmt.Sprintf("Failed to generate a scoped access token for %s", host), err)
+		}
+		t = scopedToken{value: resp.GetAccessToken(), expires: resp.GetExpireTime().AsTime()}
+	}
+	if bounded {
+		value, expires, err := gcpclient.DownscopeToken(t.value, boundaries)
+		if err != nil {
+			return scopedToken{}, err
+		}
+		t.value = value
+		if !expires.IsZero() && expires.Before(t.expires) {
+			t.expires = expires
+		}
+	}
+	return t, nil
+}
+
+// storageHost reports whether host serves the Cloud Storage API, which is the
+// only API that supports Credential Access Boundaries.
+func storageHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	return host == "storage.googleapis.com" || strings.HasSuffix(host, ".storage.googleapis.com")
+}
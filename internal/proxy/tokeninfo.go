@@ -0,0 +1,64 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+)
+
+// tokenInfoPath is the path that the auth proxy describes its access token on.
+const tokenInfoPath = "/tokeninfo"
+
+// tokenInfoHandler describes the session's current access token without
+// exposing the token itself.
+func tokenInfoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := sessionToken.get()
+		info, err := gcpclient.DescribeToken(token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info) //nolint:errcheck // The client went away
+	})
+}
+
+// TokenInfo asks the session's auth proxy to describe its access token.
+func (s *Session) TokenInfo() (*gcpclient.TokenInfo, error) {
+	resp, err := s.client().Get(s.url(tokenInfoPath))
+	if err != nil {
+		return nil, errorsutil.New("Failed to reach the auth proxy", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		err := fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+		return nil, errorsutil.New("The auth proxy failed to describe its access token", err)
+	}
+	info := &gcpclient.TokenInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return nil, errorsutil.New("Failed to parse the token info", err)
+	}
+	return info, nil
+}
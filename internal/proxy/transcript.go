@@ -0,0 +1,88 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	localaudit "github.com/rigup/ephemeral-iam/internal/audit"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// commandLogEnvVar is set to the file that the privileged sub-shell appends
+// each command to when session.transcript is set.
+const commandLogEnvVar = "EIAM_COMMAND_LOG"
+
+// The files in the audit directory of a session.
+const (
+	commandLogFileName = "commands.log"
+	outputLogFileName  = "output.log"
+)
+
+// transcript is where the privileged sub-shell is recorded.
+type transcript struct {
+	// commandLog is the file that the sub-shell appends each command to, or
+	// "" if commands aren't recorded.
+	commandLog string
+	// output is the file that the output of the sub-shell is copied to, or
+	// nil if it isn't recorded.
+	output *os.File
+}
+
+// openTranscript creates the audit directory of the session for what
+// session.transcript records in the sub-shell. When fullOutput is false, the
+// output of the sub-shell can't be recorded and only its commands are.
+func openTranscript(fullOutput bool) (*transcript, error) {
+	mode := viper.GetString(appconfig.SessionTranscript)
+	if mode == "" || mode == appconfig.TranscriptNone {
+		return &transcript{}, nil
+	}
+	dir := localaudit.SessionDir(os.Getpid())
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errorsutil.New("Failed to create the audit directory of the session", err)
+	}
+	t := &transcript{commandLog: filepath.Join(dir, commandLogFileName)}
+	if mode == appconfig.TranscriptFull && fullOutput {
+		f, err := os.OpenFile(filepath.Join(dir, outputLogFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, errorsutil.New("Failed to create the transcript of the session", err)
+		}
+		t.output = f
+	}
+	return t, nil
+}
+
+// notice tells the user what is recorded in the sub-shell, or is "" if
+// nothing is.
+func (t *transcript) notice() string {
+	switch {
+	case t.output != nil:
+		return fmt.Sprintf("The commands and output of this session are recorded in %s", filepath.Dir(t.commandLog))
+	case t.commandLog != "":
+		return fmt.Sprintf("The commands run in this session are recorded in %s", filepath.Dir(t.commandLog))
+	}
+	return ""
+}
+
+func (t *transcript) close() {
+	if t.output != nil {
+		t.output.Close()
+	}
+}
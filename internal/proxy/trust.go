@@ -0,0 +1,51 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+var errTrustUnsupported = errors.New(
+	"installing the auth proxy CA is not supported on this system, add it to the system trust store " +
+		"with your distribution's tools, e.g. update-ca-certificates",
+)
+
+// TrustCA adds the auth proxy CA to the trust store of the current user, so
+// that tools which only read the OS trust store can use the auth proxy.
+func TrustCA() error {
+	certFile, _ := proxyCertFiles()
+	if _, err := os.Stat(certFile); err != nil {
+		return errorsutil.New(fmt.Sprintf("Failed to read the auth proxy CA %s", certFile), err)
+	}
+	c, err := trustCACommand(certFile)
+	if err != nil {
+		return err
+	}
+	// The OS may ask the user to confirm the change.
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		return errorsutil.New("Failed to add the auth proxy CA to the trust store", err)
+	}
+	util.Logger.Infof("Added the auth proxy CA %s to the trust store", certFile)
+	return nil
+}
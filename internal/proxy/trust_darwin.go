@@ -0,0 +1,34 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin
+// +build darwin
+
+package proxy
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// The CA is added to the login keychain with the security command.
+func trustCACommand(certFile string) (*exec.Cmd, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	keychain := filepath.Join(home, "Library", "Keychains", "login.keychain-db")
+	return exec.Command("security", "add-trusted-cert", "-r", "trustRoot", "-k", keychain, certFile), nil //nolint:gosec // The path comes from the user's config
+}
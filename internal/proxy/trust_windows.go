@@ -0,0 +1,26 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package proxy
+
+import "os/exec"
+
+// The CA is added to the Trusted Root Certification Authorities store of the
+// current user, which doesn't need an administrator.
+func trustCACommand(certFile string) (*exec.Cmd, error) {
+	return exec.Command("certutil", "-user", "-addstore", "Root", certFile), nil //nolint:gosec // The path comes from the user's config
+}
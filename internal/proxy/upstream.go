@@ -0,0 +1,88 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+	"github.com/spf13/viper"
+	"golang.org/x/net/http2"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// configureUpstreamProxy sends the traffic that leaves the auth proxy through
+// the proxy set in authproxy.upstreamproxy. When it isn't set, the
+// HTTPS_PROXY environment variable is used as before.
+func configureUpstreamProxy(proxy *goproxy.ProxyHttpServer) error {
+	proxy.Tr.TLSClientConfig = applyTLSSettings(proxy.Tr.TLSClientConfig)
+	if rawURL := viper.GetString(appconfig.AuthProxyUpstream); rawURL != "" {
+		upstream, err := url.Parse(rawURL)
+		if err != nil {
+			return errorsutil.New("Failed to parse the upstream proxy URL", err)
+		}
+		if auth := viper.GetString(appconfig.AuthProxyUpstreamAuth); auth != "" {
+			creds := strings.SplitN(auth, ":", 2)
+			upstream.User = url.UserPassword(creds[0], creds[len(creds)-1])
+		}
+
+		proxy.Tr = &http.Transport{
+			TLSClientConfig: proxy.Tr.TLSClientConfig,
+			Proxy:           http.ProxyURL(upstream),
+		}
+		proxy.ConnectDial = proxy.NewConnectDialToProxyWithHandler(upstream.String(), func(req *http.Request) {
+			if upstream.User != nil {
+				req.Header.Set("Proxy-Authorization", "Basic "+basicAuth(upstream.User))
+			}
+		})
+	}
+	http2Transport = newHTTP2Transport(proxy.ConnectDial)
+	return nil
+}
+
+// newHTTP2Transport returns the transport for intercepted HTTP/2 requests.
+// Connections are tunneled through dial when it isn't nil.
+func newHTTP2Transport(dial func(network, addr string) (net.Conn, error)) http.RoundTripper {
+	if dial == nil {
+		return &http2.Transport{TLSClientConfig: applyTLSSettings(nil)}
+	}
+	return &http2.Transport{
+		TLSClientConfig: applyTLSSettings(nil),
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			conn, err := dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Client(conn, cfg)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+	}
+}
+
+func basicAuth(user *url.Userinfo) string {
+	password, _ := user.Password()
+	return base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+}
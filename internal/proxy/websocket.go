@@ -0,0 +1,117 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+
+	"github.com/elazarl/goproxy"
+)
+
+// upgradedConns tracks the open upgraded connections, such as WebSockets and
+// the SPDY streams of kubectl exec and port-forward, so that they can be
+// closed when the proxy stops.
+var upgradedConns = &openConns{cancel: make(map[int]context.CancelFunc)}
+
+type openConns struct {
+	mu     sync.Mutex
+	next   int
+	cancel map[int]context.CancelFunc
+}
+
+func (o *openConns) add(cancel context.CancelFunc) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.next++
+	o.cancel[o.next] = cancel
+	return o.next
+}
+
+func (o *openConns) remove(id int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.cancel, id)
+}
+
+// closeAll closes the open connections and returns how many there were.
+func (o *openConns) closeAll() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	open := len(o.cancel)
+	for id, cancel := range o.cancel {
+		cancel()
+		delete(o.cancel, id)
+	}
+	return open
+}
+
+// isUpgrade reports whether r asks to upgrade the connection to a WebSocket,
+// or to SPDY as kubectl does for exec, attach, and port-forward.
+func isUpgrade(r *http.Request) bool {
+	if !headerHasToken(r.Header, "Connection", "upgrade") {
+		return false
+	}
+	upgrade := strings.ToLower(r.Header.Get("Upgrade"))
+	return headerHasToken(r.Header, "Upgrade", "websocket") || strings.HasPrefix(upgrade, "spdy/")
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, val := range header.Values(name) {
+		for _, t := range strings.Split(val, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveUpgrade forwards an upgrade request with the access token and, once the
+// upstream server accepts it, copies the data in both directions until either
+// side closes the connection. The connection is made with the
+// proxy's transport so that it goes through the upstream proxy if one is set.
+func serveUpgrade(w http.ResponseWriter, r *http.Request, ctx *goproxy.ProxyCtx, reason string) {
+	if err := throttle(r.Context(), r.URL.Host); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	// The upgraded connection is closed when the context is canceled.
+	connCtx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	id := upgradedConns.add(cancel)
+	defer upgradedConns.remove(id)
+
+	reverseProxy := &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			authorizeRequest(out, reason)
+		},
+		Transport: ctx.Proxy.Tr,
+		ModifyResponse: func(resp *http.Response) error {
+			recordResponse(resp.Request, resp.StatusCode)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, out *http.Request, err error) {
+			ctx.Warnf("Cannot upgrade the connection to %s: %v", out.URL.Host, err)
+			recordResponse(out, http.StatusBadGateway)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	reverseProxy.ServeHTTP(w, r.WithContext(connCtx))
+}
@@ -16,12 +16,15 @@ package eiamplugin
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
-	"path"
+	"path/filepath"
 	"text/tabwriter"
+	"time"
 
 	hcplugin "github.com/hashicorp/go-plugin"
 	"github.com/spf13/cobra"
@@ -38,19 +41,59 @@ import (
 type RootCommand struct {
 	Plugins []*plugins.EphemeralIamPlugin
 	cobra.Command
+
+	// expandedAlias is the alias that os.Args was expanded from, and
+	// unexpandedArgs holds os.Args as it was before the expansion.
+	expandedAlias  string
+	unexpandedArgs []string
+}
+
+// pluginInfoFileName is the file in the config directory that caches the
+// name, description, and version of each plugin, so that shell completions can
+// list the plugins without starting them.
+const pluginInfoFileName = "plugins.json"
+
+// pluginInfo is what is cached about a plugin file.
+type pluginInfo struct {
+	ModTime     time.Time `json:"modTime"`
+	Size        int64     `json:"size"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Version     string    `json:"version"`
 }
 
 // LoadPlugins searches for files in the plugin directory and attempts to load them.
+// Shell completions only start the plugins that have changed since they were
+// last loaded, and list the others from the cached plugin info.
 func (rc *RootCommand) LoadPlugins() error {
 	configDir := appconfig.GetConfigDir()
-	pluginsDir := path.Join(configDir, "plugins")
+	pluginsDir := filepath.Join(configDir, "plugins")
 
 	files, err := os.ReadDir(pluginsDir)
 	if err != nil {
 		return errorsutil.New("Failed to read plugins directory", err)
 	}
 
+	infoFile := filepath.Join(configDir, pluginInfoFileName)
+	cached := readPluginInfo(infoFile)
+	loaded := map[string]pluginInfo{}
+	completing := isCompletion()
 	for _, f := range files {
+		fi, err := f.Info()
+		if err != nil {
+			util.Logger.WithError(err).Errorf("Failed to load plugin: %s", f.Name())
+			continue
+		}
+		if info, ok := cached[f.Name()]; ok && completing && info.matches(fi) {
+			rc.AddCommand(&cobra.Command{
+				Use:                info.Name,
+				Short:              fmt.Sprintf("%s %s: %s", info.Name, info.Version, info.Description),
+				DisableFlagParsing: true,
+			})
+			loaded[f.Name()] = info
+			continue
+		}
+
 		pl, plClient, err := loadPlugin(f.Name(), pluginsDir)
 		if err != nil {
 			util.Logger.WithError(err).Errorf("Failed to load plugin: %s", f.Name())
@@ -66,12 +109,66 @@ func (rc *RootCommand) LoadPlugins() error {
 			Description: desc,
 			Version:     version,
 			Client:      plClient,
-			Path:        path.Join(pluginsDir, f.Name()),
+			Path:        filepath.Join(pluginsDir, f.Name()),
 		})
+		loaded[f.Name()] = pluginInfo{ModTime: fi.ModTime(), Size: fi.Size(), Name: name, Description: desc, Version: version}
+	}
+	if pluginInfoChanged(cached, loaded) {
+		writePluginInfo(infoFile, loaded)
 	}
 	return nil
 }
 
+// matches reports whether the info was cached for the plugin file as it is now.
+func (p pluginInfo) matches(fi os.FileInfo) bool {
+	return p.ModTime.Equal(fi.ModTime()) && p.Size == fi.Size()
+}
+
+func pluginInfoChanged(cached, loaded map[string]pluginInfo) bool {
+	if len(cached) != len(loaded) {
+		return true
+	}
+	for file, info := range loaded {
+		old, ok := cached[file]
+		if !ok || !old.ModTime.Equal(info.ModTime) || old.Size != info.Size ||
+			old.Name != info.Name || old.Description != info.Description || old.Version != info.Version {
+			return true
+		}
+	}
+	return false
+}
+
+// isCompletion reports whether eiam was run by a shell to complete a command
+// line.
+func isCompletion() bool {
+	return len(os.Args) > 1 && (os.Args[1] == cobra.ShellCompRequestCmd || os.Args[1] == cobra.ShellCompNoDescRequestCmd)
+}
+
+func readPluginInfo(filename string) map[string]pluginInfo {
+	info := map[string]pluginInfo{}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return info
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		util.Logger.Debugf("Ignoring the cached plugin info in %s: %v", filename, err)
+		return map[string]pluginInfo{}
+	}
+	return info
+}
+
+// writePluginInfo caches the plugin info. The cache is only an optimization,
+// so errors are only logged at debug level.
+func writePluginInfo(filename string, info map[string]pluginInfo) {
+	data, err := json.Marshal(info)
+	if err == nil {
+		err = ioutil.WriteFile(filename, data, 0o600)
+	}
+	if err != nil {
+		util.Logger.Debugf("Failed to cache the plugin info in %s: %v", filename, err)
+	}
+}
+
 func loadPlugin(pf, pluginsDir string) (plugins.EIAMPlugin, *hcplugin.Client, error) {
 	args := []string{}
 	if len(os.Args) >= 2 {
@@ -82,7 +179,7 @@ func loadPlugin(pf, pluginsDir string) (plugins.EIAMPlugin, *hcplugin.Client, er
 		Plugins: map[string]hcplugin.Plugin{
 			"run-command": &eiamplugin.Command{},
 		},
-		Cmd:              exec.Command(path.Join(pluginsDir, pf), args...), //nolint:gosec // Single string with no args
+		Cmd:              exec.Command(filepath.Join(pluginsDir, pf), args...), //nolint:gosec // Single string with no args
 		AllowedProtocols: []hcplugin.Protocol{hcplugin.ProtocolGRPC},
 		SyncStderr:       os.Stderr,
 		SyncStdout:       os.Stdout,
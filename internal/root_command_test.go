@@ -0,0 +1,48 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiamplugin
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+func TestPluginInfoCache(t *testing.T) {
+	util.Logger = util.NewLogger()
+	filename := filepath.Join(t.TempDir(), pluginInfoFileName)
+
+	loaded := map[string]pluginInfo{
+		"eiam-plugin-deploy": {ModTime: time.Now(), Size: 1024, Name: "deploy", Description: "Deploys things", Version: "v1.0.0"},
+	}
+	if !pluginInfoChanged(readPluginInfo(filename), loaded) {
+		t.Error("expected the plugin info to change when nothing was cached")
+	}
+	writePluginInfo(filename, loaded)
+	cached := readPluginInfo(filename)
+	if pluginInfoChanged(cached, loaded) {
+		t.Errorf("expected the cached plugin info %+v to match %+v", cached, loaded)
+	}
+
+	updated := map[string]pluginInfo{"eiam-plugin-deploy": loaded["eiam-plugin-deploy"]}
+	info := updated["eiam-plugin-deploy"]
+	info.Version = "v1.1.0"
+	updated["eiam-plugin-deploy"] = info
+	if !pluginInfoChanged(cached, updated) {
+		t.Error("expected a new plugin version to change the plugin info")
+	}
+}
@@ -17,6 +17,8 @@ package options
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/manifoldco/promptui"
 	"github.com/spf13/pflag"
@@ -26,6 +28,8 @@ import (
 	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
 	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/cache"
+	"github.com/rigup/ephemeral-iam/internal/output"
 )
 
 // Flag annotation strings.
@@ -40,9 +44,44 @@ var (
 
 // Flag names and shorthands.
 var (
+	// AccessBoundaryFlag down-scopes the access token of a privileged session
+	// with a Credential Access Boundary.
+	AccessBoundaryFlag = flagName{"access-boundary", ""}
+
+	// AudienceFlag sets the audience of a generated ID token.
+	AudienceFlag = flagName{"audience", ""}
+
+	// CaptureFlag records the traffic intercepted by the auth proxy.
+	CaptureFlag = flagName{"capture", ""}
+
+	// ClusterFlag sets the GKE cluster that a kubectl command is run against.
+	ClusterFlag = flagName{"cluster", ""}
+
+	// DelegatesFlag sets the delegation chain used to impersonate the service
+	// account.
+	DelegatesFlag = flagName{"delegates", ""}
+
+	// DurationFlag sets how long a privileged session lasts.
+	DurationFlag = flagName{"duration", ""}
+
+	// ExecFlag runs a command in a privileged session instead of a sub-shell.
+	ExecFlag = flagName{"exec", ""}
+
+	// FieldsFlag selects the fields of the results that a command prints.
+	FieldsFlag = flagName{"fields", ""}
+
 	// FormatFlag controls the output format for a command.
 	FormatFlag = flagName{"format", "f"}
 
+	// LifetimeFlag sets how long the generated access token is valid for.
+	LifetimeFlag = flagName{"lifetime", ""}
+
+	// OutputFlag sets the format that a command prints its results in.
+	OutputFlag = flagName{"output", "o"}
+
+	// NoCacheFlag makes a command fetch GCP API results again instead of using the cache.
+	NoCacheFlag = flagName{"no-cache", ""}
+
 	// ProjectFlag sets the GCP project to use for a command.
 	ProjectFlag = flagName{"project", "p"}
 
@@ -52,9 +91,20 @@ var (
 	// RegionFlag sets the GCP region to use for a command.
 	RegionFlag = flagName{"region", "r"}
 
+	// RoleFlag grants a role to the user's own identity for a privileged
+	// session instead of impersonating a service account.
+	RoleFlag = flagName{"role", ""}
+
+	// ScopesFlag sets the OAuth scopes of the generated access tokens.
+	ScopesFlag = flagName{"scopes", ""}
+
 	// ServiceAccountEmailFlag sets the service account to use for a command.
 	ServiceAccountEmailFlag = flagName{"service-account-email", "s"}
 
+	// SubjectFlag sets the Google Workspace user that the service account acts
+	// as through domain-wide delegation.
+	SubjectFlag = flagName{"subject", ""}
+
 	// YesFlag is a boolean that when set to true ignores non-required user prompts.
 	YesFlag = flagName{"yes", "y"}
 
@@ -69,30 +119,95 @@ type flagName struct {
 
 // CmdConfig holds the values passed to a command.
 type CmdConfig struct {
+	AccessBoundary      []string
+	Audience            string
+	Capture             string
+	Cluster             string
 	ComputeInstance     string
+	Delegates           []string
+	Exec                string
+	Folder              string
+	Organization        string
 	Project             string
 	PubSubTopic         string
 	Reason              string
 	Region              string
+	Role                string
+	Scopes              []string
 	ServiceAccountEmail string
+	SessionDuration     time.Duration
 	StorageBucket       string
+	Subject             string
+	TokenLifetime       time.Duration
 	Zone                string
 }
 
 // AddPersistentFlags add persistent flags to the root command.
 func AddPersistentFlags(fs *pflag.FlagSet) {
+	addGlobalFlags(fs)
+	if err := appconfig.BindFlag(appconfig.LoggingFormat, fs.Lookup(FormatFlag.Name)); err != nil {
+		util.Logger.Fatalf("failed to add `--format` flag to root command")
+	}
+}
+
+func addGlobalFlags(fs *pflag.FlagSet) {
 	fs.BoolVarP(&YesOption, YesFlag.Name, YesFlag.Shorthand, YesOption, "Assume 'yes' to all prompts")
 
+	// The config file is loaded before flags are parsed, so this flag is only
+	// registered to be accepted and documented. See appconfig.InitConfig.
+	fs.String(
+		appconfig.ConfigFileFlag,
+		appconfig.ConfigFile(),
+		fmt.Sprintf("The config file to use. Can also be set with the %s environment variable", appconfig.ConfigFileEnv),
+	)
+
+	fs.BoolVar(&cache.Bypass, NoCacheFlag.Name, false, "Fetch service accounts, IAM policies, and permissions again instead of using the cache")
+
+	// Like --config, these flags are read before the command line is parsed.
+	// See appconfig.InitConfig.
+	fs.CountP(appconfig.VerboseFlag, "v", "Log more details for this command, -v at debug level and -vv at trace level")
+	fs.BoolP(appconfig.QuietFlag, "q", false, "Only log errors for this command")
+	fs.Bool(appconfig.NoColorFlag, false, "Don't color logs and tables for this command, like logging.color 'never'")
+
 	currLogFmt := viper.GetString(appconfig.LoggingFormat)
 	fs.StringP(FormatFlag.Name, FormatFlag.Shorthand, currLogFmt, "Set the output of the current command")
-	if err := viper.BindPFlag(appconfig.LoggingFormat, fs.Lookup(FormatFlag.Name)); err != nil {
-		util.Logger.Fatalf("failed to add `--format` flag to root command")
+}
+
+// StripGlobalFlags returns args without the flags that AddPersistentFlags
+// adds and their values, so that the names of the command that runs can be
+// read before the command line is parsed, e.g. in "eiam -v config doctor".
+// Everything after "--" is kept.
+func StripGlobalFlags(args []string) []string {
+	fs := pflag.NewFlagSet("global", pflag.ContinueOnError)
+	addGlobalFlags(fs)
+
+	stripped := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		var flag *pflag.Flag
+		switch {
+		case arg == "--":
+			return append(stripped, args[i:]...)
+		case strings.HasPrefix(arg, "--"):
+			name := strings.SplitN(arg[2:], "=", 2)[0]
+			if flag = fs.Lookup(name); flag != nil && flag.NoOptDefVal == "" && !strings.Contains(arg, "=") {
+				i++
+			}
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			if flag = fs.ShorthandLookup(arg[1:2]); flag != nil && flag.NoOptDefVal == "" && len(arg) == 2 {
+				i++
+			}
+		}
+		if flag == nil {
+			stripped = append(stripped, arg)
+		}
 	}
+	return stripped
 }
 
 // AddProjectFlag adds the --project/-p flag to the command.
 func AddProjectFlag(fs *pflag.FlagSet, project *string, required bool) {
-	defaultVal, err := gcpclient.GetCurrentProject()
+	defaultVal, err := DefaultProject()
 	errorsutil.CheckError(err)
 
 	fs.StringVarP(
@@ -100,7 +215,7 @@ func AddProjectFlag(fs *pflag.FlagSet, project *string, required bool) {
 		ProjectFlag.Name,
 		ProjectFlag.Shorthand,
 		defaultVal,
-		"The GCP project. Inherits from the active gcloud config by default",
+		"The GCP project. Defaults to the configured default project or the active gcloud config",
 	)
 	if defaultVal == "" || required {
 		if err := fs.SetAnnotation(ProjectFlag.Name, RequiredAnnotation, []string{"true"}); err != nil {
@@ -149,19 +264,14 @@ func AddZoneFlag(fs *pflag.FlagSet, zone *string, required bool) {
 
 // AddServiceAccountEmailFlag adds the --service-account-email/-s flag.
 func AddServiceAccountEmailFlag(fs *pflag.FlagSet, serviceAccountEmail *string, required bool) {
-	defaultVal := ""
-	defaultSAs := viper.GetStringMapString(appconfig.DefaultServiceAccounts)
-	activeProject, err := gcpclient.GetCurrentProject()
+	activeProject, err := DefaultProject()
 	errorsutil.CheckError(err)
 
-	if val, ok := defaultSAs[activeProject]; ok {
-		defaultVal = val
-	}
 	fs.StringVarP(
 		serviceAccountEmail,
 		ServiceAccountEmailFlag.Name,
 		ServiceAccountEmailFlag.Shorthand,
-		defaultVal,
+		DefaultServiceAccount(activeProject),
 		"The email address for the service account. Defaults to the configured default account for the current project",
 	)
 	if required {
@@ -187,6 +297,304 @@ func AddReasonFlag(fs *pflag.FlagSet, reason *string, required bool) {
 	}
 }
 
+// AddLifetimeFlag adds the --lifetime flag.
+func AddLifetimeFlag(fs *pflag.FlagSet, lifetime *time.Duration) {
+	fs.DurationVar(
+		lifetime,
+		LifetimeFlag.Name,
+		viper.GetDuration(appconfig.TokenLifetime),
+		"How long the generated access token is valid for. Defaults to the tokenconfig.lifetime config value",
+	)
+}
+
+// AddAudienceFlag adds the --audience flag.
+func AddAudienceFlag(fs *pflag.FlagSet, audience *string) {
+	fs.StringVar(
+		audience,
+		AudienceFlag.Name,
+		"",
+		"The audience of the ID token, such as the URL of a Cloud Run service or the OAuth client ID of an IAP-protected resource",
+	)
+	if err := fs.SetAnnotation(AudienceFlag.Name, RequiredAnnotation, []string{"true"}); err != nil {
+		util.Logger.Fatalf("failed to set required annotation on flag: %v", err)
+	}
+}
+
+// AddAccessBoundaryFlag adds the --access-boundary flag.
+func AddAccessBoundaryFlag(fs *pflag.FlagSet, boundary *[]string) {
+	fs.StringArrayVar(
+		boundary,
+		AccessBoundaryFlag.Name,
+		nil,
+		"Limit the access token with a Credential Access Boundary. Either the path to a JSON file with the "+
+			"boundary's rules, or a rule in the form 'BUCKET ROLE'. Can be repeated",
+	)
+}
+
+// AddDelegatesFlag adds the --delegates flag.
+func AddDelegatesFlag(fs *pflag.FlagSet, delegates *[]string) {
+	fs.StringSliceVar(
+		delegates,
+		DelegatesFlag.Name,
+		nil,
+		"A comma separated delegation chain of service accounts to impersonate the service account through. "+
+			"You must be able to impersonate the first one, and each one must be able to impersonate the next",
+	)
+}
+
+// AddScopesFlag adds the --scopes flag.
+func AddScopesFlag(fs *pflag.FlagSet, scopes *[]string) {
+	fs.StringSliceVar(
+		scopes,
+		ScopesFlag.Name,
+		nil,
+		"A comma separated list of OAuth scopes to limit the access token to instead of the defaults.scopes "+
+			"config value, e.g. 'devstorage.read_only'. Scopes that aren't URLs are relative to https://www.googleapis.com/auth/",
+	)
+}
+
+// AddOutputFlags adds the -o/--output and --fields flags to the commands that
+// print results. They aren't global flags, since the commands that wrap other
+// tools pass -o on to them, e.g. 'eiam kubectl get pods -o json'.
+func AddOutputFlags(fs *pflag.FlagSet) {
+	fs.StringVarP(
+		&output.Format,
+		OutputFlag.Name,
+		OutputFlag.Shorthand,
+		output.FormatTable,
+		fmt.Sprintf("The format to print the results in. One of %v", output.Formats),
+	)
+	fs.StringSliceVar(
+		&output.Fields,
+		FieldsFlag.Name,
+		nil,
+		"A comma separated list of the fields to print, in order. Selects the columns of a table or CSV, or the "+
+			"fields of each result in JSON or YAML",
+	)
+}
+
+// AddSubjectFlag adds the --subject flag.
+func AddSubjectFlag(fs *pflag.FlagSet, subject *string) {
+	fs.StringVar(
+		subject,
+		SubjectFlag.Name,
+		"",
+		"The email of a Google Workspace user to act as through domain-wide delegation. The service account "+
+			"must be allowed to use domain-wide delegation with the requested scopes",
+	)
+}
+
+// AddClusterFlag adds the --cluster flag.
+func AddClusterFlag(fs *pflag.FlagSet, cluster *string) {
+	fs.StringVar(
+		cluster,
+		ClusterFlag.Name,
+		"",
+		"The GKE cluster to run the command against. Its credentials are fetched with the service account's "+
+			"token and written to a temporary kubeconfig instead of using your own kubeconfig",
+	)
+}
+
+// AddRoleFlag adds the --role flag.
+func AddRoleFlag(fs *pflag.FlagSet, role *string) {
+	fs.StringVar(
+		role,
+		RoleFlag.Name,
+		"",
+		"An IAM role, e.g. roles/storage.admin, to grant to your own identity on the project for the session "+
+			"instead of impersonating a service account. The role binding is removed when the session ends",
+	)
+}
+
+// AddDurationFlag adds the --duration flag.
+func AddDurationFlag(fs *pflag.FlagSet, duration *time.Duration) {
+	fs.DurationVar(
+		duration,
+		DurationFlag.Name,
+		viper.GetDuration(appconfig.TokenSessionLength),
+		"How long the privileged session lasts. The access token is refreshed until then. Defaults to the "+
+			"tokenconfig.sessionlength config value, or the lifetime of the access token if that is 0s",
+	)
+}
+
+// AddExecFlag adds the --exec flag.
+func AddExecFlag(fs *pflag.FlagSet, command *string) {
+	fs.StringVar(
+		command,
+		ExecFlag.Name,
+		"",
+		"Run the command with bash in the privileged session instead of starting a sub-shell, and exit with its exit status",
+	)
+}
+
+// AddCaptureFlag adds the --capture flag.
+func AddCaptureFlag(fs *pflag.FlagSet, capture *string) {
+	fs.StringVar(
+		capture,
+		CaptureFlag.Name,
+		"",
+		"Record the traffic intercepted by the auth proxy to a file in the auth proxy log directory. The only supported format is 'har'",
+	)
+}
+
+// CheckOutput ensures that the value of the -o/--output flag is a supported
+// format.
+func CheckOutput() error {
+	if err := output.Check(); err != nil {
+		return errorsutil.New(fmt.Sprintf("Invalid value for the --%s flag", OutputFlag.Name), err)
+	}
+	return nil
+}
+
+// CheckCapture ensures that the value of the --capture flag is a supported
+// format.
+func CheckCapture(capture string) error {
+	if capture != "" && capture != "har" {
+		return errorsutil.New(
+			fmt.Sprintf("Invalid value for the --%s flag", CaptureFlag.Name),
+			fmt.Errorf("the capture format must be 'har', got %q", capture),
+		)
+	}
+	return nil
+}
+
+// CheckLifetime ensures that the value of the --lifetime flag is within the
+// limits that GCP allows for generated access tokens.
+func CheckLifetime(lifetime time.Duration) error {
+	if _, err := appconfig.ParseValue(appconfig.TokenLifetime, lifetime.String()); err != nil {
+		return errorsutil.New(fmt.Sprintf("Invalid value for the --%s flag", LifetimeFlag.Name), err)
+	}
+	return nil
+}
+
+// CheckDuration ensures that the value of the --duration flag is a valid
+// session length.
+func CheckDuration(duration time.Duration) error {
+	if _, err := appconfig.ParseValue(appconfig.TokenSessionLength, duration.String()); err != nil {
+		return errorsutil.New(fmt.Sprintf("Invalid value for the --%s flag", DurationFlag.Name), err)
+	}
+	return nil
+}
+
+// ParseAccessBoundary reads the rules of the Credential Access Boundary set with
+// the --access-boundary flag. Each value is either a JSON file with rules, or a
+// rule in the form "BUCKET ROLE".
+func ParseAccessBoundary(values []string) ([]gcpclient.AccessBoundaryRule, error) {
+	flagErr := fmt.Sprintf("Invalid value for the --%s flag", AccessBoundaryFlag.Name)
+	var rules []gcpclient.AccessBoundaryRule
+	for _, val := range values {
+		if info, err := os.Stat(val); err == nil && !info.IsDir() {
+			fileRules, err := gcpclient.ReadAccessBoundaryFile(val)
+			if err != nil {
+				return nil, errorsutil.New(flagErr, err)
+			}
+			rules = append(rules, fileRules...)
+			continue
+		}
+		boundary, err := appconfig.ParseAccessBoundary(val)
+		if err != nil {
+			return nil, errorsutil.New(flagErr, err)
+		}
+		rules = append(rules, boundary.Rule())
+	}
+	if err := gcpclient.CheckAccessBoundary(rules); err != nil {
+		return nil, errorsutil.New(flagErr, err)
+	}
+	return rules, nil
+}
+
+// CheckSubject ensures that the value of the --subject flag is a user's email
+// address.
+func CheckSubject(subject string) error {
+	if subject == "" {
+		return nil
+	}
+	if strings.Count(subject, "@") != 1 || strings.HasSuffix(subject, ".gserviceaccount.com") {
+		return errorsutil.New(
+			fmt.Sprintf("Invalid value for the --%s flag", SubjectFlag.Name),
+			fmt.Errorf("the subject must be the email of a Google Workspace user, got %q", subject),
+		)
+	}
+	return nil
+}
+
+// CheckRole validates the value of the --role flag.
+func CheckRole(role string) error {
+	if role == "" {
+		return nil
+	}
+	parts := strings.Split(role, "/")
+	valid := (len(parts) == 2 && parts[0] == "roles") ||
+		(len(parts) == 4 && (parts[0] == "projects" || parts[0] == "organizations") && parts[2] == "roles")
+	if !valid || parts[len(parts)-1] == "" {
+		return errorsutil.New(
+			fmt.Sprintf("Invalid value for the --%s flag", RoleFlag.Name),
+			fmt.Errorf("expected a role such as roles/viewer or projects/PROJECT/roles/ROLE, got %q", role),
+		)
+	}
+	return nil
+}
+
+// ParseScopes returns the full URLs of the OAuth scopes set with the --scopes
+// flag.
+func ParseScopes(scopes []string) []string {
+	var expanded []string
+	for _, scope := range scopes {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			expanded = append(expanded, appconfig.ExpandScope(scope))
+		}
+	}
+	return expanded
+}
+
+// CheckDelegates ensures that the configuration allows the service accounts in
+// the delegation chain to be impersonated.
+func CheckDelegates(delegates []string) error {
+	for _, delegate := range delegates {
+		if err := appconfig.CheckServiceAccountAllowed(delegate); err != nil {
+			return errorsutil.New("Refusing to impersonate delegate service account", err)
+		}
+	}
+	return nil
+}
+
+// CheckReason ensures that the reason for a command is one that the
+// configuration accepts.
+func CheckReason(reason string) error {
+	if err := appconfig.CheckReason(reason); err != nil {
+		return errorsutil.New(fmt.Sprintf("Invalid value for the --%s flag", ReasonFlag.Name), err)
+	}
+	return nil
+}
+
+// CheckServiceAccount ensures that the configuration allows the service account
+// to be impersonated.
+func CheckServiceAccount(serviceAccountEmail string) error {
+	if err := appconfig.CheckServiceAccountAllowed(serviceAccountEmail); err != nil {
+		return errorsutil.New("Refusing to impersonate service account", err)
+	}
+	return nil
+}
+
+// DefaultProject returns the configured default project, falling back to the
+// project set in the active gcloud config.
+func DefaultProject() (string, error) {
+	if project := viper.GetString(appconfig.DefaultsProject); project != "" {
+		return project, nil
+	}
+	return gcpclient.GetCurrentProject()
+}
+
+// DefaultServiceAccount returns the default service account for a project.
+// A default set for the project takes precedence over the global default.
+func DefaultServiceAccount(project string) string {
+	defaultSAs := viper.GetStringMapString(appconfig.DefaultServiceAccounts)
+	if val, ok := defaultSAs[project]; ok {
+		return val
+	}
+	return viper.GetString(appconfig.DefaultsServiceAccount)
+}
+
 // CheckRequired ensures that a command's required flags have been set. The only
 // way to iterate over every flag in a pflag.FlagSet is with the VisitAll command.
 // VisitAll takes a function as a parameter and calls that function on each flag in the
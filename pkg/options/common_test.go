@@ -0,0 +1,42 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package options
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStripGlobalFlags(t *testing.T) {
+	tests := []struct {
+		args string
+		want []string
+	}{
+		{args: "config doctor", want: []string{"config", "doctor"}},
+		{args: "-v config doctor", want: []string{"config", "doctor"}},
+		{args: "-vv -q --no-color config doctor", want: []string{"config", "doctor"}},
+		{args: "--no-color=false config setup", want: []string{"config", "setup"}},
+		{args: "--config /tmp/eiam.yml config doctor", want: []string{"config", "doctor"}},
+		{args: "--config=/tmp/eiam.yml -f json reauth", want: []string{"reauth"}},
+		{args: "--yes --no-cache completion bash", want: []string{"completion", "bash"}},
+		{args: "gcloud compute ssh vm -p my-project -- -v", want: []string{"gcloud", "compute", "ssh", "vm", "-p", "my-project", "--", "-v"}},
+	}
+	for _, tt := range tests {
+		if got := StripGlobalFlags(strings.Fields(tt.args)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("StripGlobalFlags(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
@@ -25,6 +25,12 @@ var (
 	// ComputeInstanceFlag sets the compute instance to use for a command.
 	ComputeInstanceFlag = flagName{"instance", "i"}
 
+	// FolderFlag sets the folder to use for a command.
+	FolderFlag = flagName{"folder", ""}
+
+	// OrganizationFlag sets the organization to use for a command.
+	OrganizationFlag = flagName{"organization", ""}
+
 	// PubSubTopicFlag sets the Pub/Sub topic to use for a command.
 	PubSubTopicFlag = flagName{"topic", "t"}
 
@@ -48,6 +54,26 @@ func AddComputeInstanceFlag(fs *pflag.FlagSet, instance *string, required bool)
 	}
 }
 
+// AddFolderFlag adds the --folder flag to the command.
+func AddFolderFlag(fs *pflag.FlagSet, folder *string, required bool) {
+	fs.StringVar(folder, FolderFlag.Name, "", "The ID of the folder, e.g. 123456789012")
+	if required {
+		if err := fs.SetAnnotation(FolderFlag.Name, RequiredAnnotation, []string{"true"}); err != nil {
+			util.Logger.Fatalf("failed to set required annotation on flag: %v", err)
+		}
+	}
+}
+
+// AddOrganizationFlag adds the --organization flag to the command.
+func AddOrganizationFlag(fs *pflag.FlagSet, organization *string, required bool) {
+	fs.StringVar(organization, OrganizationFlag.Name, "", "The ID of the organization, e.g. 123456789012")
+	if required {
+		if err := fs.SetAnnotation(OrganizationFlag.Name, RequiredAnnotation, []string{"true"}); err != nil {
+			util.Logger.Fatalf("failed to set required annotation on flag: %v", err)
+		}
+	}
+}
+
 // AddPubSubTopicFlag adds the --topic/-t flag to the command.
 func AddPubSubTopicFlag(fs *pflag.FlagSet, topic *string, required bool) {
 	fs.StringVarP(topic, PubSubTopicFlag.Name, PubSubTopicFlag.Shorthand, "", "The name of the Pub/Sub topic")